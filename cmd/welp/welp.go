@@ -1,13 +1,25 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/chzyer/readline"
+	"github.com/rtfb/welp/compiler"
 	"github.com/rtfb/welp/evaluator"
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/optimizer"
 	"github.com/rtfb/welp/parser"
+	"github.com/rtfb/welp/pkg"
+	"github.com/rtfb/welp/stdlib"
 )
 
 type repl struct {
@@ -29,16 +41,55 @@ func newREPL() (*repl, error) {
 	if err != nil {
 		return nil, err
 	}
-	r, w := io.Pipe()
-	return &repl{
+	pr, pw := io.Pipe()
+	r := &repl{
 		rl:     rl,
 		ch:     make(chan *parser.Node),
 		prompt: "welp> ",
-		env:    evaluator.New().NewEnv(),
-		r:      r,
-		w:      w,
-		p:      parser.New(r),
-	}, nil
+		r:      pr,
+		w:      pw,
+		p:      parser.New(pr),
+	}
+	evtor, err := evaluator.Load(evaluator.WithStdlibDir(*stdlibDir),
+		evaluator.WithDebugger(r.debug))
+	if err != nil {
+		rl.Close()
+		return nil, err
+	}
+	r.env = evtor.NewEnv()
+	return r, nil
+}
+
+// debug offers the restarts in effect when a condition isn't handled, and
+// reads the one to invoke, e.g. "1 42" invokes the second restart with 42.
+// An empty line, or args that fail to evaluate, let the condition fail the
+// evaluation.
+func (r *repl) debug(kind, data object.Object, restarts []evaluator.Restart) (int, []object.Object) {
+	fmt.Printf("unhandled condition %s: %s\n", kind.Inspect(), data.Inspect())
+	for i, restart := range restarts {
+		fmt.Printf("  %d: %s %s\n", i, restart.Name, restart.Params)
+	}
+	r.rl.SetPrompt("restart> ")
+	defer r.rl.SetPrompt("welp> ")
+	line, err := r.rl.Readline()
+	fields := strings.Fields(line)
+	if err != nil || len(fields) == 0 {
+		return -1, nil
+	}
+	i, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return -1, nil
+	}
+	var args []object.Object
+	for expr := range parser.ParseStream(strings.NewReader(strings.Join(fields[1:], " "))) {
+		arg := evaluator.Eval(r.env, expr)
+		if err, ok := arg.(*object.Error); ok {
+			fmt.Println(err.Inspect())
+			return -1, nil
+		}
+		args = append(args, arg)
+	}
+	return i, args
 }
 
 func (r *repl) epl() {
@@ -48,7 +99,10 @@ func (r *repl) epl() {
 		return
 	}
 	r.rl.SetPrompt("welp> ")
-	fmt.Println(evaluator.Eval(r.env, expr).Inspect())
+	// let ^C stop the evaluation instead of the REPL
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	fmt.Println(evaluator.EvalWith(r.env, expr, evalOptions(ctx)).Inspect())
+	stop()
 	r.p.Reset()
 }
 
@@ -64,11 +118,145 @@ func (r *repl) Run() {
 	fmt.Println("Quitting")
 }
 
+// optFlags are the flags controlling the optimizer.
+type optFlags struct {
+	optimize *bool
+	explain  *bool
+}
+
+func addOptFlags(flags *flag.FlagSet) *optFlags {
+	return &optFlags{
+		optimize: flags.Bool("O", false, "optimize the code"),
+		explain:  flags.Bool("explain-opt", false, "optimize the code and report the optimizations to stderr"),
+	}
+}
+
+// apply optimizes exprs if the flags ask for it. The code is assumed to run
+// with the stdlib loaded.
+func (f *optFlags) apply(exprs []*parser.Node) ([]*parser.Node, error) {
+	if !*f.optimize && !*f.explain {
+		return exprs, nil
+	}
+	lib, err := stdlib.Parse(*stdlibDir)
+	if err != nil {
+		return nil, err
+	}
+	opt := optimizer.New()
+	opt.Learn(lib...)
+	exprs = opt.Optimize(exprs...)
+	if *f.explain {
+		for _, note := range opt.Notes() {
+			fmt.Fprintln(os.Stderr, note)
+		}
+	}
+	return exprs, nil
+}
+
+// evalOptions grant the code run by the command line everything, the file,
+// network and process builtins included, until ctx is done.
+func evalOptions(ctx context.Context) evaluator.EvalOptions {
+	return evaluator.EvalOptions{Context: ctx, Capabilities: evaluator.AllCapabilities}
+}
+
+// run evaluates the named file.
+func run(name string, opts *optFlags) error {
+	exprs, err := parser.ParseFile(name)
+	if err != nil {
+		return err
+	}
+	if exprs, err = opts.apply(exprs); err != nil {
+		return err
+	}
+	evtor, err := evaluator.Load(evaluator.WithStdlibDir(*stdlibDir))
+	if err != nil {
+		return err
+	}
+	env := evtor.NewEnv()
+	env.SetDir(filepath.Dir(name))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	for _, expr := range exprs {
+		result := evaluator.EvalWith(env, expr, evalOptions(ctx))
+		if err, ok := result.(*object.Error); ok && errors.Is(err.Err, evaluator.ErrCanceled) {
+			return err.Err
+		}
+	}
+	return nil
+}
+
+// compile implements "welp compile [-O] foo.lisp [-o foo.welpc]".
+func compile(args []string) error {
+	flags := flag.NewFlagSet("compile", flag.ExitOnError)
+	out := flags.String("o", "", "output `file`, defaults to the source with the .welpc extension")
+	opts := addOptFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return errors.New("usage: welp compile [-O] foo.lisp [-o foo.welpc]")
+	}
+	src := flags.Arg(0)
+	// let the flags follow the source file too
+	flags.Parse(flags.Args()[1:])
+	if *out == "" {
+		*out = evaluator.CompiledPath(src)
+	}
+	exprs, err := parser.ParseFile(src)
+	if err != nil {
+		return err
+	}
+	if exprs, err = opts.apply(exprs); err != nil {
+		return err
+	}
+	bc, err := compiler.New().Compile(exprs...)
+	if err != nil {
+		return err
+	}
+	return compiler.WriteFile(*out, bc)
+}
+
+// disasm implements "welp disasm foo.welpc".
+func disasm(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: welp disasm foo.welpc")
+	}
+	bc, err := compiler.ReadFile(args[0])
+	if err != nil {
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+	return compiler.Disassemble(os.Stdout, bc)
+}
+
+// pkgCmd implements "welp pkg vendor [dir]".
+func pkgCmd(args []string) error {
+	if len(args) == 0 || len(args) > 2 || args[0] != "vendor" {
+		return errors.New("usage: welp pkg vendor [dir]")
+	}
+	dir := "."
+	if len(args) == 2 {
+		dir = args[1]
+	}
+	return pkg.Vendor(dir)
+}
+
+var stdlibDir = flag.String("stdlib", "", "load the stdlib from the `dir` instead of the embedded one")
+
 func main() {
-	if len(os.Args) > 1 {
-		env := evaluator.New().NewEnv()
-		if err := evaluator.EvalFile(env, os.Args[1]); err != nil {
-			panic(err)
+	opts := addOptFlags(flag.CommandLine)
+	flag.Parse()
+	if args := flag.Args(); len(args) > 0 {
+		var err error
+		switch args[0] {
+		case "compile":
+			err = compile(args[1:])
+		case "disasm":
+			err = disasm(args[1:])
+		case "pkg":
+			err = pkgCmd(args[1:])
+		default:
+			err = run(args[0], opts)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
 		return
 	}
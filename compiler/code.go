@@ -0,0 +1,185 @@
+package compiler
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Opcode is the first byte of an instruction, which is followed by its
+// operands.
+type Opcode byte
+
+// These are all the opcodes. The comments describe the operands and the
+// effect on the stack.
+const (
+	OpConstant       Opcode = iota // index: push constant
+	OpNull                         // push null
+	OpTrue                         // push t
+	OpFalse                        // push nil
+	OpPop                          // pop one value
+	OpPopN                         // n: pop n values
+	OpDup                          // push a copy of the top value
+	OpGetGlobal                    // index: push global
+	OpSetGlobal                    // index: pop into an existing global
+	OpDefGlobal                    // index: pop into global, defining it
+	OpGetLocal                     // slot: push local
+	OpSetLocal                     // slot: pop into local
+	OpNewBox                       // slot: pop into a fresh box stored in local
+	OpGetBoxed                     // slot: push the value boxed in local
+	OpSetBoxed                     // slot: pop into the box stored in local
+	OpGetFree                      // index: push the value of a captured variable
+	OpSetFree                      // index: pop into a captured variable
+	OpJump                         // address: jump
+	OpJumpIfFalse                  // address: pop, jump if not truthy
+	OpJumpIfBound                  // slot, address: jump if the optional param in slot got an arg
+	OpCall                         // argc: call the func below the args
+	OpReturn                       // return the top value
+	OpRecur                        // argc: rebind the params of the current func and restart it
+	OpClosure                      // index: push a closure over the FuncProto constant
+	OpArray                        // n: pop n values, push an array of them
+	OpMap                          // n: pop n key-value pairs, push a map of them
+	OpIter                         // replace the collection on top with an iterator over it
+	OpIterNext                     // address: push the next item, or pop the iterator and jump
+	OpAdd                          // pop b, pop a, push (+ a b)
+	OpSub                          // pop b, pop a, push (- a b)
+	OpMul                          // pop b, pop a, push (* a b)
+	OpEq                           // pop b, pop a, push (eq a b)
+	OpLess                         // pop b, pop a, push (< a b)
+	OpGreater                      // pop b, pop a, push (> a b)
+	OpLessOrEqual                  // pop b, pop a, push (<= a b)
+	OpGreaterOrEqual               // pop b, pop a, push (>= a b)
+)
+
+// Definition describes an opcode: its name and the widths of its operands in
+// bytes.
+type Definition struct {
+	Name          string
+	OperandWidths []int
+}
+
+var definitions = map[Opcode]*Definition{
+	OpConstant:       {"OpConstant", []int{2}},
+	OpNull:           {"OpNull", nil},
+	OpTrue:           {"OpTrue", nil},
+	OpFalse:          {"OpFalse", nil},
+	OpPop:            {"OpPop", nil},
+	OpPopN:           {"OpPopN", []int{2}},
+	OpDup:            {"OpDup", nil},
+	OpGetGlobal:      {"OpGetGlobal", []int{2}},
+	OpSetGlobal:      {"OpSetGlobal", []int{2}},
+	OpDefGlobal:      {"OpDefGlobal", []int{2}},
+	OpGetLocal:       {"OpGetLocal", []int{2}},
+	OpSetLocal:       {"OpSetLocal", []int{2}},
+	OpNewBox:         {"OpNewBox", []int{2}},
+	OpGetBoxed:       {"OpGetBoxed", []int{2}},
+	OpSetBoxed:       {"OpSetBoxed", []int{2}},
+	OpGetFree:        {"OpGetFree", []int{2}},
+	OpSetFree:        {"OpSetFree", []int{2}},
+	OpJump:           {"OpJump", []int{2}},
+	OpJumpIfFalse:    {"OpJumpIfFalse", []int{2}},
+	OpJumpIfBound:    {"OpJumpIfBound", []int{2, 2}},
+	OpCall:           {"OpCall", []int{1}},
+	OpReturn:         {"OpReturn", nil},
+	OpRecur:          {"OpRecur", []int{1}},
+	OpClosure:        {"OpClosure", []int{2}},
+	OpArray:          {"OpArray", []int{2}},
+	OpMap:            {"OpMap", []int{2}},
+	OpIter:           {"OpIter", nil},
+	OpIterNext:       {"OpIterNext", []int{2}},
+	OpAdd:            {"OpAdd", nil},
+	OpSub:            {"OpSub", nil},
+	OpMul:            {"OpMul", nil},
+	OpEq:             {"OpEq", nil},
+	OpLess:           {"OpLess", nil},
+	OpGreater:        {"OpGreater", nil},
+	OpLessOrEqual:    {"OpLessOrEqual", nil},
+	OpGreaterOrEqual: {"OpGreaterOrEqual", nil},
+}
+
+// Lookup returns the definition of an opcode.
+func Lookup(op Opcode) (*Definition, error) {
+	def, ok := definitions[op]
+	if !ok {
+		return nil, fmt.Errorf("opcode %d undefined", op)
+	}
+	return def, nil
+}
+
+// Make encodes an instruction.
+func Make(op Opcode, operands ...int) []byte {
+	def, ok := definitions[op]
+	if !ok {
+		return nil
+	}
+	length := 1
+	for _, w := range def.OperandWidths {
+		length += w
+	}
+	ins := make([]byte, length)
+	ins[0] = byte(op)
+	offset := 1
+	for i, o := range operands {
+		switch def.OperandWidths[i] {
+		case 1:
+			ins[offset] = byte(o)
+		case 2:
+			binary.BigEndian.PutUint16(ins[offset:], uint16(o))
+		}
+		offset += def.OperandWidths[i]
+	}
+	return ins
+}
+
+// ReadOperands decodes the operands of an instruction, returning them along
+// with the number of bytes read.
+func ReadOperands(def *Definition, ins []byte) ([]int, int) {
+	operands := make([]int, len(def.OperandWidths))
+	offset := 0
+	for i, w := range def.OperandWidths {
+		switch w {
+		case 1:
+			operands[i] = int(ins[offset])
+		case 2:
+			operands[i] = int(ReadUint16(ins[offset:]))
+		}
+		offset += w
+	}
+	return operands, offset
+}
+
+// ReadUint16 decodes a two byte operand.
+func ReadUint16(ins []byte) uint16 {
+	return binary.BigEndian.Uint16(ins)
+}
+
+// Instructions is a sequence of encoded instructions.
+type Instructions []byte
+
+// String disassembles the instructions, one per line.
+func (ins Instructions) String() string {
+	var sb strings.Builder
+	for i := 0; i < len(ins); {
+		line, n := ins.format(i)
+		sb.WriteString(line)
+		sb.WriteString("\n")
+		i += n
+	}
+	return sb.String()
+}
+
+// format disassembles the instruction at offset i, returning it along with
+// its length.
+func (ins Instructions) format(i int) (string, int) {
+	def, err := Lookup(Opcode(ins[i]))
+	if err != nil {
+		return fmt.Sprintf("ERROR: %s", err), 1
+	}
+	operands, read := ReadOperands(def, ins[i+1:])
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%04d %s", i, def.Name)
+	for _, o := range operands {
+		fmt.Fprintf(&sb, " %d", o)
+	}
+	return sb.String(), 1 + read
+}
@@ -0,0 +1,601 @@
+// Package compiler lowers parsed welp expressions to bytecode for the vm.
+//
+// Variables are resolved at compile time: the locals of a func live in
+// numbered slots of its frame, the variables a closure captures from the
+// enclosing funcs are numbered in the closure, and only the globals are
+// looked up by name, once per run. A local captured by a closure is kept in a
+// box, a fresh one every time the binding is made, so that like in the
+// evaluator, each iteration of a loop gets a binding of its own.
+//
+// The compiler handles the same forms the evaluator does, except for macros,
+// match, eval, import, destructuring and &key params, which are reported as
+// compile errors. Unlike the evaluator, the compiled code has a single
+// namespace for vars and funcs.
+package compiler
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/rtfb/welp/lexer"
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+)
+
+// Compiler compiles expressions. It remembers the globals between the calls
+// to Compile, so that consecutive pieces of code can be run in the same vm.
+type Compiler struct {
+	globals map[string]int
+	names   []string
+
+	// defined holds the globals bound by the compiled code, which thereby
+	// may shadow the primitives
+	defined map[string]bool
+
+	// captured holds the declarations of the locals captured by closures
+	captured map[*parser.Node]bool
+
+	// recapture is set when a local turns out to be captured after the code
+	// that binds it was already compiled
+	recapture bool
+
+	fn *funcState
+
+	// module and exports are set by the module form
+	module  string
+	exports []string
+}
+
+// funcState is the state of the func being compiled.
+type funcState struct {
+	proto    *FuncProto
+	outer    *funcState
+	isFunc   bool // false for the top-level code
+	scope    *scope
+	slots    int // local slots in use
+	depth    int // values on the operand stack
+	loop     *loopState
+	free     []*parser.Node // the declarations of the captured variables
+	constIdx map[object.HashKey]int
+}
+
+// scope is a block of local variables, like the bindings of a let.
+type scope struct {
+	vars  map[string]*local
+	outer *scope
+	slots int // the slots in use when the scope was entered
+}
+
+type local struct {
+	slot int
+	decl *parser.Node // the identifier that declared the variable
+}
+
+type refKind int
+
+const (
+	refGlobal refKind = iota
+	refLocal
+	refBoxed
+	refFree
+)
+
+// ref is a resolved variable.
+type ref struct {
+	kind  refKind
+	index int
+}
+
+// New creates a Compiler.
+func New() *Compiler {
+	return &Compiler{
+		globals:  make(map[string]int),
+		defined:  make(map[string]bool),
+		captured: make(map[*parser.Node]bool),
+	}
+}
+
+// Compile compiles a sequence of top-level expressions. Running the result
+// yields the value of the last one.
+func (c *Compiler) Compile(exprs ...*parser.Node) (*Bytecode, error) {
+	for {
+		c.recapture = false
+		main, err := c.compileMain(exprs)
+		if err != nil {
+			return nil, err
+		}
+		// The code binding the newly captured locals has to be compiled
+		// again to box them. Since this pass has found all the captures,
+		// the next one is the last.
+		if !c.recapture {
+			return &Bytecode{
+				Main:    main,
+				Globals: append([]string(nil), c.names...),
+				Module:  c.module,
+				Exports: c.exports,
+			}, nil
+		}
+	}
+}
+
+// CompileFile compiles the entire content of a file.
+func (c *Compiler) CompileFile(name string) (*Bytecode, error) {
+	exprs, err := parser.ParseFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.Compile(exprs...)
+}
+
+func (c *Compiler) compileMain(exprs []*parser.Node) (*FuncProto, error) {
+	c.fn = newFuncState("main", nil, false)
+	defer func() { c.fn = nil }()
+	if len(exprs) == 0 {
+		c.emit(OpNull)
+	}
+	for i, expr := range exprs {
+		if expr.Err != nil {
+			return nil, expr.Err
+		}
+		if i > 0 {
+			c.emit(OpPop)
+		}
+		if err := c.compileList(expr); err != nil {
+			return nil, err
+		}
+	}
+	c.emit(OpReturn)
+	return c.finish()
+}
+
+func newFuncState(name string, outer *funcState, isFunc bool) *funcState {
+	return &funcState{
+		proto:    &FuncProto{Name: name},
+		outer:    outer,
+		isFunc:   isFunc,
+		constIdx: make(map[object.HashKey]int),
+	}
+}
+
+// finish checks that the current func fits the limits of the bytecode.
+func (c *Compiler) finish() (*FuncProto, error) {
+	p := c.fn.proto
+	switch {
+	case len(p.Code) > math.MaxUint16:
+		return nil, fmt.Errorf("%s: too much code", p.Name)
+	case len(p.Constants) > math.MaxUint16:
+		return nil, fmt.Errorf("%s: too many constants", p.Name)
+	case p.NumLocals > math.MaxUint16 || len(p.Free) > math.MaxUint16:
+		return nil, fmt.Errorf("%s: too many variables", p.Name)
+	case len(c.names) > math.MaxUint16:
+		return nil, fmt.Errorf("too many globals")
+	}
+	return p, nil
+}
+
+// emit appends an instruction to the current func and returns its offset.
+func (c *Compiler) emit(op Opcode, operands ...int) int {
+	f := c.fn
+	offset := len(f.proto.Code)
+	f.proto.Code = append(f.proto.Code, Make(op, operands...)...)
+	f.depth += stackEffect(op, operands)
+	return offset
+}
+
+// emitAt is like emit, but also records the source position of the
+// instruction, for error messages.
+func (c *Compiler) emitAt(pos int, op Opcode, operands ...int) int {
+	offset := c.emit(op, operands...)
+	c.fn.proto.Positions = append(c.fn.proto.Positions, Position{Offset: offset, Source: pos})
+	return offset
+}
+
+// stackEffect tells how an instruction changes the number of values on the
+// operand stack when it falls through to the next one.
+func stackEffect(op Opcode, operands []int) int {
+	switch op {
+	case OpConstant, OpNull, OpTrue, OpFalse, OpDup, OpGetGlobal, OpGetLocal,
+		OpGetBoxed, OpGetFree, OpClosure, OpIterNext:
+		return 1
+	case OpPop, OpSetGlobal, OpDefGlobal, OpSetLocal, OpNewBox, OpSetBoxed,
+		OpSetFree, OpJumpIfFalse, OpReturn, OpAdd, OpSub, OpMul, OpEq, OpLess,
+		OpGreater, OpLessOrEqual, OpGreaterOrEqual:
+		return -1
+	case OpPopN, OpCall, OpRecur:
+		return -operands[0]
+	case OpArray:
+		return 1 - operands[0]
+	case OpMap:
+		return 1 - 2*operands[0]
+	}
+	return 0
+}
+
+// patch points the jump at offset to the current end of the code.
+func (c *Compiler) patch(offset int) {
+	code := c.fn.proto.Code
+	def, _ := Lookup(Opcode(code[offset]))
+	end := offset + 1
+	for _, w := range def.OperandWidths {
+		end += w
+	}
+	target := len(code)
+	code[end-2] = byte(target >> 8)
+	code[end-1] = byte(target)
+}
+
+func (c *Compiler) here() int {
+	return len(c.fn.proto.Code)
+}
+
+// constant adds a value to the constant pool, reusing the slot of an equal
+// hashable value.
+func (c *Compiler) constant(value object.Object) int {
+	f := c.fn
+	h, ok := value.(object.Hashable)
+	if ok {
+		if i, ok := f.constIdx[h.HashKey()]; ok {
+			return i
+		}
+	}
+	f.proto.Constants = append(f.proto.Constants, value)
+	i := len(f.proto.Constants) - 1
+	if ok {
+		f.constIdx[h.HashKey()] = i
+	}
+	return i
+}
+
+func (c *Compiler) global(name string) int {
+	if i, ok := c.globals[name]; ok {
+		return i
+	}
+	c.names = append(c.names, name)
+	c.globals[name] = len(c.names) - 1
+	return len(c.names) - 1
+}
+
+func (c *Compiler) pushScope() {
+	f := c.fn
+	f.scope = &scope{vars: make(map[string]*local), outer: f.scope, slots: f.slots}
+}
+
+func (c *Compiler) popScope() {
+	f := c.fn
+	f.slots = f.scope.slots
+	f.scope = f.scope.outer
+}
+
+// alloc reserves a local slot.
+func (c *Compiler) alloc() int {
+	f := c.fn
+	f.slots++
+	if f.slots > f.proto.NumLocals {
+		f.proto.NumLocals = f.slots
+	}
+	return f.slots - 1
+}
+
+// declare adds a local variable to the innermost scope.
+func (c *Compiler) declare(decl *parser.Node) *local {
+	l := &local{slot: c.alloc(), decl: decl}
+	c.fn.scope.vars[string(decl.Tok.Value)] = l
+	return l
+}
+
+// inScope reports whether the code being compiled belongs to a func or a
+// block, i.e. whether definitions are local.
+func (c *Compiler) inScope() bool {
+	return c.fn.isFunc || c.fn.scope != nil
+}
+
+func (f *funcState) lookupLocal(name string) *local {
+	for s := f.scope; s != nil; s = s.outer {
+		if l, ok := s.vars[name]; ok {
+			return l
+		}
+	}
+	return nil
+}
+
+// isLexical reports whether name refers to a local variable of the current
+// func or of one of the enclosing ones.
+func (c *Compiler) isLexical(name string) bool {
+	for f := c.fn; f != nil; f = f.outer {
+		if f.lookupLocal(name) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Compiler) resolve(name string) ref {
+	f := c.fn
+	if l := f.lookupLocal(name); l != nil {
+		if c.captured[l.decl] {
+			return ref{kind: refBoxed, index: l.slot}
+		}
+		return ref{kind: refLocal, index: l.slot}
+	}
+	if i, ok := c.resolveFree(f, name); ok {
+		return ref{kind: refFree, index: i}
+	}
+	return ref{kind: refGlobal, index: c.global(name)}
+}
+
+// resolveFree looks name up in the funcs enclosing f, making f capture it if
+// it's found.
+func (c *Compiler) resolveFree(f *funcState, name string) (int, bool) {
+	if f.outer == nil {
+		return 0, false
+	}
+	if l := f.outer.lookupLocal(name); l != nil {
+		if !c.captured[l.decl] {
+			c.captured[l.decl] = true
+			c.recapture = true
+		}
+		return f.addFree(l.decl, FreeVar{Local: true, Index: l.slot}), true
+	}
+	i, ok := c.resolveFree(f.outer, name)
+	if !ok {
+		return 0, false
+	}
+	return f.addFree(f.outer.free[i], FreeVar{Local: false, Index: i}), true
+}
+
+func (f *funcState) addFree(decl *parser.Node, fv FreeVar) int {
+	for i, d := range f.free {
+		if d == decl {
+			return i
+		}
+	}
+	f.free = append(f.free, decl)
+	f.proto.Free = append(f.proto.Free, fv)
+	return len(f.free) - 1
+}
+
+func (c *Compiler) load(r ref) {
+	switch r.kind {
+	case refLocal:
+		c.emit(OpGetLocal, r.index)
+	case refBoxed:
+		c.emit(OpGetBoxed, r.index)
+	case refFree:
+		c.emit(OpGetFree, r.index)
+	default:
+		c.emit(OpGetGlobal, r.index)
+	}
+}
+
+// store pops the top value into an existing variable.
+func (c *Compiler) store(r ref) {
+	switch r.kind {
+	case refLocal:
+		c.emit(OpSetLocal, r.index)
+	case refBoxed:
+		c.emit(OpSetBoxed, r.index)
+	case refFree:
+		c.emit(OpSetFree, r.index)
+	default:
+		c.emit(OpSetGlobal, r.index)
+	}
+}
+
+// bind pops the top value into a fresh binding of l.
+func (c *Compiler) bind(l *local) {
+	if c.captured[l.decl] {
+		c.emit(OpNewBox, l.slot)
+	} else {
+		c.emit(OpSetLocal, l.slot)
+	}
+}
+
+// compileArg compiles the single expression held in cell.L, the way evalArg
+// evaluates it.
+func (c *Compiler) compileArg(cell *parser.Node) error {
+	if cell == nil || cell.L == nil {
+		c.emit(OpNull)
+		return nil
+	}
+	node := cell.L
+	switch node.Tok.Typ {
+	case lexer.TokIdentifier:
+		c.compileIdent(string(node.Tok.Value))
+		return nil
+	case lexer.TokNumber:
+		n, err := strconv.ParseInt(string(node.Tok.Value), 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad number %s: %v", node.Tok.Value, err)
+		}
+		c.emit(OpConstant, c.constant(&object.Integer{Value: n}))
+		return nil
+	case lexer.TokString:
+		c.emit(OpConstant, c.constant(&object.String{Value: string(node.Tok.Value)}))
+		return nil
+	case lexer.TokVoid, lexer.TokOpenBracket, lexer.TokOpenBrace:
+		return c.compileList(node)
+	}
+	return fmt.Errorf("unknown token type for %q", node.Tok.String())
+}
+
+func (c *Compiler) compileIdent(name string) {
+	switch {
+	case name == "t":
+		c.emit(OpTrue)
+	case name == "nil":
+		c.emit(OpFalse)
+	case strings.HasPrefix(name, ":") && len(name) > 1:
+		c.emit(OpConstant, c.constant(&object.Keyword{Name: name[1:]}))
+	default:
+		c.load(c.resolve(name))
+	}
+}
+
+// compileBody compiles a sequence of expressions yielding the value of the
+// last one.
+func (c *Compiler) compileBody(cell *parser.Node) error {
+	if cell == nil || cell.L == nil {
+		c.emit(OpNull)
+		return nil
+	}
+	for ; cell != nil && cell.L != nil; cell = cell.R {
+		if err := c.compileArg(cell); err != nil {
+			return err
+		}
+		if cell.R != nil && cell.R.L != nil {
+			c.emit(OpPop)
+		}
+	}
+	return nil
+}
+
+// compileStatements compiles a sequence of expressions whose values are
+// discarded.
+func (c *Compiler) compileStatements(cell *parser.Node) error {
+	for ; cell != nil && cell.L != nil; cell = cell.R {
+		if err := c.compileArg(cell); err != nil {
+			return err
+		}
+		c.emit(OpPop)
+	}
+	return nil
+}
+
+var binaryOps = map[string]Opcode{
+	"+":  OpAdd,
+	"-":  OpSub,
+	"*":  OpMul,
+	"eq": OpEq,
+	"<":  OpLess,
+	">":  OpGreater,
+	"<=": OpLessOrEqual,
+	">=": OpGreaterOrEqual,
+}
+
+// compileList compiles a list expression, the way eval evaluates it.
+func (c *Compiler) compileList(expr *parser.Node) error {
+	if expr == nil {
+		c.emit(OpNull)
+		return nil
+	}
+	switch expr.Tok.Typ {
+	case lexer.TokOpenBracket:
+		return c.compileArray(expr)
+	case lexer.TokOpenBrace:
+		return c.compileMap(expr)
+	}
+	if expr.L == nil {
+		c.emit(OpNull)
+		return nil
+	}
+	switch expr.L.Tok.Typ {
+	case lexer.TokIdentifier:
+		name := string(expr.L.Tok.Value)
+		if c.isLexical(name) {
+			break
+		}
+		if ok, err := c.compileForm(name, expr); ok {
+			return err
+		}
+		if op, ok := binaryOps[name]; ok && !c.defined[name] {
+			if ok, err := c.compileBinary(op, expr); ok {
+				return err
+			}
+		}
+	case lexer.TokVoid:
+	default:
+		return c.compileArg(expr)
+	}
+	return c.compileCall(expr)
+}
+
+// compileBinary compiles a call to one of the arithmetic or comparison
+// primitives to the corresponding instructions. It reports false if the
+// number of args doesn't allow that, so a regular call is needed.
+func (c *Compiler) compileBinary(op Opcode, expr *parser.Node) (bool, error) {
+	argc := 0
+	for arg := expr.R; arg != nil && arg.L != nil; arg = arg.R {
+		argc++
+	}
+	switch op {
+	case OpAdd, OpSub, OpMul:
+		if argc < 2 {
+			return false, nil
+		}
+	default:
+		if argc != 2 {
+			return false, nil
+		}
+	}
+	if err := c.compileArg(expr.R); err != nil {
+		return true, err
+	}
+	for arg := expr.R.R; arg != nil && arg.L != nil; arg = arg.R {
+		if err := c.compileArg(arg); err != nil {
+			return true, err
+		}
+		c.emit(op)
+	}
+	return true, nil
+}
+
+func (c *Compiler) compileCall(expr *parser.Node) error {
+	if err := c.compileArg(expr); err != nil {
+		return err
+	}
+	argc := 0
+	for arg := expr.R; arg != nil && arg.L != nil; arg = arg.R {
+		if err := c.compileArg(arg); err != nil {
+			return err
+		}
+		argc++
+	}
+	if argc > math.MaxUint8 {
+		return fmt.Errorf("too many args at position %d", callPos(expr))
+	}
+	c.emitAt(callPos(expr), OpCall, argc)
+	return nil
+}
+
+func (c *Compiler) compileArray(expr *parser.Node) error {
+	n := 0
+	for cell := expr; cell.L != nil; cell = cell.R {
+		if err := c.compileArg(cell); err != nil {
+			return err
+		}
+		n++
+	}
+	c.emit(OpArray, n)
+	return nil
+}
+
+func (c *Compiler) compileMap(expr *parser.Node) error {
+	n := 0
+	for cell := expr; cell.L != nil; cell = cell.R.R {
+		if cell.R == nil || cell.R.L == nil {
+			return fmt.Errorf("map literal needs an even number of forms")
+		}
+		if err := c.compileArg(cell); err != nil {
+			return err
+		}
+		if err := c.compileArg(cell.R); err != nil {
+			return err
+		}
+		n++
+	}
+	c.emit(OpMap, n)
+	return nil
+}
+
+// callPos returns the position of a call for error reporting.
+func callPos(call *parser.Node) int {
+	for call != nil && call.Tok.Typ == lexer.TokVoid && call.L != nil {
+		call = call.L
+	}
+	if call == nil {
+		return 0
+	}
+	return call.Tok.Pos
+}
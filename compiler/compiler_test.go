@@ -0,0 +1,105 @@
+package compiler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMake(t *testing.T) {
+	assert.Equal(t, []byte{byte(OpConstant), 1, 2}, Make(OpConstant, 258))
+	assert.Equal(t, []byte{byte(OpCall), 3}, Make(OpCall, 3))
+	assert.Equal(t, []byte{byte(OpJumpIfBound), 0, 1, 0, 9}, Make(OpJumpIfBound, 1, 9))
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		input string
+		code  string
+	}{
+		{"(+ 1 2)", "0000 OpConstant 0\n0003 OpConstant 1\n0006 OpAdd\n0007 OpReturn\n"},
+		{"(let ((x 1)) x)",
+			"0000 OpConstant 0\n0003 OpSetLocal 0\n0006 OpGetLocal 0\n0009 OpReturn\n"},
+		{"[1 1]", "0000 OpConstant 0\n0003 OpConstant 0\n0006 OpArray 2\n0009 OpReturn\n"},
+	}
+	for _, test := range tests {
+		bc, err := New().Compile(parser.ParseString(test.input))
+		if assert.NoError(t, err, test.input) {
+			assert.Equal(t, test.code, bc.Main.Code.String(), test.input)
+		}
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	for _, input := range []string{
+		"(defmacro m () 1)",
+		"(eval 1)",
+		"(match 1 (_ 2))",
+		"(let () (fn f (&key a) a))",
+	} {
+		_, err := New().Compile(parser.ParseString(input))
+		if assert.Error(t, err, input) {
+			assert.Contains(t, err.Error(), "is not supported by the compiler", input)
+		}
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	bc, err := New().Compile(parser.ParseString(`(let ()
+	  (fn f (a &optional (b 2) &rest c) (lambda () [a b c :k "s" -7]))
+	  (f 1))`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	var buf bytes.Buffer
+	if !assert.NoError(t, Encode(&buf, bc)) {
+		return
+	}
+	decoded, err := Decode(&buf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, bc, decoded)
+	}
+	_, err = Decode(strings.NewReader("WELPC\x01"))
+	assert.Equal(t, &VersionError{Version: 1}, err)
+	_, err = Decode(strings.NewReader("(fn f () 1)"))
+	assert.Equal(t, ErrNotCompiled, err)
+}
+
+func TestDecodeCorrupt(t *testing.T) {
+	code := func(ins ...[]byte) Instructions {
+		return Instructions(bytes.Join(ins, nil))
+	}
+	ret := Make(OpReturn)
+	for _, test := range []struct {
+		proto *FuncProto
+		err   string
+	}{
+		{&FuncProto{Code: code([]byte{255}, ret)}, "opcode 255 undefined"},
+		{&FuncProto{Code: code(Make(OpConstant, 0), ret)}, "OpConstant operand 0 out of range"},
+		{&FuncProto{Code: code(Make(OpGetGlobal, 1), ret)}, "OpGetGlobal operand 1 out of range"},
+		{&FuncProto{Code: code(Make(OpGetLocal, 0), ret)}, "OpGetLocal operand 0 out of range"},
+		{&FuncProto{Code: code(Make(OpJump, 1), ret)}, "jump to 0001, which isn't an instruction"},
+		{&FuncProto{Code: code(Make(OpJump, 4), ret)}, "jump to 0004, which isn't an instruction"},
+		{&FuncProto{Code: code(Make(OpNull))}, "doesn't end with a return"},
+		{&FuncProto{Code: code(Make(OpNull), Make(OpConstant, 0)[:2])}, "truncated OpConstant"},
+		{&FuncProto{NumRequired: 1, Code: code(ret)}, "more params than locals"},
+		{&FuncProto{Code: code(Make(OpClosure, 0), ret), Constants: []object.Object{&object.Integer{}}},
+			"OpClosure over a INTEGER"},
+		{&FuncProto{Code: code(Make(OpClosure, 0), ret), Constants: []object.Object{
+			&FuncProto{Name: "f", Code: code(ret), Free: []FreeVar{{Local: true, Index: 0}}}}},
+			"f: free var 0 out of range"},
+	} {
+		var buf bytes.Buffer
+		if !assert.NoError(t, Encode(&buf, &Bytecode{Main: test.proto, Globals: []string{"g"}})) {
+			continue
+		}
+		_, err := Decode(&buf)
+		if assert.Error(t, err, test.err) {
+			assert.Contains(t, err.Error(), test.err)
+		}
+	}
+}
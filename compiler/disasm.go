@@ -0,0 +1,46 @@
+package compiler
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Disassemble writes a listing of bc: the globals, then each func with its
+// constants and code. The instructions that have a known source position are
+// annotated with its byte offset.
+func Disassemble(w io.Writer, bc *Bytecode) error {
+	if _, err := fmt.Fprintf(w, "globals: %s\n", strings.Join(bc.Globals, " ")); err != nil {
+		return err
+	}
+	return disassemble(w, bc.Main)
+}
+
+func disassemble(w io.Writer, p *FuncProto) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "\n== %s, args: %s, locals: %d, free: %d ==\n",
+		p.Name, p.Arity(), p.NumLocals, len(p.Free))
+	for i, c := range p.Constants {
+		fmt.Fprintf(&sb, "const %d: %s\n", i, c.Inspect())
+	}
+	for i := 0; i < len(p.Code); {
+		line, n := p.Code.format(i)
+		sb.WriteString(line)
+		if pos := p.PosAt(i); pos != 0 {
+			fmt.Fprintf(&sb, "\t; byte %d", pos)
+		}
+		sb.WriteString("\n")
+		i += n
+	}
+	if _, err := io.WriteString(w, sb.String()); err != nil {
+		return err
+	}
+	for _, c := range p.Constants {
+		if inner, ok := c.(*FuncProto); ok {
+			if err := disassemble(w, inner); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,392 @@
+package compiler
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rtfb/welp/object"
+)
+
+// The compiled modules start with the magic followed by the version of the
+// format, which has to be bumped on every incompatible change to the format or
+// to the instruction set.
+const (
+	magic         = "WELPC"
+	FormatVersion = 2
+)
+
+// ErrNotCompiled is returned when decoding something that isn't a compiled
+// module.
+var ErrNotCompiled = errors.New("not a compiled welp module")
+
+// VersionError is returned when decoding a module compiled for a different
+// version of the format.
+type VersionError struct {
+	Version int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("compiled module has format version %d, expected %d",
+		e.Version, FormatVersion)
+}
+
+// These tag the constants in the constant pools.
+const (
+	tagInteger byte = iota
+	tagString
+	tagKeyword
+	tagProto
+)
+
+// Encode writes bc in the binary format:
+//
+//	magic, version
+//	number of globals, their names
+//	module name, number of exports, their names
+//	main proto
+//
+// where each proto is:
+//
+//	name, required, optional, rest, locals
+//	code
+//	number of constants, tagged constants
+//	number of free vars, pairs of local and index
+//	number of positions, pairs of offset and source offset
+//
+// Numbers are varints, strings and code are prefixed with their length.
+func Encode(w io.Writer, bc *Bytecode) error {
+	e := &encoder{w: bufio.NewWriter(w)}
+	e.w.WriteString(magic)
+	e.uint(FormatVersion)
+	e.uint(len(bc.Globals))
+	for _, name := range bc.Globals {
+		e.string(name)
+	}
+	e.string(bc.Module)
+	e.uint(len(bc.Exports))
+	for _, name := range bc.Exports {
+		e.string(name)
+	}
+	e.proto(bc.Main)
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// WriteFile encodes bc into the named file.
+func WriteFile(name string, bc *Bytecode) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := Encode(f, bc); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// encoder remembers the first error, so that the writes don't have to be
+// checked one by one.
+type encoder struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (e *encoder) write(b []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+func (e *encoder) uint(n int) {
+	e.write(e.buf[:binary.PutUvarint(e.buf[:], uint64(n))])
+}
+
+func (e *encoder) int(n int64) {
+	e.write(e.buf[:binary.PutVarint(e.buf[:], n)])
+}
+
+func (e *encoder) bool(b bool) {
+	if b {
+		e.uint(1)
+	} else {
+		e.uint(0)
+	}
+}
+
+func (e *encoder) string(s string) {
+	e.uint(len(s))
+	e.write([]byte(s))
+}
+
+func (e *encoder) proto(p *FuncProto) {
+	e.string(p.Name)
+	e.uint(p.NumRequired)
+	e.uint(p.NumOptional)
+	e.bool(p.HasRest)
+	e.uint(p.NumLocals)
+	e.uint(len(p.Code))
+	e.write(p.Code)
+	e.uint(len(p.Constants))
+	for _, c := range p.Constants {
+		e.constant(c)
+	}
+	e.uint(len(p.Free))
+	for _, fv := range p.Free {
+		e.bool(fv.Local)
+		e.uint(fv.Index)
+	}
+	e.uint(len(p.Positions))
+	for _, pos := range p.Positions {
+		e.uint(pos.Offset)
+		e.uint(pos.Source)
+	}
+}
+
+func (e *encoder) constant(c object.Object) {
+	switch c := c.(type) {
+	case *object.Integer:
+		e.write([]byte{tagInteger})
+		e.int(c.Value)
+	case *object.String:
+		e.write([]byte{tagString})
+		e.string(c.Value)
+	case *object.Keyword:
+		e.write([]byte{tagKeyword})
+		e.string(c.Name)
+	case *FuncProto:
+		e.write([]byte{tagProto})
+		e.proto(c)
+	default:
+		if e.err == nil {
+			e.err = fmt.Errorf("can't encode a constant of type %s", c.Type())
+		}
+	}
+}
+
+// Decode reads a module written by Encode. The code is verified as well, see
+// verify.
+func Decode(r io.Reader) (*Bytecode, error) {
+	d := &decoder{r: bufio.NewReader(r)}
+	head := make([]byte, len(magic))
+	if _, err := io.ReadFull(d.r, head); err != nil || string(head) != magic {
+		return nil, ErrNotCompiled
+	}
+	if v := d.uint(); d.err == nil && v != FormatVersion {
+		return nil, &VersionError{Version: v}
+	}
+	bc := &Bytecode{}
+	n := d.uint()
+	for i := 0; i < n && d.err == nil; i++ {
+		bc.Globals = append(bc.Globals, d.string())
+	}
+	bc.Module = d.string()
+	n = d.uint()
+	for i := 0; i < n && d.err == nil; i++ {
+		bc.Exports = append(bc.Exports, d.string())
+	}
+	bc.Main = d.proto()
+	if d.err == nil {
+		d.err = verify(bc.Main, len(bc.Globals), nil)
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("corrupt compiled module: %v", d.err)
+	}
+	return bc, nil
+}
+
+// verify checks that the code of p and its nested protos only refers to what
+// exists, so that a corrupt module fails to decode rather than crashing the
+// vm: that the opcodes are defined, that the operands are in range, and that
+// the jumps land on instructions. outer is the proto p is a constant of.
+func verify(p *FuncProto, globals int, outer *FuncProto) error {
+	params := p.NumRequired + p.NumOptional
+	if p.HasRest {
+		params++
+	}
+	if params > p.NumLocals {
+		return fmt.Errorf("%s: more params than locals", p.Name)
+	}
+	for _, fv := range p.Free {
+		switch {
+		case outer == nil:
+			return fmt.Errorf("%s: free vars at the top level", p.Name)
+		case fv.Local && fv.Index >= outer.NumLocals, !fv.Local && fv.Index >= len(outer.Free):
+			return fmt.Errorf("%s: free var %d out of range", p.Name, fv.Index)
+		}
+	}
+	starts := make(map[int]bool)
+	var jumps []int
+	last := -1
+	for i := 0; i < len(p.Code); {
+		op := Opcode(p.Code[i])
+		def, err := Lookup(op)
+		if err != nil {
+			return fmt.Errorf("%s: %04d: %v", p.Name, i, err)
+		}
+		width := 0
+		for _, w := range def.OperandWidths {
+			width += w
+		}
+		if i+1+width > len(p.Code) {
+			return fmt.Errorf("%s: %04d: truncated %s", p.Name, i, def.Name)
+		}
+		operands, _ := ReadOperands(def, p.Code[i+1:])
+		var limit int
+		switch op {
+		case OpConstant, OpClosure:
+			limit = len(p.Constants)
+		case OpGetGlobal, OpSetGlobal, OpDefGlobal:
+			limit = globals
+		case OpGetLocal, OpSetLocal, OpNewBox, OpGetBoxed, OpSetBoxed:
+			limit = p.NumLocals
+		case OpGetFree, OpSetFree:
+			limit = len(p.Free)
+		case OpJumpIfBound:
+			limit = p.NumLocals
+			jumps = append(jumps, operands[1])
+		case OpJump, OpJumpIfFalse, OpIterNext:
+			limit = -1
+			jumps = append(jumps, operands[0])
+		default:
+			limit = -1
+		}
+		if limit >= 0 && operands[0] >= limit {
+			return fmt.Errorf("%s: %04d: %s operand %d out of range", p.Name, i, def.Name, operands[0])
+		}
+		if op == OpClosure {
+			if _, ok := p.Constants[operands[0]].(*FuncProto); !ok {
+				return fmt.Errorf("%s: %04d: OpClosure over a %s", p.Name, i, p.Constants[operands[0]].Type())
+			}
+		}
+		starts[i] = true
+		last = i
+		i += 1 + width
+	}
+	if last < 0 || Opcode(p.Code[last]) != OpReturn {
+		return fmt.Errorf("%s: the code doesn't end with a return", p.Name)
+	}
+	for _, target := range jumps {
+		if !starts[target] {
+			return fmt.Errorf("%s: jump to %04d, which isn't an instruction", p.Name, target)
+		}
+	}
+	for _, c := range p.Constants {
+		if inner, ok := c.(*FuncProto); ok {
+			if err := verify(inner, globals, p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReadFile decodes the named file.
+func ReadFile(name string) (*Bytecode, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Decode(f)
+}
+
+// decoder remembers the first error like the encoder. After an error all
+// reads return zero values.
+type decoder struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (d *decoder) uint() int {
+	if d.err != nil {
+		return 0
+	}
+	n, err := binary.ReadUvarint(d.r)
+	if err == nil && n > maxLen {
+		err = fmt.Errorf("length %d out of range", n)
+	}
+	d.err = err
+	return int(n)
+}
+
+// maxLen limits the decoded lengths and counts, none of which can be larger
+// than what fits into the operands.
+const maxLen = 1 << 24
+
+func (d *decoder) int() int64 {
+	if d.err != nil {
+		return 0
+	}
+	n, err := binary.ReadVarint(d.r)
+	d.err = err
+	return n
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uint()
+	if d.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	_, d.err = io.ReadFull(d.r, b)
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) proto() *FuncProto {
+	p := &FuncProto{
+		Name:        d.string(),
+		NumRequired: d.uint(),
+		NumOptional: d.uint(),
+		HasRest:     d.uint() != 0,
+		NumLocals:   d.uint(),
+		Code:        d.bytes(),
+	}
+	n := d.uint()
+	for i := 0; i < n && d.err == nil; i++ {
+		p.Constants = append(p.Constants, d.constant())
+	}
+	n = d.uint()
+	for i := 0; i < n && d.err == nil; i++ {
+		p.Free = append(p.Free, FreeVar{Local: d.uint() != 0, Index: d.uint()})
+	}
+	n = d.uint()
+	for i := 0; i < n && d.err == nil; i++ {
+		p.Positions = append(p.Positions, Position{Offset: d.uint(), Source: d.uint()})
+	}
+	return p
+}
+
+func (d *decoder) constant() object.Object {
+	if d.err != nil {
+		return nil
+	}
+	tag, err := d.r.ReadByte()
+	if err != nil {
+		d.err = err
+		return nil
+	}
+	switch tag {
+	case tagInteger:
+		return &object.Integer{Value: d.int()}
+	case tagString:
+		return &object.String{Value: d.string()}
+	case tagKeyword:
+		return &object.Keyword{Name: d.string()}
+	case tagProto:
+		return d.proto()
+	}
+	d.err = fmt.Errorf("unknown constant tag %d", tag)
+	return nil
+}
@@ -0,0 +1,668 @@
+package compiler
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/rtfb/welp/lexer"
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+)
+
+// loopState describes a loop being compiled, for the break, continue and
+// recur forms inside it to find their way out.
+type loopState struct {
+	form   string
+	outer  *loopState
+	result int // the slot holding the value of a break
+	depth  int // the operand stack depth to restore on break and recur
+
+	// contDepth is the depth to restore on continue, it's bigger than depth
+	// if the loop keeps state on the stack
+	contDepth int
+
+	breaks    []int // the jumps to patch to the exit of the loop
+	continues []int // the jumps to patch to the next iteration
+
+	start    int      // the first instruction of the body of a loop form
+	bindings []*local // the bindings of a loop form, rebound by recur
+}
+
+// compileForm compiles the special form called name, if there's one. It
+// reports whether there was.
+func (c *Compiler) compileForm(name string, expr *parser.Node) (bool, error) {
+	switch name {
+	case "define", "def":
+		return true, c.compileDefine(expr)
+	case "set!":
+		return true, c.compileSet(expr)
+	case "let":
+		return true, c.compileLet(expr)
+	case "let*":
+		return true, c.compileLetStar(expr)
+	case "letrec":
+		return true, c.compileLetrec(expr)
+	case "fn":
+		return true, c.compileDefun(expr)
+	case "lambda":
+		return true, c.compileFunc("lambda", expr.R)
+	case "cond":
+		return true, c.compileCond(expr)
+	case "while":
+		return true, c.compileWhile(expr)
+	case "dotimes":
+		return true, c.compileDotimes(expr)
+	case "doseq", "for-each":
+		return true, c.compileDoseq(expr)
+	case "loop":
+		return true, c.compileLoop(expr)
+	case "recur":
+		return true, c.compileRecur(expr)
+	case "break":
+		return true, c.compileBreak(expr)
+	case "continue":
+		return true, c.compileContinue(expr)
+	case "module":
+		return true, c.compileModule(expr)
+	case "defmacro", "match", "eval", "import", ".", "go", "select", "with-lock",
+		"dosync", "future", "reset", "shift", "generator", "yield", "defvar", "binding",
+		"parameterize", "handler-bind", "restart-case":
+		return true, fmt.Errorf("%s is not supported by the compiler", name)
+	}
+	return false, nil
+}
+
+// (define x (+ 2 3)) => 5
+// A definition inside a func or a block makes a local variable, which is
+// visible in its own init expression, so that local funcs can be recursive.
+func (c *Compiler) compileDefine(expr *parser.Node) error {
+	name := expr.R
+	if name == nil || name.L == nil || name.L.Tok.Typ != lexer.TokIdentifier {
+		return fmt.Errorf("define expects an identifier")
+	}
+	return c.define(name.L, func() error {
+		return c.compileArg(name.R)
+	})
+}
+
+// define compiles the definition of decl, with the value compiled by init.
+func (c *Compiler) define(decl *parser.Node, init func() error) error {
+	name := string(decl.Tok.Value)
+	if !c.inScope() {
+		if err := init(); err != nil {
+			return err
+		}
+		c.emit(OpDup)
+		c.emit(OpDefGlobal, c.global(name))
+		c.defined[name] = true
+		return nil
+	}
+	l, ok := c.fn.scope.vars[name]
+	if !ok {
+		l = c.declare(decl)
+		c.emit(OpNull)
+		c.bind(l)
+	}
+	if err := init(); err != nil {
+		return err
+	}
+	c.emit(OpDup)
+	c.store(c.resolve(name))
+	return nil
+}
+
+// (module geometry (export area perimeter)) => nil
+// The declaration ends up in the Bytecode, for the evaluator to pick up when
+// importing the compiled module.
+func (c *Compiler) compileModule(expr *parser.Node) error {
+	if c.inScope() {
+		return fmt.Errorf("module must be at the top level")
+	}
+	args := expr.R
+	if args == nil || args.L == nil || args.L.Tok.Typ != lexer.TokIdentifier {
+		return fmt.Errorf("module expects a name")
+	}
+	name := string(args.L.Tok.Value)
+	exports := []string{}
+	for cell := args.R; cell != nil && cell.L != nil; cell = cell.R {
+		list := cell.L
+		if list.Tok.Typ != lexer.TokVoid || list.L == nil ||
+			string(list.L.Tok.Value) != "export" {
+			return fmt.Errorf("module %s: expected an export list, got %s", name, list)
+		}
+		for n := list.R; n != nil && n.L != nil; n = n.R {
+			if n.L.Tok.Typ != lexer.TokIdentifier {
+				return fmt.Errorf("module %s: can't export %s", name, n.L)
+			}
+			exports = append(exports, string(n.L.Tok.Value))
+		}
+	}
+	c.module, c.exports = name, exports
+	c.emit(OpNull)
+	return nil
+}
+
+// (set! x 2) => 2
+func (c *Compiler) compileSet(expr *parser.Node) error {
+	name := expr.R
+	if name == nil || name.L == nil || name.L.Tok.Typ != lexer.TokIdentifier {
+		return fmt.Errorf("set! expects an identifier")
+	}
+	if err := c.compileArg(name.R); err != nil {
+		return err
+	}
+	c.emit(OpDup)
+	c.store(c.resolve(string(name.L.Tok.Value)))
+	return nil
+}
+
+// bindingList returns the (name init) pairs of a let-like form.
+func bindingList(form string, expr *parser.Node) ([]*parser.Node, error) {
+	list := expr.R
+	if list == nil || list.L == nil || list.L.Tok.Typ != lexer.TokVoid {
+		return nil, fmt.Errorf("%s expects a binding list", form)
+	}
+	var bindings []*parser.Node
+	for cell := list.L; cell.L != nil; cell = cell.R {
+		binding := cell.L
+		if binding.L == nil || binding.R == nil {
+			return nil, fmt.Errorf("%s: malformed binding", form)
+		}
+		if binding.L.Tok.Typ != lexer.TokIdentifier {
+			return nil, fmt.Errorf("%s: destructuring is not supported by the compiler", form)
+		}
+		bindings = append(bindings, binding)
+	}
+	return bindings, nil
+}
+
+// (let ((x 1) (y 2)) (+ x y)) => 3
+func (c *Compiler) compileLet(expr *parser.Node) error {
+	bindings, err := bindingList("let", expr)
+	if err != nil {
+		return err
+	}
+	for _, b := range bindings {
+		if err := c.compileArg(b.R); err != nil {
+			return err
+		}
+	}
+	c.pushScope()
+	defer c.popScope()
+	locals := make([]*local, len(bindings))
+	for i, b := range bindings {
+		locals[i] = c.declare(b.L)
+	}
+	for i := len(locals) - 1; i >= 0; i-- {
+		c.bind(locals[i])
+	}
+	return c.compileBody(expr.R.R)
+}
+
+// (let* ((x 1) (y (+ x 1))) y) => 2
+func (c *Compiler) compileLetStar(expr *parser.Node) error {
+	bindings, err := bindingList("let*", expr)
+	if err != nil {
+		return err
+	}
+	c.pushScope()
+	defer c.popScope()
+	for _, b := range bindings {
+		if err := c.compileArg(b.R); err != nil {
+			return err
+		}
+		c.bind(c.declare(b.L))
+	}
+	return c.compileBody(expr.R.R)
+}
+
+// (letrec ((x 1) (y (+ x 1))) y) => 2
+func (c *Compiler) compileLetrec(expr *parser.Node) error {
+	bindings, err := bindingList("letrec", expr)
+	if err != nil {
+		return err
+	}
+	c.pushScope()
+	defer c.popScope()
+	locals := make([]*local, len(bindings))
+	for i, b := range bindings {
+		locals[i] = c.declare(b.L)
+		c.emit(OpNull)
+		c.bind(locals[i])
+	}
+	for _, b := range bindings {
+		if err := c.compileArg(b.R); err != nil {
+			return err
+		}
+		c.store(c.resolve(string(b.L.Tok.Value)))
+	}
+	return c.compileBody(expr.R.R)
+}
+
+// (fn add (a b) (+ a b)) => <func add>
+func (c *Compiler) compileDefun(expr *parser.Node) error {
+	name := expr.R
+	if name == nil || name.L == nil || name.L.Tok.Typ != lexer.TokIdentifier {
+		return fmt.Errorf("fn expects a name")
+	}
+	return c.define(name.L, func() error {
+		return c.compileFunc(string(name.L.Tok.Value), name.R)
+	})
+}
+
+// compileFunc compiles a parameter list followed by a body, held in expr.L
+// and expr.R, to a closure.
+func (c *Compiler) compileFunc(name string, expr *parser.Node) error {
+	if expr == nil || expr.L == nil || expr.L.Tok.Typ != lexer.TokVoid {
+		return fmt.Errorf("%s: expected a parameter list", name)
+	}
+	outer := c.fn
+	f := newFuncState(name, outer, true)
+	c.fn = f
+	defer func() { c.fn = outer }()
+	c.pushScope()
+	if err := c.compileParams(name, expr.L); err != nil {
+		return err
+	}
+	if err := c.compileBody(expr.R); err != nil {
+		return err
+	}
+	c.emit(OpReturn)
+	proto, err := c.finish()
+	if err != nil {
+		return err
+	}
+	c.fn = outer
+	c.emit(OpClosure, c.constant(proto))
+	return nil
+}
+
+// compileParams parses a parameter list and compiles the prologue of a func
+// which evaluates the defaults of the &optional params, and boxes the
+// captured params. The args are placed in the slots of the params by the
+// call.
+func (c *Compiler) compileParams(name string, params *parser.Node) error {
+	type param struct {
+		decl *parser.Node
+		init *parser.Node
+	}
+	var required, optional []param
+	var rest *param
+	section := ""
+	for cell := params; cell.L != nil; cell = cell.R {
+		node := cell.L
+		if node.Tok.Typ == lexer.TokIdentifier && strings.HasPrefix(string(node.Tok.Value), "&") {
+			marker := string(node.Tok.Value)
+			switch {
+			case marker == "&key":
+				return fmt.Errorf("%s: &key is not supported by the compiler", name)
+			case marker != "&optional" && marker != "&rest":
+				return fmt.Errorf("%s: unknown parameter marker %s", name, marker)
+			case marker == "&optional" && section != "":
+				return fmt.Errorf("%s: &optional must precede &rest and &key", name)
+			case marker == "&rest" && section == "&rest":
+				return fmt.Errorf("%s: only one &rest parameter is allowed", name)
+			}
+			section = marker
+			continue
+		}
+		p := param{decl: node}
+		if node.Tok.Typ == lexer.TokVoid && node.L != nil && section == "&optional" {
+			p.decl = node.L
+			if node.R != nil && node.R.L != nil {
+				p.init = node.R
+			}
+		}
+		if p.decl.Tok.Typ != lexer.TokIdentifier {
+			return fmt.Errorf("%s: destructuring is not supported by the compiler", name)
+		}
+		switch section {
+		case "":
+			required = append(required, p)
+		case "&optional":
+			optional = append(optional, p)
+		case "&rest":
+			if rest != nil {
+				return fmt.Errorf("%s: only one &rest parameter is allowed", name)
+			}
+			rest = &p
+		}
+	}
+	if section == "&rest" && rest == nil {
+		return fmt.Errorf("%s: &rest requires a parameter name", name)
+	}
+	all := append(append([]param(nil), required...), optional...)
+	if rest != nil {
+		all = append(all, *rest)
+	}
+	if len(all) > math.MaxUint8 {
+		return fmt.Errorf("%s: too many parameters", name)
+	}
+	proto := c.fn.proto
+	proto.NumRequired = len(required)
+	proto.NumOptional = len(optional)
+	proto.HasRest = rest != nil
+	slots := make([]int, len(all))
+	for i := range all {
+		slots[i] = c.alloc()
+	}
+	// The params are declared one by one, so that the defaults see only the
+	// preceding ones.
+	for i, p := range all {
+		l := &local{slot: slots[i], decl: p.decl}
+		if i >= len(required) && i < len(required)+len(optional) {
+			jump := c.emit(OpJumpIfBound, l.slot, 0)
+			if err := c.compileArg(p.init); err != nil {
+				return err
+			}
+			c.emit(OpSetLocal, l.slot)
+			c.patch(jump)
+		}
+		if c.captured[p.decl] {
+			c.emit(OpGetLocal, l.slot)
+			c.emit(OpNewBox, l.slot)
+		}
+		c.fn.scope.vars[string(p.decl.Tok.Value)] = l
+	}
+	return nil
+}
+
+// (cond
+//
+//	((eq x 1) 1)
+//	((eq x 2) 1)
+//	(t (fib (- x 1))))
+//
+// Like in the evaluator, the last clause is taken without checking its
+// condition.
+func (c *Compiler) compileCond(expr *parser.Node) error {
+	var clauses []*parser.Node
+	for cell := expr.R; cell != nil && cell.L != nil; cell = cell.R {
+		if cell.L.Tok.Typ != lexer.TokVoid {
+			return fmt.Errorf("cond: malformed clause %s", cell.L)
+		}
+		clauses = append(clauses, cell.L)
+	}
+	if len(clauses) == 0 {
+		c.emit(OpNull)
+		return nil
+	}
+	var ends []int
+	for _, clause := range clauses[:len(clauses)-1] {
+		if err := c.compileArg(clause); err != nil {
+			return err
+		}
+		next := c.emit(OpJumpIfFalse, 0)
+		if err := c.compileArg(clause.R); err != nil {
+			return err
+		}
+		ends = append(ends, c.emit(OpJump, 0))
+		c.fn.depth--
+		c.patch(next)
+	}
+	if err := c.compileArg(clauses[len(clauses)-1].R); err != nil {
+		return err
+	}
+	for _, end := range ends {
+		c.patch(end)
+	}
+	return nil
+}
+
+// enterLoop starts compiling a loop form.
+func (c *Compiler) enterLoop(form string) *loopState {
+	f := c.fn
+	ls := &loopState{
+		form:      form,
+		outer:     f.loop,
+		result:    c.alloc(),
+		depth:     f.depth,
+		contDepth: f.depth,
+	}
+	f.loop = ls
+	return ls
+}
+
+// exitLoop finishes compiling a loop whose body has just fallen through, with
+// the value of the loop on the stack.
+func (c *Compiler) exitLoop(ls *loopState) {
+	end := c.emit(OpJump, 0)
+	c.fn.depth--
+	for _, b := range ls.breaks {
+		c.patch(b)
+	}
+	c.emit(OpGetLocal, ls.result)
+	c.patch(end)
+	c.fn.loop = ls.outer
+}
+
+// (while (< i 3) (set! i (+ i 1)))
+func (c *Compiler) compileWhile(expr *parser.Node) error {
+	if expr.R == nil || expr.R.L == nil {
+		return fmt.Errorf("while expects a condition")
+	}
+	ls := c.enterLoop("while")
+	start := c.here()
+	if err := c.compileArg(expr.R); err != nil {
+		return err
+	}
+	exit := c.emit(OpJumpIfFalse, 0)
+	if err := c.compileStatements(expr.R.R); err != nil {
+		return err
+	}
+	for _, cont := range ls.continues {
+		c.patch(cont)
+	}
+	c.emit(OpJump, start)
+	c.patch(exit)
+	c.emit(OpNull)
+	c.exitLoop(ls)
+	return nil
+}
+
+// loopHeader parses the (name expr) header of dotimes and doseq.
+func loopHeader(form string, expr *parser.Node) (*parser.Node, *parser.Node, error) {
+	if expr.R == nil || expr.R.L == nil || expr.R.L.Tok.Typ != lexer.TokVoid {
+		return nil, nil, fmt.Errorf("%s expects a (name expr) header", form)
+	}
+	header := expr.R.L
+	if header.L == nil || header.R == nil || header.R.L == nil {
+		return nil, nil, fmt.Errorf("%s expects a (name expr) header", form)
+	}
+	if header.L.Tok.Typ != lexer.TokIdentifier {
+		return nil, nil, fmt.Errorf("%s: destructuring is not supported by the compiler", form)
+	}
+	return header.L, header.R, nil
+}
+
+// (dotimes (i 3) (print i))
+func (c *Compiler) compileDotimes(expr *parser.Node) error {
+	decl, countExpr, err := loopHeader("dotimes", expr)
+	if err != nil {
+		return err
+	}
+	c.pushScope()
+	defer c.popScope()
+	if err := c.compileArg(countExpr); err != nil {
+		return err
+	}
+	count := c.alloc()
+	c.emit(OpSetLocal, count)
+	i := c.alloc()
+	c.emit(OpConstant, c.constant(&object.Integer{Value: 0}))
+	c.emit(OpSetLocal, i)
+	ls := c.enterLoop("dotimes")
+	start := c.here()
+	c.emit(OpGetLocal, i)
+	c.emit(OpGetLocal, count)
+	c.emit(OpLess)
+	exit := c.emit(OpJumpIfFalse, 0)
+	c.pushScope()
+	c.emit(OpGetLocal, i)
+	c.bind(c.declare(decl))
+	if err := c.compileStatements(expr.R.R); err != nil {
+		return err
+	}
+	c.popScope()
+	for _, cont := range ls.continues {
+		c.patch(cont)
+	}
+	c.emit(OpGetLocal, i)
+	c.emit(OpConstant, c.constant(&object.Integer{Value: 1}))
+	c.emit(OpAdd)
+	c.emit(OpSetLocal, i)
+	c.emit(OpJump, start)
+	c.patch(exit)
+	c.emit(OpNull)
+	c.exitLoop(ls)
+	return nil
+}
+
+// (doseq (x [1 2 3]) (print x))
+func (c *Compiler) compileDoseq(expr *parser.Node) error {
+	decl, collExpr, err := loopHeader("doseq", expr)
+	if err != nil {
+		return err
+	}
+	c.pushScope()
+	defer c.popScope()
+	ls := c.enterLoop("doseq")
+	if err := c.compileArg(collExpr); err != nil {
+		return err
+	}
+	c.emit(OpIter)
+	ls.contDepth = c.fn.depth
+	start := c.here()
+	exit := c.emit(OpIterNext, 0)
+	c.pushScope()
+	c.bind(c.declare(decl))
+	if err := c.compileStatements(expr.R.R); err != nil {
+		return err
+	}
+	c.popScope()
+	for _, cont := range ls.continues {
+		c.patch(cont)
+	}
+	c.emit(OpJump, start)
+	c.patch(exit)
+	// OpIterNext pops the iterator when it's done
+	c.fn.depth = ls.depth
+	c.emit(OpNull)
+	c.exitLoop(ls)
+	return nil
+}
+
+// (loop ((i 0) (acc 1))
+//
+//	(cond
+//	  ((eq i 5) acc)
+//	  (t (recur (+ i 1) (* acc 2)))))
+//
+// => 32
+func (c *Compiler) compileLoop(expr *parser.Node) error {
+	bindings, err := bindingList("loop", expr)
+	if err != nil {
+		return err
+	}
+	c.pushScope()
+	defer c.popScope()
+	ls := c.enterLoop("loop")
+	for _, b := range bindings {
+		if err := c.compileArg(b.R); err != nil {
+			return err
+		}
+		l := c.declare(b.L)
+		c.bind(l)
+		ls.bindings = append(ls.bindings, l)
+	}
+	ls.start = c.here()
+	if err := c.compileBody(expr.R.R); err != nil {
+		return err
+	}
+	c.exitLoop(ls)
+	return nil
+}
+
+// findLoop returns the innermost loop accepting a break, continue or recur.
+func (c *Compiler) findLoop(form string) *loopState {
+	for ls := c.fn.loop; ls != nil; ls = ls.outer {
+		switch {
+		case form == "break",
+			form == "continue" && ls.form != "loop",
+			form == "recur" && ls.form == "loop":
+			return ls
+		}
+	}
+	return nil
+}
+
+// (recur (+ i 1) acc) restarts the innermost loop form, or if there's none,
+// the func.
+func (c *Compiler) compileRecur(expr *parser.Node) error {
+	argc := 0
+	for arg := expr.R; arg != nil && arg.L != nil; arg = arg.R {
+		if err := c.compileArg(arg); err != nil {
+			return err
+		}
+		argc++
+	}
+	ls := c.findLoop("recur")
+	if ls == nil {
+		if !c.fn.isFunc {
+			return fmt.Errorf("recur outside of a loop")
+		}
+		if argc > math.MaxUint8 {
+			return fmt.Errorf("too many args at position %d", callPos(expr))
+		}
+		c.emitAt(callPos(expr), OpRecur, argc)
+		c.fn.depth++
+		return nil
+	}
+	if argc != len(ls.bindings) {
+		return fmt.Errorf("recur: expected %d args, got %d", len(ls.bindings), argc)
+	}
+	for i := argc - 1; i >= 0; i-- {
+		c.bind(ls.bindings[i])
+	}
+	c.jumpOut(ls.depth, ls.start)
+	return nil
+}
+
+// (break) or (break value)
+func (c *Compiler) compileBreak(expr *parser.Node) error {
+	ls := c.findLoop("break")
+	if ls == nil {
+		return fmt.Errorf("break outside of a loop")
+	}
+	if err := c.compileArg(expr.R); err != nil {
+		return err
+	}
+	c.emit(OpSetLocal, ls.result)
+	ls.breaks = append(ls.breaks, c.jumpOut(ls.depth, 0))
+	return nil
+}
+
+// (continue)
+func (c *Compiler) compileContinue(expr *parser.Node) error {
+	ls := c.findLoop("continue")
+	if ls == nil {
+		return fmt.Errorf("continue outside of a loop")
+	}
+	ls.continues = append(ls.continues, c.jumpOut(ls.contDepth, 0))
+	return nil
+}
+
+// jumpOut drops the operand stack to depth and jumps to target. Since the
+// code after the jump is unreachable, the depth tracked for it is that of the
+// form being compiled, which yields one value.
+func (c *Compiler) jumpOut(depth int, target int) int {
+	f := c.fn
+	before := f.depth
+	if n := f.depth - depth; n > 0 {
+		c.emit(OpPopN, n)
+	}
+	jump := c.emit(OpJump, target)
+	f.depth = before + 1
+	return jump
+}
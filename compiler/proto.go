@@ -0,0 +1,87 @@
+package compiler
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/rtfb/welp/object"
+)
+
+// ProtoType is the type of FuncProto objects. They only ever appear in
+// constant pools.
+const ProtoType = "PROTO"
+
+// FuncProto is a compiled func: its code along with everything needed to make
+// a closure out of it. The parameters occupy the first local slots: first the
+// required ones, then the optional ones, then the &rest one.
+type FuncProto struct {
+	Name        string
+	NumRequired int
+	NumOptional int
+	HasRest     bool
+	NumLocals   int
+	Code        Instructions
+	Constants   []object.Object
+	Free        []FreeVar
+	Positions   []Position
+}
+
+// FreeVar tells where a closure finds a variable it captures when it's
+// created: in a local slot of the enclosing func, or among the captured
+// variables of the enclosing func.
+type FreeVar struct {
+	Local bool
+	Index int
+}
+
+// Position maps the instruction at Offset to the source expression it was
+// compiled from. Source is the byte offset of the expression in the source,
+// which is what the positions in the error messages are.
+type Position struct {
+	Offset int
+	Source int
+}
+
+// Bytecode is the output of the compiler: the code to run, and the names of
+// the globals it refers to by index. Module and Exports come from the module
+// form, if the code has one.
+type Bytecode struct {
+	Main    *FuncProto
+	Globals []string
+	Module  string
+	Exports []string
+}
+
+// Type implements Object.
+func (p *FuncProto) Type() object.Type {
+	return ProtoType
+}
+
+// Inspect implements Object.
+func (p *FuncProto) Inspect() string {
+	return fmt.Sprintf("<proto %s>", p.Name)
+}
+
+// Arity describes the number of arguments accepted, for error messages.
+func (p *FuncProto) Arity() string {
+	switch {
+	case p.HasRest:
+		return fmt.Sprintf("at least %d", p.NumRequired)
+	case p.NumOptional > 0:
+		return fmt.Sprintf("%d to %d", p.NumRequired, p.NumRequired+p.NumOptional)
+	default:
+		return fmt.Sprintf("%d", p.NumRequired)
+	}
+}
+
+// PosAt returns the byte offset in the source of the instruction at offset,
+// or 0 if it's unknown.
+func (p *FuncProto) PosAt(offset int) int {
+	i := sort.Search(len(p.Positions), func(i int) bool {
+		return p.Positions[i].Offset >= offset
+	})
+	if i == len(p.Positions) || p.Positions[i].Offset != offset {
+		return 0
+	}
+	return p.Positions[i].Source
+}
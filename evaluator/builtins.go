@@ -3,10 +3,13 @@ package evaluator
 import (
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/rtfb/welp/lexer"
 	"github.com/rtfb/welp/object"
 	"github.com/rtfb/welp/parser"
+	"github.com/rtfb/welp/primitive"
+	"github.com/rtfb/welp/vm"
 )
 
 type callable struct {
@@ -16,102 +19,114 @@ type callable struct {
 	// pointer to a built-in func if it's a builtin
 	f func(env *Environ, expr *parser.Node) object.Object
 
-	// params and body of a user-defined func if it's no a builtin
-	params *parser.Node
-	body   *parser.Node
-}
+	// prim is set instead of f if the builtin is a primitive, which gets
+	// its args evaluated
+	prim primitive.Func
 
-func makeBuiltins() map[string]*callable {
-	return map[string]*callable{
-		"+":        &callable{name: "+", f: sum, builtin: true},
-		"-":        &callable{name: "-", f: sub, builtin: true},
-		"*":        &callable{name: "*", f: mul, builtin: true},
-		"exp":      &callable{name: "exp", f: exp, builtin: true},
-		"eval":     &callable{name: "eval", f: eval, builtin: true},
-		"fn":       &callable{name: "fn", f: defun, builtin: true},
-		"cond":     &callable{name: "cond", f: cond, builtin: true},
-		"eq":       &callable{name: "eq", f: eq, builtin: true},
-		"let":      &callable{name: "let", f: let, builtin: true},
-		"mk-array": &callable{name: "mk-array", f: makeArray, builtin: true},
-		"append":   &callable{name: "append", f: arrAppend, builtin: true},
-		"nth":      &callable{name: "nth", f: nth, builtin: true},
-		"len":      &callable{name: "len", f: arrLen, builtin: true},
-		"print":    &callable{name: "print", f: print, builtin: true},
-		"import":   &callable{name: "import", f: importFiles, builtin: true},
-	}
-}
+	// arity is checked before calling prim if it's set
+	arity *Arity
 
-func sum(env *Environ, expr *parser.Node) object.Object {
-	lval := eval(env, expr)
-	intLval, ok := lval.(*object.Integer)
-	if !ok {
-		fmt.Printf("Type error: unexpected type %T for +\n", lval)
-	}
-	acc := intLval.Value
-	for !nilNode(expr.R) {
-		rval := eval(env, expr.R)
-		intRval, ok := rval.(*object.Integer)
-		if !ok {
-			fmt.Printf("Type error: unexpected type %T for +\n", rval)
-		}
-		acc += intRval.Value
-		expr = expr.R
-	}
-	return &object.Integer{Value: acc}
-}
+	// host is set for the funcs registered from Go, which get the funcs
+	// among their args bound to the state of the caller, see bindFuncs
+	host bool
 
-func sub(env *Environ, expr *parser.Node) object.Object {
-	lval := eval(env, expr)
-	intLval, ok := lval.(*object.Integer)
-	if !ok {
-		fmt.Printf("Type error: unexpected type %T for -\n", lval)
-	}
-	acc := intLval.Value
-	for !nilNode(expr.R) {
-		rval := eval(env, expr.R)
-		intRval, ok := rval.(*object.Integer)
-		if !ok {
-			fmt.Printf("Type error: unexpected type %T for -\n", rval)
-		}
-		acc -= intRval.Value
-		expr = expr.R
-	}
-	return &object.Integer{Value: acc}
-}
+	// metered is set for the funcs run by a vm, see vm.MeteredApplicable
+	metered vm.MeteredApplicable
 
-func mul(env *Environ, expr *parser.Node) object.Object {
-	acc := num(env, expr.L.Tok)
-	for !nilNode(expr.R) {
-		rval := eval(env, expr.R)
-		intRval, ok := rval.(*object.Integer)
-		if !ok {
-			fmt.Printf("Type error: unexpected type %T for *\n", rval)
-		}
-		acc *= intRval.Value
-		expr = expr.R
-	}
-	return &object.Integer{Value: acc}
+	// needs lists the capabilities required by a builtin
+	needs Capability
+
+	// params and body of a user-defined func if it's no a builtin
+	spec *paramSpec
+	body *parser.Node
+
+	// env is the scope the user-defined func was defined in
+	env *Environ
+
+	// macro is set if the user-defined func is a macro
+	macro bool
 }
 
-// (exp base pow1 pow2 pow3) => base ^ (pow1 + pow2 + pow3)
-func exp(env *Environ, expr *parser.Node) object.Object {
-	base := num(env, expr.L.Tok)
-	pow := int64(0)
-	for !nilNode(expr.R) {
-		rval := eval(env, expr.R)
-		intRval, ok := rval.(*object.Integer)
-		if !ok {
-			fmt.Printf("Type error: unexpected type %T for exp\n", rval)
+func makeBuiltins() map[string]*callable {
+	builtins := map[string]*callable{
+		"eval":           &callable{name: "eval", f: evalArg, builtin: true},
+		"fn":             &callable{name: "fn", f: defun, builtin: true},
+		"lambda":         &callable{name: "lambda", f: lambda, builtin: true},
+		"defmacro":       &callable{name: "defmacro", f: defmacro, builtin: true},
+		"cond":           &callable{name: "cond", f: cond, builtin: true},
+		"match":          &callable{name: "match", f: match, builtin: true},
+		"define":         &callable{name: "define", f: define, builtin: true},
+		"def":            &callable{name: "def", f: define, builtin: true},
+		"let":            &callable{name: "let", f: let, builtin: true},
+		"let*":           &callable{name: "let*", f: letStar, builtin: true},
+		"letrec":         &callable{name: "letrec", f: letrec, builtin: true},
+		"set!":           &callable{name: "set!", f: set, builtin: true},
+		"while":          &callable{name: "while", f: whileLoop, builtin: true},
+		"dotimes":        &callable{name: "dotimes", f: dotimes, builtin: true},
+		"doseq":          &callable{name: "doseq", f: doseq, builtin: true},
+		"for-each":       &callable{name: "for-each", f: doseq, builtin: true},
+		"loop":           &callable{name: "loop", f: loop, builtin: true},
+		"recur":          &callable{name: "recur", f: recur, builtin: true},
+		"break":          &callable{name: "break", f: breakLoop, builtin: true},
+		"continue":       &callable{name: "continue", f: continueLoop, builtin: true},
+		"import":         &callable{name: "import", f: importFiles, builtin: true, needs: ModuleAccess},
+		"module":         &callable{name: "module", f: moduleForm, builtin: true},
+		".":              &callable{name: ".", f: dotCall, builtin: true},
+		"spawn":          &callable{name: "spawn", f: spawn, builtin: true},
+		"go":             &callable{name: "go", f: goForm, builtin: true},
+		"chan":           &callable{name: "chan", f: makeChan, builtin: true},
+		"send":           &callable{name: "send", f: send, builtin: true},
+		"recv":           &callable{name: "recv", f: recv, builtin: true},
+		"close":          &callable{name: "close", f: closeChan, builtin: true},
+		"select":         &callable{name: "select", f: selectForm, builtin: true},
+		"wait-group":     &callable{name: "wait-group", f: makeWaitGroup, builtin: true},
+		"wg-add":         &callable{name: "wg-add", f: wgAdd, builtin: true},
+		"wg-done":        &callable{name: "wg-done", f: wgDone, builtin: true},
+		"wg-wait":        &callable{name: "wg-wait", f: wgWait, builtin: true},
+		"mutex":          &callable{name: "mutex", f: makeMutex, builtin: true},
+		"lock":           &callable{name: "lock", f: lock, builtin: true},
+		"unlock":         &callable{name: "unlock", f: unlock, builtin: true},
+		"with-lock":      &callable{name: "with-lock", f: withLock, builtin: true},
+		"atom":           &callable{name: "atom", f: makeAtom, builtin: true},
+		"deref":          &callable{name: "deref", f: deref, builtin: true},
+		"reset!":         &callable{name: "reset!", f: reset, builtin: true},
+		"swap!":          &callable{name: "swap!", f: swap, builtin: true},
+		"add-watch":      &callable{name: "add-watch", f: addWatch, builtin: true},
+		"remove-watch":   &callable{name: "remove-watch", f: removeWatch, builtin: true},
+		"ref":            &callable{name: "ref", f: makeRef, builtin: true},
+		"dosync":         &callable{name: "dosync", f: dosync, builtin: true},
+		"ref-set":        &callable{name: "ref-set", f: refSet, builtin: true},
+		"alter":          &callable{name: "alter", f: alter, builtin: true},
+		"future":         &callable{name: "future", f: future, builtin: true},
+		"await":          &callable{name: "await", f: await, builtin: true},
+		"promise":        &callable{name: "promise", f: makePromise, builtin: true},
+		"deliver":        &callable{name: "deliver", f: deliver, builtin: true},
+		"all":            &callable{name: "all", f: all, builtin: true},
+		"race":           &callable{name: "race", f: race, builtin: true},
+		"reset":          &callable{name: "reset", f: resetForm, builtin: true},
+		"shift":          &callable{name: "shift", f: shiftForm, builtin: true},
+		"generator":      &callable{name: "generator", f: generatorForm, builtin: true},
+		"yield":          &callable{name: "yield", f: yieldForm, builtin: true},
+		"take":           &callable{name: "take", f: take, builtin: true},
+		"seq":            &callable{name: "seq", f: seq, builtin: true},
+		"defvar":         &callable{name: "defvar", f: defvar, builtin: true},
+		"binding":        &callable{name: "binding", f: bindingForm, builtin: true},
+		"parameterize":   &callable{name: "parameterize", f: bindingForm, builtin: true},
+		"handler-bind":   &callable{name: "handler-bind", f: handlerBind, builtin: true},
+		"signal":         &callable{name: "signal", f: signalCondition, builtin: true},
+		"error":          &callable{name: "error", f: raiseCondition, builtin: true},
+		"restart-case":   &callable{name: "restart-case", f: restartCase, builtin: true},
+		"invoke-restart": &callable{name: "invoke-restart", f: invokeRestart, builtin: true},
+	}
+	for name, prim := range primitive.Table {
+		if _, ok := builtins[name]; !ok {
+			builtins[name] = &callable{name: name, prim: prim, builtin: true}
 		}
-		pow += intRval.Value
-		expr = expr.R
 	}
-	result := base
-	for pow > 1 {
-		result *= base
-		pow--
+	for name, f := range systemBuiltins {
+		builtins[name] = f
 	}
-	return &object.Integer{Value: result}
+	return builtins
 }
 
 // Eval evals.
@@ -119,38 +134,82 @@ func Eval(env *Environ, expr *parser.Node) object.Object {
 	if expr.Err != nil {
 		return &object.Error{Err: expr.Err}
 	}
-	return eval(env, expr)
+	result := eval(env, expr)
+	if sig, ok := result.(*signal); ok {
+		return strayError(sig)
+	}
+	return result
 }
 
+// eval evaluates a list expression: the head of the list is called with the
+// rest of the list as arguments. A head that names a variable which doesn't
+// hold a func just evaluates to the variable's value.
 func eval(env *Environ, expr *parser.Node) object.Object {
-	if expr == nil || expr.L == nil {
+	if expr == nil {
+		return &object.Null{}
+	}
+	switch expr.Tok.Typ {
+	case lexer.TokOpenBracket:
+		return arrayLiteral(env, expr)
+	case lexer.TokOpenBrace:
+		return mapLiteral(env, expr)
+	}
+	if expr.L == nil {
 		return &object.Null{}
 	}
 	switch expr.L.Tok.Typ {
 	case lexer.TokIdentifier:
 		identName := ident(expr)
-		if identName == "t" {
-			return &object.Boolean{Value: true}
+		if function, ok := env.lookupFunc(identName); ok {
+			return callFunc(env, function, expr)
 		}
-		if identName == "nil" {
-			return &object.Boolean{Value: true}
+		if result, ok := methodCall(env, identName, expr); ok {
+			return result
 		}
-		function, ok := env.funcs[identName]
-		if ok {
-			if function.builtin {
-				return function.f(env, expr.R)
-			}
-			return callUserFunc(env, function, expr.R)
+	case lexer.TokVoid:
+	default:
+		return evalArg(env, expr)
+	}
+	head := evalArg(env, expr)
+	if f, ok := head.(*object.Func); ok {
+		return callFunc(env, funcCallable(f), expr)
+	}
+	return head
+}
+
+// evalArg evaluates the single expression held in expr.L, e.g. an argument
+// of a func call. Unlike eval, it never calls a func named by an identifier,
+// it returns the func itself.
+func evalArg(env *Environ, expr *parser.Node) object.Object {
+	if expr == nil || expr.L == nil {
+		return &object.Null{}
+	}
+	if err := env.step(); err != nil {
+		return err
+	}
+	switch expr.L.Tok.Typ {
+	case lexer.TokIdentifier:
+		identName := ident(expr)
+		switch {
+		case identName == "t":
+			return &object.Boolean{Value: true}
+		case identName == "nil":
+			return &object.Boolean{Value: false}
+		case strings.HasPrefix(identName, ":") && len(identName) > 1:
+			return &object.Keyword{Name: identName[1:]}
 		}
-		if v, ok := env.vars[identName]; ok {
+		if v, ok := env.lookupVar(identName); ok {
 			return v
 		}
-		fmt.Printf("No such symbol %q\n", expr.L.Tok.String())
+		if function, ok := env.lookupFunc(identName); ok {
+			return &object.Func{Name: function.name, Impl: function}
+		}
+		return &object.Error{Err: fmt.Errorf("no such symbol %q", identName)}
 	case lexer.TokNumber:
 		return &object.Integer{Value: num(env, expr.L.Tok)}
 	case lexer.TokString:
 		return &object.String{Value: string(expr.L.Tok.Value)}
-	case lexer.TokVoid:
+	case lexer.TokVoid, lexer.TokOpenBracket, lexer.TokOpenBrace:
 		return eval(env, expr.L)
 	default:
 		fmt.Printf("Unknown token type for %q\n", expr.L.Tok.String())
@@ -158,29 +217,127 @@ func eval(env *Environ, expr *parser.Node) object.Object {
 	return &object.Error{Err: errors.New("huh?")}
 }
 
-// (eq 3 3) => T
-// (eq 3 4) => NIL
-func eq(env *Environ, expr *parser.Node) object.Object {
-	leftObj := eval(env, expr)
-	rightObj := eval(env, expr.R)
-	if leftObj.Type() != rightObj.Type() {
-		return &object.Error{Err: fmt.Errorf("type mismatch: %v and %v",
-			leftObj.Type(), rightObj.Type())}
+// callFunc calls f with the arguments in call.R. The head of the call is only
+// used for error reporting.
+func callFunc(env *Environ, f *callable, call *parser.Node) object.Object {
+	if !env.state.allows(f.needs) {
+		return &object.Error{Err: fmt.Errorf("%s isn't allowed here", f.name)}
 	}
-	switch left := leftObj.(type) {
-	case *object.Integer:
-		right := rightObj.(*object.Integer)
-		return &object.Boolean{Value: left.Value == right.Value}
-	case *object.Boolean:
-		right := rightObj.(*object.Boolean)
-		return &object.Boolean{Value: left.Value == right.Value}
-	case *object.Error:
-		right := rightObj.(*object.Error)
-		return &object.Boolean{Value: left.Err == right.Err}
+	switch {
+	case f.prim != nil:
+		args, errObj := evalArgs(env, call.R)
+		if errObj != nil {
+			return errObj
+		}
+		if f.arity != nil {
+			if err := f.arity.check(f.name, callPos(call), len(args)); err != nil {
+				return &object.Error{Err: err}
+			}
+		}
+		return callPrim(env.state, f, args)
+	case f.builtin:
+		return f.f(env, call.R)
+	case f.macro:
+		return expandMacro(env, f, call)
 	default:
-		return &object.Error{Err: fmt.Errorf("types not comparable with eq: %v and %v",
-			leftObj.Type(), rightObj.Type())}
+		return callUserFunc(env, f, call)
+	}
+}
+
+// evalArgs evaluates the args in the list. It returns the first error or
+// signal, if there's one.
+func evalArgs(env *Environ, list *parser.Node) ([]object.Object, object.Object) {
+	var args []object.Object
+	for arg := list; arg != nil && arg.L != nil; arg = arg.R {
+		val := evalArg(env, arg)
+		if isAbrupt(val) {
+			return nil, val
+		}
+		args = append(args, val)
+	}
+	return args, nil
+}
+
+// callPrim calls a primitive as a part of the evaluation tracked by state,
+// charging the values it allocates: either the ones it returns, or the ones it
+// adds to its first arg if it grows it in place, like append does.
+func callPrim(state *evalState, f *callable, args []object.Object) object.Object {
+	switch {
+	case !state.limited():
+		return f.prim(args)
+	case f.metered != nil:
+		// the vm charges for itself
+		return f.metered.ApplyMetered(meter{state.limits}, args)
+	case f.host:
+		args = bindFuncs(args, state)
+	}
+	var before int64
+	if len(args) > 0 {
+		before = primitive.Size(args[0])
+	}
+	result := f.prim(args)
+	n := primitive.Size(result)
+	if len(args) > 0 && result == args[0] {
+		n -= before
+	}
+	if err := state.limits.charge(n); err != nil {
+		return err
+	}
+	return result
+}
+
+// funcCallable returns the callable behind a func value. The funcs that come
+// from elsewhere, like the ones compiled for the vm, get wrapped.
+func funcCallable(f *object.Func) *callable {
+	switch impl := f.Impl.(type) {
+	case *callable:
+		return impl
+	case primitive.Func:
+		return &callable{name: f.Name, prim: impl, builtin: true}
+	case *boundFunc:
+		return impl.f
+	case vm.MeteredApplicable:
+		return &callable{name: f.Name, prim: impl.Apply, builtin: true, metered: impl}
+	case object.Applicable:
+		return &callable{name: f.Name, prim: impl.Apply, builtin: true}
+	}
+	return &callable{name: f.Name, builtin: true, prim: func([]object.Object) object.Object {
+		return &object.Error{Err: fmt.Errorf("%s can't be called", f.Name)}
+	}}
+}
+
+// Apply implements object.Applicable, which lets the vm and the Go code call
+// the funcs of the evaluator. Special forms and macros can't be called that
+// way, since they need their args unevaluated.
+func (f *callable) Apply(args []object.Object) object.Object {
+	return f.apply(args, nil)
+}
+
+// ApplyMetered implements vm.MeteredApplicable: the funcs called by a vm that
+// runs as a part of a limited evaluation are subject to its limits.
+func (f *callable) ApplyMetered(m vm.Meter, args []object.Object) object.Object {
+	var state *evalState
+	if m, ok := m.(meter); ok {
+		state = &evalState{limits: m.l}
+	}
+	return f.apply(args, state)
+}
+
+// apply calls f with evaluated args, as a part of the evaluation tracked by
+// state.
+func (f *callable) apply(args []object.Object, state *evalState) object.Object {
+	switch {
+	case f.prim != nil:
+		if f.arity != nil {
+			if err := f.arity.check(f.name, 0, len(args)); err != nil {
+				return &object.Error{Err: err}
+			}
+		}
+		return callPrim(state, f, args)
+	case f.builtin, f.macro:
+		return &object.Error{Err: fmt.Errorf("%s can't be called with evaluated args", f.name)}
 	}
+	return applyUserFunc(f, 0, args, state)
 }
 
 // (cond
@@ -188,132 +345,80 @@ func eq(env *Environ, expr *parser.Node) object.Object {
 //    ((eq x 2) 1)
 //    (t (fib (- x 1))))
 func cond(env *Environ, expr *parser.Node) object.Object {
+	if expr.L == nil {
+		return &object.Error{Err: errors.New("cond expects a clause")}
+	}
 	for expr.L != nil && expr.R.R != nil {
-		conditional := eval(env, expr.L)
+		conditional := evalArg(env, expr.L)
+		if isAbrupt(conditional) {
+			return conditional
+		}
 		boolCond, ok := conditional.(*object.Boolean)
 		if !ok {
-			fmt.Printf("Type error: cond clause evaluates to %T, not bool\n",
-				conditional)
+			return &object.Error{Err: fmt.Errorf("type error: cond clause evaluates to %v, not %v",
+				conditional.Type(), object.BooleanType)}
 		}
 		if boolCond.Value {
-			return eval(env, expr.L.R)
+			return evalArg(env, expr.L.R)
 		}
 		expr = expr.R
 	}
-	return eval(env, expr.L.R)
+	return evalArg(env, expr.L.R)
 }
 
 // (fn add (a b) (+ a b)) => ADD
+// The body may consist of several expressions, the value of the last one is
+// returned. See parseParams for the supported parameter lists.
 func defun(env *Environ, expr *parser.Node) object.Object {
+	if expr.L == nil || expr.L.Tok.Typ != lexer.TokIdentifier {
+		return &object.Error{Err: fmt.Errorf("fn expects a name")}
+	}
 	funcName := ident(expr)
-	params := expr.R.L
-	body := expr.R.R.L
-	env.funcs[funcName] = &callable{
-		name:    funcName,
-		builtin: false,
-		params:  params,
-		body:    body,
+	f, err := newUserFunc(env, funcName, expr.R)
+	if err != nil {
+		return err
 	}
-	return &object.Func{Name: funcName}
+	env.setFunc(funcName, f)
+	return &object.Func{Name: funcName, Impl: f}
 }
 
-// (let identifier (+ 2 3)) => 5
-// identifier => 5
-func let(env *Environ, expr *parser.Node) object.Object {
-	value := eval(env, expr.R)
-	env.vars[ident(expr)] = value
-	return value
-}
-
-// (let arr (mk-array))
-// arr => []
-// TODO: find a way to specify the array type upfront.
-func makeArray(env *Environ, expr *parser.Node) object.Object {
-	return &object.Array{Value: nil}
-}
-
-// (let arr (mk-array))
-// arr => []
-// (append arr 3 5)
-// arr => [3, 5]
-func arrAppend(env *Environ, expr *parser.Node) object.Object {
-	arrObj := eval(env, expr)
-	if arrObj.Type() != object.ArrayType {
-		return &object.Error{Err: fmt.Errorf("expected array, got %v", arrObj.Type())}
-	}
-	arr := arrObj.(*object.Array)
-	arg := expr.R
-	for arg.L != nil {
-		value := eval(env, arg)
-		if len(arr.Value) == 0 {
-			arr.ValueType = value.Type()
-		} else if value.Type() != arr.ValueType {
-			return &object.Error{Err: fmt.Errorf("type mismatch: %v and %v",
-				value.Type(), arr.ValueType)}
+// [1 (+ 1 1) 3] => [1, 2, 3]
+func arrayLiteral(env *Environ, expr *parser.Node) object.Object {
+	var values []object.Object
+	for cell := expr; cell.L != nil; cell = cell.R {
+		value := evalArg(env, cell)
+		if isAbrupt(value) {
+			return value
 		}
-		arr.Value = append(arr.Value, value)
-		arg = arg.R
+		values = append(values, value)
 	}
-	return arr
-}
-
-// (append arr 1 2 3)
-// (nth 1 arr)
-// => 2
-func nth(env *Environ, expr *parser.Node) object.Object {
-	indexObj := eval(env, expr)
-	if indexObj.Type() != object.IntegerType {
-		return &object.Error{Err: fmt.Errorf("type mismatch: %v and %v",
-			indexObj.Type(), object.IntegerType)}
+	if err := env.charge(int64(len(values))); err != nil {
+		return err
 	}
-	index := (indexObj.(*object.Integer)).Value
-	arrObj := eval(env, expr.R)
-	arr, ok := arrObj.(*object.Array)
-	if !ok {
-		return &object.Error{Err: fmt.Errorf("expected array, got %v", arrObj.Type())}
-	}
-	if index >= int64(len(arr.Value)) {
-		return &object.Error{Err: fmt.Errorf("out of bounds: %d >= %d",
-			index, len(arr.Value))}
-	}
-	return arr.Value[index]
-}
-
-// (len (append (mk-array) 7 9))
-// => 2
-func arrLen(env *Environ, expr *parser.Node) object.Object {
-	arrObj := eval(env, expr)
-	if arrObj.Type() != object.ArrayType {
-		return &object.Error{Err: fmt.Errorf("expected array, got %v", arrObj.Type())}
-	}
-	arr := arrObj.(*object.Array)
-	return &object.Integer{Value: int64(len(arr.Value))}
-}
-
-func print(env *Environ, expr *parser.Node) object.Object {
-	fmt.Println(eval(env, expr).Inspect())
-	return &object.Null{}
+	return object.NewArray(values)
 }
 
-// (import "foo.lisp" "bar.lisp") => nil
-// will evaluate foo.lisp and bar.lisp, and populate the env.
-func importFiles(env *Environ, expr *parser.Node) object.Object {
-	var files []string
-	for expr.L != nil {
-		value := eval(env, expr)
-		if value.Type() != object.StringType {
-			return &object.Error{Err: fmt.Errorf("import only does strings, but got %v",
-				value.Type())}
+// {:a 1 "b" (+ 1 1)} => {:a 1, "b" 2}
+func mapLiteral(env *Environ, expr *parser.Node) object.Object {
+	m := object.NewMap()
+	for cell := expr; cell.L != nil; cell = cell.R.R {
+		if cell.R == nil || cell.R.L == nil {
+			return &object.Error{Err: fmt.Errorf("map literal needs an even number of forms")}
 		}
-		valueStr := value.(*object.String)
-		files = append(files, valueStr.Value)
-		expr = expr.R
-	}
-	for _, file := range files {
-		err := EvalFile(env, file)
-		if err != nil {
+		key := evalArg(env, cell)
+		if isAbrupt(key) {
+			return key
+		}
+		value := evalArg(env, cell.R)
+		if isAbrupt(value) {
+			return value
+		}
+		if err := m.Set(key, value); err != nil {
 			return &object.Error{Err: err}
 		}
 	}
-	return &object.Null{}
+	if err := env.charge(int64(m.Len())); err != nil {
+		return err
+	}
+	return m
 }
@@ -0,0 +1,96 @@
+package evaluator
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rtfb/welp/compiler"
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/vm"
+)
+
+// CompiledExt is the extension of the compiled modules.
+const CompiledExt = ".welpc"
+
+// CompiledPath returns the path of the compiled module for the source file
+// name, e.g. foo.welpc for foo.lisp.
+func CompiledPath(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + CompiledExt
+}
+
+// loadFile populates the env of a module with the definitions from the named
+// file. If there's a compiled module for it that's newer than the source, the
+// compiled module is run instead of evaluating the source. Modules compiled
+// for another version of the format are ignored in favor of the source.
+func loadFile(env *Environ, name string) error {
+	if filepath.Ext(name) == CompiledExt {
+		return importCompiled(env, name, false)
+	}
+	compiled := CompiledPath(name)
+	cinfo, err := os.Stat(compiled)
+	if err != nil {
+		return evalModuleFile(env, name)
+	}
+	sinfo, err := os.Stat(name)
+	if err != nil {
+		return importCompiled(env, compiled, false)
+	}
+	if !cinfo.ModTime().After(sinfo.ModTime()) {
+		return evalModuleFile(env, name)
+	}
+	err = importCompiled(env, compiled, true)
+	if err == errStaleFormat {
+		return evalModuleFile(env, name)
+	}
+	return err
+}
+
+var errStaleFormat = errors.New("compiled module has a stale format")
+
+// importCompiled runs the compiled module in a vm of its own, and copies the
+// globals it defines into env, the env of the module. The globals the module
+// doesn't define are looked up in env. If fallback is set, errStaleFormat is
+// returned for the modules compiled for another version of the format.
+func importCompiled(env *Environ, name string, fallback bool) error {
+	bc, err := compiler.ReadFile(name)
+	if err != nil {
+		if _, ok := err.(*compiler.VersionError); ok && fallback {
+			return errStaleFormat
+		}
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	machine := vm.New()
+	if env.state.limited() {
+		// the later calls of the funcs of the module are metered by
+		// their callers
+		machine.SetMeter(meter{env.state.limits})
+		defer machine.SetMeter(nil)
+	}
+	machine.SetResolver(func(name string) object.Object {
+		if v, ok := env.lookupVar(name); ok {
+			return v
+		}
+		if f, ok := env.lookupFunc(name); ok && !f.builtin && !f.macro {
+			return &object.Func{Name: f.name, Impl: f}
+		}
+		return nil
+	})
+	if _, err := machine.Run(bc); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if bc.Module != "" && env.mod != nil {
+		env.mod.name = bc.Module
+		env.mod.declared = append([]string{}, bc.Exports...)
+	}
+	for name, value := range machine.Globals() {
+		if f, ok := value.(*object.Func); ok {
+			env.setFunc(name, funcCallable(f))
+		} else {
+			env.setVar(name, value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package evaluator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rtfb/welp/compiler"
+	"github.com/rtfb/welp/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportCompiled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "welp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "mod.lisp")
+	compiled := filepath.Join(dir, "mod.welpc")
+	writeFile := func(name, content string, mtime time.Time) {
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	importAndRun := func(input string) string {
+		env := testEvaluator.NewEnv()
+		result := Eval(env, parser.ParseString(`(import "`+src+`")`))
+		if result.Type() == "ERROR" {
+			return result.Inspect()
+		}
+		return Eval(env, parser.ParseString(input)).Inspect()
+	}
+	old := time.Now().Add(-time.Hour)
+	writeFile(src, "(define x 1)", old)
+	bc, err := compiler.New().Compile(parser.ParseString("(define x 2)"),
+		parser.ParseString("(fn f (g y) (g (+ y x)))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := compiler.WriteFile(compiled, bc); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "2", importAndRun("x"))
+	assert.Equal(t, "30", importAndRun("(f (lambda (n) (* n 10)) 1)"))
+
+	writeFile(src, "(define x 1)", time.Now().Add(time.Hour))
+	assert.Equal(t, "1", importAndRun("x"))
+
+	writeFile(src, "(define x 1)", old)
+	writeFile(compiled, "WELPC\x63", time.Now())
+	assert.Equal(t, "1", importAndRun("x"))
+
+	writeFile(compiled, "garbage", time.Now())
+	assert.Contains(t, importAndRun("x"), "not a compiled welp module")
+}
@@ -0,0 +1,286 @@
+package evaluator
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rtfb/welp/lexer"
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+)
+
+// A condition is a keyword naming its kind, along with a value describing
+// it. Signaling a condition calls the handlers established by handler-bind
+// for its kind, innermost first, right where it's signaled: a handler can
+// decline it by returning, or take care of it by invoking one of the
+// restarts established by restart-case, which unwinds the evaluation to the
+// restart-case. The handlers and the restarts follow the calls like the
+// dynamic variables do, except that they don't span goroutines.
+
+// handler is a handler established by handler-bind. The handlers make a
+// stack, the innermost one on the top.
+type handler struct {
+	kind  object.Object // the kind of the conditions handled, or t for all
+	fn    *object.Func
+	outer *handler
+
+	// outside are the handlers established outside of the handler-bind,
+	// the only ones in effect while fn runs
+	outside *handler
+}
+
+// handles tells if h handles the conditions of the kind.
+func (h *handler) handles(kind *object.Keyword) bool {
+	if k, ok := h.kind.(*object.Keyword); ok {
+		return k.Name == kind.Name
+	}
+	return true
+}
+
+// restart is a restart established by restart-case. The restarts make a
+// stack, the innermost one on the top.
+type restart struct {
+	name   string
+	params *parser.Node
+	f      *callable
+	outer  *restart
+}
+
+// Restart describes one of the restarts offered to a Debugger.
+type Restart struct {
+	// Name is the keyword naming the restart, e.g. :skip.
+	Name string
+
+	// Params is the parameter list of the restart, e.g. (value).
+	Params string
+}
+
+// Debugger is called when no handler takes care of a condition signaled by
+// error, before the evaluation is unwound, with the restarts in effect,
+// innermost first. It returns the index of the restart to invoke along with
+// its args, or -1 to let error fail.
+type Debugger func(kind, data object.Object, restarts []Restart) (int, []object.Object)
+
+// WithDebugger makes the Evaluator call d with the conditions no handler
+// takes care of, which is how an interactive session offers the restarts.
+func WithDebugger(d Debugger) Option {
+	return func(e *Evaluator) {
+		e.debugger = d
+	}
+}
+
+func (s *evalState) handlers() *handler {
+	if s == nil {
+		return nil
+	}
+	return s.handler
+}
+
+func (s *evalState) restarts() *restart {
+	if s == nil {
+		return nil
+	}
+	return s.restart
+}
+
+// (handler-bind ((:bad-line (lambda (kind line) (invoke-restart :skip))))
+//    (parse-lines lines))
+// evaluates the body with the handlers established: each handler is a func
+// called with the kind and the value of the conditions of the kind signaled
+// by the body, t handles all of them. The handlers are tried in order, and
+// the ones of the outer handler-binds after them.
+func handlerBind(env *Environ, expr *parser.Node) object.Object {
+	if expr == nil || expr.L == nil || expr.L.Tok.Typ != lexer.TokVoid {
+		return &object.Error{Err: errors.New("handler-bind expects a handler list")}
+	}
+	outside := env.state.handlers()
+	var handlers []*handler
+	for cell := expr.L; cell.L != nil; cell = cell.R {
+		clause := cell.L
+		if clause.Tok.Typ != lexer.TokVoid || clause.L == nil || clause.R == nil ||
+			clause.R.L == nil {
+			return &object.Error{Err: fmt.Errorf("handler-bind: malformed handler %s", clause)}
+		}
+		kind := evalArg(env, clause)
+		if isAbrupt(kind) {
+			return kind
+		}
+		if b, ok := kind.(*object.Boolean); !ok || !b.Value {
+			if _, ok := kind.(*object.Keyword); !ok {
+				return &object.Error{Err: fmt.Errorf("handler-bind: expected a keyword or t, got %s",
+					kind.Type())}
+			}
+		}
+		fn := evalArg(env, clause.R)
+		if isAbrupt(fn) {
+			return fn
+		}
+		f, ok := fn.(*object.Func)
+		if !ok {
+			return typeError("handler-bind", object.FuncType, fn)
+		}
+		handlers = append(handlers, &handler{kind: kind, fn: f, outside: outside})
+	}
+	state := env.state.clone()
+	state.handler = outside
+	for i := len(handlers) - 1; i >= 0; i-- {
+		handlers[i].outer = state.handler
+		state.handler = handlers[i]
+	}
+	return evalBody(newFrame(env, state), expr.R)
+}
+
+// conditionArgs evaluates the args of signal and error.
+func conditionArgs(env *Environ, name string, expr *parser.Node) (*object.Keyword, object.Object, object.Object) {
+	args, err := evalArgsOf(env, name, expr, Arity{Min: 1, Max: 2})
+	if err != nil {
+		return nil, nil, err
+	}
+	kind, ok := args[0].(*object.Keyword)
+	if !ok {
+		return nil, nil, typeError(name, object.KeywordType, args[0])
+	}
+	if len(args) == 1 {
+		return kind, &object.Null{}, nil
+	}
+	return kind, args[1], nil
+}
+
+// runHandlers calls the handlers of the condition, stopping at the one that
+// invokes a restart, or fails. It returns what that handler did, or nil if
+// all the handlers declined the condition.
+func runHandlers(env *Environ, pos int, kind *object.Keyword, data object.Object) object.Object {
+	for h := env.state.handlers(); h != nil; h = h.outer {
+		if !h.handles(kind) {
+			continue
+		}
+		state := env.state.clone()
+		state.handler = h.outside
+		result := applyFunc(newFrame(env, state), funcCallable(h.fn), pos,
+			[]object.Object{kind, data})
+		if isAbrupt(result) {
+			return result
+		}
+	}
+	return nil
+}
+
+// (signal :bad-line 3) => <null>
+// signals a condition of the kind, described by the value, which is null if
+// it's not given. It returns null if no handler takes care of it.
+func signalCondition(env *Environ, expr *parser.Node) object.Object {
+	kind, data, err := conditionArgs(env, "signal", expr)
+	if err != nil {
+		return err
+	}
+	if result := runHandlers(env, callPos(expr), kind, data); result != nil {
+		return result
+	}
+	return &object.Null{}
+}
+
+// (error :bad-line 3) => ERR: unhandled condition :bad-line: 3
+// signals a condition like signal does, except that it fails if no handler
+// takes care of it. Before it does, the Debugger of the Evaluator, if it has
+// one, gets to invoke one of the restarts in effect.
+func raiseCondition(env *Environ, expr *parser.Node) object.Object {
+	kind, data, err := conditionArgs(env, "error", expr)
+	if err != nil {
+		return err
+	}
+	if result := runHandlers(env, callPos(expr), kind, data); result != nil {
+		return result
+	}
+	var restarts []*restart
+	for r := env.state.restarts(); r != nil; r = r.outer {
+		restarts = append(restarts, r)
+	}
+	if d := env.debugger(); d != nil && len(restarts) > 0 {
+		offered := make([]Restart, len(restarts))
+		for i, r := range restarts {
+			offered[i] = Restart{Name: ":" + r.name, Params: r.params.String()}
+		}
+		if i, args := d(kind, data, offered); i >= 0 && i < len(restarts) {
+			return &signal{kind: restartSignal, restart: restarts[i], args: args}
+		}
+	}
+	if _, ok := data.(*object.Null); ok {
+		return &object.Error{Err: fmt.Errorf("unhandled condition %s", kind.Inspect())}
+	}
+	return &object.Error{Err: fmt.Errorf("unhandled condition %s: %s", kind.Inspect(),
+		data.Inspect())}
+}
+
+// (restart-case (parse-line line)
+//    (:skip () nil)
+//    (:use-value (v) v))
+// evaluates the expr with the restarts established: each restart is a
+// keyword followed by a parameter list and a body, like the ones of a lambda.
+// Invoking a restart makes the restart-case return the value of its body.
+func restartCase(env *Environ, expr *parser.Node) object.Object {
+	if expr == nil || expr.L == nil {
+		return &object.Error{Err: errors.New("restart-case expects an expression")}
+	}
+	state := env.state.clone()
+	var own []*restart
+	for cell := expr.R; cell != nil && cell.L != nil; cell = cell.R {
+		clause := cell.L
+		if clause.Tok.Typ != lexer.TokVoid || clause.L == nil ||
+			clause.L.Tok.Typ != lexer.TokIdentifier || !isKeyword(string(clause.L.Tok.Value)) {
+			return &object.Error{Err: fmt.Errorf("restart-case: malformed restart %s", clause)}
+		}
+		name := string(clause.L.Tok.Value)
+		f, err := newUserFunc(env, name, clause.R)
+		if err != nil {
+			return err
+		}
+		own = append(own, &restart{name: name[1:], params: clause.R.L, f: f})
+	}
+	for i := len(own) - 1; i >= 0; i-- {
+		own[i].outer = state.restart
+		state.restart = own[i]
+	}
+	result := evalArg(newFrame(env, state), expr)
+	sig, ok := result.(*signal)
+	if !ok || sig.kind != restartSignal {
+		return result
+	}
+	for _, r := range own {
+		if sig.restart == r {
+			return applyUserFunc(r.f, callPos(expr), sig.args, env.state)
+		}
+	}
+	// the restart belongs to an outer restart-case
+	return sig
+}
+
+// (invoke-restart :use-value 0)
+// invokes the innermost restart of the name with the args.
+func invokeRestart(env *Environ, expr *parser.Node) object.Object {
+	args, err := evalArgsOf(env, "invoke-restart", expr, Arity{Min: 1, Max: Variadic})
+	if err != nil {
+		return err
+	}
+	name, ok := args[0].(*object.Keyword)
+	if !ok {
+		return typeError("invoke-restart", object.KeywordType, args[0])
+	}
+	for r := env.state.restarts(); r != nil; r = r.outer {
+		if r.name == name.Name {
+			return &signal{kind: restartSignal, restart: r, args: args[1:]}
+		}
+	}
+	return &object.Error{Err: fmt.Errorf("invoke-restart: no restart %s", name.Inspect())}
+}
+
+// debugger returns the Debugger of the Evaluator, if it has one.
+func (e *Environ) debugger() Debugger {
+	if e.evtor == nil {
+		return nil
+	}
+	return e.evtor.debugger
+}
+
+func isKeyword(name string) bool {
+	return len(name) > 1 && name[0] == ':'
+}
@@ -0,0 +1,96 @@
+package evaluator
+
+import (
+	"testing"
+
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConditions(t *testing.T) {
+	tests := []struct {
+		inputs   []string
+		expected string
+	}{
+		{[]string{"(signal :oops)"}, "null"},
+		{[]string{"(error :oops)"}, "ERR: unhandled condition :oops"},
+		{[]string{`(error :bad-line "x")`}, `ERR: unhandled condition :bad-line: "x"`},
+		// the handlers run without unwinding, so the body goes on once they
+		// decline the condition
+		{[]string{`(let ((log (mk-array)))
+			(handler-bind ((:oops (lambda (kind data) (append log kind))))
+				(signal :oops 1)
+				(append log :after)))`}, "[:oops, :after]"},
+		{[]string{`(let ((log (mk-array)))
+			(handler-bind ((t (lambda (kind data) (append log :outer))))
+				(handler-bind ((:other (lambda (kind data) (append log :other)))
+				               (:oops (lambda (kind data) (append log :inner))))
+					(signal :oops)))
+			log)`}, "[:inner, :outer]"},
+		// a handler sees the handlers outside of its handler-bind only
+		{[]string{`(let ((log (mk-array)))
+			(handler-bind ((:a (lambda (kind data) (append log :outer-a))))
+				(handler-bind ((:a (lambda (kind data) (signal :a))))
+					(signal :a)))
+			log)`}, "[:outer-a, :outer-a]"},
+		// the restarts unwind to their restart-case, through the funcs
+		{[]string{
+			`(fn parse-line (line)
+				(restart-case (cond ((eq line 0) (error :bad-line line)) (t line))
+					(:skip () 99)
+					(:use-value (v) v)))`,
+			`(fn parse-all (lines)
+				(let ((out (mk-array))) (doseq (l lines) (append out (parse-line l))) out))`,
+			`(handler-bind ((:bad-line (lambda (kind line) (invoke-restart :skip))))
+				(parse-all [1 0 3]))`}, "[1, 99, 3]"},
+		{[]string{
+			`(fn parse-line (line)
+				(restart-case (cond ((eq line 0) (error :bad-line line)) (t line))
+					(:skip () 99)
+					(:use-value (v) v)))`,
+			`(handler-bind ((:bad-line (lambda (kind line) (invoke-restart :use-value 42))))
+				(parse-line 0))`}, "42"},
+		{[]string{`(restart-case (+ 1 2) (:skip () 0))`}, "3"},
+		{[]string{`(restart-case (restart-case (invoke-restart :outer 1) (:inner () 2)) (:outer (x) (+ x 10)))`}, "11"},
+		{[]string{`(restart-case (restart-case (invoke-restart :r) (:r () :inner)) (:r () :outer))`}, ":inner"},
+		{[]string{`(restart-case (loop ((i 0)) (cond ((eq i 3) (invoke-restart :done i)) (t (recur (+ i 1))))) (:done (n) n))`}, "3"},
+		{[]string{"(invoke-restart :nope)"}, "ERR: invoke-restart: no restart :nope"},
+		{[]string{"(restart-case (recv (spawn (lambda () (invoke-restart :r)))) (:r () 1))"}, "ERR: invoke-restart: no restart :r"},
+		{[]string{"(restart-case (invoke-restart :r 1 2) (:r (x) x))"}, "ERR: :r: wrong number of args at position 15: expected 1, got 2"},
+		{[]string{"(restart-case 1 (skip () 0))"}, "ERR: restart-case: malformed restart (skip () 0)"},
+		{[]string{"(handler-bind ((1 (lambda (k d) 1))) 1)"}, "ERR: handler-bind: expected a keyword or t, got INTEGER"},
+		{[]string{"(handler-bind ((:a 1)) 1)"}, "ERR: handler-bind: expected FUNCTION, got INTEGER"},
+		{[]string{"(signal 1)"}, "ERR: signal: expected KEYWORD, got INTEGER"},
+	}
+	for _, test := range tests {
+		env := testEvaluator.NewEnv()
+		var got string
+		for _, input := range test.inputs {
+			got = Eval(env, parser.ParseString(input)).Inspect()
+		}
+		assert.Equal(t, test.expected, got, "eval(%q)", test.inputs)
+	}
+}
+
+func TestDebugger(t *testing.T) {
+	var offered []Restart
+	debug := func(kind, data object.Object, restarts []Restart) (int, []object.Object) {
+		offered = restarts
+		if data.Inspect() == "0" {
+			return -1, nil
+		}
+		return 1, []object.Object{&object.Integer{Value: 7}}
+	}
+	env := New(WithDebugger(debug)).NewEnv()
+	got := Eval(env, parser.ParseString("(restart-case (error :bad 1) (:skip () 0) (:use-value (v) v))"))
+	assert.Equal(t, "7", got.Inspect())
+	assert.Equal(t, []Restart{{Name: ":skip", Params: "()"}, {Name: ":use-value", Params: "(v)"}}, offered)
+	got = Eval(env, parser.ParseString("(restart-case (error :bad 0) (:skip () 0))"))
+	assert.Equal(t, "ERR: unhandled condition :bad: 0", got.Inspect())
+	// the debugger isn't bothered without restarts to offer
+	offered = nil
+	got = Eval(env, parser.ParseString("(error :bad 1)"))
+	assert.Equal(t, "ERR: unhandled condition :bad: 1", got.Inspect())
+	assert.Nil(t, offered)
+}
@@ -0,0 +1,231 @@
+package evaluator
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/rtfb/welp/lexer"
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+)
+
+// The body of a reset is evaluated by a goroutine of its own, which is what
+// holds the stack of the continuations captured by shift: the body suspends
+// by waiting for the continuation to be resumed. The goroutine of the body
+// and the ones that resume it take turns, only one of them runs at a time, so
+// they share the envs like a single goroutine does. A stack can only be
+// resumed once, so a continuation is one-shot: it can be resumed once while
+// the body of its shift is evaluated, and it's abandoned once the body of the
+// shift is done, which unwinds the body of the reset with an error, so its
+// goroutine ends too.
+
+// errAbandoned unwinds the body of a reset or a generator once the
+// continuation it waits for can't be resumed anymore.
+var errAbandoned = errors.New("continuation abandoned")
+
+// prompt delimits the continuations captured by the shifts in the body of a
+// reset.
+type prompt struct {
+	// yields receives a *suspension every time the body shifts, and its
+	// value once it's done
+	yields chan object.Object
+}
+
+// suspension is handed over by the body of a reset when it shifts, or by the
+// body of a generator when it yields.
+type suspension struct {
+	k *continuation
+
+	// value is the value of a yield
+	value object.Object
+
+	// scope, name and body are the scope, the name of the continuation
+	// and the body of the shift, which are evaluated by the goroutine
+	// that resumed the body
+	scope *Environ
+	name  string
+	body  *parser.Node
+}
+
+// These are the states of a continuation.
+const (
+	suspended int32 = iota // the body waits for it
+	resumed                // the body goes on
+	dropped                // the body is unwound, see drop
+)
+
+// Type implements Object.
+func (s *suspension) Type() object.Type {
+	return "SUSPENSION"
+}
+
+// Inspect implements Object.
+func (s *suspension) Inspect() string {
+	return "<suspension>"
+}
+
+// continuation resumes the body of a reset suspended by a shift.
+type continuation struct {
+	p       *prompt
+	resume  chan object.Object // receives the value of the shift
+	abandon chan struct{}      // closed once the continuation is dropped
+	state   int32              // accessed atomically
+}
+
+func newPrompt() *prompt {
+	return &prompt{yields: make(chan object.Object, 1)}
+}
+
+// start evaluates body in scope by a new goroutine. The state of the scope
+// has to be delimited by the prompt, and to have no restarts, which can't be
+// invoked from another goroutine.
+func (p *prompt) start(scope *Environ, body *parser.Node) {
+	go func() {
+		result := evalBody(scope, body)
+		if sig, ok := result.(*signal); ok {
+			result = strayError(sig)
+		}
+		p.yields <- result
+	}()
+}
+
+// next waits for the body to shift or to get done, returning either the
+// *suspension or the value of the body.
+func (p *prompt) next(env *Environ) object.Object {
+	_, value, err := waitFor(env, []reflect.SelectCase{recvCase(p.yields)})
+	if err != nil {
+		return err
+	}
+	return value
+}
+
+// handle waits for the body to shift or to get done. It returns the value of
+// the body, or the value of the body of the shift, which gets the
+// continuation bound. Once the body of the shift is done, the continuation
+// can't be resumed anymore.
+func (p *prompt) handle(env *Environ) object.Object {
+	result := p.next(env)
+	s, ok := result.(*suspension)
+	if !ok {
+		return result
+	}
+	s.scope.state = env.state
+	s.scope.setVar(s.name, continuationFunc(env, s.k))
+	result = evalBody(s.scope, s.body)
+	if s.k.drop() {
+		// wait for the body to unwind
+		p.next(env)
+	}
+	return result
+}
+
+// continuationFunc returns the func that resumes k, as a part of the
+// evaluation of env.
+func continuationFunc(env *Environ, k *continuation) *object.Func {
+	arity := Arity{Min: 0, Max: 1}
+	return &object.Func{Name: "continuation", Impl: &callable{
+		name:    "continuation",
+		builtin: true,
+		arity:   &arity,
+		prim: func(args []object.Object) object.Object {
+			var value object.Object = &object.Null{}
+			if len(args) > 0 {
+				value = args[0]
+			}
+			return k.resumeWith(env, value)
+		},
+	}}
+}
+
+// resumeWith resumes the body with the value for the shift, and returns what
+// handle does.
+func (k *continuation) resumeWith(env *Environ, value object.Object) object.Object {
+	if !atomic.CompareAndSwapInt32(&k.state, suspended, resumed) {
+		if atomic.LoadInt32(&k.state) == dropped {
+			return &object.Error{Err: errors.New("a continuation can't be resumed once its shift is done")}
+		}
+		return &object.Error{Err: errors.New("a continuation can only be resumed once")}
+	}
+	k.resume <- value
+	return k.p.handle(env)
+}
+
+// drop abandons the continuation, unless it's been resumed. It reports
+// whether it did.
+func (k *continuation) drop() bool {
+	if !atomic.CompareAndSwapInt32(&k.state, suspended, dropped) {
+		return false
+	}
+	close(k.abandon)
+	return true
+}
+
+// suspend hands s over to the goroutine waiting for the body of the reset or
+// the generator delimited by p, and waits for the continuation to be
+// resumed, returning the value it's resumed with. The goroutine waiting for
+// the body either resumes or drops the continuation.
+func suspend(env *Environ, p *prompt, s *suspension) object.Object {
+	resume := make(chan object.Object, 1)
+	abandon := make(chan struct{})
+	s.k = &continuation{p: p, resume: resume, abandon: abandon}
+	p.yields <- s
+	chosen, value, err := waitFor(env, []reflect.SelectCase{recvCase(resume), recvCase(abandon)})
+	switch {
+	case err != nil:
+		return err
+	case chosen == 1:
+		return &object.Error{Err: errAbandoned}
+	}
+	return value
+}
+
+// (reset (+ 1 (shift k (* 2 (k 10))))) => 22
+// evaluates the body, delimiting the continuations captured by the shifts in
+// it. The value of a reset is the value of its body, or of the body of the
+// shift that suspended it.
+func resetForm(env *Environ, expr *parser.Node) object.Object {
+	p := newPrompt()
+	scope := newFrame(env, env.state.clone())
+	scope.state.prompt = p
+	scope.state.restart = nil
+	p.start(scope, expr)
+	return p.handle(env)
+}
+
+// (shift k (k 10)) => 10
+// suspends the body of the nearest enclosing reset, and makes the reset
+// evaluate the body of the shift instead, with k bound to the continuation:
+// a func that resumes the body of the reset, making the shift return the value
+// k is called with. Calling k returns what the reset would: the value of its
+// body, or of the body of the next shift. The body of the shift is evaluated
+// outside of the reset, so a shift in it belongs to an outer reset.
+//
+// The continuations are one-shot: k can be called once, and only by the body
+// of the shift, or the funcs it calls. Calling it again, or after the body of
+// the shift is done, fails. See generator for the generators that outlive
+// the reset.
+func shiftForm(env *Environ, expr *parser.Node) object.Object {
+	if expr.L == nil || expr.L.Tok.Typ != lexer.TokIdentifier {
+		return &object.Error{Err: errors.New("shift expects a name")}
+	}
+	p := env.prompt()
+	if p == nil {
+		return &object.Error{Err: fmt.Errorf("shift outside of a reset")}
+	}
+	return suspend(env, p, &suspension{
+		scope: newEnclosedEnv(env),
+		name:  string(expr.L.Tok.Value),
+		body:  expr.R,
+	})
+}
+
+// prompt returns the prompt of the nearest enclosing reset, or nil if there's
+// none.
+func (e *Environ) prompt() *prompt {
+	if e.state == nil {
+		return nil
+	}
+	return e.state.prompt
+}
@@ -0,0 +1,68 @@
+package evaluator
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/rtfb/welp/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContinuations(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"(reset (+ 1 2))", "3"},
+		{"(reset (+ 1 (shift k (* 2 (k 10)))))", "22"},
+		{"(reset (+ 1 (shift k 5)))", "5"},
+		{"(reset [(shift k (k 1)) (shift k (k 2))])", "[1, 2]"},
+		{"(reset (+ 1 (reset (+ 10 (shift k (k 100))))))", "111"},
+		{"(reset (+ 1 (reset (+ 10 (shift k (shift j (k 100)))))))", "110"},
+		// early exit from a loop, and from the funcs called in the reset
+		{"(reset (doseq (x [1 2 3 4]) (cond ((> x 2) (shift k x)) (t nil))) :none)", "3"},
+		{`(let ((find (lambda (pred xs)
+				(reset (doseq (x xs) (cond ((pred x) (shift k x)) (t nil))) nil))))
+			(find (lambda (x) (> x 2)) [1 2 3 4]))`, "3"},
+		// generators
+		{`(let ((out (mk-array)))
+			(reset (dotimes (i 3) (shift k (append out i) (k))))
+			out)`, "[0, 1, 2]"},
+		{`(let ((out (mk-array)))
+			(reset (doseq (x [1 2 3]) (shift k (append out x) (cond ((eq x 2) nil) (t (k))))))
+			out)`, "[1, 2]"},
+		// the continuations are one-shot
+		{"(let ((n 0)) (reset (set! n (+ n 1)) (shift k (k 1) (k 2))) n)",
+			"ERR: a continuation can only be resumed once"},
+		{"(reset (+ 1 (shift k (+ (k 1) (k 2)))))", "ERR: a continuation can only be resumed once"},
+		{"(let ((k2 (reset (+ 10 (shift k k))))) (k2 1))",
+			"ERR: a continuation can't be resumed once its shift is done"},
+		{"(shift k 1)", "ERR: shift outside of a reset"},
+		{"(reset (recv (spawn (lambda () (shift k 1)))))", "ERR: shift outside of a reset"},
+		{"(reset (shift 1 1))", "ERR: shift expects a name"},
+		{"(reset (nope))", `ERR: no such symbol "nope"`},
+		{"(reset (shift k (k 1)) (nope))", `ERR: no such symbol "nope"`},
+	}
+	for _, test := range tests {
+		env := testEvaluator.NewEnv()
+		got := Eval(env, parser.ParseString(test.input))
+		assert.Equal(t, test.expected, got.Inspect(), "eval(%q)", test.input)
+	}
+}
+
+func TestContinuationsAbandoned(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		env := testEvaluator.NewEnv()
+		got := Eval(env, parser.ParseString("(reset (shift k :early) (nope))"))
+		assert.Equal(t, ":early", got.Inspect())
+	}
+	// the bodies suspended by the shifts are unwound once the resets are
+	// done, their goroutines end without waiting for the continuations to
+	// be collected
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, runtime.NumGoroutine() <= before, "%d goroutines left running", runtime.NumGoroutine()-before)
+}
@@ -0,0 +1,218 @@
+package evaluator
+
+import (
+	"fmt"
+
+	"github.com/rtfb/welp/lexer"
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+)
+
+// isPattern reports whether node can be used as a binding pattern: either a
+// plain identifier or a destructuring [...] or {...} pattern.
+func isPattern(node *parser.Node) bool {
+	switch node.Tok.Typ {
+	case lexer.TokIdentifier, lexer.TokOpenBracket, lexer.TokOpenBrace:
+		return true
+	}
+	return false
+}
+
+// bindPattern destructures value according to pattern, binding the
+// identifiers found in the pattern in env. The patterns are:
+//
+//	x                                  binds the whole value
+//	_                                  ignores the value
+//	[a b & rest :as all]               destructures an array by position
+//	{:keys [x y] :or {y 0} :as m}      destructures a map by keyword keys
+//	{:strs [x y]}                      destructures a map by string keys
+//	{p :k}                             destructures the value of :k with p
+//
+// Patterns nest arbitrarily. It returns an error object if the value doesn't
+// fit the pattern, nil otherwise.
+func bindPattern(env *Environ, pattern *parser.Node, value object.Object) object.Object {
+	switch pattern.Tok.Typ {
+	case lexer.TokIdentifier:
+		if name := string(pattern.Tok.Value); name != "_" {
+			env.setVar(name, value)
+		}
+		return nil
+	case lexer.TokOpenBracket:
+		return bindArrayPattern(env, pattern, value)
+	case lexer.TokOpenBrace:
+		return bindMapPattern(env, pattern, value)
+	default:
+		return patternError(pattern, "not a valid pattern")
+	}
+}
+
+func bindArrayPattern(env *Environ, pattern *parser.Node, value object.Object) object.Object {
+	arr, ok := value.(*object.Array)
+	if !ok {
+		return patternError(pattern, "expected %v, got %v", object.ArrayType, value.Type())
+	}
+	var positional []*parser.Node
+	var rest, as *parser.Node
+	for cell := pattern; cell.L != nil; cell = cell.R {
+		marker := ""
+		if cell.L.Tok.Typ == lexer.TokIdentifier {
+			marker = string(cell.L.Tok.Value)
+		}
+		switch marker {
+		case "&", ":as":
+			if cell.R == nil || cell.R.L == nil || !isPattern(cell.R.L) {
+				return patternError(pattern, "%s must be followed by a pattern", marker)
+			}
+			cell = cell.R
+			if marker == "&" {
+				rest = cell.L
+			} else {
+				as = cell.L
+			}
+		default:
+			if rest != nil {
+				return patternError(pattern, "only :as may follow the rest pattern")
+			}
+			positional = append(positional, cell.L)
+		}
+	}
+	n := len(arr.Value)
+	if n < len(positional) || (rest == nil && n > len(positional)) {
+		return patternError(pattern, "expected %d elements, got %d", len(positional), n)
+	}
+	for i, p := range positional {
+		if err := bindPattern(env, p, arr.Value[i]); err != nil {
+			return err
+		}
+	}
+	if rest != nil {
+		if err := bindPattern(env, rest, object.NewArray(arr.Value[len(positional):])); err != nil {
+			return err
+		}
+	}
+	if as != nil {
+		return bindPattern(env, as, value)
+	}
+	return nil
+}
+
+func bindMapPattern(env *Environ, pattern *parser.Node, value object.Object) object.Object {
+	m, ok := value.(*object.Map)
+	if !ok {
+		return patternError(pattern, "expected %v, got %v", object.MapType, value.Type())
+	}
+	defaults := make(map[string]*parser.Node)
+	var entries []*parser.Node
+	for cell := pattern; cell.L != nil; cell = cell.R.R {
+		if cell.R == nil || cell.R.L == nil {
+			return patternError(pattern, "expected an even number of forms")
+		}
+		entries = append(entries, cell)
+		if string(cell.L.Tok.Value) != ":or" || cell.L.Tok.Typ != lexer.TokIdentifier {
+			continue
+		}
+		if cell.R.L.Tok.Typ != lexer.TokOpenBrace {
+			return patternError(pattern, ":or must be followed by a map")
+		}
+		for d := cell.R.L; d.L != nil; d = d.R.R {
+			if d.L.Tok.Typ != lexer.TokIdentifier || d.R == nil || d.R.L == nil {
+				return patternError(pattern, "malformed :or defaults")
+			}
+			defaults[string(d.L.Tok.Value)] = d.R
+		}
+	}
+	for _, entry := range entries {
+		key := entry.L
+		switch string(key.Tok.Value) {
+		case ":or":
+			continue
+		case ":as":
+			if err := bindPattern(env, entry.R.L, value); err != nil {
+				return err
+			}
+			continue
+		case ":keys", ":strs":
+			if entry.R.L.Tok.Typ != lexer.TokOpenBracket {
+				return patternError(pattern, "%s must be followed by an array of names", key.Tok.Value)
+			}
+			for name := entry.R.L; name.L != nil; name = name.R {
+				if name.L.Tok.Typ != lexer.TokIdentifier {
+					return patternError(pattern, "%s must be followed by an array of names", key.Tok.Value)
+				}
+				var k object.Object = &object.Keyword{Name: string(name.L.Tok.Value)}
+				if string(key.Tok.Value) == ":strs" {
+					k = &object.String{Value: string(name.L.Tok.Value)}
+				}
+				if err := bindMapEntry(env, pattern, m, name.L, k, defaults); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !isPattern(key) {
+			return patternError(pattern, "%s is not a valid pattern", key)
+		}
+		k := evalArg(env, entry.R)
+		if isAbrupt(k) {
+			return k
+		}
+		if err := bindMapEntry(env, pattern, m, key, k, defaults); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindMapEntry binds the value of key k in m to pattern p, falling back to the
+// default given in :or, if there is one.
+func bindMapEntry(env *Environ, pattern *parser.Node, m *object.Map,
+	p *parser.Node, k object.Object, defaults map[string]*parser.Node) object.Object {
+	v, ok := m.Get(k)
+	if !ok {
+		init, hasDefault := defaults[string(p.Tok.Value)]
+		if p.Tok.Typ != lexer.TokIdentifier || !hasDefault {
+			return patternError(pattern, "missing key %s", k.Inspect())
+		}
+		v = evalArg(env, init)
+		if isAbrupt(v) {
+			return v
+		}
+	}
+	return bindPattern(env, p, v)
+}
+
+// patternNames lists all the identifiers bound by a pattern.
+func patternNames(pattern *parser.Node) []string {
+	switch pattern.Tok.Typ {
+	case lexer.TokIdentifier:
+		name := string(pattern.Tok.Value)
+		if name == "_" || name == "&" || name[0] == ':' {
+			return nil
+		}
+		return []string{name}
+	case lexer.TokOpenBracket:
+		var names []string
+		for cell := pattern; cell.L != nil; cell = cell.R {
+			names = append(names, patternNames(cell.L)...)
+		}
+		return names
+	case lexer.TokOpenBrace:
+		var names []string
+		for cell := pattern; cell.L != nil && cell.R != nil && cell.R.L != nil; cell = cell.R.R {
+			switch string(cell.L.Tok.Value) {
+			case ":or":
+			case ":keys", ":strs", ":as":
+				names = append(names, patternNames(cell.R.L)...)
+			default:
+				names = append(names, patternNames(cell.L)...)
+			}
+		}
+		return names
+	}
+	return nil
+}
+
+func patternError(pattern *parser.Node, format string, args ...interface{}) object.Object {
+	return &object.Error{Err: fmt.Errorf("can't destructure %s: %s", pattern,
+		fmt.Sprintf(format, args...))}
+}
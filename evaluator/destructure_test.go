@@ -0,0 +1,98 @@
+package evaluator
+
+import (
+	"testing"
+
+	"github.com/rtfb/welp/object"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLiterals(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"[1 (+ 1 1) 3]", "[1, 2, 3]"},
+		{"[]", "[]"},
+		{`{:a 1 "b" [2]}`, `{:a 1, "b" [2]}`},
+		{"{}", "{}"},
+		{"(get {:a 1} :a)", "1"},
+		{"(get {:a 1} :b 0)", "0"},
+		{"(get {:a 1} :b)", "ERR: key not found: :b"},
+		{"(append [1 :a] 2)", "[1, :a, 2]"},
+		{"(append [1 2] :a)", "ERR: type mismatch: KEYWORD and INTEGER"},
+		{"{:a}", "ERR: map literal needs an even number of forms"},
+		{"{[1] 2}", "ERR: unusable as map key: ARRAY"},
+	}
+	for _, test := range tests {
+		env := testEvaluator.NewEnv()
+		got := evalAll(env, test.input)
+		assert.Equal(t, test.expected, got.Inspect(), "eval(%q)", test.input)
+	}
+}
+
+func TestDestructuring(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"(let (([a b] [1 2])) (+ a b))", "3"},
+		{"(let (([a _ c] [1 2 3])) (+ a c))", "4"},
+		{"(let (([a & more] [1 2 3])) more)", "[2, 3]"},
+		{"(let (([a & more :as all] [1 2])) all)", "[1, 2]"},
+		{"(let (([a [b c]] [1 [2 3]])) (+ a b c))", "6"},
+		{"(let (({:keys [x y]} {:x 1 :y 2})) (+ x y))", "3"},
+		{"(let (({:keys [x y] :or {y 10}} {:x 1})) (+ x y))", "11"},
+		{`(let (({:strs [x]} {"x" 5})) x)`, "5"},
+		{"(let (({[a b] :point} {:point [3 4]})) (* a b))", "12"},
+		{"(let (({:keys [p] :as m} {:p 1})) m)", "{:p 1}"},
+		{"(let* (([a b] [1 2]) (c (+ a b))) c)", "3"},
+		{"(fn f ([a b] {:keys [c]}) (+ a b c)) (f [1 2] {:c 3})", "6"},
+		{"(fn f (x &rest [a b]) (+ x a b)) (f 1 2 3)", "6"},
+		{"(fn f (&optional ([a b] [5 6])) (+ a b)) (f)", "11"},
+		{`(define acc 0)
+		  (doseq ([k v] {:a 1 :b 2}) (set! acc (+ acc v)))
+		  acc`, "3"},
+		{`(define acc 0)
+		  (doseq ({:keys [n]} [{:n 1} {:n 2}]) (set! acc (+ acc n)))
+		  acc`, "3"},
+		{"(loop (([i n] [0 3])) (cond ((eq i n) i) (t (recur [(+ i 1) n]))))", "3"},
+	}
+	for _, test := range tests {
+		env := testEvaluator.NewEnv()
+		got := evalAll(env, test.input)
+		assert.Equal(t, test.expected, got.Inspect(), "eval(%q)", test.input)
+	}
+}
+
+func TestDestructuringErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"(let (([a b] [1])) a)",
+			"ERR: can't destructure [a b]: expected 2 elements, got 1"},
+		{"(let (([a b] [1 2 3])) a)",
+			"ERR: can't destructure [a b]: expected 2 elements, got 3"},
+		{"(let (([a b] 5)) a)",
+			"ERR: can't destructure [a b]: expected ARRAY, got INTEGER"},
+		{"(let (({:keys [x]} {:y 1})) x)",
+			"ERR: can't destructure {:keys [x]}: missing key :x"},
+		{"(let (({:keys [x]} [1])) x)",
+			"ERR: can't destructure {:keys [x]}: expected MAP, got ARRAY"},
+		{"(let (([a & b c] [1 2 3])) a)",
+			"ERR: can't destructure [a & b c]: only :as may follow the rest pattern"},
+		{"(fn f ([a b]) a) (f [1])",
+			"ERR: f: can't destructure [a b]: expected 2 elements, got 1"},
+		{"(fn f (&key [a]) a)", "ERR: f: malformed parameter [a]"},
+		{"(defmacro m ([a]) a)", "ERR: m: macro params can't be destructured"},
+		{"(doseq ([a b] [1 2]) a)",
+			"ERR: can't destructure [a b]: expected ARRAY, got INTEGER"},
+	}
+	for _, test := range tests {
+		env := testEvaluator.NewEnv()
+		got := evalAll(env, test.input)
+		assert.IsType(t, &object.Error{}, got, "eval(%q)", test.input)
+		assert.Equal(t, test.expected, got.Inspect(), "eval(%q)", test.input)
+	}
+}
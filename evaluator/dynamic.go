@@ -0,0 +1,137 @@
+package evaluator
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/rtfb/welp/lexer"
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+)
+
+// dynamicVar is bound in the env in place of the value of a variable defined
+// by defvar. Its value is the one set by the innermost binding of the
+// evaluation, or its root value if there's none.
+type dynamicVar struct {
+	name string
+	root atomic.Value // holds the object.Object
+
+	// id is the variable the bindings are made for: the variable itself,
+	// unless it shadows one of a frozen env, see shadow
+	id *dynamicVar
+}
+
+func newDynamicVar(name string, root object.Object) *dynamicVar {
+	v := &dynamicVar{name: name}
+	v.id = v
+	v.root.Store(root)
+	return v
+}
+
+// shadow returns a copy of v with another root value, to be bound in place of
+// v in an env that can be modified when v is in a frozen one. The copy shares
+// the bindings of v.
+func (v *dynamicVar) shadow(root object.Object) *dynamicVar {
+	c := &dynamicVar{name: v.name, id: v.id}
+	c.root.Store(root)
+	return c
+}
+
+// Type implements Object.
+func (v *dynamicVar) Type() object.Type {
+	return "DYNAMIC-VAR"
+}
+
+// Inspect implements Object.
+func (v *dynamicVar) Inspect() string {
+	return fmt.Sprintf("<dynamic-var %s>", v.name)
+}
+
+// dynamicBinding is a value of a dynamic variable set by binding, for a part
+// of the evaluation. The bindings make a stack, the innermost one on the top.
+type dynamicBinding struct {
+	v     *dynamicVar  // the id of the variable bound
+	value atomic.Value // holds the object.Object, set! changes it
+	outer *dynamicBinding
+}
+
+// binding returns the innermost binding of v, or nil if it's not bound. The
+// variables are told apart by their identity rather than their names, so
+// the dynamic variables of different modules don't affect each other.
+func (s *evalState) binding(v *dynamicVar) *dynamicBinding {
+	if s == nil {
+		return nil
+	}
+	for b := s.dyn; b != nil; b = b.outer {
+		if b.v == v.id {
+			return b
+		}
+	}
+	return nil
+}
+
+// dynamicValue returns the value v holds in the evaluation of env.
+func (e *Environ) dynamicValue(v *dynamicVar) object.Object {
+	if b := e.state.binding(v); b != nil {
+		return b.value.Load().(object.Object)
+	}
+	return v.root.Load().(object.Object)
+}
+
+// (defvar *depth* 0) => 0
+// (defvar *out*) => nil
+// defines a dynamic variable in the current scope, which can be rebound by
+// binding for the dynamic extent of its body. Its value is nil unless it's
+// given. Like define, defvar sets the value anew if it's already defined.
+func defvar(env *Environ, expr *parser.Node) object.Object {
+	if expr.L == nil || expr.L.Tok.Typ != lexer.TokIdentifier {
+		return &object.Error{Err: fmt.Errorf("defvar expects an identifier")}
+	}
+	var value object.Object = &object.Boolean{Value: false}
+	if expr.R != nil && expr.R.L != nil {
+		value = evalArg(env, expr.R)
+		if isAbrupt(value) {
+			return value
+		}
+	}
+	name := ident(expr)
+	env.setVar(name, newDynamicVar(name, value))
+	return value
+}
+
+// (defvar *depth* 0)
+// (fn depth () *depth*)
+// (binding ((*depth* 1)) (depth)) => 1
+// (depth) => 0
+// binding evaluates the body with the dynamic variables bound to the values,
+// which are evaluated like the ones of let. The bindings are seen by the funcs
+// called by the body, and by the goroutines they start, no matter where the
+// funcs were defined, until the body is done, even if it fails. parameterize
+// is a synonym.
+func bindingForm(env *Environ, expr *parser.Node) object.Object {
+	state := env.state.clone()
+	err := forEachBinding("binding", expr, func(pattern, init *parser.Node) object.Object {
+		if pattern.Tok.Typ != lexer.TokIdentifier {
+			return &object.Error{Err: fmt.Errorf("binding: malformed binding")}
+		}
+		name := string(pattern.Tok.Value)
+		raw, _ := env.rawVar(name)
+		v, ok := raw.(*dynamicVar)
+		if !ok {
+			return &object.Error{Err: fmt.Errorf("binding: %s isn't a dynamic variable, see defvar",
+				name)}
+		}
+		value := evalArg(env, init)
+		if isAbrupt(value) {
+			return value
+		}
+		b := &dynamicBinding{v: v.id, outer: state.dyn}
+		b.value.Store(value)
+		state.dyn = b
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return evalBody(newFrame(env, state), expr.R)
+}
@@ -0,0 +1,84 @@
+package evaluator
+
+import (
+	"os"
+	"testing"
+
+	"github.com/rtfb/welp/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDynamicVars(t *testing.T) {
+	tests := []struct {
+		inputs   []string
+		expected string
+	}{
+		{[]string{"(defvar *x* 1)"}, "1"},
+		{[]string{"(defvar *x*)"}, "false"},
+		{[]string{"(defvar *x* 1)", "(fn get-x () *x*)", "(binding ((*x* 2)) (get-x))"}, "2"},
+		{[]string{"(defvar *x* 1)", "(fn get-x () *x*)", "(binding ((*x* 2)) (get-x))", "(get-x)"}, "1"},
+		{[]string{"(defvar *x* 1)", "(parameterize ((*x* 2)) *x*)"}, "2"},
+		// the inits are evaluated like the ones of let
+		{[]string{"(defvar *x* 1)", "(defvar *y* 0)", "(binding ((*x* 2) (*y* *x*)) [*x* *y*])"}, "[2, 1]"},
+		{[]string{"(defvar *x* 1)", "(binding ((*x* 2)) (binding ((*x* 3)) *x*))"}, "3"},
+		// the bindings are restored once the body fails
+		{[]string{"(defvar *x* 1)", "(binding ((*x* 2)) (nope))", "*x*"}, "1"},
+		// set! changes the innermost binding, or the root value
+		{[]string{"(defvar *x* 1)", "[(binding ((*x* 2)) (set! *x* 3) *x*) *x*]"}, "[3, 1]"},
+		{[]string{"(defvar *x* 1)", "(set! *x* 5)", "(fn get-x () *x*)", "[(get-x) (binding ((*x* 2)) (get-x))]"}, "[5, 2]"},
+		// a closure sees the binding of its caller, not the one it was made in
+		{[]string{"(defvar *x* 1)", "(define f (binding ((*x* 2)) (lambda () *x*)))", "[(f) (binding ((*x* 3)) (f))]"}, "[1, 3]"},
+		// the bindings are seen by the goroutines started in the body
+		{[]string{"(defvar *x* 1)", "(fn get-x () *x*)", "(binding ((*x* 2)) (recv (spawn get-x)))"}, "2"},
+		// a let shadows the dynamic variable lexically
+		{[]string{"(defvar *x* 1)", "(let ((*x* 2)) (binding ((*x* 3)) *x*))"}, "ERR: binding: *x* isn't a dynamic variable, see defvar"},
+		{[]string{"(define x 1)", "(binding ((x 2)) x)"}, "ERR: binding: x isn't a dynamic variable, see defvar"},
+		{[]string{"(binding (([a b] [1 2])) 1)"}, "ERR: binding: malformed binding"},
+		{[]string{"(defvar 1)"}, "ERR: defvar expects an identifier"},
+	}
+	for _, test := range tests {
+		env := testEvaluator.NewEnv()
+		var got string
+		for _, input := range test.inputs {
+			got = Eval(env, parser.ParseString(input)).Inspect()
+		}
+		assert.Equal(t, test.expected, got, "eval(%q)", test.inputs)
+	}
+}
+
+func TestDynamicVarsModules(t *testing.T) {
+	dir := writeModules(t, map[string]string{
+		"logger.lisp": `(defvar *depth* 0)
+			(fn level () *depth*)`,
+	})
+	defer os.RemoveAll(dir)
+	evtor := &Evaluator{stdlibEnv: newEmptyEnv()}
+	env := evtor.NewEnv()
+	env.SetDir(dir)
+	Eval(env, parser.ParseString(`(import "logger" :as log)`))
+	Eval(env, parser.ParseString("(defvar *depth* 100)"))
+	// a binding of a variable doesn't affect the ones of the same name
+	got := Eval(env, parser.ParseString("(binding ((*depth* 5)) [*depth* (log/level)])"))
+	assert.Equal(t, "[5, 0]", got.Inspect())
+	got = Eval(env, parser.ParseString("(binding ((log/*depth* 5)) [*depth* (log/level)])"))
+	assert.Equal(t, "[100, 5]", got.Inspect())
+}
+
+func TestDynamicVarsShared(t *testing.T) {
+	lib := newEmptyEnv()
+	eval(lib, parser.ParseString("(defvar *depth* 0)"))
+	eval(lib, parser.ParseString("(fn depth () *depth*)"))
+	lib.freeze()
+	evtor := &Evaluator{stdlibEnv: lib}
+	env := evtor.NewEnv()
+	assert.Equal(t, "0", Eval(env, parser.ParseString("*depth*")).Inspect())
+	assert.Equal(t, "1", Eval(env, parser.ParseString("(binding ((*depth* 1)) *depth*)")).Inspect())
+	// setting the root value of a dynamic variable of the stdlib changes it
+	// for one env only, and keeps it dynamic
+	Eval(env, parser.ParseString("(set! *depth* 5)"))
+	assert.Equal(t, "5", Eval(env, parser.ParseString("*depth*")).Inspect())
+	assert.Equal(t, "6", Eval(env, parser.ParseString("(binding ((*depth* 6)) *depth*)")).Inspect())
+	// the bindings of the shadowing copy are seen by the stdlib
+	assert.Equal(t, "7", Eval(env, parser.ParseString("(binding ((*depth* 7)) (depth))")).Inspect())
+	assert.Equal(t, "0", Eval(evtor.NewEnv(), parser.ParseString("*depth*")).Inspect())
+}
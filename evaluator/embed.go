@@ -0,0 +1,150 @@
+package evaluator
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/rtfb/welp/object"
+)
+
+// GoFunc is a func implemented in Go, callable from welp. The args are
+// evaluated before the call. A nil result becomes null, and an error becomes
+// a welp error.
+type GoFunc func(args ...object.Object) (object.Object, error)
+
+// Variadic is the Max of an Arity without an upper limit.
+const Variadic = -1
+
+// Arity tells how many args a func accepts.
+type Arity struct {
+	Min, Max int
+}
+
+// check returns an error if nargs args aren't accepted.
+func (a Arity) check(name string, pos int, nargs int) error {
+	if nargs < a.Min || (a.Max != Variadic && nargs > a.Max) {
+		return fmt.Errorf("%s: wrong number of args at position %d: expected %s, got %d",
+			name, pos, a, nargs)
+	}
+	return nil
+}
+
+// String describes the arity like the errors of the welp funcs do.
+func (a Arity) String() string {
+	switch {
+	case a.Max == Variadic:
+		return fmt.Sprintf("at least %d", a.Min)
+	case a.Max != a.Min:
+		return fmt.Sprintf("%d to %d", a.Min, a.Max)
+	default:
+		return fmt.Sprintf("%d", a.Min)
+	}
+}
+
+// Define binds the variable name to value in the env, as if it was defined
+// by (define name value).
+func (e *Environ) Define(name string, value object.Object) {
+	e.setVar(name, value)
+}
+
+// RegisterFunc makes fn callable as name by the code evaluated in the env.
+// The calls with a number of args not accepted by arity fail without calling
+// fn.
+func (e *Environ) RegisterFunc(name string, arity Arity, fn GoFunc) {
+	e.setFunc(name, &callable{
+		name:    name,
+		builtin: true,
+		host:    true,
+		arity:   &arity,
+		prim: func(args []object.Object) object.Object {
+			result, err := fn(args...)
+			switch {
+			case err != nil:
+				return &object.Error{Err: fmt.Errorf("%s: %v", name, err)}
+			case result == nil:
+				return &object.Null{}
+			}
+			return result
+		},
+	})
+}
+
+// RegisterGoFunc makes the Go func fn callable as name, converting the args
+// and the results like object.FromGo does. The arity follows from the params
+// of fn. It fails if fn isn't a func.
+func (e *Environ) RegisterGoFunc(name string, fn interface{}) error {
+	t := reflect.TypeOf(fn)
+	if t == nil || t.Kind() != reflect.Func {
+		return fmt.Errorf("RegisterGoFunc %s: %T isn't a func", name, fn)
+	}
+	obj, err := object.FromGo(fn)
+	if err != nil {
+		return fmt.Errorf("RegisterGoFunc %s: %v", name, err)
+	}
+	impl := obj.(*object.Func).Impl.(object.Applicable)
+	arity := Arity{Min: t.NumIn(), Max: t.NumIn()}
+	if t.IsVariadic() {
+		arity = Arity{Min: t.NumIn() - 1, Max: Variadic}
+	}
+	e.RegisterFunc(name, arity, func(args ...object.Object) (object.Object, error) {
+		return result(impl.Apply(args))
+	})
+	return nil
+}
+
+// Lookup returns the value of the variable name, or the func called name if
+// there's no such variable, as seen by the code evaluated in the env. The
+// funcs can be called with their Impl, which is an object.Applicable.
+func (e *Environ) Lookup(name string) (object.Object, bool) {
+	if v, ok := e.lookupVar(name); ok {
+		return v, true
+	}
+	if f, ok := e.lookupFunc(name); ok {
+		return &object.Func{Name: f.name, Impl: f}, true
+	}
+	return nil, false
+}
+
+// Call calls the func called name in the env with the args, like
+// (name args...) would, returning the errors raised by the func as Go errors.
+// The special forms and the macros can't be called.
+func (e *Environ) Call(name string, args ...object.Object) (object.Object, error) {
+	f, ok := e.lookupFunc(name)
+	if !ok {
+		v, ok := e.lookupVar(name)
+		if !ok {
+			return nil, fmt.Errorf("call: no such func %q", name)
+		}
+		return CallFunc(v, args...)
+	}
+	return result(f.Apply(args))
+}
+
+// CallFunc calls fn, a func value like the ones returned by Eval and Lookup,
+// with the args. The errors raised by fn are returned as Go errors.
+func CallFunc(fn object.Object, args ...object.Object) (object.Object, error) {
+	switch f := fn.(type) {
+	case nil:
+		return nil, errors.New("call: nil isn't a func")
+	case *object.Func:
+		if f == nil {
+			return nil, errors.New("call: nil isn't a func")
+		}
+		if impl, ok := f.Impl.(object.Applicable); ok {
+			return result(impl.Apply(args))
+		}
+		return result(funcCallable(f).Apply(args))
+	case object.Applicable:
+		return result(f.Apply(args))
+	}
+	return nil, fmt.Errorf("call: %s isn't a func", fn.Inspect())
+}
+
+// result turns an error value into a Go error.
+func result(value object.Object) (object.Object, error) {
+	if err, ok := value.(*object.Error); ok {
+		return nil, err.Err
+	}
+	return value, nil
+}
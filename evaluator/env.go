@@ -1,16 +1,54 @@
 package evaluator
 
-import "github.com/rtfb/welp/object"
+import (
+	"strings"
+	"sync"
 
-// Environ represents the execution environment.
+	"github.com/rtfb/welp/object"
+)
+
+// Environ represents the execution environment. Environments are chained: a
+// lookup that fails in the current frame continues in the outer one.
+//
+// An env can be used by several goroutines at once, its bindings are guarded
+// by a lock. The frozen envs, like the one holding the stdlib, are never
+// modified, so they're read without locking.
 type Environ struct {
-	vars  map[string]object.Object
-	funcs map[string]*callable
+	mu     sync.RWMutex // guards vars, funcs, aliases and dir
+	vars   map[string]object.Object
+	funcs  map[string]*callable
+	frozen bool
+	outer  *Environ
+	evtor  *Evaluator // nil while bootstrapping the stdlib
+
+	// dir is the directory of the file evaluated in this env, which the
+	// imports are resolved against
+	dir string
+
+	// mod is set in the env of an imported module
+	mod *module
+
+	// aliases holds the modules imported with :as
+	aliases map[string]*module
+
+	// state is the state of the evaluations using the env, see evalState
+	state *evalState
+
+	// through is set for the frames that only carry the state of an
+	// evaluation, see newStateFrame. The definitions made in them go to
+	// outer.
+	through bool
 }
 
-// newEnv creates an environment.
+// newEnv creates a top level environment. It's cheap, since it shares the
+// frozen stdlib env instead of copying it.
 func newEnv(evtor *Evaluator) *Environ {
-	return newEmptyEnv().extend(evtor.stdlibEnv)
+	return &Environ{
+		vars:  make(map[string]object.Object),
+		funcs: make(map[string]*callable),
+		outer: evtor.stdlibEnv,
+		evtor: evtor,
+	}
 }
 
 func newEmptyEnv() *Environ {
@@ -20,17 +58,240 @@ func newEmptyEnv() *Environ {
 	}
 }
 
-func (e *Environ) deepCopy() *Environ {
-	fresh := newEmptyEnv()
-	return fresh.extend(e)
+// newEnclosedEnv creates a fresh scope nested inside outer.
+func newEnclosedEnv(outer *Environ) *Environ {
+	return newFrame(outer, outer.state)
+}
+
+// newFrame creates a fresh scope nested inside outer, used by the evaluation
+// tracked by state. Unlike newEnclosedEnv, it doesn't touch the state of
+// outer, which may belong to an evaluation in another goroutine.
+func newFrame(outer *Environ, state *evalState) *Environ {
+	return &Environ{
+		vars:  make(map[string]object.Object),
+		funcs: make(map[string]*callable),
+		outer: outer,
+		evtor: outer.evtor,
+		state: state,
+	}
+}
+
+// newStateFrame creates a frame for evaluating the code of outer as a part of
+// the evaluation tracked by state. The definitions made by the code go to
+// outer, as if it was evaluated there, while the state stays with the frame,
+// so the evaluations sharing outer don't see each other's state.
+func newStateFrame(outer *Environ, state *evalState) *Environ {
+	frame := newFrame(outer, state)
+	frame.through = true
+	return frame
+}
+
+// freeze makes the env read-only. It must be done before the env is shared
+// with other goroutines.
+func (e *Environ) freeze() {
+	e.frozen = true
+}
+
+// ownVar looks up a variable in this frame only.
+func (e *Environ) ownVar(name string) (object.Object, bool) {
+	if !e.frozen {
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+	}
+	v, ok := e.vars[name]
+	return v, ok
+}
+
+// ownFunc looks up a func in this frame only.
+func (e *Environ) ownFunc(name string) (*callable, bool) {
+	if !e.frozen {
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+	}
+	f, ok := e.funcs[name]
+	return f, ok
+}
+
+// ownDir returns the directory set for this frame, or "" if there's none.
+func (e *Environ) ownDir() string {
+	if !e.frozen {
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+	}
+	return e.dir
+}
+
+// ownAlias looks up a module alias in this frame only.
+func (e *Environ) ownAlias(name string) (*module, bool) {
+	if !e.frozen {
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+	}
+	mod, ok := e.aliases[name]
+	return mod, ok
+}
+
+// setVar binds a variable in this frame.
+func (e *Environ) setVar(name string, value object.Object) {
+	if e.through {
+		e.outer.setVar(name, value)
+		return
+	}
+	e.checkWritable()
+	e.mu.Lock()
+	e.vars[name] = value
+	e.mu.Unlock()
+}
+
+// setFunc binds a func in this frame.
+func (e *Environ) setFunc(name string, f *callable) {
+	if e.through {
+		e.outer.setFunc(name, f)
+		return
+	}
+	e.checkWritable()
+	e.mu.Lock()
+	e.funcs[name] = f
+	e.mu.Unlock()
+}
+
+// setAlias binds a module alias in this frame.
+func (e *Environ) setAlias(name string, mod *module) {
+	if e.through {
+		e.outer.setAlias(name, mod)
+		return
+	}
+	e.checkWritable()
+	e.mu.Lock()
+	if e.aliases == nil {
+		e.aliases = make(map[string]*module)
+	}
+	e.aliases[name] = mod
+	e.mu.Unlock()
+}
+
+func (e *Environ) checkWritable() {
+	if e.frozen {
+		panic("evaluator: a frozen env can't be modified")
+	}
+}
+
+// names returns the names of the variables and the funcs bound in this
+// frame.
+func (e *Environ) names() (vars, funcs []string) {
+	if !e.frozen {
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+	}
+	for name := range e.vars {
+		vars = append(vars, name)
+	}
+	for name := range e.funcs {
+		funcs = append(funcs, name)
+	}
+	return vars, funcs
 }
 
-func (e *Environ) extend(src *Environ) *Environ {
-	for k, v := range src.vars {
-		e.vars[k] = v
+// SetDir sets the directory that the imports done by the code evaluated in
+// the env are resolved against. It's the working directory by default.
+func (e *Environ) SetDir(dir string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.dir = dir
+}
+
+func (e *Environ) lookupVar(name string) (object.Object, bool) {
+	v, ok := e.rawVar(name)
+	if dv, isDynamic := v.(*dynamicVar); isDynamic {
+		return e.dynamicValue(dv), true
+	}
+	return v, ok
+}
+
+// rawVar looks up a variable like lookupVar does, except that it returns the
+// dynamic variables themselves rather than their values.
+func (e *Environ) rawVar(name string) (object.Object, bool) {
+	for env := e; env != nil; env = env.outer {
+		if v, ok := env.ownVar(name); ok {
+			return v, true
+		}
+	}
+	if mod, name := e.lookupAlias(name); mod != nil {
+		if v, _, ok := mod.lookup(name); ok && v != nil {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// lookupFunc looks up a func, skipping the builtins that need capabilities
+// the evaluation lacks.
+func (e *Environ) lookupFunc(name string) (*callable, bool) {
+	for env := e; env != nil; env = env.outer {
+		if f, ok := env.ownFunc(name); ok {
+			if !e.state.allows(f.needs) {
+				return nil, false
+			}
+			return f, true
+		}
+	}
+	if mod, name := e.lookupAlias(name); mod != nil {
+		if _, f, ok := mod.lookup(name); ok && f != nil {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+// lookupAlias splits a qualified name like f/area, returning the module
+// imported as f along with the rest of the name. It returns a nil module if
+// the name isn't qualified by an alias.
+func (e *Environ) lookupAlias(name string) (*module, string) {
+	i := strings.IndexByte(name, '/')
+	if i <= 0 || i == len(name)-1 {
+		return nil, ""
+	}
+	for env := e; env != nil; env = env.outer {
+		if mod, ok := env.ownAlias(name[:i]); ok {
+			return mod, name[i+1:]
+		}
 	}
-	for k, v := range src.funcs {
-		e.funcs[k] = v
+	return nil, ""
+}
+
+// assign rebinds an existing variable in the innermost scope that has it.
+// Returns false if the variable is not bound anywhere. A variable found in a
+// frozen env is shadowed by a copy in the outermost of the envs that can be
+// modified, which makes the change visible to the same code as it would be
+// if the frozen env was modified. A dynamic variable gets its innermost
+// binding changed, or its root value if it's not bound.
+func (e *Environ) assign(name string, value object.Object) bool {
+	var writable *Environ
+	for env := e; env != nil; env = env.outer {
+		if !env.frozen {
+			writable = env
+		}
+		if v, ok := env.ownVar(name); ok {
+			if dv, isDynamic := v.(*dynamicVar); isDynamic {
+				if b := e.state.binding(dv); b != nil {
+					b.value.Store(value)
+					return true
+				}
+				if !env.frozen {
+					dv.root.Store(value)
+					return true
+				}
+				value = dv.shadow(value)
+			}
+			if env.frozen {
+				if writable == nil {
+					return false
+				}
+				env = writable
+			}
+			env.setVar(name, value)
+			return true
+		}
 	}
-	return e
+	return false
 }
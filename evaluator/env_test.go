@@ -0,0 +1,88 @@
+package evaluator
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrentEnvs(t *testing.T) {
+	dir := writeModules(t, map[string]string{
+		"geo.lisp": "(module geo (export area)) (fn area (r) (* 3 (square r)))",
+	})
+	defer os.RemoveAll(dir)
+	evtor := New()
+	const scripts = 300
+	results := make([]string, scripts)
+	var wg sync.WaitGroup
+	for i := 0; i < scripts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			env := evtor.NewEnv()
+			env.SetDir(dir)
+			// half of the scripts redefine a stdlib func, which mustn't
+			// affect the other half
+			redefine := ""
+			if i%2 == 0 {
+				redefine = "(fn square (x) x)"
+			}
+			script := fmt.Sprintf(`(let ()
+				(define n %d)
+				%s
+				(import "geo" :as g)
+				(define total 0)
+				(dotimes (i 10) (set! total (+ total (square n))))
+				[total (g/area 1)])`, i, redefine)
+			results[i] = Eval(env, parser.ParseString(script)).Inspect()
+		}(i)
+	}
+	wg.Wait()
+	for i, got := range results {
+		expected := fmt.Sprintf("[%d, 3]", 10*i*i)
+		if i%2 == 0 {
+			expected = fmt.Sprintf("[%d, 3]", 10*i)
+		}
+		assert.Equal(t, expected, got, "script %d", i)
+	}
+}
+
+func TestSharedEnv(t *testing.T) {
+	env := New().NewEnv()
+	Eval(env, parser.ParseString("(define counter 0)"))
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			Eval(env, parser.ParseString(fmt.Sprintf("(define v%d %d)", i, i)))
+			Eval(env, parser.ParseString(fmt.Sprintf("(fn f%d () v%d)", i, i)))
+			// the increments can get lost, but they mustn't race
+			Eval(env, parser.ParseString("(set! counter (+ counter 1))"))
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 100; i++ {
+		got := Eval(env, parser.ParseString(fmt.Sprintf("(f%d)", i)))
+		assert.Equal(t, fmt.Sprint(i), got.Inspect())
+	}
+}
+
+func TestAssignFrozen(t *testing.T) {
+	lib := newEmptyEnv()
+	lib.setVar("x", &object.Integer{Value: 1})
+	lib.freeze()
+	evtor := &Evaluator{stdlibEnv: lib}
+	env1, env2 := evtor.NewEnv(), evtor.NewEnv()
+	got := Eval(env1, parser.ParseString("(let ((y 0)) (set! x 2) x)"))
+	assert.Equal(t, "2", got.Inspect())
+	assert.Equal(t, "2", Eval(env1, parser.ParseString("x")).Inspect())
+	assert.Equal(t, "1", Eval(env2, parser.ParseString("x")).Inspect())
+	v, _ := lib.ownVar("x")
+	assert.Equal(t, "1", v.Inspect())
+}
@@ -0,0 +1,155 @@
+package evaluator_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rtfb/welp/evaluator"
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+)
+
+func ExampleEnviron_Define() {
+	env := evaluator.New().NewEnv()
+	env.Define("limit", &object.Integer{Value: 10})
+	fmt.Println(evaluator.Eval(env, parser.ParseString("(* limit 2)")).Inspect())
+	// Output: 20
+}
+
+func ExampleEnviron_RegisterFunc() {
+	env := evaluator.New().NewEnv()
+	env.RegisterFunc("shout", evaluator.Arity{Min: 1, Max: 1},
+		func(args ...object.Object) (object.Object, error) {
+			s, ok := args[0].(*object.String)
+			if !ok {
+				return nil, fmt.Errorf("expected a string, got %s", args[0].Type())
+			}
+			return &object.String{Value: strings.ToUpper(s.Value)}, nil
+		})
+	for _, code := range []string{
+		`(shout "hi")`,
+		`(shout 1)`,
+		`(shout "a" "b")`,
+	} {
+		fmt.Println(evaluator.Eval(env, parser.ParseString(code)).Inspect())
+	}
+	// Output:
+	// "HI"
+	// ERR: shout: expected a string, got INTEGER
+	// ERR: shout: wrong number of args at position 1: expected 1, got 2
+}
+
+func ExampleEnviron_RegisterFunc_variadic() {
+	env := evaluator.New().NewEnv()
+	env.RegisterFunc("audit", evaluator.Arity{Min: 1, Max: evaluator.Variadic},
+		func(args ...object.Object) (object.Object, error) {
+			if len(args) > 3 {
+				return nil, errors.New("too much to audit")
+			}
+			for _, arg := range args {
+				fmt.Println("audit:", arg.Inspect())
+			}
+			return nil, nil
+		})
+	fmt.Println(evaluator.Eval(env, parser.ParseString(`(audit "login" :ok)`)).Inspect())
+	fmt.Println(evaluator.Eval(env, parser.ParseString(`(audit)`)).Inspect())
+	fmt.Println(evaluator.Eval(env, parser.ParseString(`(audit 1 2 3 4)`)).Inspect())
+	// Output:
+	// audit: "login"
+	// audit: :ok
+	// null
+	// ERR: audit: wrong number of args at position 1: expected at least 1, got 0
+	// ERR: audit: too much to audit
+}
+
+func ExampleEnviron_Lookup() {
+	env := evaluator.New().NewEnv()
+	evaluator.Eval(env, parser.ParseString("(define total 42)"))
+	evaluator.Eval(env, parser.ParseString("(fn double (x) (* 2 x))"))
+	total, _ := env.Lookup("total")
+	fmt.Println(total.Inspect())
+	double, _ := env.Lookup("double")
+	f := double.(*object.Func).Impl.(object.Applicable)
+	fmt.Println(f.Apply([]object.Object{total}).Inspect())
+	_, ok := env.Lookup("nope")
+	fmt.Println(ok)
+	// Output:
+	// 42
+	// 84
+	// false
+}
+
+func ExampleEnviron_RegisterGoFunc() {
+	type user struct {
+		Name  string `welp:"name"`
+		Admin bool   `welp:"admin"`
+	}
+	users := map[string]user{"ann": {Name: "Ann", Admin: true}}
+	env := evaluator.New().NewEnv()
+	env.RegisterGoFunc("find-user", func(id string) (user, error) {
+		u, ok := users[id]
+		if !ok {
+			return user{}, fmt.Errorf("no user %s", id)
+		}
+		return u, nil
+	})
+	for _, code := range []string{
+		`(find-user "ann")`,
+		`(get (find-user "ann") :admin)`,
+		`(find-user "bob")`,
+		`(find-user 1)`,
+	} {
+		fmt.Println(evaluator.Eval(env, parser.ParseString(code)).Inspect())
+	}
+	var u user
+	object.ToGo(evaluator.Eval(env, parser.ParseString(`{:name "Bob" :admin nil}`)), &u)
+	fmt.Printf("%+v\n", u)
+	// Output:
+	// {:name "Ann", :admin true}
+	// true
+	// ERR: find-user: no user bob
+	// ERR: find-user: arg 1: can't convert INTEGER to string
+	// {Name:Bob Admin:false}
+}
+
+func ExampleEnviron_Call() {
+	env := evaluator.New().NewEnv()
+	evaluator.Eval(env, parser.ParseString(`
+		(fn on-event (kind count)
+			(match kind
+				(:click (* count 2))
+				(_ 0)))`))
+	for i := int64(1); i <= 3; i++ {
+		result, err := env.Call("on-event", &object.Keyword{Name: "click"}, &object.Integer{Value: i})
+		fmt.Println(result.Inspect(), err)
+	}
+	_, err := env.Call("on-event", &object.Keyword{Name: "click"})
+	fmt.Println(err)
+	_, err = env.Call("on-exit")
+	fmt.Println(err)
+	// Output:
+	// 2 <nil>
+	// 4 <nil>
+	// 6 <nil>
+	// on-event: wrong number of args at position 0: expected 2, got 1
+	// call: no such func "on-exit"
+}
+
+func ExampleCallFunc() {
+	env := evaluator.New().NewEnv()
+	adder := evaluator.Eval(env, parser.ParseString("(let ((n 10)) (lambda (x) (+ x n)))"))
+	result, err := evaluator.CallFunc(adder, &object.Integer{Value: 5})
+	fmt.Println(result.Inspect(), err)
+	_, err = evaluator.CallFunc(adder, &object.String{Value: "5"})
+	fmt.Println(err)
+	_, err = evaluator.CallFunc(&object.Integer{Value: 1})
+	fmt.Println(err)
+	_, err = evaluator.CallFunc(nil)
+	fmt.Println(err)
+	// Output:
+	// 15 <nil>
+	// type error: unexpected type STRING for +
+	// call: 1 isn't a func
+	// call: nil isn't a func
+}
@@ -0,0 +1,187 @@
+package evaluator
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+)
+
+// (future (http-get url)) => <future pending>
+// evaluates the body in a new goroutine, returning a future of its value,
+// see await. The body runs like the funcs started by spawn do.
+func future(env *Environ, expr *parser.Node) object.Object {
+	scope := goroutineEnv(env)
+	f := object.NewFuture()
+	go func() {
+		result := evalBody(scope, expr)
+		if sig, ok := result.(*signal); ok {
+			result = strayError(sig)
+		}
+		f.Deliver(result)
+	}()
+	return f
+}
+
+// (promise) => <promise pending>
+// makes a promise, which gets its value from deliver.
+func makePromise(env *Environ, expr *parser.Node) object.Object {
+	if _, err := evalArgsOf(env, "promise", expr, Arity{}); err != nil {
+		return err
+	}
+	return object.NewPromise()
+}
+
+// (deliver p 42) => true
+// delivers the value of a promise, unless it's delivered already, in which
+// case it returns false.
+func deliver(env *Environ, expr *parser.Node) object.Object {
+	args, err := evalArgsOf(env, "deliver", expr, Arity{Min: 2, Max: 2})
+	if err != nil {
+		return err
+	}
+	p, ok := args[0].(*object.Promise)
+	if !ok {
+		return typeError("deliver", object.PromiseType, args[0])
+	}
+	return &object.Boolean{Value: p.Deliver(args[1])}
+}
+
+// (await f) => 42
+// (await f 100) => 42
+// waits for the value of a future or a promise, for at most the given number
+// of milliseconds, if it's given. The error a future fails with is raised
+// by await.
+func await(env *Environ, expr *parser.Node) object.Object {
+	args, err := evalArgsOf(env, "await", expr, Arity{Min: 1, Max: 2})
+	if err != nil {
+		return err
+	}
+	a, ok := args[0].(object.Awaitable)
+	if !ok {
+		return &object.Error{Err: fmt.Errorf("await: expected a future or a promise, got %s",
+			args[0].Type())}
+	}
+	return awaitValue(env, "await", a, args[1:])
+}
+
+// awaitValue waits for the value of a, for at most the number of
+// milliseconds given by the first of the opts, if there's one. The value
+// returned once the time runs out is the second of the opts, it's an error
+// if there's none.
+func awaitValue(env *Environ, name string, a object.Awaitable, opts []object.Object) object.Object {
+	cases := []reflect.SelectCase{recvCase(a.Done())}
+	var ms int64
+	if len(opts) > 0 {
+		n, ok := opts[0].(*object.Integer)
+		if !ok {
+			return typeError(name, object.IntegerType, opts[0])
+		}
+		ms = n.Value
+		timer := time.NewTimer(time.Duration(ms) * time.Millisecond)
+		defer timer.Stop()
+		cases = append(cases, recvCase(timer.C))
+	}
+	chosen, _, err := waitFor(env, cases)
+	switch {
+	case err != nil:
+		return err
+	case chosen == 1 && len(opts) > 1:
+		return opts[1]
+	case chosen == 1:
+		return &object.Error{Err: fmt.Errorf("%s: timed out after %dms", name, ms)}
+	}
+	value, _ := a.Value()
+	return value
+}
+
+// awaitablesArg evaluates the arg of the combinator called name, which is an
+// array of futures and promises.
+func awaitablesArg(env *Environ, name string, expr *parser.Node) ([]object.Awaitable, object.Object) {
+	args, err := evalArgsOf(env, name, expr, Arity{Min: 1, Max: 1})
+	if err != nil {
+		return nil, err
+	}
+	arr, ok := args[0].(*object.Array)
+	if !ok {
+		return nil, typeError(name, object.ArrayType, args[0])
+	}
+	awaitables := make([]object.Awaitable, len(arr.Value))
+	for i, elem := range arr.Value {
+		a, ok := elem.(object.Awaitable)
+		if !ok {
+			return nil, &object.Error{Err: fmt.Errorf("%s: expected futures or promises, got %s",
+				name, elem.Type())}
+		}
+		awaitables[i] = a
+	}
+	return awaitables, nil
+}
+
+// (all [f g]) => <future pending>
+// returns a future of the array of the values of the futures or the promises,
+// in their order. It fails as soon as any of them fails, with its error.
+func all(env *Environ, expr *parser.Node) object.Object {
+	awaitables, err := awaitablesArg(env, "all", expr)
+	if err != nil {
+		return err
+	}
+	scope := goroutineEnv(env)
+	result := object.NewFuture()
+	go func() {
+		values := make([]object.Object, len(awaitables))
+		cases := make([]reflect.SelectCase, len(awaitables))
+		for i, a := range awaitables {
+			cases[i] = recvCase(a.Done())
+		}
+		for range awaitables {
+			chosen, _, err := waitFor(scope, cases)
+			if err != nil {
+				result.Deliver(err)
+				return
+			}
+			value, _ := awaitables[chosen].Value()
+			if isError(value) {
+				result.Deliver(value)
+				return
+			}
+			values[chosen] = value
+			// the case of the zero channel is never chosen again
+			cases[chosen].Chan = reflect.Value{}
+		}
+		result.Deliver(object.NewArray(values))
+	}()
+	return result
+}
+
+// (race [f g]) => <future pending>
+// returns a future of the value of whichever of the futures or the promises
+// gets its value first, be it an error or not.
+func race(env *Environ, expr *parser.Node) object.Object {
+	awaitables, err := awaitablesArg(env, "race", expr)
+	if err != nil {
+		return err
+	}
+	if len(awaitables) == 0 {
+		return &object.Error{Err: errors.New("race expects at least one future or promise")}
+	}
+	scope := goroutineEnv(env)
+	result := object.NewFuture()
+	go func() {
+		cases := make([]reflect.SelectCase, len(awaitables))
+		for i, a := range awaitables {
+			cases[i] = recvCase(a.Done())
+		}
+		chosen, _, err := waitFor(scope, cases)
+		if err != nil {
+			result.Deliver(err)
+			return
+		}
+		value, _ := awaitables[chosen].Value()
+		result.Deliver(value)
+	}()
+	return result
+}
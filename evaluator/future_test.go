@@ -0,0 +1,42 @@
+package evaluator
+
+import (
+	"testing"
+
+	"github.com/rtfb/welp/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFutures(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"(await (future (+ 1 2)))", "3"},
+		{"(let ((f (future 1))) (await f) f)", "<future 1>"},
+		{"(promise)", "<promise pending>"},
+		{`(let ((p (promise)))
+			(spawn (lambda () (deliver p 42)))
+			(await p))`, "42"},
+		{"(let ((p (promise))) [(deliver p 1) (deliver p 2) (deref p)])", "[true, false, 1]"},
+		{"(await (future (nope)))", `ERR: no such symbol "nope"`},
+		{"(await (promise) 10)", "ERR: await: timed out after 10ms"},
+		{"(deref (promise) 10 :late)", ":late"},
+		{"(deref (future 1) 1000 :late)", "1"},
+		{"(await (all [(future 1) (future (+ 1 1)) (future 3)]))", "[1, 2, 3]"},
+		{"(await (all []))", "[]"},
+		{"(await (all [(future 1) (future (nope)) (promise)]))", `ERR: no such symbol "nope"`},
+		{"(await (race [(promise) (future :first)]))", ":first"},
+		{"(race [])", "ERR: race expects at least one future or promise"},
+		{"(all [1])", "ERR: all: expected futures or promises, got INTEGER"},
+		{"(await 1)", "ERR: await: expected a future or a promise, got INTEGER"},
+		{"(await (promise) :x)", "ERR: await: expected INTEGER, got KEYWORD"},
+		{"(deliver (future 1) 2)", "ERR: deliver: expected PROMISE, got FUTURE"},
+		{"(deref (atom 1) 10)", "ERR: deref: only futures and promises take a timeout"},
+	}
+	for _, test := range tests {
+		env := testEvaluator.NewEnv()
+		got := Eval(env, parser.ParseString(test.input))
+		assert.Equal(t, test.expected, got.Inspect(), "eval(%q)", test.input)
+	}
+}
@@ -0,0 +1,121 @@
+package evaluator
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+	"github.com/rtfb/welp/primitive"
+)
+
+// generator produces the values yielded by its body, see generatorForm.
+type generator struct {
+	env   *Environ
+	state *evalState
+	body  *parser.Node
+}
+
+// Type implements Object.
+func (g *generator) Type() object.Type {
+	return object.GeneratorType
+}
+
+// Inspect implements Object.
+func (g *generator) Inspect() string {
+	return "<generator>"
+}
+
+// Iterate implements object.Iterable. The body is evaluated by a goroutine
+// of its own, like the body of a reset, which suspends at every yield until
+// yield asks for the next item. Once yield asks for no more, the body is
+// unwound before Iterate returns, so no goroutine is left waiting.
+func (g *generator) Iterate(yield func(item object.Object) bool) error {
+	p := newPrompt()
+	scope := newFrame(g.env, g.state)
+	scope.state = scope.state.clone()
+	scope.state.prompt = nil
+	scope.state.gen = p
+	scope.state.restart = nil
+	p.start(scope, g.body)
+	for {
+		result := p.next(scope)
+		s, ok := result.(*suspension)
+		if !ok {
+			if err, ok := result.(*object.Error); ok {
+				return err.Err
+			}
+			return nil
+		}
+		if !yield(s.value) {
+			s.k.drop()
+			// wait for the body to unwind
+			p.next(scope)
+			return nil
+		}
+		s.k.resume <- &object.Null{}
+	}
+}
+
+// (generator (dotimes (i 3) (yield (* i i)))) => <generator>
+// makes a generator, which can be iterated over like an array: doseq, take,
+// seq and the funcs of the seq module take the items it yields. Every
+// iteration evaluates the body anew, stopping it as soon as the consumer
+// stops asking for items, so the body of a generator may loop forever.
+func generatorForm(env *Environ, expr *parser.Node) object.Object {
+	return &generator{env: env, state: env.state, body: expr}
+}
+
+// (yield x) => nil
+// hands over the next item of the generator the body of which it's in, and
+// waits until the next one is asked for.
+func yieldForm(env *Environ, expr *parser.Node) object.Object {
+	args, err := evalArgsOf(env, "yield", expr, Arity{Min: 1, Max: 1})
+	if err != nil {
+		return err
+	}
+	p := env.generator()
+	if p == nil {
+		return &object.Error{Err: errors.New("yield outside of a generator")}
+	}
+	return suspend(env, p, &suspension{value: args[0]})
+}
+
+// generator returns the prompt of the generator the evaluation is in, or nil
+// if there's none.
+func (e *Environ) generator() *prompt {
+	if e.state == nil {
+		return nil
+	}
+	return e.state.gen
+}
+
+// (take 2 (generator (while t (yield 1)))) => [1, 1]
+// overrides the primitive, charging the items to the allocation budget of the
+// evaluation as they're taken rather than once they all are, which may be
+// never for a generator.
+func take(env *Environ, expr *parser.Node) object.Object {
+	args, err := evalArgsOf(env, "take", expr, Arity{Min: 2, Max: 2})
+	if err != nil {
+		return err
+	}
+	n, ok := args[0].(*object.Integer)
+	if !ok {
+		return &object.Error{Err: fmt.Errorf("type mismatch: %v and %v", args[0].Type(),
+			object.IntegerType)}
+	}
+	if n.Value <= 0 {
+		return object.NewArray([]object.Object{})
+	}
+	return primitive.Collect(args[1], n.Value, func() object.Object { return env.charge(1) })
+}
+
+// (seq (generator (yield 1) (yield 2))) => [1, 2]
+// overrides the primitive like take does.
+func seq(env *Environ, expr *parser.Node) object.Object {
+	args, err := evalArgsOf(env, "seq", expr, Arity{Min: 1, Max: 1})
+	if err != nil {
+		return err
+	}
+	return primitive.Collect(args[0], -1, func() object.Object { return env.charge(1) })
+}
@@ -0,0 +1,84 @@
+package evaluator
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/rtfb/welp/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerators(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"(generator (yield 1))", "<generator>"},
+		{"(seq (generator (dotimes (i 4) (yield (* i i)))))", "[0, 1, 4, 9]"},
+		{"(seq (generator))", "[]"},
+		{`(let ((out (mk-array)))
+			(doseq (x (generator (yield 1) (yield 2) (yield 3)))
+				(append out x))
+			out)`, "[1, 2, 3]"},
+		{`(let ((out (mk-array)))
+			(doseq ([k v] (generator (yield [:a 1]) (yield [:b 2])))
+				(append out k))
+			out)`, "[:a, :b]"},
+		// the consumer stops early, even if the generator doesn't
+		{`(let ((naturals (generator (let ((i 0)) (while t (yield i) (set! i (+ i 1)))))))
+			(take 5 naturals))`, "[0, 1, 2, 3, 4]"},
+		{`(let ((out (mk-array)))
+			(doseq (x (generator (while t (yield 1))))
+				(append out x)
+				(cond ((eq (len out) 3) (break out)) (t nil))))`, "[1, 1, 1]"},
+		// every iteration starts over
+		{`(let ((g (generator (yield 1) (yield 2))))
+			[(take 1 g) (seq g)])`, "[[1], [1, 2]]"},
+		// the yields of the funcs called by the body
+		{`(let* ((emit (lambda (x) (yield x) (yield x)))
+			 (g (generator (doseq (x [1 2]) (emit x)))))
+			(seq g))`, "[1, 1, 2, 2]"},
+		{`(let ((inner (generator (yield 1) (yield 2))))
+			(seq (generator (doseq (x inner) (yield (* x 10))))))`, "[10, 20]"},
+		{"(take 2 [1 2 3])", "[1, 2]"},
+		{"(take 0 (generator (nope)))", "[]"},
+		{`(take 2 "abc")`, `["a", "b"]`},
+		{"(seq [1 2])", "[1, 2]"},
+		{"(yield 1)", "ERR: yield outside of a generator"},
+		{"(seq (generator (recv (spawn (lambda () (yield 1))))))", "ERR: yield outside of a generator"},
+		{"(seq (generator (yield 1) (nope)))", `ERR: no such symbol "nope"`},
+		{"(doseq (x (generator (nope))) x)", `ERR: doseq: no such symbol "nope"`},
+		{"(take 1 1)", "ERR: can't iterate over INTEGER"},
+	}
+	for _, test := range tests {
+		env := testEvaluator.NewEnv()
+		got := Eval(env, parser.ParseString(test.input))
+		assert.Equal(t, test.expected, got.Inspect(), "eval(%q)", test.input)
+	}
+}
+
+func TestGeneratorsSeqModule(t *testing.T) {
+	env := New().NewEnv()
+	eval(env, parser.ParseString("(define g (generator (yield 1) (yield 2) (yield 3)))"))
+	assert.Equal(t, "[2, 3]", Eval(env, parser.ParseString("(rest g)")).Inspect())
+	assert.Equal(t, "3", Eval(env, parser.ParseString("(last g)")).Inspect())
+	assert.Equal(t, "false", Eval(env, parser.ParseString("(empty? g)")).Inspect())
+	assert.Equal(t, "true", Eval(env, parser.ParseString("(empty? (generator))")).Inspect())
+}
+
+func TestGeneratorsStopped(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		env := testEvaluator.NewEnv()
+		got := Eval(env, parser.ParseString("(take 1 (generator (while t (yield 1))))"))
+		assert.Equal(t, "[1]", got.Inspect())
+	}
+	// the bodies are unwound before take returns, so their goroutines end
+	// without waiting for the garbage collector
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, runtime.NumGoroutine() <= before, "%d goroutines left running",
+		runtime.NumGoroutine()-before)
+}
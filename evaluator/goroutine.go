@@ -0,0 +1,487 @@
+package evaluator
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/rtfb/welp/lexer"
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+)
+
+// The funcs started by spawn and go run in goroutines of their own, sharing
+// the envs they captured with the goroutine that started them. The bindings
+// of an env are safe to read and set from any goroutine, but the arrays and
+// the maps bound in them aren't: the goroutines have to hand such values over
+// channels, or guard them with a mutex. The goroutines are a part of the
+// evaluation that started them, so they're bound by its limits, and stopped
+// once its context is done.
+
+// (spawn f 1 2) => <channel 0/1>
+// calls f with the args in a new goroutine. The returned channel receives the
+// value of the call, or the error it raised, once it's done.
+func spawn(env *Environ, expr *parser.Node) object.Object {
+	args, err := evalArgsOf(env, "spawn", expr, Arity{Min: 1, Max: Variadic})
+	if err != nil {
+		return err
+	}
+	f, ok := args[0].(*object.Func)
+	if !ok {
+		return &object.Error{Err: fmt.Errorf("spawn expects a func, got %s", args[0].Type())}
+	}
+	return startGoroutine(env, funcCallable(f), callPos(expr), args[1:])
+}
+
+// (go (f 1 2)) => <channel 0/1>
+// is like (spawn f 1 2): f and the args are evaluated by the current
+// goroutine, and the call is made by a new one.
+func goForm(env *Environ, expr *parser.Node) object.Object {
+	call := expr.L
+	if call == nil || call.Tok.Typ != lexer.TokVoid || call.L == nil {
+		return &object.Error{Err: errors.New("go expects a func call")}
+	}
+	var f *callable
+	if call.L.Tok.Typ == lexer.TokIdentifier {
+		f, _ = env.lookupFunc(ident(call))
+	}
+	if f == nil {
+		head := evalArg(env, call)
+		if isAbrupt(head) {
+			return head
+		}
+		fn, ok := head.(*object.Func)
+		if !ok {
+			return &object.Error{Err: fmt.Errorf("go expects a func call, got %s", head.Type())}
+		}
+		f = funcCallable(fn)
+	}
+	if f.builtin && f.prim == nil {
+		return &object.Error{Err: fmt.Errorf("go can't start %s", f.name)}
+	}
+	args, err := evalArgs(env, call.R)
+	if err != nil {
+		return err
+	}
+	return startGoroutine(env, f, callPos(call), args)
+}
+
+// startGoroutine calls f with the args in a new goroutine, returning the
+// channel that receives the result.
+func startGoroutine(env *Environ, f *callable, pos int, args []object.Object) object.Object {
+	scope := goroutineEnv(env)
+	done := object.NewChan(1)
+	go func() {
+		result := applyFunc(scope, f, pos, args)
+		if sig, ok := result.(*signal); ok {
+			result = strayError(sig)
+		}
+		done.C <- result
+		close(done.C)
+	}()
+	return done
+}
+
+// goroutineEnv creates the scope of a new goroutine, nested inside env.
+func goroutineEnv(env *Environ) *Environ {
+	scope := newEnclosedEnv(env)
+	if scope.state != nil {
+		// neither the transactions, the continuations, the conditions
+		// nor the loading of the modules span goroutines
+		scope.state = scope.state.clone()
+		scope.state.tx = nil
+		scope.state.prompt = nil
+		scope.state.gen = nil
+		scope.state.handler = nil
+		scope.state.restart = nil
+		scope.state.loading = nil
+	}
+	return scope
+}
+
+// applyFunc calls f with already evaluated args, as a part of the evaluation
+// of env.
+func applyFunc(env *Environ, f *callable, pos int, args []object.Object) object.Object {
+	if !env.state.allows(f.needs) {
+		return &object.Error{Err: fmt.Errorf("%s isn't allowed here", f.name)}
+	}
+	switch {
+	case f.prim != nil:
+		if f.arity != nil {
+			if err := f.arity.check(f.name, pos, len(args)); err != nil {
+				return &object.Error{Err: err}
+			}
+		}
+		return callPrim(env.state, f, args)
+	case f.builtin, f.macro:
+		return &object.Error{Err: fmt.Errorf("%s can't be called with evaluated args", f.name)}
+	}
+	return applyUserFunc(f, pos, args, env.state)
+}
+
+// evalArgsOf evaluates the args of the builtin called name, which have to
+// fit the arity.
+func evalArgsOf(env *Environ, name string, list *parser.Node, arity Arity) ([]object.Object, object.Object) {
+	args, err := evalArgs(env, list)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < arity.Min || (arity.Max != Variadic && len(args) > arity.Max) {
+		return nil, &object.Error{Err: fmt.Errorf("%s expects %s args, got %d", name, arity,
+			len(args))}
+	}
+	return args, nil
+}
+
+// typeError reports an arg of the builtin called name that isn't of the
+// expected type.
+func typeError(name string, expected object.Type, got object.Object) object.Object {
+	return &object.Error{Err: fmt.Errorf("%s: expected %v, got %v", name, expected, got.Type())}
+}
+
+// waitFor blocks until one of the cases can proceed, or the evaluation of env
+// is canceled. It returns the index of the case chosen, and the value it
+// received, which is null if the channel is closed.
+func waitFor(env *Environ, cases []reflect.SelectCase) (chosen int, value object.Object, errObj object.Object) {
+	ctx := env.context()
+	if done := ctx.Done(); done != nil {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)})
+	}
+	defer func() {
+		// the only thing that can panic is a send to a closed channel
+		if recover() != nil {
+			errObj = &object.Error{Err: errors.New("send on a closed channel")}
+		}
+	}()
+	chosen, received, ok := reflect.Select(cases)
+	if ctx.Done() != nil && chosen == len(cases)-1 {
+		return 0, nil, &object.Error{Err: &CanceledError{Err: ctx.Err()}}
+	}
+	value = &object.Null{}
+	if ok {
+		value, _ = received.Interface().(object.Object)
+	}
+	return chosen, value, nil
+}
+
+func recvCase(c interface{}) reflect.SelectCase {
+	return reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(c)}
+}
+
+func sendCase(c interface{}, value interface{}) reflect.SelectCase {
+	return reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(c),
+		Send: reflect.ValueOf(value)}
+}
+
+// (chan) => <channel 0/0>
+// (chan 10) => <channel 0/10>
+// makes a channel, unbuffered unless the size of the buffer is given.
+func makeChan(env *Environ, expr *parser.Node) object.Object {
+	args, err := evalArgsOf(env, "chan", expr, Arity{Min: 0, Max: 1})
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return object.NewChan(0)
+	}
+	size, ok := args[0].(*object.Integer)
+	if !ok {
+		return typeError("chan", object.IntegerType, args[0])
+	}
+	if size.Value < 0 {
+		return &object.Error{Err: fmt.Errorf("chan: negative buffer size %d", size.Value)}
+	}
+	return object.NewChan(int(size.Value))
+}
+
+// chanArg evaluates the args of the channel builtin called name, the first of
+// which is the channel.
+func chanArg(env *Environ, name string, expr *parser.Node, nargs int) (*object.Chan, []object.Object, object.Object) {
+	args, err := evalArgsOf(env, name, expr, Arity{Min: nargs, Max: nargs})
+	if err != nil {
+		return nil, nil, err
+	}
+	c, ok := args[0].(*object.Chan)
+	if !ok {
+		return nil, nil, typeError(name, object.ChanType, args[0])
+	}
+	return c, args[1:], nil
+}
+
+// (send ch 42) => 42
+// sends a value to a channel, blocking until it's received or buffered.
+func send(env *Environ, expr *parser.Node) object.Object {
+	c, args, err := chanArg(env, "send", expr, 2)
+	if err != nil {
+		return err
+	}
+	if _, _, err := waitFor(env, []reflect.SelectCase{sendCase(c.C, args[0])}); err != nil {
+		return err
+	}
+	return args[0]
+}
+
+// (recv ch) => 42
+// receives a value from a channel, blocking until there's one. It returns
+// null once the channel is closed and drained.
+func recv(env *Environ, expr *parser.Node) object.Object {
+	c, _, err := chanArg(env, "recv", expr, 1)
+	if err != nil {
+		return err
+	}
+	_, value, err := waitFor(env, []reflect.SelectCase{recvCase(c.C)})
+	if err != nil {
+		return err
+	}
+	return value
+}
+
+// (close ch) => nil
+// closes a channel: the values sent before can still be received, the
+// receives that follow them return null.
+func closeChan(env *Environ, expr *parser.Node) (result object.Object) {
+	c, _, err := chanArg(env, "close", expr, 1)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if recover() != nil {
+			result = &object.Error{Err: errors.New("close of a closed channel")}
+		}
+	}()
+	close(c.C)
+	return &object.Null{}
+}
+
+// (select
+//    ((recv ch) msg (print msg))
+//    ((send out 42) (print "sent"))
+//    ((timeout 100) (print "timed out"))
+//    (default (print "nothing to do")))
+// waits until one of the clauses can proceed and evaluates its body, which is
+// like the select statement of Go. The value received by a recv clause is
+// bound to the pattern that follows it. A timeout clause proceeds once the
+// number of milliseconds passes, a default clause if no other clause can
+// proceed right away. The channels and the values are evaluated up front.
+func selectForm(env *Environ, expr *parser.Node) object.Object {
+	var cases []reflect.SelectCase
+	var bodies []*parser.Node
+	var patterns []*parser.Node
+	for cell := expr; cell != nil && cell.L != nil; cell = cell.R {
+		clause := cell.L
+		if clause.Tok.Typ != lexer.TokVoid || clause.L == nil {
+			return &object.Error{Err: fmt.Errorf("select: malformed clause %s", clause)}
+		}
+		if clause.L.Tok.Typ == lexer.TokIdentifier && ident(clause) == "default" {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectDefault})
+			bodies = append(bodies, clause.R)
+			patterns = append(patterns, nil)
+			continue
+		}
+		var pattern *parser.Node
+		body := clause.R
+		kind := head(clause.L)
+		switch kind {
+		case "recv", "send", "timeout":
+		default:
+			return &object.Error{Err: fmt.Errorf("select: malformed clause %s", clause)}
+		}
+		args, err := evalArgs(env, clause.L.R)
+		if err != nil {
+			return err
+		}
+		var c reflect.SelectCase
+		switch {
+		case kind == "timeout" && len(args) == 1:
+			ms, ok := args[0].(*object.Integer)
+			if !ok {
+				return typeError("timeout", object.IntegerType, args[0])
+			}
+			timer := time.NewTimer(time.Duration(ms.Value) * time.Millisecond)
+			defer timer.Stop()
+			c = recvCase(timer.C)
+		case kind == "recv" && len(args) == 1:
+			ch, ok := args[0].(*object.Chan)
+			if !ok {
+				return typeError("recv", object.ChanType, args[0])
+			}
+			if body == nil || body.L == nil || !isPattern(body.L) {
+				return &object.Error{Err: fmt.Errorf("select: %s expects a pattern", clause.L)}
+			}
+			pattern = body.L
+			body = body.R
+			c = recvCase(ch.C)
+		case kind == "send" && len(args) == 2:
+			ch, ok := args[0].(*object.Chan)
+			if !ok {
+				return typeError("send", object.ChanType, args[0])
+			}
+			c = sendCase(ch.C, args[1])
+		default:
+			return &object.Error{Err: fmt.Errorf("select: malformed clause %s", clause)}
+		}
+		cases = append(cases, c)
+		bodies = append(bodies, body)
+		patterns = append(patterns, pattern)
+	}
+	if len(cases) == 0 {
+		return &object.Error{Err: errors.New("select expects at least one clause")}
+	}
+	chosen, value, err := waitFor(env, cases)
+	if err != nil {
+		return err
+	}
+	scope := newEnclosedEnv(env)
+	if patterns[chosen] != nil {
+		if err := bindPattern(scope, patterns[chosen], value); err != nil {
+			return err
+		}
+	}
+	return evalBody(scope, bodies[chosen])
+}
+
+// waitGroupArg evaluates the args of the wait group builtin called name, the
+// first of which is the wait group.
+func waitGroupArg(env *Environ, name string, expr *parser.Node, arity Arity) (*object.WaitGroup, []object.Object, object.Object) {
+	args, err := evalArgsOf(env, name, expr, arity)
+	if err != nil {
+		return nil, nil, err
+	}
+	wg, ok := args[0].(*object.WaitGroup)
+	if !ok {
+		return nil, nil, typeError(name, object.WaitGroupType, args[0])
+	}
+	return wg, args[1:], nil
+}
+
+// (wait-group) => <wait-group 0>
+// makes a wait group, which counts the goroutines to wait for, see
+// wg-add, wg-done and wg-wait.
+func makeWaitGroup(env *Environ, expr *parser.Node) object.Object {
+	if _, err := evalArgsOf(env, "wait-group", expr, Arity{}); err != nil {
+		return err
+	}
+	return object.NewWaitGroup()
+}
+
+// (wg-add wg 2) => nil
+// adds to the count of a wait group, by one if the number isn't given.
+func wgAdd(env *Environ, expr *parser.Node) object.Object {
+	wg, args, err := waitGroupArg(env, "wg-add", expr, Arity{Min: 1, Max: 2})
+	if err != nil {
+		return err
+	}
+	delta := int64(1)
+	if len(args) > 0 {
+		n, ok := args[0].(*object.Integer)
+		if !ok {
+			return typeError("wg-add", object.IntegerType, args[0])
+		}
+		delta = n.Value
+	}
+	if err := wg.Add(delta); err != nil {
+		return &object.Error{Err: fmt.Errorf("wg-add: %v", err)}
+	}
+	return &object.Null{}
+}
+
+// (wg-done wg) => nil
+// decrements the count of a wait group.
+func wgDone(env *Environ, expr *parser.Node) object.Object {
+	wg, _, err := waitGroupArg(env, "wg-done", expr, Arity{Min: 1, Max: 1})
+	if err != nil {
+		return err
+	}
+	if err := wg.Add(-1); err != nil {
+		return &object.Error{Err: fmt.Errorf("wg-done: %v", err)}
+	}
+	return &object.Null{}
+}
+
+// (wg-wait wg) => nil
+// blocks until the count of a wait group drops to zero.
+func wgWait(env *Environ, expr *parser.Node) object.Object {
+	wg, _, err := waitGroupArg(env, "wg-wait", expr, Arity{Min: 1, Max: 1})
+	if err != nil {
+		return err
+	}
+	if _, _, err := waitFor(env, []reflect.SelectCase{recvCase(wg.Wait())}); err != nil {
+		return err
+	}
+	return &object.Null{}
+}
+
+// mutexArg evaluates the arg of the mutex builtin called name.
+func mutexArg(env *Environ, name string, expr *parser.Node) (*object.Mutex, object.Object) {
+	args, err := evalArgsOf(env, name, expr, Arity{Min: 1, Max: 1})
+	if err != nil {
+		return nil, err
+	}
+	m, ok := args[0].(*object.Mutex)
+	if !ok {
+		return nil, typeError(name, object.MutexType, args[0])
+	}
+	return m, nil
+}
+
+// (mutex) => <mutex>
+// makes a mutex, see lock, unlock and with-lock.
+func makeMutex(env *Environ, expr *parser.Node) object.Object {
+	if _, err := evalArgsOf(env, "mutex", expr, Arity{}); err != nil {
+		return err
+	}
+	return object.NewMutex()
+}
+
+// (lock m) => nil
+// locks a mutex, blocking until it's unlocked if it's locked.
+func lock(env *Environ, expr *parser.Node) object.Object {
+	m, err := mutexArg(env, "lock", expr)
+	if err != nil {
+		return err
+	}
+	return lockMutex(env, m)
+}
+
+func lockMutex(env *Environ, m *object.Mutex) object.Object {
+	if _, _, err := waitFor(env, []reflect.SelectCase{sendCase(m.Lock(), struct{}{})}); err != nil {
+		return err
+	}
+	return &object.Null{}
+}
+
+// (unlock m) => nil
+// unlocks a locked mutex.
+func unlock(env *Environ, expr *parser.Node) object.Object {
+	m, err := mutexArg(env, "unlock", expr)
+	if err != nil {
+		return err
+	}
+	if err := m.Unlock(); err != nil {
+		return &object.Error{Err: fmt.Errorf("unlock: %v", err)}
+	}
+	return &object.Null{}
+}
+
+// (with-lock m (append shared 1)) => [1]
+// evaluates the body with the mutex locked, unlocking it afterwards even if
+// the body fails.
+func withLock(env *Environ, expr *parser.Node) object.Object {
+	if expr == nil || expr.L == nil {
+		return &object.Error{Err: errors.New("with-lock expects a mutex")}
+	}
+	value := evalArg(env, expr)
+	if isAbrupt(value) {
+		return value
+	}
+	m, ok := value.(*object.Mutex)
+	if !ok {
+		return typeError("with-lock", object.MutexType, value)
+	}
+	if err := lockMutex(env, m); isAbrupt(err) {
+		return err
+	}
+	defer m.Unlock()
+	return evalBody(env, expr.R)
+}
@@ -0,0 +1,110 @@
+package evaluator
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGoroutines(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"(recv (spawn (lambda (a b) (+ a b)) 1 2))", "3"},
+		{"(recv (go (+ 1 2)))", "3"},
+		{"(let ((f (lambda (x) (* x x)))) (recv (go (f 7))))", "49"},
+		{`(let ((ch (chan)) (total 0))
+			(spawn (lambda () (dotimes (i 10) (send ch i)) (close ch)))
+			(dotimes (i 10) (set! total (+ total (recv ch))))
+			[total (recv ch)])`, "[45, null]"},
+		{`(let ((wg (wait-group)) (m (mutex)) (acc (mk-array)))
+			(dotimes (i 50)
+				(wg-add wg)
+				(spawn (lambda (n) (with-lock m (append acc n)) (wg-done wg)) i))
+			(wg-wait wg)
+			(len acc))`, "50"},
+		{`(select ((recv (chan)) v v) ((timeout 10) "timed out"))`, `"timed out"`},
+		{`(select ((recv (chan)) v v) (default 42))`, "42"},
+		{`(let ((ch (chan 1)))
+			(send ch 5)
+			(select ((recv ch) v (* v 2)) ((timeout 1000) 0)))`, "10"},
+		{`(let ((ch (chan 1))) (select ((send ch 7) (recv ch))))`, "7"},
+		{`(let ((ch (chan 1))) (send ch [1 2]) (select ((recv ch) [a b] (+ a b))))`, "3"},
+		{"(recv (spawn (lambda () (nope))))", `ERR: no such symbol "nope"`},
+		{"(recv (spawn (lambda () (break))))", "ERR: break outside of a loop"},
+		{"(let ((ch (chan))) (close ch) (close ch))", "ERR: close of a closed channel"},
+		{"(let ((ch (chan))) (close ch) (send ch 1))", "ERR: send on a closed channel"},
+		{"(unlock (mutex))", "ERR: unlock: unlock of an unlocked mutex"},
+		{"(wg-done (wait-group))", "ERR: wg-done: negative wait group count"},
+		{"(send 1 2)", "ERR: send: expected CHANNEL, got INTEGER"},
+		{"(recv)", "ERR: recv expects 1 args, got 0"},
+		{"(chan (- 0 1))", "ERR: chan: negative buffer size -1"},
+		{"(spawn 1)", "ERR: spawn expects a func, got INTEGER"},
+		{"(go 1)", "ERR: go expects a func call"},
+		{"(go (let () 1))", "ERR: go can't start let"},
+		{"(select)", "ERR: select expects at least one clause"},
+		{"(select ((recv (chan))))", "ERR: select: (recv (chan)) expects a pattern"},
+		{"(select ((foo 1) 2))", "ERR: select: malformed clause ((foo 1) 2)"},
+	}
+	for _, test := range tests {
+		env := testEvaluator.NewEnv()
+		got := Eval(env, parser.ParseString(test.input))
+		assert.Equal(t, test.expected, got.Inspect(), "eval(%q)", test.input)
+	}
+}
+
+func TestGoroutinesShareEnv(t *testing.T) {
+	env := testEvaluator.NewEnv()
+	for _, input := range []string{
+		"(define n 0)",
+		"(define wg (wait-group))",
+		"(define m (mutex))",
+		"(fn bump () (with-lock m (set! n (+ n 1))) (wg-done wg))",
+		"(dotimes (i 200) (wg-add wg) (go (bump)))",
+		"(wg-wait wg)",
+	} {
+		Eval(env, parser.ParseString(input))
+	}
+	assert.Equal(t, "200", Eval(env, parser.ParseString("n")).Inspect())
+}
+
+func TestWithLock(t *testing.T) {
+	env := testEvaluator.NewEnv()
+	Eval(env, parser.ParseString("(define m (mutex))"))
+	got := Eval(env, parser.ParseString("(with-lock m (nth 5 [1]))"))
+	assert.Equal(t, "ERR: out of bounds: 5 >= 1", got.Inspect())
+	// the failed body unlocked the mutex
+	got = Eval(env, parser.ParseString("(with-lock m 1)"))
+	assert.Equal(t, "1", got.Inspect())
+}
+
+func TestGoroutinesCanceled(t *testing.T) {
+	for _, input := range []string{
+		"(recv (chan))",
+		"(send (chan) 1)",
+		"(select ((recv (chan)) v v))",
+		"(let ((m (mutex))) (lock m) (lock m))",
+		"(let ((wg (wait-group))) (wg-add wg) (wg-wait wg))",
+		"(recv (spawn (lambda () (while t 1))))",
+		"(await (promise))",
+		"(await (future (while t 1)))",
+		"(await (all [(promise)]))",
+		"(reset (shift k (k)) (while t 1))",
+		"(seq (generator (while t 1)))",
+		"(doseq (x (generator (yield 1) (recv (chan)))) x)",
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		got := EvalContext(ctx, testEvaluator.NewEnv(), parser.ParseString(input))
+		cancel()
+		if assert.IsType(t, &object.Error{}, got, input) {
+			assert.True(t, errors.Is(got.(*object.Error).Err, ErrCanceled), "%s: %s", input,
+				got.Inspect())
+		}
+	}
+}
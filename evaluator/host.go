@@ -0,0 +1,100 @@
+package evaluator
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rtfb/welp/lexer"
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+)
+
+// (. conn query "select 1") => ...
+// calls a method of a host object, see object.Host. The method name isn't
+// evaluated. The methods of the types given to WithHostTypes can also be
+// called like funcs, (query conn "select 1"), unless there's a func or a
+// variable of the same name.
+func dotCall(env *Environ, expr *parser.Node) object.Object {
+	if expr.L == nil || expr.R == nil || expr.R.L == nil ||
+		expr.R.L.Tok.Typ != lexer.TokIdentifier {
+		return &object.Error{Err: errors.New(". expects an object and a method name")}
+	}
+	value := evalArg(env, expr)
+	if isAbrupt(value) {
+		return value
+	}
+	host, ok := value.(*object.Host)
+	if !ok {
+		return &object.Error{Err: fmt.Errorf(". expects a host object, got %s", value.Type())}
+	}
+	return callMethod(env, host, string(expr.R.L.Tok.Value), expr.R.R)
+}
+
+// callMethod evaluates the args in the list and calls the method with them.
+func callMethod(env *Environ, host *object.Host, method string, list *parser.Node) object.Object {
+	args, err := evalArgs(env, list)
+	if err != nil {
+		return err
+	}
+	return host.Call(method, args)
+}
+
+// WithHostTypes makes the methods of the types callable like funcs, with the
+// host object as the first arg, by the code evaluated by the Evaluator.
+func WithHostTypes(types ...*object.HostType) Option {
+	return func(e *Evaluator) {
+		if e.methods == nil {
+			e.methods = make(map[string]bool)
+		}
+		for _, t := range types {
+			for name := range t.Methods {
+				e.methods[name] = true
+			}
+		}
+	}
+}
+
+// isMethod tells if name is a method of one of the types given to
+// WithHostTypes.
+func (e *Environ) isMethod(name string) bool {
+	return e.evtor != nil && e.evtor.methods[name]
+}
+
+// methodCall calls the method named by the head of the call if the first arg
+// is a host object that has it. It reports whether it did the call, which it
+// does as an ordinary one if the first arg isn't such a host object, so that
+// the arg is evaluated once. The first arg is only evaluated if name is a
+// method of a type given to WithHostTypes.
+func methodCall(env *Environ, name string, call *parser.Node) (object.Object, bool) {
+	if call.R == nil || call.R.L == nil || !env.isMethod(name) {
+		return nil, false
+	}
+	if _, ok := env.lookupVar(name); ok {
+		return nil, false
+	}
+	value := evalArg(env, call.R)
+	if isAbrupt(value) {
+		return value, true
+	}
+	host, ok := value.(*object.Host)
+	if !ok || host.Method(name) == nil {
+		return callWith(env, call, value), true
+	}
+	return callMethod(env, host, name, call.R.R), true
+}
+
+// callWith does the call like eval does, but with its first arg evaluated
+// already to value.
+func callWith(env *Environ, call *parser.Node, value object.Object) object.Object {
+	head := evalArg(env, call)
+	f, ok := head.(*object.Func)
+	if !ok {
+		return head
+	}
+	rest, err := evalArgs(env, call.R.R)
+	if err != nil {
+		return err
+	}
+	args := append([]object.Object{value}, rest...)
+	return applyFunc(env, funcCallable(f), callPos(call), args)
+}
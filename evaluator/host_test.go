@@ -0,0 +1,84 @@
+package evaluator
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+// store is a host resource for the tests.
+type store struct {
+	items map[string]int64
+}
+
+var storeType = &object.HostType{
+	Name: "STORE",
+	Methods: map[string]object.HostMethod{
+		"put": func(value interface{}, args []object.Object) (object.Object, error) {
+			if len(args) != 2 {
+				return nil, errors.New("expected a key and a value")
+			}
+			var key string
+			var n int64
+			if err := object.ToGo(args[0], &key); err != nil {
+				return nil, err
+			}
+			if err := object.ToGo(args[1], &n); err != nil {
+				return nil, err
+			}
+			value.(*store).items[key] = n
+			return args[1], nil
+		},
+		"fetch": func(value interface{}, args []object.Object) (object.Object, error) {
+			var key string
+			if len(args) != 1 || object.ToGo(args[0], &key) != nil {
+				return nil, errors.New("expected a key")
+			}
+			return object.FromGo(value.(*store).items[key])
+		},
+	},
+}
+
+func TestHost(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"db", "<STORE>"},
+		{`(. db put :a 1)`, "1"},
+		{`(put db "b" (+ 1 1))`, "2"},
+		{`(+ (. db fetch "a") (fetch db :b))`, "3"},
+		{`(let ((f (lambda (s) (fetch s :a)))) (f db))`, "1"},
+		{`(eq db db)`, "true"},
+		{`(eq db other)`, "false"},
+		{`(. db drop)`, "ERR: STORE has no method drop"},
+		{`(. db put 1 2)`, "ERR: put: can't convert INTEGER to string"},
+		{`(. db)`, "ERR: . expects an object and a method name"},
+		{`(. 1 put)`, "ERR: . expects a host object, got INTEGER"},
+		{`(put 1 2)`, `ERR: no such symbol "put"`},
+		{`(let ((fetch 7)) (fetch db :a))`, "7"},
+		// the first arg is only evaluated for the names of methods
+		{`(nosuch (put db :c 3))`, `ERR: no such symbol "nosuch"`},
+		{`(fetch db :c)`, "0"},
+		{`(nosuch (nosuch2 1))`, `ERR: no such symbol "nosuch"`},
+		// and only once if it's not a host object after all
+		{`(fetch (. db put :n (+ (. db fetch :n) 1)))`, `ERR: no such symbol "fetch"`},
+		{`(fetch db :n)`, "1"},
+	}
+	env := New(WithHostTypes(storeType)).NewEnv()
+	env.Define("db", object.NewHost(storeType, &store{items: map[string]int64{}}))
+	env.Define("other", object.NewHost(storeType, &store{}))
+	for _, test := range tests {
+		got := Eval(env, parser.ParseString(test.input))
+		assert.Equal(t, test.expected, got.Inspect(), "eval(%q)", test.input)
+	}
+	// without WithHostTypes, the methods are only called with .
+	env = testEvaluator.NewEnv()
+	env.Define("db", object.NewHost(storeType, &store{items: map[string]int64{"a": 1}}))
+	assert.Equal(t, "1", Eval(env, parser.ParseString("(. db fetch :a)")).Inspect())
+	assert.Equal(t, `ERR: no such symbol "fetch"`,
+		Eval(env, parser.ParseString("(fetch db :a)")).Inspect())
+}
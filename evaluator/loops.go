@@ -0,0 +1,257 @@
+package evaluator
+
+import (
+	"fmt"
+
+	"github.com/rtfb/welp/lexer"
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+	"github.com/rtfb/welp/primitive"
+)
+
+type signalKind int
+
+const (
+	breakSignal signalKind = iota
+	continueSignal
+	recurSignal
+	restartSignal
+)
+
+// String implements Stringer.
+func (k signalKind) String() string {
+	switch k {
+	case breakSignal:
+		return "break"
+	case continueSignal:
+		return "continue"
+	case recurSignal:
+		return "recur"
+	case restartSignal:
+		return "invoke-restart"
+	default:
+		panic("unknown signalKind")
+	}
+}
+
+// signal is a control flow marker produced by break, continue and recur. It
+// travels up the evaluation as a regular return value until the nearest
+// enclosing loop consumes it. Since the loops consume it by iterating instead
+// of recursing, recur never grows the Go stack. The signal of invoke-restart
+// travels through the funcs too, up to the restart-case of the restart.
+type signal struct {
+	kind    signalKind
+	value   object.Object   // the value of (break value)
+	args    []object.Object // the new bindings of (recur args...), or the args of the restart
+	restart *restart        // the restart invoked
+}
+
+// Type implements Object.
+func (s *signal) Type() object.Type {
+	return "SIGNAL"
+}
+
+// Inspect implements Object.
+func (s *signal) Inspect() string {
+	return fmt.Sprintf("<%s>", s.kind)
+}
+
+// isAbrupt reports whether obj should stop the evaluation of a sequence of
+// expressions: it's either an error or a control flow signal.
+func isAbrupt(obj object.Object) bool {
+	switch obj.(type) {
+	case *object.Error, *signal:
+		return true
+	}
+	return false
+}
+
+// strayError converts a signal that escaped all the loops into an error.
+func strayError(sig *signal) object.Object {
+	return &object.Error{Err: fmt.Errorf("%s outside of a loop", sig.kind)}
+}
+
+// loopBody evaluates a loop body once. done reports whether the loop should
+// terminate, in which case result holds the value to return from the loop.
+func loopBody(env *Environ, body *parser.Node) (result object.Object, done bool) {
+	result = evalBody(env, body)
+	sig, ok := result.(*signal)
+	switch {
+	case isError(result):
+		return result, true
+	case !ok:
+		return nil, false
+	case sig.kind == breakSignal:
+		return sig.value, true
+	case sig.kind == continueSignal:
+		return nil, false
+	default:
+		// recur belongs to the enclosing loop or func
+		return sig, true
+	}
+}
+
+// (define i 0)
+// (while (< i 3) (set! i (+ i 1)))
+// i => 3
+func whileLoop(env *Environ, expr *parser.Node) object.Object {
+	for {
+		c := evalArg(env, expr)
+		if isAbrupt(c) {
+			return c
+		}
+		if !primitive.Truthy(c) {
+			return &object.Null{}
+		}
+		if result, done := loopBody(env, expr.R); done {
+			return result
+		}
+	}
+}
+
+// (dotimes (i 3) (print i))
+// will print 0, 1 and 2.
+func dotimes(env *Environ, expr *parser.Node) object.Object {
+	header, countExpr, err := loopHeader("dotimes", expr)
+	if err != nil {
+		return err
+	}
+	if header.Tok.Typ != lexer.TokIdentifier {
+		return &object.Error{Err: fmt.Errorf("dotimes expects a (name expr) header")}
+	}
+	name := string(header.Tok.Value)
+	countObj := evalArg(env, countExpr)
+	if isAbrupt(countObj) {
+		return countObj
+	}
+	count, ok := countObj.(*object.Integer)
+	if !ok {
+		return &object.Error{Err: fmt.Errorf("dotimes: expected %v, got %v",
+			object.IntegerType, countObj.Type())}
+	}
+	for i := int64(0); i < count.Value; i++ {
+		scope := newEnclosedEnv(env)
+		scope.setVar(name, &object.Integer{Value: i})
+		if result, done := loopBody(scope, expr.R); done {
+			return result
+		}
+	}
+	return &object.Null{}
+}
+
+// (doseq (x (append (mk-array) 1 2 3)) (print x))
+// will print 1, 2 and 3. for-each is a synonym. The name can be a
+// destructuring pattern:
+// (doseq ([k v] {:a 1 :b 2}) (print v))
+func doseq(env *Environ, expr *parser.Node) object.Object {
+	pattern, collExpr, err := loopHeader("doseq", expr)
+	if err != nil {
+		return err
+	}
+	coll := evalArg(env, collExpr)
+	if isAbrupt(coll) {
+		return coll
+	}
+	var result object.Object = &object.Null{}
+	iterErr := primitive.Iterate(coll, func(item object.Object) bool {
+		scope := newEnclosedEnv(env)
+		if err := bindPattern(scope, pattern, item); err != nil {
+			result = err
+			return false
+		}
+		res, done := loopBody(scope, expr.R)
+		if done {
+			result = res
+		}
+		return !done
+	})
+	if iterErr != nil {
+		return &object.Error{Err: fmt.Errorf("doseq: %w", iterErr)}
+	}
+	return result
+}
+
+// loopHeader parses the (pattern expr) header of dotimes and doseq.
+func loopHeader(form string, expr *parser.Node) (*parser.Node, *parser.Node, object.Object) {
+	if expr == nil || expr.L == nil || expr.L.Tok.Typ != lexer.TokVoid {
+		return nil, nil, &object.Error{Err: fmt.Errorf("%s expects a (name expr) header", form)}
+	}
+	header := expr.L
+	if header.L == nil || !isPattern(header.L) || header.R == nil || header.R.L == nil {
+		return nil, nil, &object.Error{Err: fmt.Errorf("%s expects a (name expr) header", form)}
+	}
+	return header.L, header.R, nil
+}
+
+// (loop ((i 0) (acc 1))
+//   (cond
+//     ((eq i 5) acc)
+//     (t (recur (+ i 1) (* acc 2)))))
+// => 32
+// The bindings are established like in let*, and a recur in tail position
+// rebinds them and restarts the body.
+func loop(env *Environ, expr *parser.Node) object.Object {
+	var patterns []*parser.Node
+	scope := newEnclosedEnv(env)
+	err := forEachBinding("loop", expr, func(pattern, init *parser.Node) object.Object {
+		patterns = append(patterns, pattern)
+		return bindInit(scope, scope, pattern, init)
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		result := evalBody(scope, expr.R)
+		sig, ok := result.(*signal)
+		if !ok {
+			return result
+		}
+		switch sig.kind {
+		case recurSignal:
+			if len(sig.args) != len(patterns) {
+				return &object.Error{Err: fmt.Errorf("recur: expected %d args, got %d",
+					len(patterns), len(sig.args))}
+			}
+			scope = newEnclosedEnv(env)
+			for i, pattern := range patterns {
+				if err := bindPattern(scope, pattern, sig.args[i]); err != nil {
+					return err
+				}
+			}
+		case breakSignal:
+			return sig.value
+		default:
+			return sig
+		}
+	}
+}
+
+// (recur (+ i 1) acc)
+func recur(env *Environ, expr *parser.Node) object.Object {
+	var args []object.Object
+	for ; expr.L != nil; expr = expr.R {
+		value := evalArg(env, expr)
+		if isAbrupt(value) {
+			return value
+		}
+		args = append(args, value)
+	}
+	return &signal{kind: recurSignal, args: args}
+}
+
+// (break) or (break value)
+func breakLoop(env *Environ, expr *parser.Node) object.Object {
+	var value object.Object = &object.Null{}
+	if expr.L != nil {
+		value = evalArg(env, expr)
+		if isAbrupt(value) {
+			return value
+		}
+	}
+	return &signal{kind: breakSignal, value: value}
+}
+
+// (continue)
+func continueLoop(env *Environ, expr *parser.Node) object.Object {
+	return &signal{kind: continueSignal}
+}
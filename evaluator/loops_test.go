@@ -0,0 +1,91 @@
+package evaluator
+
+import (
+	"testing"
+
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+// evalAll evaluates a sequence of expressions, returning the value of the last
+// one.
+func evalAll(env *Environ, input string) object.Object {
+	return Eval(env, parser.ParseString("(let () "+input+")"))
+}
+
+func TestLoops(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected object.Object
+	}{
+		{`(define i 0)
+		  (while (< i 5) (set! i (+ i 1)))
+		  i`, &object.Integer{Value: 5}},
+		{`(define i 0)
+		  (while t
+		    (set! i (+ i 1))
+		    (cond ((eq i 3) (break)) (t nil)))
+		  i`, &object.Integer{Value: 3}},
+		{`(while t (break 7))`, &object.Integer{Value: 7}},
+		{`(define acc 0)
+		  (dotimes (i 5)
+		    (cond ((eq i 2) (continue)) (t nil))
+		    (set! acc (+ acc i)))
+		  acc`, &object.Integer{Value: 8}},
+		{`(define acc 0)
+		  (doseq (x (append (mk-array) 1 2 3)) (set! acc (+ acc x)))
+		  acc`, &object.Integer{Value: 6}},
+		{`(define acc 0)
+		  (for-each (x (append (mk-array) 1 2 3))
+		    (cond ((eq x 2) (break)) (t nil))
+		    (set! acc (+ acc x)))
+		  acc`, &object.Integer{Value: 1}},
+		{`(define n 0)
+		  (doseq (c "abc") (set! n (+ n 1)))
+		  n`, &object.Integer{Value: 3}},
+		{`(loop ((i 0) (acc 1))
+		    (cond
+		      ((eq i 5) acc)
+		      (t (recur (+ i 1) (* acc 2)))))`, &object.Integer{Value: 32}},
+		{`(fn count-down (n)
+		    (cond
+		      ((eq n 0) 0)
+		      (t (recur (- n 1)))))
+		  (count-down 100000)`, &object.Integer{Value: 0}},
+		{`(define z 0)
+		  (while t (set! z (break 5)))
+		  z`, &object.Integer{Value: 0}},
+		{`(define z 0)
+		  (while t (define z (break 5)))
+		  z`, &object.Integer{Value: 0}},
+		{`(define z 0)
+		  (loop ((i 0))
+		    (cond
+		      ((eq i 3) z)
+		      (t (set! z (recur (+ i 1))))))`, &object.Integer{Value: 0}},
+		{`(not nil)`, &object.Boolean{Value: true}},
+		{`(>= 3 3)`, &object.Boolean{Value: true}},
+	}
+	for _, test := range tests {
+		env := testEvaluator.NewEnv()
+		got := evalAll(env, test.input)
+		assert.Equal(t, test.expected, got, "eval(%q)", test.input)
+	}
+}
+
+func TestLoopErrors(t *testing.T) {
+	tests := []string{
+		"(break)",
+		"(continue)",
+		"(recur 1)",
+		"(loop ((i 0)) (recur 1 2))",
+		"(dotimes (i \"x\") i)",
+		"(doseq (x 5) x)",
+	}
+	for _, input := range tests {
+		env := testEvaluator.NewEnv()
+		got := evalAll(env, input)
+		assert.IsType(t, &object.Error{}, got, "eval(%q)", input)
+	}
+}
@@ -0,0 +1,99 @@
+package evaluator
+
+import (
+	"fmt"
+
+	"github.com/rtfb/welp/lexer"
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+)
+
+// (defmacro unless (c &rest body) (cond (c nil) (t (let () body))))
+// (unless (eq 1 2) (print "yes")) => prints "yes"
+//
+// Macros are templates: a call substitutes the unevaluated argument
+// expressions for the parameters in the body, then evaluates the result in the
+// caller's environment. A &rest parameter is spliced into the list it appears
+// in.
+func defmacro(env *Environ, expr *parser.Node) object.Object {
+	if expr.L == nil || expr.L.Tok.Typ != lexer.TokIdentifier {
+		return &object.Error{Err: fmt.Errorf("defmacro expects a name")}
+	}
+	name := ident(expr)
+	m, err := newUserFunc(env, name, expr.R)
+	if err != nil {
+		return err
+	}
+	for _, p := range m.spec.all() {
+		if p.name == "" {
+			return &object.Error{Err: fmt.Errorf("%s: macro params can't be destructured", name)}
+		}
+	}
+	m.macro = true
+	env.setFunc(name, m)
+	return &object.Func{Name: name, Impl: m}
+}
+
+// expandMacro expands a call to the macro m and evaluates the expansion.
+func expandMacro(env *Environ, m *callable, call *parser.Node) object.Object {
+	var args []*parser.Node
+	for arg := call.R; arg != nil && arg.L != nil; arg = arg.R {
+		args = append(args, arg.L)
+	}
+	bs, err := m.spec.bindings(m.name, callPos(call), len(args), func(i int) (string, bool) {
+		tok := args[i].Tok
+		if tok.Typ != lexer.TokIdentifier || len(tok.Value) < 2 || tok.Value[0] != ':' {
+			return "", false
+		}
+		return string(tok.Value[1:]), true
+	})
+	if err != nil {
+		return &object.Error{Err: err}
+	}
+	subst := make(map[string][]*parser.Node)
+	for _, b := range bs {
+		switch {
+		case b.rest:
+			if b.arg < len(args) {
+				subst[b.name] = args[b.arg:]
+			} else {
+				subst[b.name] = []*parser.Node{}
+			}
+		case b.arg >= 0:
+			subst[b.name] = []*parser.Node{args[b.arg]}
+		case b.init != nil:
+			subst[b.name] = []*parser.Node{expand(b.init, subst).L}
+		default:
+			subst[b.name] = []*parser.Node{{Tok: lexer.Token{
+				Typ: lexer.TokIdentifier, Value: []byte("nil")}}}
+		}
+	}
+	return evalBody(env, expand(m.body, subst))
+}
+
+// expand copies a list of expressions, replacing each identifier that names a
+// parameter with the argument expressions bound to it.
+func expand(cell *parser.Node, subst map[string][]*parser.Node) *parser.Node {
+	if cell == nil {
+		return nil
+	}
+	if cell.L == nil {
+		return &parser.Node{Tok: cell.Tok}
+	}
+	rest := expand(cell.R, subst)
+	elem := cell.L
+	switch elem.Tok.Typ {
+	case lexer.TokIdentifier:
+		if nodes, ok := subst[string(elem.Tok.Value)]; ok {
+			for i := len(nodes) - 1; i >= 0; i-- {
+				rest = &parser.Node{L: nodes[i], R: rest}
+			}
+			return rest
+		}
+	case lexer.TokVoid, lexer.TokOpenBracket, lexer.TokOpenBrace:
+		listTok := elem.Tok
+		elem = expand(elem, subst)
+		elem.Tok = listTok
+	}
+	return &parser.Node{Tok: cell.Tok, L: elem, R: rest}
+}
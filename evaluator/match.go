@@ -0,0 +1,349 @@
+package evaluator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rtfb/welp/lexer"
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+	"github.com/rtfb/welp/primitive"
+)
+
+// MatchError is the error produced when none of the clauses of a match form
+// match the value.
+type MatchError struct {
+	Value object.Object
+}
+
+// Error implements error.
+func (e *MatchError) Error() string {
+	return fmt.Sprintf("no match for %s", e.Value.Inspect())
+}
+
+// matcher checks whether a value matches a compiled pattern, appending the
+// bindings it makes to binds.
+type matcher func(v object.Object, binds *[]matchBinding) bool
+
+type matchBinding struct {
+	name  string
+	value object.Object
+}
+
+type matchClause struct {
+	match matcher
+	guard *parser.Node // the cell holding the :when expression, nil if none
+	body  *parser.Node
+}
+
+// compiledMatch is a match form with all the patterns compiled. Clauses with
+// literal patterns are indexed by the literal, so only the clauses that can
+// possibly match a value are tried.
+type compiledMatch struct {
+	clauses  []matchClause
+	byKey    map[object.HashKey][]int
+	fallback []int // the clauses without a literal pattern
+}
+
+// typePatterns maps the names usable in (type pattern) patterns to types.
+var typePatterns = map[string]object.Type{
+	"integer": object.IntegerType,
+	"boolean": object.BooleanType,
+	"string":  object.StringType,
+	"null":    object.NullType,
+	"func":    object.FuncType,
+	"array":   object.ArrayType,
+	"map":     object.MapType,
+	"keyword": object.KeywordType,
+	"error":   object.ErrType,
+}
+
+// (match x
+//
+//	(0 "zero")
+//	((integer n) :when (< n 0) "negative")
+//	([a b & more] (+ a b))
+//	({:shape :circle :r r} (* 3 r r))
+//	(_ "anything else"))
+//
+// The patterns are:
+//
+//	_                  matches anything
+//	x                  matches anything and binds it to x
+//	1, "s", :k, t, nil match an equal literal
+//	[p1 p2 & rest]     matches an array of the given shape, like in bindPattern
+//	{:k p}             matches a map having the key :k, with its value matching p
+//	(integer p)        matches a value of the given type that also matches p;
+//	                   p is optional, see typePatterns for the type names
+//
+// The first clause that matches, and whose :when guard is true if it has one,
+// gets its body evaluated with the bindings in scope. If no clause matches,
+// the result is a MatchError. The patterns are compiled once per match form.
+func match(env *Environ, expr *parser.Node) object.Object {
+	if expr == nil || expr.L == nil {
+		return &object.Error{Err: fmt.Errorf("match expects an expression")}
+	}
+	m, err := compileMatch(expr)
+	if err != nil {
+		return &object.Error{Err: err}
+	}
+	value := evalArg(env, expr)
+	if isAbrupt(value) {
+		return value
+	}
+	candidates := m.fallback
+	if h, ok := value.(object.Hashable); ok {
+		if c, ok := m.byKey[h.HashKey()]; ok {
+			candidates = c
+		}
+	}
+	var binds []matchBinding
+	for _, i := range candidates {
+		clause := m.clauses[i]
+		binds = binds[:0]
+		if !clause.match(value, &binds) {
+			continue
+		}
+		scope := newEnclosedEnv(env)
+		for _, b := range binds {
+			scope.setVar(b.name, b.value)
+		}
+		if clause.guard != nil {
+			ok := evalArg(scope, clause.guard)
+			if isAbrupt(ok) {
+				return ok
+			}
+			if !primitive.Truthy(ok) {
+				continue
+			}
+		}
+		return evalBody(scope, clause.body)
+	}
+	return &object.Error{Err: &MatchError{Value: value}}
+}
+
+// compileMatch returns the compiled form of a match expression, compiling it
+// on the first use. It's kept by the node, so it's collected along with it.
+func compileMatch(expr *parser.Node) (*compiledMatch, error) {
+	if m, ok := expr.Memo().(*compiledMatch); ok {
+		return m, nil
+	}
+	m, err := newCompiledMatch(expr)
+	if err != nil {
+		return nil, err
+	}
+	expr.SetMemo(m)
+	return m, nil
+}
+
+// newCompiledMatch compiles the clauses of a match expression.
+func newCompiledMatch(expr *parser.Node) (*compiledMatch, error) {
+	m := &compiledMatch{byKey: make(map[object.HashKey][]int)}
+	var literals []object.HashKey
+	literalAt := make(map[int]object.HashKey)
+	for cell := expr.R; cell != nil && cell.L != nil; cell = cell.R {
+		node := cell.L
+		if node.Tok.Typ != lexer.TokVoid || node.L == nil {
+			return nil, fmt.Errorf("match: malformed clause %s", node)
+		}
+		match, err := compilePattern(node.L)
+		if err != nil {
+			return nil, err
+		}
+		clause := matchClause{match: match, body: node.R}
+		if node.R != nil && node.R.L != nil && node.R.L.Tok.Typ == lexer.TokIdentifier &&
+			string(node.R.L.Tok.Value) == ":when" {
+			if node.R.R == nil || node.R.R.L == nil {
+				return nil, fmt.Errorf("match: :when needs a guard in %s", node)
+			}
+			clause.guard = node.R.R
+			clause.body = node.R.R.R
+		}
+		i := len(m.clauses)
+		m.clauses = append(m.clauses, clause)
+		if lit, ok := literal(node.L); ok {
+			if h, ok := lit.(object.Hashable); ok {
+				literals = append(literals, h.HashKey())
+				literalAt[i] = h.HashKey()
+				continue
+			}
+		}
+		m.fallback = append(m.fallback, i)
+	}
+	for _, key := range literals {
+		if _, ok := m.byKey[key]; ok {
+			continue
+		}
+		var candidates []int
+		for i := range m.clauses {
+			if k, ok := literalAt[i]; !ok || k == key {
+				candidates = append(candidates, i)
+			}
+		}
+		m.byKey[key] = candidates
+	}
+	return m, nil
+}
+
+// literal returns the value of a literal pattern.
+func literal(p *parser.Node) (object.Object, bool) {
+	value := string(p.Tok.Value)
+	switch p.Tok.Typ {
+	case lexer.TokNumber:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		return &object.Integer{Value: n}, true
+	case lexer.TokString:
+		return &object.String{Value: value}, true
+	case lexer.TokIdentifier:
+		switch {
+		case value == "t":
+			return &object.Boolean{Value: true}, true
+		case value == "nil":
+			return &object.Boolean{Value: false}, true
+		case strings.HasPrefix(value, ":") && len(value) > 1:
+			return &object.Keyword{Name: value[1:]}, true
+		}
+	}
+	return nil, false
+}
+
+func compilePattern(p *parser.Node) (matcher, error) {
+	if lit, ok := literal(p); ok {
+		return func(v object.Object, binds *[]matchBinding) bool {
+			return object.Equal(lit, v)
+		}, nil
+	}
+	switch p.Tok.Typ {
+	case lexer.TokIdentifier:
+		name := string(p.Tok.Value)
+		if name == "_" {
+			return func(v object.Object, binds *[]matchBinding) bool {
+				return true
+			}, nil
+		}
+		return func(v object.Object, binds *[]matchBinding) bool {
+			*binds = append(*binds, matchBinding{name: name, value: v})
+			return true
+		}, nil
+	case lexer.TokOpenBracket:
+		return compileArrayPattern(p)
+	case lexer.TokOpenBrace:
+		return compileMapPattern(p)
+	case lexer.TokVoid:
+		return compileTypePattern(p)
+	}
+	return nil, fmt.Errorf("match: invalid pattern %s", p)
+}
+
+func compileArrayPattern(p *parser.Node) (matcher, error) {
+	var elems []matcher
+	var rest, as matcher
+	for cell := p; cell.L != nil; cell = cell.R {
+		marker := ""
+		if cell.L.Tok.Typ == lexer.TokIdentifier {
+			marker = string(cell.L.Tok.Value)
+		}
+		if marker != "&" && marker != ":as" {
+			if rest != nil {
+				return nil, fmt.Errorf("match: only :as may follow the rest pattern in %s", p)
+			}
+			m, err := compilePattern(cell.L)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, m)
+			continue
+		}
+		if cell.R == nil || cell.R.L == nil {
+			return nil, fmt.Errorf("match: %s must be followed by a pattern in %s", marker, p)
+		}
+		cell = cell.R
+		m, err := compilePattern(cell.L)
+		if err != nil {
+			return nil, err
+		}
+		if marker == "&" {
+			rest = m
+		} else {
+			as = m
+		}
+	}
+	return func(v object.Object, binds *[]matchBinding) bool {
+		arr, ok := v.(*object.Array)
+		if !ok || len(arr.Value) < len(elems) || (rest == nil && len(arr.Value) > len(elems)) {
+			return false
+		}
+		for i, m := range elems {
+			if !m(arr.Value[i], binds) {
+				return false
+			}
+		}
+		if rest != nil && !rest(object.NewArray(arr.Value[len(elems):]), binds) {
+			return false
+		}
+		return as == nil || as(v, binds)
+	}, nil
+}
+
+func compileMapPattern(p *parser.Node) (matcher, error) {
+	var keys []object.Object
+	var values []matcher
+	for cell := p; cell.L != nil; cell = cell.R.R {
+		if cell.R == nil || cell.R.L == nil {
+			return nil, fmt.Errorf("match: expected an even number of forms in %s", p)
+		}
+		key, ok := literal(cell.L)
+		if !ok {
+			return nil, fmt.Errorf("match: map pattern keys must be literals in %s", p)
+		}
+		m, err := compilePattern(cell.R.L)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		values = append(values, m)
+	}
+	return func(v object.Object, binds *[]matchBinding) bool {
+		mv, ok := v.(*object.Map)
+		if !ok {
+			return false
+		}
+		for i, key := range keys {
+			value, ok := mv.Get(key)
+			if !ok || !values[i](value, binds) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func compileTypePattern(p *parser.Node) (matcher, error) {
+	if p.L == nil || p.L.Tok.Typ != lexer.TokIdentifier {
+		return nil, fmt.Errorf("match: invalid pattern %s", p)
+	}
+	typ, ok := typePatterns[ident(p)]
+	if !ok {
+		return nil, fmt.Errorf("match: unknown type %s in %s", p.L.Tok.Value, p)
+	}
+	inner := func(v object.Object, binds *[]matchBinding) bool {
+		return true
+	}
+	if p.R != nil && p.R.L != nil {
+		if p.R.R != nil && p.R.R.L != nil {
+			return nil, fmt.Errorf("match: type pattern takes one pattern in %s", p)
+		}
+		var err error
+		inner, err = compilePattern(p.R.L)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return func(v object.Object, binds *[]matchBinding) bool {
+		return v.Type() == typ && inner(v, binds)
+	}, nil
+}
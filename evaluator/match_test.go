@@ -0,0 +1,107 @@
+package evaluator
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+const classify = `(fn classify (x)
+  (match x
+    (0 "zero")
+    ((integer n) :when (< n 0) "negative")
+    ((integer _) "positive")
+    ("" "empty string")
+    ((string s) s)
+    (:none "none")
+    ([] "empty array")
+    ([a] "one")
+    ([a b & more] (len more))
+    ({:shape :circle :r r} (* 3 r r))
+    ({:shape :square :side s} (* s s))
+    (t "true")))
+`
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"(classify 0)", `"zero"`},
+		{"(classify (- 0 5))", `"negative"`},
+		{"(classify 7)", `"positive"`},
+		{`(classify "")`, `"empty string"`},
+		{`(classify "abc")`, `"abc"`},
+		{"(classify :none)", `"none"`},
+		{"(classify [])", `"empty array"`},
+		{"(classify [1])", `"one"`},
+		{"(classify [1 2 3 4])", "2"},
+		{"(classify {:shape :circle :r 2})", "12"},
+		{"(classify {:shape :square :side 3 :color :red})", "9"},
+		{"(classify t)", `"true"`},
+		{"(classify nil)", "ERR: no match for false"},
+		{"(classify :other)", "ERR: no match for :other"},
+		{"(classify {:shape :triangle})", `ERR: no match for {:shape :triangle}`},
+	}
+	env := testEvaluator.NewEnv()
+	Eval(env, parser.ParseString(classify))
+	for _, test := range tests {
+		got := evalAll(env, test.input)
+		assert.Equal(t, test.expected, got.Inspect(), "eval(%q)", test.input)
+	}
+}
+
+func TestMatchBindings(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"(match [1 [2 3]] ([a [b c]] (+ a b c)))", "6"},
+		{"(match [1 2] ([a b :as all] all))", "[1, 2]"},
+		{"(define x 5) (match 1 (x x)) x", "5"},
+		{"(match {:a {:b 1}} ({:a {:b (integer n)}} n))", "1"},
+		{"(match 3 ((integer n) :when (> n 5) :big) (_ :small))", ":small"},
+		{"(match (+ 1 1) (1 :one) (2 :two) (2 :again))", ":two"},
+	}
+	for _, test := range tests {
+		env := testEvaluator.NewEnv()
+		got := evalAll(env, test.input)
+		assert.Equal(t, test.expected, got.Inspect(), "eval(%q)", test.input)
+	}
+}
+
+func TestMatchErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"(match 1 ((bogus x) x))", "ERR: match: unknown type bogus in (bogus x)"},
+		{"(match 1 ({x 1} x))", "ERR: match: map pattern keys must be literals in {x 1}"},
+		{"(match 1 (_ :when))", "ERR: match: :when needs a guard in (_ :when)"},
+		{"(match 1 x)", "ERR: match: malformed clause x"},
+	}
+	for _, test := range tests {
+		env := testEvaluator.NewEnv()
+		got := evalAll(env, test.input)
+		assert.Equal(t, test.expected, got.Inspect(), "eval(%q)", test.input)
+	}
+	got := evalAll(testEvaluator.NewEnv(), "(match 1 (2 2))")
+	var matchErr *MatchError
+	assert.True(t, errors.As(got.(*object.Error).Err, &matchErr))
+	assert.Equal(t, &object.Integer{Value: 1}, matchErr.Value)
+}
+
+func TestMatchCompiledOnce(t *testing.T) {
+	env := testEvaluator.NewEnv()
+	Eval(env, parser.ParseString("(define x 1)"))
+	expr := parser.ParseString("(match x (1 :one) (_ :other))")
+	assert.Equal(t, ":one", Eval(env, expr).Inspect())
+	m := expr.R.Memo()
+	assert.NotNil(t, m)
+	Eval(env, parser.ParseString("(set! x 2)"))
+	assert.Equal(t, ":other", Eval(env, expr).Inspect())
+	assert.True(t, m == expr.R.Memo(), "the match got compiled again")
+}
@@ -0,0 +1,345 @@
+package evaluator
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rtfb/welp/lexer"
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+	"github.com/rtfb/welp/pkg"
+)
+
+// module is an imported file. Its definitions live in an env of its own, and
+// only the exported ones are visible to the importers.
+type module struct {
+	path string // the absolute path of the source
+	name string // set by the module form, if there's one
+	env  *Environ
+
+	// declared holds the names listed by the module form, nil if there's
+	// none
+	declared []string
+
+	// exports holds the exported names, it's nil while the module is
+	// being loaded
+	exports map[string]bool
+
+	loadedAt time.Time
+}
+
+// displayName names the module in the error messages.
+func (m *module) displayName() string {
+	if m.name != "" {
+		return m.name
+	}
+	return m.path
+}
+
+// lookup looks up an exported name.
+func (m *module) lookup(name string) (object.Object, *callable, bool) {
+	if !m.exports[name] {
+		return nil, nil, false
+	}
+	if v, ok := m.env.ownVar(name); ok {
+		return v, nil, true
+	}
+	f, ok := m.env.ownFunc(name)
+	return nil, f, ok
+}
+
+// stale tells if the source or the compiled module changed since the module
+// was loaded.
+func (m *module) stale() bool {
+	for _, name := range []string{m.path, CompiledPath(m.path)} {
+		if info, err := os.Stat(name); err == nil && info.ModTime().After(m.loadedAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// finishExports works out what the module exports once it's loaded: either
+// the names listed by its module form, or everything it defines.
+func (m *module) finishExports() error {
+	exports := make(map[string]bool)
+	if m.declared == nil {
+		vars, funcs := m.env.names()
+		for _, name := range append(vars, funcs...) {
+			exports[name] = true
+		}
+	}
+	for _, name := range m.declared {
+		_, isVar := m.env.ownVar(name)
+		_, isFunc := m.env.ownFunc(name)
+		if !isVar && !isFunc {
+			return fmt.Errorf("module %s exports %s, but doesn't define it", m.displayName(), name)
+		}
+		exports[name] = true
+	}
+	m.exports = exports
+	return nil
+}
+
+// (module geometry (export area perimeter)) => nil
+// declares the name of the module defined by the file, and the names it
+// exports. A module without it exports everything it defines. The form has no
+// effect in a file that isn't imported.
+func moduleForm(env *Environ, expr *parser.Node) object.Object {
+	if expr.L == nil || expr.L.Tok.Typ != lexer.TokIdentifier {
+		return &object.Error{Err: errors.New("module expects a name")}
+	}
+	name := string(expr.L.Tok.Value)
+	exports := []string{}
+	for cell := expr.R; cell != nil && cell.L != nil; cell = cell.R {
+		if head(cell.L) != "export" {
+			return &object.Error{Err: fmt.Errorf("module %s: expected an export list, got %s",
+				name, cell.L)}
+		}
+		for n := cell.L.R; n != nil && n.L != nil; n = n.R {
+			if n.L.Tok.Typ != lexer.TokIdentifier {
+				return &object.Error{Err: fmt.Errorf("module %s: can't export %s", name, n.L)}
+			}
+			exports = append(exports, string(n.L.Tok.Value))
+		}
+	}
+	for e := env; e != nil; e = e.outer {
+		if e.mod != nil {
+			e.mod.name = name
+			e.mod.declared = exports
+			break
+		}
+	}
+	return &object.Null{}
+}
+
+// head returns the name at the head of a list, or "" if there's none.
+func head(list *parser.Node) string {
+	if list.Tok.Typ != lexer.TokVoid || list.L == nil || list.L.Tok.Typ != lexer.TokIdentifier {
+		return ""
+	}
+	return string(list.L.Tok.Value)
+}
+
+// (import "lib/foo" "bar.lisp") => nil
+// (import "lib/foo" :as f) => nil
+// loads the modules and binds the names they export: unqualified, or
+// qualified by the alias, like f/area. See findModule for how the paths are
+// resolved. A module is loaded once per Evaluator, and loaded again only if
+// its file has changed since. The modules are loaded one at a time, so the
+// imports done by the goroutines a module starts wait for it to be loaded.
+func importFiles(env *Environ, expr *parser.Node) object.Object {
+	for expr != nil && expr.L != nil {
+		value := evalArg(env, expr)
+		if isAbrupt(value) {
+			return value
+		}
+		path, ok := value.(*object.String)
+		if !ok {
+			return &object.Error{Err: fmt.Errorf("import only does strings, but got %v",
+				value.Type())}
+		}
+		expr = expr.R
+		alias := ""
+		if expr != nil && expr.L != nil && expr.L.Tok.Typ == lexer.TokIdentifier &&
+			string(expr.L.Tok.Value) == ":as" {
+			if expr.R == nil || expr.R.L == nil || expr.R.L.Tok.Typ != lexer.TokIdentifier {
+				return &object.Error{Err: fmt.Errorf("import %s: :as expects a name", path.Value)}
+			}
+			alias = string(expr.R.L.Tok.Value)
+			expr = expr.R.R
+		}
+		if err := importModule(env, path.Value, alias); err != nil {
+			return &object.Error{Err: err}
+		}
+	}
+	return &object.Null{}
+}
+
+// importModule loads the module found at path and binds its exports in env.
+func importModule(env *Environ, path, alias string) error {
+	if env.evtor == nil {
+		return fmt.Errorf("import %s: modules can't be imported here", path)
+	}
+	file, err := env.findModule(path)
+	if err != nil {
+		return err
+	}
+	// the module is loaded in a state of its own, since it outlives the
+	// import: it doesn't see the transaction, the dynamic bindings, the
+	// handlers or the continuations of the importer. The loading counts
+	// against the limits of the importer though, which it's a part of.
+	state := &evalState{}
+	if env.state != nil {
+		state.limits = env.state.limits
+		state.loading = env.state.loading
+	}
+	if !state.loading.heldFor(env.evtor) {
+		env.evtor.loading.Lock()
+		defer env.evtor.loading.Unlock()
+		state.loading = &loadingLock{evtor: env.evtor, held: 1}
+		defer atomic.StoreInt32(&state.loading.held, 0)
+	}
+	mod, err := env.evtor.loadModule(file, state)
+	if err != nil {
+		return err
+	}
+	if alias != "" {
+		env.setAlias(alias, mod)
+		return nil
+	}
+	for name := range mod.exports {
+		v, f, _ := mod.lookup(name)
+		if f != nil {
+			env.setFunc(name, f)
+		} else {
+			env.setVar(name, v)
+		}
+	}
+	return nil
+}
+
+// findModule returns the absolute path of the module at path. The extension
+// can be left out, in which case it's .lisp. A relative path is looked up
+// relative to the directory of the importing file, which is the working
+// directory for the code that's not in a file, then in the directories listed
+// in the WELP_PATH environment variable, and finally among the packages
+// vendored into welp_modules (see pkg.Find). The module is found if either
+// its source or its compiled module exists.
+func (e *Environ) findModule(path string) (string, error) {
+	file := path
+	if filepath.Ext(file) == "" {
+		file += ".lisp"
+	}
+	if filepath.IsAbs(file) {
+		if moduleExists(file) {
+			return file, nil
+		}
+		return "", fmt.Errorf("import: can't find %s", file)
+	}
+	dirs := append([]string{e.importDir()}, filepath.SplitList(os.Getenv("WELP_PATH"))...)
+	for _, dir := range dirs {
+		if candidate := filepath.Join(dir, file); moduleExists(candidate) {
+			return filepath.Abs(candidate)
+		}
+	}
+	candidate, err := pkg.Find(e.importDir(), path)
+	if err != nil {
+		return "", fmt.Errorf("import %s: %v", path, err)
+	}
+	if candidate != "" {
+		if filepath.Ext(candidate) == "" {
+			candidate += ".lisp"
+		}
+		if moduleExists(candidate) {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("import: can't find %s", file)
+}
+
+// moduleExists tells if the source or the compiled module exists.
+func moduleExists(file string) bool {
+	for _, name := range []string{file, CompiledPath(file)} {
+		if _, err := os.Stat(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// importDir returns the directory of the file being evaluated.
+func (e *Environ) importDir() string {
+	for env := e; env != nil; env = env.outer {
+		if dir := env.ownDir(); dir != "" {
+			return dir
+		}
+	}
+	return "."
+}
+
+// loadingLock is in the states of the evaluations done while a goroutine
+// holds the lock of the module loading, so that the imports they do, which
+// are nested in the one that took the lock, don't wait for it. It's dropped by
+// the goroutines they start, which wait for the lock like any other, and it's
+// released along with the lock, for the continuations and the generators that
+// outlive the loading.
+type loadingLock struct {
+	evtor *Evaluator
+	held  int32 // accessed atomically
+}
+
+// heldFor tells if the lock of the module loading of evtor is held by the
+// evaluation.
+func (l *loadingLock) heldFor(evtor *Evaluator) bool {
+	return l != nil && l.evtor == evtor && atomic.LoadInt32(&l.held) == 1
+}
+
+// loadModule returns the module in the file, loading it unless it's loaded
+// already. The loading is a part of the evaluation tracked by state. The
+// caller must hold e.loading.
+func (e *Evaluator) loadModule(file string, state *evalState) (*module, error) {
+	if mod, ok := e.modules[file]; ok {
+		if mod.exports == nil {
+			return nil, e.cycleError(file)
+		}
+		if !mod.stale() {
+			return mod, nil
+		}
+	}
+	if e.modules == nil {
+		e.modules = make(map[string]*module)
+	}
+	mod := &module{path: file, loadedAt: time.Now()}
+	mod.env = newEnclosedEnv(newEnv(e))
+	mod.env.dir = filepath.Dir(file)
+	mod.env.mod = mod
+	mod.env.state = state
+	e.modules[file] = mod
+	e.importing = append(e.importing, file)
+	defer func() {
+		e.importing = e.importing[:len(e.importing)-1]
+		mod.env.state = nil
+	}()
+	err := loadFile(mod.env, file)
+	if err == nil {
+		err = mod.finishExports()
+	}
+	if err != nil {
+		delete(e.modules, file)
+		return nil, err
+	}
+	return mod, nil
+}
+
+// cycleError describes the chain of imports that leads back to file.
+func (e *Evaluator) cycleError(file string) error {
+	var chain []string
+	for i, f := range e.importing {
+		if f == file {
+			chain = e.importing[i:]
+			break
+		}
+	}
+	return fmt.Errorf("import cycle: %s -> %s", strings.Join(chain, " -> "), file)
+}
+
+// evalModuleFile evaluates the source of a module, stopping at the first
+// error.
+func evalModuleFile(env *Environ, name string) error {
+	exprs, err := parser.ParseFile(name)
+	if err != nil {
+		return err
+	}
+	for _, expr := range exprs {
+		if err, ok := Eval(env, expr).(*object.Error); ok {
+			return fmt.Errorf("%s: %v", name, err.Err)
+		}
+	}
+	return nil
+}
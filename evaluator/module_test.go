@@ -0,0 +1,178 @@
+package evaluator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/rtfb/welp/compiler"
+	"github.com/rtfb/welp/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeModules writes the files into a fresh temporary directory, returning
+// its path.
+func writeModules(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "welp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestModules(t *testing.T) {
+	dir := writeModules(t, map[string]string{
+		"lib/geo.lisp": `(module geo (export area unit))
+			(fn square (x) (* x x))
+			(define unit 1)
+			(fn area (r) (* 3 (square r)))`,
+		"lib/shapes.lisp": `(import "geo" :as g)
+			(fn circle (r) (g/area r))`,
+		"counter.lisp":                        "(define counter (mk-array))",
+		"cycle/a.lisp":                        `(import "b")`,
+		"cycle/b.lisp":                        `(import "a")`,
+		"bad.lisp":                            "(module bad (export nope))",
+		"welp_modules/mathutil/welp.mod":      "package mathutil\nmain lib/math.lisp",
+		"welp_modules/mathutil/lib/math.lisp": "(fn twice (x) (* 2 x))",
+		"welp_modules/mathutil/extra.lisp":    "(fn thrice (x) (* 3 x))",
+		"welp_modules/stats/stats.lisp": `(import "mathutil")
+			(fn sum2 (a b) (twice (+ a b)))`,
+	})
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`(let () (import "lib/geo" :as g) (g/area 2))`, "12"},
+		{`(let () (import "lib/geo" :as g) [g/unit (g/area g/unit)])`, "[1, 3]"},
+		{`(let () (import "lib/geo" :as g) (g/square 2))`, `ERR: no such symbol "g/square"`},
+		{`(let () (import "lib/geo") (area 1))`, "3"},
+		{`(let () (import "lib/geo") (square 2))`, `ERR: no such symbol "square"`},
+		{`(let () (import "lib/shapes.lisp") (circle 1))`, "3"},
+		{`(let () (import "lib/shapes.lisp") (g/area 1))`, `ERR: no such symbol "g/area"`},
+		{`(let () (import "counter") (append counter 1))`, "[1]"},
+		{`(let () (import "counter") (len counter))`, "1"},
+		{`(let () (import "mathutil" :as m) (m/twice 2))`, "4"},
+		{`(let () (import "mathutil/extra") (thrice 2))`, "6"},
+		{`(let () (import "stats") (sum2 4 6))`, "20"},
+		{`(import "cycle/a")`, "import cycle: "},
+		{`(import "bad")`, "ERR: module bad exports nope, but doesn't define it"},
+		{`(import "nope")`, "ERR: import: can't find nope.lisp"},
+		{`(import "lib/geo" :as)`, "ERR: import lib/geo: :as expects a name"},
+	}
+	evtor := &Evaluator{stdlibEnv: newEmptyEnv()}
+	for _, test := range tests {
+		env := evtor.NewEnv()
+		env.SetDir(dir)
+		got := Eval(env, parser.ParseString(test.input)).Inspect()
+		assert.Contains(t, got, test.expected, "eval(%q)", test.input)
+	}
+}
+
+func TestModulesSpawning(t *testing.T) {
+	dir := writeModules(t, map[string]string{
+		"geo.lisp":  "(fn area (r) (* 3 r r))",
+		"unit.lisp": "(define unit 1)",
+		"spawn.lisp": `(define f1 (future (import "geo" :as g) (g/area 1)))
+			(define f2 (future (import "geo" :as g) (g/area 2)))
+			(import "unit")`,
+	})
+	defer os.RemoveAll(dir)
+	for i := 0; i < 10; i++ {
+		env := (&Evaluator{stdlibEnv: newEmptyEnv()}).NewEnv()
+		env.SetDir(dir)
+		got := Eval(env, parser.ParseString(`(let () (import "spawn") [(await f1) (await f2) unit])`))
+		assert.Equal(t, "[3, 12, 1]", got.Inspect())
+	}
+}
+
+func TestModulesState(t *testing.T) {
+	dir := writeModules(t, map[string]string{
+		"vars.lisp": "(defvar *mode* :plain)",
+		"mode.lisp": `(import "vars") (define mode *mode*)`,
+		"spin.lisp": "(define n 0) (dotimes (i 100) (set! n (+ n 1)))",
+	})
+	defer os.RemoveAll(dir)
+	env := (&Evaluator{stdlibEnv: newEmptyEnv()}).NewEnv()
+	env.SetDir(dir)
+	// the module doesn't see the dynamic bindings of the importer
+	got := Eval(env, parser.ParseString(`(let ()
+	  (import "vars")
+	  (binding ((*mode* :fancy)) (import "mode") [*mode* mode]))`))
+	assert.Equal(t, "[:fancy, :plain]", got.Inspect())
+	// the loading counts against the limits of the importer only
+	got = EvalWith(env, parser.ParseString(`(import "spin")`),
+		EvalOptions{MaxSteps: 50, Capabilities: ModuleAccess})
+	assert.Contains(t, got.Inspect(), "step limit exceeded")
+	got = EvalWith(env, parser.ParseString(`(let () (import "spin") n)`),
+		EvalOptions{MaxSteps: 1000, Capabilities: ModuleAccess})
+	assert.Equal(t, "100", got.Inspect())
+}
+
+func TestEvalFileShared(t *testing.T) {
+	dir := writeModules(t, map[string]string{
+		"geo.lisp":      "(fn area (r) (* 3 r r))",
+		"sub/main.lisp": `(import "../geo")`,
+	})
+	defer os.RemoveAll(dir)
+	env := (&Evaluator{stdlibEnv: newEmptyEnv()}).NewEnv()
+	env.SetDir(dir)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				assert.NoError(t, EvalFile(env, filepath.Join(dir, "sub", "main.lisp")))
+				Eval(env, parser.ParseString(`(import "geo")`))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, "12", Eval(env, parser.ParseString("(area 2)")).Inspect())
+}
+
+func TestModulePath(t *testing.T) {
+	dir := writeModules(t, map[string]string{
+		"path/util.lisp": "(module util (export twice)) (fn twice (x) (* 2 x))",
+	})
+	defer os.RemoveAll(dir)
+	os.Setenv("WELP_PATH", filepath.Join(dir, "nope")+string(filepath.ListSeparator)+
+		filepath.Join(dir, "path"))
+	defer os.Unsetenv("WELP_PATH")
+	env := (&Evaluator{stdlibEnv: newEmptyEnv()}).NewEnv()
+	got := Eval(env, parser.ParseString(`(let () (import "util" :as u) (u/twice 4))`))
+	assert.Equal(t, "8", got.Inspect())
+}
+
+func TestCompiledModule(t *testing.T) {
+	dir := writeModules(t, nil)
+	defer os.RemoveAll(dir)
+	bc, err := compiler.New().Compile(
+		parser.ParseString("(module m (export f))"),
+		parser.ParseString("(fn helper (x) (+ x 1))"),
+		parser.ParseString("(fn f (x) (helper (helper x)))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := compiler.WriteFile(filepath.Join(dir, "m.welpc"), bc); err != nil {
+		t.Fatal(err)
+	}
+	env := (&Evaluator{stdlibEnv: newEmptyEnv()}).NewEnv()
+	env.SetDir(dir)
+	got := Eval(env, parser.ParseString(`(let () (import "m" :as m) [(m/f 1) m/helper])`))
+	assert.Equal(t, `ERR: no such symbol "m/helper"`, got.Inspect())
+	got = Eval(env, parser.ParseString(`(let () (import "m" :as m) (m/f 1))`))
+	assert.Equal(t, "3", got.Inspect())
+}
@@ -0,0 +1,270 @@
+package evaluator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rtfb/welp/lexer"
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+)
+
+// paramSpec is a parsed parameter list of a func, lambda or macro, e.g.
+// (a [b c] &optional (d 1) &rest more &key (sep ", ")).
+type paramSpec struct {
+	required []param
+	optional []param
+	rest     *param
+	keys     []param
+}
+
+// param is a single parameter. Except for &key parameters, it can be a
+// destructuring pattern, in which case name is empty. init is the default
+// value expression of an &optional or &key parameter, nil if no default was
+// given.
+type param struct {
+	name    string
+	pattern *parser.Node
+	init    *parser.Node
+}
+
+// parseParams parses the parameter list of the func called name.
+func parseParams(name string, params *parser.Node) (*paramSpec, error) {
+	if params == nil || params.Tok.Typ != lexer.TokVoid {
+		return nil, fmt.Errorf("%s: expected a parameter list", name)
+	}
+	spec := &paramSpec{}
+	section := ""
+	for cell := params; cell.L != nil; cell = cell.R {
+		node := cell.L
+		if node.Tok.Typ == lexer.TokIdentifier && strings.HasPrefix(string(node.Tok.Value), "&") {
+			marker := string(node.Tok.Value)
+			switch {
+			case marker != "&optional" && marker != "&rest" && marker != "&key":
+				return nil, fmt.Errorf("%s: unknown parameter marker %s", name, marker)
+			case marker == "&optional" && section != "":
+				return nil, fmt.Errorf("%s: &optional must precede &rest and &key", name)
+			case marker == "&rest" && (section == "&rest" || section == "&key"):
+				return nil, fmt.Errorf("%s: &rest must precede &key", name)
+			case marker == "&key" && section == "&key":
+				return nil, fmt.Errorf("%s: duplicate &key", name)
+			}
+			section = marker
+			continue
+		}
+		p, err := parseParam(name, node, section)
+		if err != nil {
+			return nil, err
+		}
+		switch section {
+		case "":
+			spec.required = append(spec.required, p)
+		case "&optional":
+			spec.optional = append(spec.optional, p)
+		case "&rest":
+			if spec.rest != nil {
+				return nil, fmt.Errorf("%s: only one &rest parameter is allowed", name)
+			}
+			spec.rest = &p
+		case "&key":
+			spec.keys = append(spec.keys, p)
+		}
+	}
+	if section == "&rest" && spec.rest == nil {
+		return nil, fmt.Errorf("%s: &rest requires a parameter name", name)
+	}
+	return spec, nil
+}
+
+// parseParam parses a single parameter, which is either a pattern (see
+// bindPattern), or a (pattern default) pair in the &optional and &key
+// sections. &key parameters can't be destructured, as their names are the
+// keywords.
+func parseParam(name string, node *parser.Node, section string) (param, error) {
+	p := param{pattern: node}
+	if node.Tok.Typ == lexer.TokVoid && node.L != nil &&
+		(section == "&optional" || section == "&key") {
+		p.pattern = node.L
+		if node.R != nil && node.R.L != nil {
+			p.init = node.R
+		}
+	}
+	if p.pattern.Tok.Typ == lexer.TokIdentifier {
+		p.name = string(p.pattern.Tok.Value)
+	} else if section == "&key" || !isPattern(p.pattern) {
+		return param{}, fmt.Errorf("%s: malformed parameter %s", name, node)
+	}
+	return p, nil
+}
+
+// arity describes the number of arguments accepted, for error messages.
+func (s *paramSpec) arity() string {
+	min := len(s.required)
+	switch {
+	case s.rest != nil || len(s.keys) > 0:
+		return fmt.Sprintf("at least %d", min)
+	case len(s.optional) > 0:
+		return fmt.Sprintf("%d to %d", min, min+len(s.optional))
+	default:
+		return fmt.Sprintf("%d", min)
+	}
+}
+
+// binding tells where a parameter gets its value from in a particular call.
+type binding struct {
+	param
+	arg  int  // index of the argument, or -1 to use the default
+	rest bool // if set, the param collects all the args from arg on
+}
+
+// bindings matches nargs arguments of a call to the func called name against
+// the parameters, checking the arity. keyword reports whether the i-th
+// argument is a keyword, and its name. pos is the position of the call, for
+// error reporting. The bindings are returned in the order of declaration, so
+// that defaults can refer to the preceding parameters.
+func (s *paramSpec) bindings(name string, pos int, nargs int,
+	keyword func(i int) (string, bool)) ([]binding, error) {
+	positional := len(s.required) + len(s.optional)
+	if nargs < len(s.required) ||
+		(nargs > positional && s.rest == nil && len(s.keys) == 0) {
+		return nil, fmt.Errorf("%s: wrong number of args at position %d: expected %s, got %d",
+			name, pos, s.arity(), nargs)
+	}
+	var result []binding
+	for i, p := range s.required {
+		result = append(result, binding{param: p, arg: i})
+	}
+	for i, p := range s.optional {
+		b := binding{param: p, arg: len(s.required) + i}
+		if b.arg >= nargs {
+			b.arg = -1
+		}
+		result = append(result, b)
+	}
+	if s.rest != nil {
+		result = append(result, binding{param: *s.rest, arg: positional, rest: true})
+	}
+	if len(s.keys) == 0 {
+		return result, nil
+	}
+	if nargs > positional && (nargs-positional)%2 != 0 {
+		return nil, fmt.Errorf("%s: odd number of keyword args at position %d", name, pos)
+	}
+	given := make(map[string]int)
+	for i := positional; i < nargs; i += 2 {
+		key, ok := keyword(i)
+		if !ok || !s.hasKey(key) {
+			return nil, fmt.Errorf("%s: unexpected keyword arg at position %d", name, pos)
+		}
+		given[key] = i + 1
+	}
+	for _, p := range s.keys {
+		b := binding{param: p, arg: -1}
+		if i, ok := given[p.name]; ok {
+			b.arg = i
+		}
+		result = append(result, b)
+	}
+	return result, nil
+}
+
+// all lists all the parameters.
+func (s *paramSpec) all() []param {
+	var params []param
+	params = append(params, s.required...)
+	params = append(params, s.optional...)
+	if s.rest != nil {
+		params = append(params, *s.rest)
+	}
+	return append(params, s.keys...)
+}
+
+func (s *paramSpec) hasKey(key string) bool {
+	for _, p := range s.keys {
+		if p.name == key {
+			return true
+		}
+	}
+	return false
+}
+
+// bindValues binds evaluated args to the parameters of a func in frame.
+// Defaults are evaluated in frame, so they can refer to the preceding
+// parameters.
+func bindValues(frame *Environ, f *callable, pos int, args []object.Object) object.Object {
+	bs, err := f.spec.bindings(f.name, pos, len(args), func(i int) (string, bool) {
+		kw, ok := args[i].(*object.Keyword)
+		if !ok {
+			return "", false
+		}
+		return kw.Name, true
+	})
+	if err != nil {
+		return &object.Error{Err: err}
+	}
+	for _, b := range bs {
+		var value object.Object
+		switch {
+		case b.rest:
+			var rest []object.Object
+			if b.arg < len(args) {
+				rest = append(rest, args[b.arg:]...)
+			}
+			value = object.NewArray(rest)
+		case b.arg >= 0:
+			value = args[b.arg]
+		case b.init != nil:
+			value = evalArg(frame, b.init)
+			if isAbrupt(value) {
+				return value
+			}
+		default:
+			value = &object.Null{}
+		}
+		if err := bindPattern(frame, b.pattern, value); err != nil {
+			if err, ok := err.(*object.Error); ok {
+				return &object.Error{Err: fmt.Errorf("%s: %v", f.name, err.Err)}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// (lambda (a b) (+ a b)) => <func lambda>
+// ((lambda (a b) (+ a b)) 1 2) => 3
+func lambda(env *Environ, expr *parser.Node) object.Object {
+	f, err := newUserFunc(env, "lambda", expr)
+	if err != nil {
+		return err
+	}
+	return &object.Func{Name: f.name, Impl: f}
+}
+
+// newUserFunc creates a callable out of a parameter list followed by a body.
+func newUserFunc(env *Environ, name string, expr *parser.Node) (*callable, object.Object) {
+	if expr == nil || expr.L == nil {
+		return nil, &object.Error{Err: fmt.Errorf("%s: expected a parameter list", name)}
+	}
+	spec, err := parseParams(name, expr.L)
+	if err != nil {
+		return nil, &object.Error{Err: err}
+	}
+	return &callable{
+		name: name,
+		spec: spec,
+		body: expr.R,
+		env:  env,
+	}, nil
+}
+
+// callPos returns the position of a call for error reporting.
+func callPos(call *parser.Node) int {
+	for call != nil && call.Tok.Typ == lexer.TokVoid && call.L != nil {
+		call = call.L
+	}
+	if call == nil {
+		return 0
+	}
+	return call.Tok.Pos
+}
@@ -0,0 +1,77 @@
+package evaluator
+
+import (
+	"testing"
+
+	"github.com/rtfb/welp/object"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParams(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"(fn add (a b) (+ a b)) (add 1 2)", "3"},
+		{"((lambda (a b) (+ a b)) 1 2)", "3"},
+		{"(define add (lambda (a b) (+ a b))) (add 3 4)", "7"},
+		{"(fn f (a &optional (b 10) c) (append (mk-array) a b)) (f 1)", "[1, 10]"},
+		{"(fn f (a &optional (b 10) c) c) (f 1 2)", "null"},
+		{"(fn f (a &optional (b (+ a 1))) b) (f 1)", "2"},
+		{"(fn f (a &optional (b 10)) b) (f 1 2)", "2"},
+		{"(fn f (a &rest more) more) (f 1 2 3)", "[2, 3]"},
+		{"(fn f (a &rest more) more) (f 1)", "[]"},
+		{"(fn f (a &key (b 2) (c 3)) (+ a b c)) (f 1 :c 30)", "33"},
+		{"(fn f (&key b) b) (f)", "null"},
+		{"(fn f (&rest all &key b) all) (f :b 1)", "[:b, 1]"},
+		{"(fn twice (f x) (f (f x))) (twice (lambda (x) (* x 2)) 3)", "12"},
+		{"(fn inc (x) (+ x 1)) (define g inc) (g 1)", "2"},
+		{"(define add-n nil) (let ((n 10)) (set! add-n (lambda (x) (+ x n)))) (add-n 1)", "11"},
+		{`(defmacro unless (c &rest body) (cond (c nil) (t (let () body))))
+		  (define x 0)
+		  (unless (eq 1 2) (set! x 1) (set! x (+ x 1)))
+		  x`, "2"},
+		{`(defmacro swap! (a b) (let ((tmp a)) (set! a b) (set! b tmp)))
+		  (define x 1) (define y 2)
+		  (swap! x y)
+		  (append (mk-array) x y)`, "[2, 1]"},
+		{`(defmacro with-default (&optional (v 5)) (+ v 1)) (with-default)`, "6"},
+		{`(defmacro kw (&key (a 1) (b 2)) (- a b)) (kw :b 10)`, "-9"},
+	}
+	for _, test := range tests {
+		env := testEvaluator.NewEnv()
+		got := evalAll(env, test.input)
+		assert.Equal(t, test.expected, got.Inspect(), "eval(%q)", test.input)
+	}
+}
+
+func TestParamErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"(fn add (a b) (+ a b)) (add 1)",
+			"ERR: add: wrong number of args at position 32: expected 2, got 1"},
+		{"(fn add (a b) (+ a b)) (add 1 2 3)",
+			"ERR: add: wrong number of args at position 32: expected 2, got 3"},
+		{"(fn f (a &optional b) a) (f)",
+			"ERR: f: wrong number of args at position 34: expected 1 to 2, got 0"},
+		{"((lambda (a &rest b) a))",
+			"ERR: lambda: wrong number of args at position 10: expected at least 1, got 0"},
+		{"(fn f (&key a) a) (f :b 1)",
+			"ERR: f: unexpected keyword arg at position 27"},
+		{"(fn f (&key a) a) (f :a)",
+			"ERR: f: odd number of keyword args at position 27"},
+		{"(fn f (a &bogus) a)", "ERR: f: unknown parameter marker &bogus"},
+		{"(fn f (&rest) 1)", "ERR: f: &rest requires a parameter name"},
+		{"(fn f (&key a &optional b) 1)", "ERR: f: &optional must precede &rest and &key"},
+		{"(defmacro m (a) a) (m)",
+			"ERR: m: wrong number of args at position 28: expected 1, got 0"},
+	}
+	for _, test := range tests {
+		env := testEvaluator.NewEnv()
+		got := evalAll(env, test.input)
+		assert.IsType(t, &object.Error{}, got, "eval(%q)", test.input)
+		assert.Equal(t, test.expected, got.Inspect(), "eval(%q)", test.input)
+	}
+}
@@ -0,0 +1,263 @@
+package evaluator
+
+import (
+	"fmt"
+
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+)
+
+// maxRetries limits the number of times a dosync is retried.
+const maxRetries = 10000
+
+// (atom 0) => <atom 0>
+// makes an atom, which holds a value shared by goroutines, see swap!, reset!
+// and deref.
+func makeAtom(env *Environ, expr *parser.Node) object.Object {
+	args, err := evalArgsOf(env, "atom", expr, Arity{Min: 1, Max: 1})
+	if err != nil {
+		return err
+	}
+	return object.NewAtom(args[0])
+}
+
+// (ref 0) => <ref 0>
+// makes a ref, which holds a value changed by the transactions, see dosync.
+func makeRef(env *Environ, expr *parser.Node) object.Object {
+	args, err := evalArgsOf(env, "ref", expr, Arity{Min: 1, Max: 1})
+	if err != nil {
+		return err
+	}
+	return object.NewRef(args[0])
+}
+
+// (deref a) => 0
+// (deref f 100 :late) => :late
+// returns the value held by an atom or a ref. Inside a dosync, a ref has the
+// value set by the transaction, or the one it had when the transaction first
+// read it. For a future or a promise, it's like await, except that the value
+// following the timeout is returned if it runs out.
+func deref(env *Environ, expr *parser.Node) object.Object {
+	args, err := evalArgsOf(env, "deref", expr, Arity{Min: 1, Max: 3})
+	if err != nil {
+		return err
+	}
+	if a, ok := args[0].(object.Awaitable); ok {
+		return awaitValue(env, "deref", a, args[1:])
+	}
+	if len(args) > 1 {
+		return &object.Error{Err: fmt.Errorf("deref: only futures and promises take a timeout")}
+	}
+	if tx := env.transaction(); tx != nil {
+		if r, ok := args[0].(*object.Ref); ok {
+			return tx.Deref(r)
+		}
+	}
+	ref, ok := args[0].(object.Reference)
+	if !ok {
+		return &object.Error{Err: fmt.Errorf("deref: %s can't be dereferenced", args[0].Type())}
+	}
+	return ref.Deref()
+}
+
+// atomArg evaluates the args of the atom builtin called name, the first of
+// which is the atom.
+func atomArg(env *Environ, name string, expr *parser.Node, arity Arity) (*object.Atom, []object.Object, object.Object) {
+	args, err := evalArgsOf(env, name, expr, arity)
+	if err != nil {
+		return nil, nil, err
+	}
+	a, ok := args[0].(*object.Atom)
+	if !ok {
+		return nil, nil, typeError(name, object.AtomType, args[0])
+	}
+	return a, args[1:], nil
+}
+
+// (reset! a 1) => 1
+// sets the value of an atom.
+func reset(env *Environ, expr *parser.Node) object.Object {
+	a, args, err := atomArg(env, "reset!", expr, Arity{Min: 2, Max: 2})
+	if err != nil {
+		return err
+	}
+	if err := notify(env, a.Reset(args[0])); err != nil {
+		return err
+	}
+	return args[0]
+}
+
+// (swap! a + 1) => 1
+// sets the value of an atom to the value of (f value args...), returning the
+// new value. If another goroutine changes the atom in the meantime, f is
+// called again with the new value, so it should have no side effects.
+func swap(env *Environ, expr *parser.Node) object.Object {
+	a, args, err := atomArg(env, "swap!", expr, Arity{Min: 2, Max: Variadic})
+	if err != nil {
+		return err
+	}
+	f, ok := args[0].(*object.Func)
+	if !ok {
+		return typeError("swap!", object.FuncType, args[0])
+	}
+	for {
+		old := a.Deref()
+		value := applyFunc(env, funcCallable(f), callPos(expr), append([]object.Object{old},
+			args[1:]...))
+		if isAbrupt(value) {
+			return value
+		}
+		if change, ok := a.CompareAndSet(old, value); ok {
+			if err := notify(env, change); err != nil {
+				return err
+			}
+			return value
+		}
+	}
+}
+
+// (add-watch a :log (lambda (key ref old new) (print new))) => <atom 0>
+// makes the func get called after every change of an atom or a ref, by the
+// goroutine that changed it. Adding a watch with the same key replaces it.
+func addWatch(env *Environ, expr *parser.Node) object.Object {
+	args, err := evalArgsOf(env, "add-watch", expr, Arity{Min: 3, Max: 3})
+	if err != nil {
+		return err
+	}
+	ref, ok := args[0].(object.Reference)
+	if !ok {
+		return &object.Error{Err: fmt.Errorf("add-watch: %s can't be watched", args[0].Type())}
+	}
+	if _, ok := args[2].(*object.Func); !ok {
+		return typeError("add-watch", object.FuncType, args[2])
+	}
+	ref.AddWatch(args[1], args[2])
+	return ref
+}
+
+// (remove-watch a :log) => <atom 0>
+func removeWatch(env *Environ, expr *parser.Node) object.Object {
+	args, err := evalArgsOf(env, "remove-watch", expr, Arity{Min: 2, Max: 2})
+	if err != nil {
+		return err
+	}
+	ref, ok := args[0].(object.Reference)
+	if !ok {
+		return &object.Error{Err: fmt.Errorf("remove-watch: %s can't be watched", args[0].Type())}
+	}
+	ref.RemoveWatch(args[1])
+	return ref
+}
+
+// notify calls the watches of the changes, stopping at the first one that
+// fails.
+func notify(env *Environ, changes ...object.Change) object.Object {
+	for _, change := range changes {
+		for _, watch := range change.Watches {
+			f := funcCallable(watch.Fn.(*object.Func))
+			result := applyFunc(env, f, 0, []object.Object{watch.Key, change.Ref, change.Old,
+				change.New})
+			if isError(result) {
+				return result
+			}
+		}
+	}
+	return nil
+}
+
+// transaction returns the transaction the evaluation is in, or nil if it's
+// not in one.
+func (e *Environ) transaction() *object.Transaction {
+	if e.state == nil {
+		return nil
+	}
+	return e.state.tx
+}
+
+// (dosync (alter a - 10) (alter b + 10)) => 10
+// evaluates the body in a transaction: the refs set by the body change at
+// once when it's done, unless any of the refs the body has seen were changed
+// by another goroutine in the meantime, in which case the body is evaluated
+// again. The body should have no side effects other than setting the refs. A
+// dosync nested in another one is a part of the outer transaction. The
+// watches of the refs are called once the transaction commits. Only an error
+// rolls the transaction back: a break, a continue or a recur leaving the body
+// commits it first.
+func dosync(env *Environ, expr *parser.Node) object.Object {
+	if env.transaction() != nil {
+		return evalBody(env, expr)
+	}
+	for i := 0; i < maxRetries; i++ {
+		tx := object.NewTransaction()
+		scope := newEnclosedEnv(env)
+		scope.state = env.state.clone()
+		scope.state.tx = tx
+		result := evalBody(scope, expr)
+		if isError(result) {
+			// the body may have failed because it saw the refs
+			// change halfway
+			if tx.Valid() {
+				return result
+			}
+			continue
+		}
+		changes, ok := tx.Commit()
+		if !ok {
+			continue
+		}
+		if err := notify(env, changes...); err != nil {
+			return err
+		}
+		return result
+	}
+	return &object.Error{Err: fmt.Errorf("dosync: gave up after %d retries", maxRetries)}
+}
+
+// refArg evaluates the args of the ref builtin called name, the first of
+// which is the ref, and returns the transaction they're changed by.
+func refArg(env *Environ, name string, expr *parser.Node, arity Arity) (*object.Transaction, *object.Ref, []object.Object, object.Object) {
+	args, err := evalArgsOf(env, name, expr, arity)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r, ok := args[0].(*object.Ref)
+	if !ok {
+		return nil, nil, nil, typeError(name, object.RefType, args[0])
+	}
+	tx := env.transaction()
+	if tx == nil {
+		return nil, nil, nil, &object.Error{Err: fmt.Errorf("%s: no transaction, see dosync", name)}
+	}
+	return tx, r, args[1:], nil
+}
+
+// (ref-set r 1) => 1
+// sets the value of a ref, inside a dosync.
+func refSet(env *Environ, expr *parser.Node) object.Object {
+	tx, r, args, err := refArg(env, "ref-set", expr, Arity{Min: 2, Max: 2})
+	if err != nil {
+		return err
+	}
+	tx.Set(r, args[0])
+	return args[0]
+}
+
+// (alter r + 1) => 1
+// sets the value of a ref to the value of (f value args...), inside a dosync.
+func alter(env *Environ, expr *parser.Node) object.Object {
+	tx, r, args, err := refArg(env, "alter", expr, Arity{Min: 2, Max: Variadic})
+	if err != nil {
+		return err
+	}
+	f, ok := args[0].(*object.Func)
+	if !ok {
+		return typeError("alter", object.FuncType, args[0])
+	}
+	value := applyFunc(env, funcCallable(f), callPos(expr), append([]object.Object{tx.Deref(r)},
+		args[1:]...))
+	if isAbrupt(value) {
+		return value
+	}
+	tx.Set(r, value)
+	return value
+}
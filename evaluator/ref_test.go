@@ -0,0 +1,81 @@
+package evaluator
+
+import (
+	"testing"
+
+	"github.com/rtfb/welp/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefs(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"(atom 1)", "<atom 1>"},
+		{"(let ((a (atom 1))) (swap! a + 2 3) (deref a))", "6"},
+		{"(let ((a (atom 1))) [(reset! a 5) (deref a)])", "[5, 5]"},
+		{`(let ((a (atom 0)) (wg (wait-group)))
+			(dotimes (i 100)
+				(wg-add wg)
+				(spawn (lambda () (swap! a + 1) (wg-done wg))))
+			(wg-wait wg)
+			(deref a))`, "100"},
+		{`(let ((a (atom 0)) (log (mk-array)))
+			(add-watch a :log (lambda (key ref old new) (append log [key old new])))
+			(swap! a + 1)
+			(reset! a 10)
+			(remove-watch a :log)
+			(reset! a 20)
+			log)`, "[[:log, 0, 1], [:log, 1, 10]]"},
+		{`(let ((a (atom 0)))
+			(add-watch a :fail (lambda (key ref old new) (nope)))
+			(swap! a + 1))`, `ERR: no such symbol "nope"`},
+		{`(let ((from (ref 100)) (to (ref 0)))
+			(dosync (alter from - 10) (alter to + 10))
+			[(deref from) (deref to)])`, "[90, 10]"},
+		{`(let ((r (ref 1)))
+			(dosync (ref-set r 2) (deref r)))`, "2"},
+		{`(let ((r (ref 1)))
+			(dosync (ref-set r 2) (dosync (alter r * 10)))
+			(deref r))`, "20"},
+		{`(let ((r (ref 1)))
+			(dosync (ref-set r 2) (nope))
+			(deref r))`, `ERR: no such symbol "nope"`},
+		{`(let* ((a (ref 100)) (b (ref 100)) (c (ref 100)) (wg (wait-group))
+			    (transfer (lambda (from to)
+			     (dosync (alter from - 1) (alter to + 1))
+			     (wg-done wg))))
+			(dotimes (i 30)
+				(wg-add wg 3)
+				(spawn transfer a b)
+				(spawn transfer b c)
+				(spawn transfer c a))
+			(wg-wait wg)
+			(dosync [(deref a) (deref b) (deref c)]))`, "[100, 100, 100]"},
+		// a break, a continue or a recur commits the transaction
+		{`(let ((r (ref 0)))
+			(while t (dosync (alter r + 1) (break)))
+			(deref r))`, "1"},
+		{`(let ((r (ref 0)))
+			(while t (dosync (alter r + 1) (break (* 10 (deref r))))))`, "10"},
+		{`(let ((r (ref 0)))
+			(while (< (deref r) 3) (dosync (alter r + 1) (continue)))
+			(deref r))`, "3"},
+		{`(let ((r (ref 0)))
+			(loop ((i 0))
+				(cond ((eq i 4) (deref r)) (t (dosync (alter r + i) (recur (+ i 1)))))))`, "6"},
+		{"(ref-set (ref 1) 2)", "ERR: ref-set: no transaction, see dosync"},
+		{"(alter (ref 1) + 1)", "ERR: alter: no transaction, see dosync"},
+		{"(dosync (recv (spawn (lambda () (ref-set (ref 1) 2)))))", "ERR: ref-set: no transaction, see dosync"},
+		{"(deref 1)", "ERR: deref: INTEGER can't be dereferenced"},
+		{"(swap! (ref 1) + 1)", "ERR: swap!: expected ATOM, got REF"},
+		{"(swap! (atom 1) 1)", "ERR: swap!: expected FUNCTION, got INTEGER"},
+		{"(add-watch 1 :k (lambda () 1))", "ERR: add-watch: INTEGER can't be watched"},
+	}
+	for _, test := range tests {
+		env := testEvaluator.NewEnv()
+		got := Eval(env, parser.ParseString(test.input))
+		assert.Equal(t, test.expected, got.Inspect(), "eval(%q)", test.input)
+	}
+}
@@ -0,0 +1,304 @@
+package evaluator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+)
+
+// These are returned, wrapped into an *object.Error, when an evaluation runs
+// out of its budget, or gets canceled. ErrCanceled is matched by the
+// *CanceledError of every canceled evaluation.
+var (
+	ErrStepLimit  = errors.New("step limit exceeded")
+	ErrAllocLimit = errors.New("allocation limit exceeded")
+	ErrCanceled   = errors.New("evaluation canceled")
+)
+
+// CanceledError is returned when the context of an evaluation is done. It
+// wraps the error of the context, so errors.Is tells both ErrCanceled and
+// e.g. context.DeadlineExceeded from it.
+type CanceledError struct {
+	Err error
+}
+
+func (e *CanceledError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrCanceled, e.Err)
+}
+
+// Unwrap returns the error of the context.
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+// Is tells if target is ErrCanceled.
+func (e *CanceledError) Is(target error) bool {
+	return target == ErrCanceled
+}
+
+// Capability grants access to a group of builtins that reach outside of the
+// evaluator. Eval and EvalContext only grant DefaultCapabilities, the others
+// have to be granted by EvalWith.
+type Capability uint
+
+const (
+	// ModuleAccess grants import.
+	ModuleAccess Capability = 1 << iota
+
+	// FileAccess grants read-file and write-file.
+	FileAccess
+
+	// NetworkAccess grants http-get.
+	NetworkAccess
+
+	// ProcessAccess grants getenv and exec.
+	ProcessAccess
+
+	// DefaultCapabilities are the ones granted by Eval.
+	DefaultCapabilities = ModuleAccess
+
+	// AllCapabilities grants everything.
+	AllCapabilities = ModuleAccess | FileAccess | NetworkAccess | ProcessAccess
+)
+
+// EvalOptions limit an evaluation done by EvalWith. The zero value sets no
+// limits, but grants no capabilities either.
+type EvalOptions struct {
+	// Context stops the evaluation when it's done.
+	Context context.Context
+
+	// MaxSteps limits the number of expressions evaluated, if it's set.
+	MaxSteps int64
+
+	// MaxAlloc limits the number of values allocated, if it's set. The
+	// array and map literals, and the values returned by the funcs count
+	// one per element, the strings returned by the funcs one per byte, and
+	// the arrays the funcs grow in place count the added elements.
+	MaxAlloc int64
+
+	// Capabilities lists the builtins that exist. The code can't tell the
+	// builtins it lacks from the undefined funcs.
+	Capabilities Capability
+}
+
+// evalState is the part of an evaluation that follows the calls rather than
+// the scopes: the frame of a func gets it from the caller, no matter where the
+// func was defined. It's nil while the evaluation doesn't need any of it.
+type evalState struct {
+	// limits is set for the evaluations done by EvalWith
+	limits *limits
+
+	// tx is set inside a dosync
+	tx *object.Transaction
+
+	// prompt is set inside the body of a reset
+	prompt *prompt
+
+	// gen is set inside the body of a generator
+	gen *prompt
+
+	// dyn is the innermost of the bindings of the dynamic variables
+	dyn *dynamicBinding
+
+	// handler and restart are the innermost of the handlers and the
+	// restarts established by handler-bind and restart-case
+	handler *handler
+	restart *restart
+
+	// loading is set while the modules are loaded, see importModule
+	loading *loadingLock
+}
+
+// clone returns a copy of the state, to be changed for a part of the
+// evaluation.
+func (s *evalState) clone() *evalState {
+	if s == nil {
+		return &evalState{}
+	}
+	c := *s
+	return &c
+}
+
+// limits tracks what a limited evaluation has used up. It's shared by all the
+// frames of the evaluation, including the frames of the funcs defined before
+// it, and by the goroutines the evaluation spawns.
+type limits struct {
+	steps int64 // accessed atomically
+	alloc int64 // accessed atomically
+
+	ctx  context.Context
+	done <-chan struct{}
+	opts EvalOptions
+
+	err atomic.Value // holds the *object.Error set once a limit is hit
+}
+
+func newLimits(opts EvalOptions) *limits {
+	l := &limits{ctx: opts.Context, opts: opts}
+	if l.ctx == nil {
+		l.ctx = context.Background()
+	}
+	l.done = l.ctx.Done()
+	return l
+}
+
+// EvalWith evaluates expr in env like Eval does, but within the limits set
+// by opts. The funcs called by expr are subject to the limits too, no matter
+// when they were defined, and so is the code of the compiled modules. The funcs
+// passed to the funcs registered with RegisterFunc stay subject to the limits
+// when they're called back, but the funcs called by Go otherwise, e.g. the
+// ones found by Lookup, aren't. The evaluations sharing env are limited
+// independently of each other.
+func EvalWith(env *Environ, expr *parser.Node, opts EvalOptions) object.Object {
+	state := env.state.clone()
+	state.limits = newLimits(opts)
+	return Eval(newStateFrame(env, state), expr)
+}
+
+// step counts an evaluation step, failing if the evaluation is out of steps
+// or its context is done. The steps are counted for every expression
+// evaluated, which includes every func call and every loop iteration.
+func (l *limits) step() *object.Error {
+	if err := l.failed(); err != nil {
+		return err
+	}
+	steps := atomic.AddInt64(&l.steps, 1)
+	switch {
+	case l.opts.MaxSteps > 0 && steps > l.opts.MaxSteps:
+		return l.fail(ErrStepLimit)
+	default:
+		select {
+		case <-l.done:
+			return l.fail(&CanceledError{Err: l.ctx.Err()})
+		default:
+		}
+	}
+	return nil
+}
+
+// charge counts n allocated values.
+func (l *limits) charge(n int64) *object.Error {
+	if err := l.failed(); err != nil {
+		return err
+	}
+	if alloc := atomic.AddInt64(&l.alloc, n); l.opts.MaxAlloc > 0 && alloc > l.opts.MaxAlloc {
+		return l.fail(ErrAllocLimit)
+	}
+	return nil
+}
+
+// fail stops the evaluation with err.
+func (l *limits) fail(err error) *object.Error {
+	errObj := &object.Error{Err: err}
+	l.err.Store(errObj)
+	return errObj
+}
+
+// failed returns the error that stopped the evaluation, if it's stopped.
+func (l *limits) failed() *object.Error {
+	err, _ := l.err.Load().(*object.Error)
+	return err
+}
+
+// allows tells if the builtins needing c exist.
+func (s *evalState) allows(c Capability) bool {
+	granted := DefaultCapabilities
+	if s.limited() {
+		granted = s.limits.opts.Capabilities
+	}
+	return granted&c == c
+}
+
+// limited tells if the evaluation is limited by EvalWith.
+func (s *evalState) limited() bool {
+	return s != nil && s.limits != nil
+}
+
+// EvalContext evaluates expr in env like Eval does, but stops once ctx is
+// done, returning a *CanceledError wrapped into an *object.Error.
+func EvalContext(ctx context.Context, env *Environ, expr *parser.Node) object.Object {
+	return EvalWith(env, expr, EvalOptions{Context: ctx, Capabilities: DefaultCapabilities})
+}
+
+// context returns the context of the evaluation.
+func (e *Environ) context() context.Context {
+	if !e.state.limited() {
+		return context.Background()
+	}
+	return e.state.limits.ctx
+}
+
+// step counts an evaluation step, see limits.step.
+func (e *Environ) step() object.Object {
+	if !e.state.limited() {
+		return nil
+	}
+	if err := e.state.limits.step(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// charge counts n allocated values, see limits.charge.
+func (e *Environ) charge(n int64) object.Object {
+	if !e.state.limited() || n == 0 {
+		return nil
+	}
+	if err := e.state.limits.charge(n); err != nil {
+		return err
+	}
+	return nil
+}
+
+// meter counts the work done by a vm against the limits, see vm.Meter.
+type meter struct {
+	l *limits
+}
+
+// Step implements vm.Meter.
+func (m meter) Step() error {
+	if err := m.l.step(); err != nil {
+		return err.Err
+	}
+	return nil
+}
+
+// Charge implements vm.Meter.
+func (m meter) Charge(n int64) error {
+	if err := m.l.charge(n); err != nil {
+		return err.Err
+	}
+	return nil
+}
+
+// boundFunc is the Impl of the funcs handed to the funcs registered from Go by
+// a limited evaluation, which keeps them within its limits when they're called
+// back from Go.
+type boundFunc struct {
+	f     *callable
+	state *evalState
+}
+
+// Apply implements object.Applicable.
+func (b *boundFunc) Apply(args []object.Object) object.Object {
+	return b.f.apply(args, b.state)
+}
+
+// bindFuncs returns the args with the user-defined funcs among them bound to
+// state.
+func bindFuncs(args []object.Object, state *evalState) []object.Object {
+	bound := make([]object.Object, len(args))
+	for i, arg := range args {
+		bound[i] = arg
+		if fn, ok := arg.(*object.Func); ok {
+			if f, ok := fn.Impl.(*callable); ok && !f.builtin && !f.macro {
+				bound[i] = &object.Func{Name: fn.Name, Impl: &boundFunc{f: f, state: state}}
+			}
+		}
+	}
+	return bound
+}
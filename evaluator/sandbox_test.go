@@ -0,0 +1,216 @@
+package evaluator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rtfb/welp/compiler"
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvalWithLimits(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	tests := []struct {
+		input    string
+		opts     EvalOptions
+		expected error
+	}{
+		{"(while t 1)", EvalOptions{MaxSteps: 1000}, ErrStepLimit},
+		{"(spin)", EvalOptions{MaxSteps: 1000}, ErrStepLimit},
+		{"(fib 30)", EvalOptions{MaxSteps: 1000}, ErrStepLimit},
+		{"(cond ((spin) 1) (t 2))", EvalOptions{MaxSteps: 1000}, ErrStepLimit},
+		{"(while t 1)", EvalOptions{Context: ctx}, context.DeadlineExceeded},
+		{"(let ((a (mk-array))) (while t (append a 1 2)))", EvalOptions{MaxAlloc: 100}, ErrAllocLimit},
+		{"(dotimes (i 100) [1 2 3 4 5])", EvalOptions{MaxAlloc: 100}, ErrAllocLimit},
+		{"(dotimes (i 100) {:a i})", EvalOptions{MaxAlloc: 50}, ErrAllocLimit},
+		{"(len (seq (generator (while t (yield 1)))))", EvalOptions{MaxAlloc: 100}, ErrAllocLimit},
+		{"(len (take 1000 (generator (while t (yield 1)))))", EvalOptions{MaxAlloc: 100}, ErrAllocLimit},
+	}
+	env := testEvaluator.NewEnv()
+	Eval(env, parser.ParseString("(fn spin () (while t 1))"))
+	Eval(env, parser.ParseString(`(fn fib (n)
+		(cond ((< n 2) n)
+		      (t (+ (fib (- n 1)) (fib (- n 2))))))`))
+	for _, test := range tests {
+		got := EvalWith(env, parser.ParseString(test.input), test.opts)
+		if assert.IsType(t, &object.Error{}, got, test.input) {
+			assert.True(t, errors.Is(got.(*object.Error).Err, test.expected),
+				"%s: %s", test.input, got.Inspect())
+		}
+	}
+	opts := EvalOptions{MaxSteps: 1000, MaxAlloc: 10}
+	got := EvalWith(env, parser.ParseString("(fib 5)"), opts)
+	assert.Equal(t, "5", got.Inspect())
+	got = EvalWith(env, parser.ParseString("(let ((a [1 2 3])) (append a 4 5) a)"), opts)
+	assert.Equal(t, "[1, 2, 3, 4, 5]", got.Inspect())
+	// the limits don't outlive EvalWith
+	got = Eval(env, parser.ParseString("(fib 15)"))
+	assert.Equal(t, "610", got.Inspect())
+}
+
+func TestEvalWithCapabilities(t *testing.T) {
+	dir, err := ioutil.TempDir("", "welp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "notes.txt")
+	os.Setenv("WELP_TEST_VAR", "welp")
+	defer os.Unsetenv("WELP_TEST_VAR")
+	tests := []struct {
+		input    string
+		caps     Capability
+		expected string
+	}{
+		{`(write-file "` + name + `" "hi")`, FileAccess, "null"},
+		{`(read-file "` + name + `")`, FileAccess, `"hi"`},
+		{`(read-file "` + name + `")`, ProcessAccess, `ERR: no such symbol "read-file"`},
+		{`(import "` + name + `")`, 0, `ERR: no such symbol "import"`},
+		{`(import "` + name + `")`, FileAccess, `ERR: no such symbol "import"`},
+		{`(getenv "WELP_TEST_VAR")`, ProcessAccess, `"welp"`},
+		{`(getenv "WELP_TEST_NOPE")`, AllCapabilities, "null"},
+		{`(getenv "WELP_TEST_VAR")`, FileAccess | NetworkAccess, `ERR: no such symbol "getenv"`},
+		{`(exec "echo" "hi")`, ProcessAccess, `"hi\n"`},
+		{`(http-get "http://localhost")`, ProcessAccess, `ERR: no such symbol "http-get"`},
+		{`(let ((f read)) (f "x"))`, 0, `ERR: read-file isn't allowed here`},
+	}
+	env := testEvaluator.NewEnv()
+	EvalWith(env, parser.ParseString("(define read read-file)"), EvalOptions{Capabilities: FileAccess})
+	for _, test := range tests {
+		got := EvalWith(env, parser.ParseString(test.input), EvalOptions{Capabilities: test.caps})
+		assert.Equal(t, test.expected, got.Inspect(), test.input)
+	}
+	// none of them is granted unless it's asked for
+	got := Eval(env, parser.ParseString(`(read-file "`+name+`")`))
+	assert.Equal(t, `ERR: no such symbol "read-file"`, got.Inspect())
+	got = Eval(env, parser.ParseString(`(read "`+name+`")`))
+	assert.Equal(t, `ERR: read-file isn't allowed here`, got.Inspect())
+	got = EvalContext(context.Background(), env, parser.ParseString(`(exec "echo" "hi")`))
+	assert.Equal(t, `ERR: no such symbol "exec"`, got.Inspect())
+}
+
+func TestEvalWithCallbacks(t *testing.T) {
+	dir := writeModules(t, nil)
+	defer os.RemoveAll(dir)
+	for name, src := range map[string][]string{
+		"spin": {"(fn spin () (while t 1))", "(fn call-back (f) (f))"},
+		"hang": {"(while t 1)"},
+	} {
+		var exprs []*parser.Node
+		for _, s := range src {
+			exprs = append(exprs, parser.ParseString(s))
+		}
+		bc, err := compiler.New().Compile(exprs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := compiler.WriteFile(filepath.Join(dir, name+".welpc"), bc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	env := testEvaluator.NewEnv()
+	env.SetDir(dir)
+	env.RegisterFunc("call", Arity{Min: 1, Max: 1}, func(args ...object.Object) (object.Object, error) {
+		return CallFunc(args[0])
+	})
+	Eval(env, parser.ParseString(`(import "spin")`))
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`(call (lambda () (while t 1)))`, "ERR: step limit exceeded"},
+		{`(call (lambda () 42))`, "42"},
+		{`(spin)`, "ERR: step limit exceeded"},
+		{`(call-back (lambda () (while t 1)))`, "ERR: step limit exceeded"},
+		{`(call-back (lambda () 42))`, "42"},
+		{`(import "hang")`, "step limit exceeded"},
+	}
+	for _, test := range tests {
+		got := EvalWith(env, parser.ParseString(test.input),
+			EvalOptions{MaxSteps: 1000, Capabilities: ModuleAccess})
+		assert.Contains(t, got.Inspect(), test.expected, test.input)
+	}
+}
+
+func TestEvalWithShared(t *testing.T) {
+	env := testEvaluator.NewEnv()
+	Eval(env, parser.ParseString("(fn spin (n) (dotimes (i n) i) n)"))
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			input := fmt.Sprintf("(define v%d (spin %d))", i, 100*(i+1))
+			if i%2 == 0 {
+				// the limits of one evaluation don't apply to the others
+				got := EvalWith(env, parser.ParseString(input), EvalOptions{MaxSteps: 50})
+				assert.Equal(t, "ERR: step limit exceeded", got.Inspect(), input)
+				got = EvalWith(env, parser.ParseString(`(getenv "HOME")`), EvalOptions{})
+				assert.Equal(t, `ERR: no such symbol "getenv"`, got.Inspect())
+				return
+			}
+			got := EvalContext(context.Background(), env, parser.ParseString(input))
+			assert.Equal(t, fmt.Sprint(100*(i+1)), got.Inspect(), input)
+			got = EvalWith(env, parser.ParseString(`(getenv "WELP_NOPE")`),
+				EvalOptions{Capabilities: ProcessAccess})
+			assert.Equal(t, "null", got.Inspect())
+		}(i)
+	}
+	wg.Wait()
+	// the definitions are made in env
+	for i := 1; i < 20; i += 2 {
+		got := Eval(env, parser.ParseString(fmt.Sprintf("v%d", i)))
+		assert.Equal(t, fmt.Sprint(100*(i+1)), got.Inspect())
+	}
+}
+
+func TestEvalContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	env := testEvaluator.NewEnv()
+	env.RegisterFunc("cancel", Arity{}, func(args ...object.Object) (object.Object, error) {
+		cancel()
+		return nil, nil
+	})
+	got := EvalContext(ctx, env, parser.ParseString("(let ((i 0)) (while t (cancel) (set! i 1)))"))
+	if assert.IsType(t, &object.Error{}, got) {
+		err := got.(*object.Error).Err
+		assert.True(t, errors.Is(err, ErrCanceled))
+		assert.True(t, errors.Is(err, context.Canceled))
+		assert.Equal(t, "evaluation canceled: context canceled", err.Error())
+	}
+	got = EvalContext(context.Background(), env, parser.ParseString(`(getenv "HOME")`))
+	assert.Equal(t, `ERR: no such symbol "getenv"`, got.Inspect())
+}
+
+func TestEvalFileContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "welp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "spin.lisp")
+	src := "(define n 1)\n(while t (set! n (+ n 1)))\n(define after 1)\n"
+	if err := ioutil.WriteFile(name, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	env := testEvaluator.NewEnv()
+	err = EvalFileContext(ctx, env, name)
+	assert.True(t, errors.Is(err, ErrCanceled), "%v", err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+	n, _ := env.Lookup("n")
+	assert.True(t, n.(*object.Integer).Value > 1)
+	_, ok := env.Lookup("after")
+	assert.False(t, ok)
+}
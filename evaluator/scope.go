@@ -0,0 +1,143 @@
+package evaluator
+
+import (
+	"fmt"
+
+	"github.com/rtfb/welp/lexer"
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+)
+
+// (define x (+ 2 3)) => 5
+// x => 5
+// define binds a variable in the current scope, which is the global scope
+// when used at the top level.
+func define(env *Environ, expr *parser.Node) object.Object {
+	if expr.L == nil || expr.L.Tok.Typ != lexer.TokIdentifier {
+		return &object.Error{Err: fmt.Errorf("define expects an identifier")}
+	}
+	value := evalArg(env, expr.R)
+	if isAbrupt(value) {
+		return value
+	}
+	env.setVar(ident(expr), value)
+	return value
+}
+
+// (define x 1)
+// (set! x 2) => 2
+// x => 2
+// set! rebinds an existing variable in the innermost scope that has it.
+func set(env *Environ, expr *parser.Node) object.Object {
+	if expr.L == nil || expr.L.Tok.Typ != lexer.TokIdentifier {
+		return &object.Error{Err: fmt.Errorf("set! expects an identifier")}
+	}
+	value := evalArg(env, expr.R)
+	if isAbrupt(value) {
+		return value
+	}
+	name := ident(expr)
+	if !env.assign(name, value) {
+		return &object.Error{Err: fmt.Errorf("set!: unbound variable %q", name)}
+	}
+	return value
+}
+
+// (let ((x 1) (y 2)) (+ x y)) => 3
+// All the init expressions are evaluated in the enclosing scope, then the body
+// is evaluated in a new scope with all the bindings in place.
+func let(env *Environ, expr *parser.Node) object.Object {
+	scope := newEnclosedEnv(env)
+	err := forEachBinding("let", expr, func(pattern, init *parser.Node) object.Object {
+		return bindInit(env, scope, pattern, init)
+	})
+	if err != nil {
+		return err
+	}
+	return evalBody(scope, expr.R)
+}
+
+// (let* ((x 1) (y (+ x 1))) y) => 2
+// Like let, but each init expression sees the bindings that precede it.
+func letStar(env *Environ, expr *parser.Node) object.Object {
+	scope := newEnclosedEnv(env)
+	err := forEachBinding("let*", expr, func(pattern, init *parser.Node) object.Object {
+		return bindInit(scope, scope, pattern, init)
+	})
+	if err != nil {
+		return err
+	}
+	return evalBody(scope, expr.R)
+}
+
+// (letrec ((x 1) (y (+ x 1))) y) => 2
+// Like let*, but all the names are bound (to null) before any of the init
+// expressions are evaluated, so that they can refer to each other.
+func letrec(env *Environ, expr *parser.Node) object.Object {
+	scope := newEnclosedEnv(env)
+	err := forEachBinding("letrec", expr, func(pattern, init *parser.Node) object.Object {
+		for _, name := range patternNames(pattern) {
+			scope.setVar(name, &object.Null{})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = forEachBinding("letrec", expr, func(pattern, init *parser.Node) object.Object {
+		return bindInit(scope, scope, pattern, init)
+	})
+	if err != nil {
+		return err
+	}
+	return evalBody(scope, expr.R)
+}
+
+// forEachBinding walks the binding list of a let-like form, e.g.
+// ((x 1) ([y z] [2 3])), calling bind with each pattern and its init
+// expression. It stops at the first error, either a malformed binding or an
+// error returned by bind.
+func forEachBinding(form string, expr *parser.Node,
+	bind func(pattern, init *parser.Node) object.Object) object.Object {
+	if expr == nil || expr.L == nil || expr.L.Tok.Typ != lexer.TokVoid {
+		return &object.Error{Err: fmt.Errorf("%s expects a binding list", form)}
+	}
+	for cell := expr.L; cell.L != nil; cell = cell.R {
+		binding := cell.L
+		if binding.L == nil || !isPattern(binding.L) || binding.R == nil {
+			return &object.Error{Err: fmt.Errorf("%s: malformed binding", form)}
+		}
+		if err := bind(binding.L, binding.R); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindInit evaluates init in env and destructures the value into scope.
+func bindInit(env, scope *Environ, pattern, init *parser.Node) object.Object {
+	value := evalArg(env, init)
+	if isAbrupt(value) {
+		return value
+	}
+	return bindPattern(scope, pattern, value)
+}
+
+// evalBody evaluates a sequence of expressions and returns the value of the
+// last one. It stops early if any of the expressions yields an error or a
+// control flow signal.
+func evalBody(env *Environ, expr *parser.Node) object.Object {
+	var result object.Object = &object.Null{}
+	for ; expr != nil && expr.L != nil; expr = expr.R {
+		result = evalArg(env, expr)
+		if isAbrupt(result) {
+			return result
+		}
+	}
+	return result
+}
+
+func isError(obj object.Object) bool {
+	_, ok := obj.(*object.Error)
+	return ok
+}
@@ -1,33 +1,63 @@
 package evaluator
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/rtfb/welp/object"
 	"github.com/rtfb/welp/parser"
+	"github.com/rtfb/welp/stdlib"
 )
 
-func initStdlib() *Environ {
+// initStdlib evaluates the stdlib modules, read from dir if it isn't empty,
+// see stdlib.Parse.
+func initStdlib(dir string) (*Environ, error) {
 	bootstrapEnv := &Environ{
 		vars:  make(map[string]object.Object),
 		funcs: makeBuiltins(),
 	}
-	err := EvalFile(bootstrapEnv, "stdlib/stdlib.lisp")
+	exprs, err := stdlib.Parse(dir)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return bootstrapEnv
+	for _, expr := range exprs {
+		if err, ok := Eval(bootstrapEnv, expr).(*object.Error); ok {
+			return nil, fmt.Errorf("stdlib: %s: %v", expr, err.Err)
+		}
+	}
+	return bootstrapEnv, nil
 }
 
-// EvalFile reads a file and evaluates its entire content.
+// EvalFile reads a file and evaluates its entire content. The imports in the
+// file are resolved relative to it.
 func EvalFile(env *Environ, name string) error {
+	return EvalFileContext(context.Background(), env, name)
+}
+
+// EvalFileContext is like EvalFile, but it stops once ctx is done, returning
+// a *CanceledError. The errors raised by the expressions in the file don't
+// stop the evaluation.
+func EvalFileContext(ctx context.Context, env *Environ, name string) error {
 	f, err := os.Open(name)
 	if err != nil {
 		return err
 	}
-	ch := parser.ParseStream(f)
-	for expr := range ch {
-		Eval(env, expr)
+	defer f.Close()
+	defer env.SetDir(env.ownDir())
+	env.SetDir(filepath.Dir(name))
+	parseCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for expr := range parser.ParseStreamContext(parseCtx, f) {
+		result := EvalContext(ctx, env, expr)
+		if err, ok := result.(*object.Error); ok && errors.Is(err.Err, ErrCanceled) {
+			return err.Err
+		}
+	}
+	if ctx.Err() != nil {
+		return &CanceledError{Err: ctx.Err()}
 	}
 	return nil
 }
@@ -0,0 +1,147 @@
+package evaluator
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+)
+
+// systemBuiltins are the builtins that reach outside of the evaluator, which
+// only exist if the evaluation has the capabilities they need. None of them is
+// granted by default, see Capability.
+var systemBuiltins = map[string]*callable{
+	"read-file":  &callable{name: "read-file", f: readFile, builtin: true, needs: FileAccess},
+	"write-file": &callable{name: "write-file", f: writeFile, builtin: true, needs: FileAccess},
+	"http-get":   &callable{name: "http-get", f: httpGet, builtin: true, needs: NetworkAccess},
+	"getenv":     &callable{name: "getenv", f: getenv, builtin: true, needs: ProcessAccess},
+	"exec":       &callable{name: "exec", f: execCommand, builtin: true, needs: ProcessAccess},
+}
+
+// stringArgs evaluates the args of the builtin called name, which all have to
+// be strings. If n is negative, at least -n args are expected, otherwise
+// exactly n.
+func stringArgs(env *Environ, name string, list *parser.Node, n int) ([]string, object.Object) {
+	args, err := evalArgs(env, list)
+	if err != nil {
+		return nil, err
+	}
+	if (n >= 0 && len(args) != n) || len(args) < -n {
+		expected := fmt.Sprint(n)
+		if n < 0 {
+			expected = fmt.Sprintf("at least %d", -n)
+		}
+		return nil, &object.Error{Err: fmt.Errorf("%s expects %s args, got %d", name, expected,
+			len(args))}
+	}
+	values := make([]string, len(args))
+	for i, arg := range args {
+		s, ok := arg.(*object.String)
+		if !ok {
+			return nil, &object.Error{Err: fmt.Errorf("%s: expected %v, got %v", name,
+				object.StringType, arg.Type())}
+		}
+		values[i] = s.Value
+	}
+	return values, nil
+}
+
+// newString makes a string returned by a builtin, charging its size.
+func newString(env *Environ, s string) object.Object {
+	if err := env.charge(int64(len(s))); err != nil {
+		return err
+	}
+	return &object.String{Value: s}
+}
+
+// (read-file "notes.txt") => "the contents"
+func readFile(env *Environ, expr *parser.Node) object.Object {
+	args, errObj := stringArgs(env, "read-file", expr, 1)
+	if errObj != nil {
+		return errObj
+	}
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return &object.Error{Err: err}
+	}
+	return newString(env, string(data))
+}
+
+// (write-file "notes.txt" "the contents") => null
+func writeFile(env *Environ, expr *parser.Node) object.Object {
+	args, errObj := stringArgs(env, "write-file", expr, 2)
+	if errObj != nil {
+		return errObj
+	}
+	if err := ioutil.WriteFile(args[0], []byte(args[1]), 0644); err != nil {
+		return &object.Error{Err: err}
+	}
+	return &object.Null{}
+}
+
+// (http-get "http://example.com/") => "<!doctype html>..."
+// fails unless the response status is 2xx.
+func httpGet(env *Environ, expr *parser.Node) object.Object {
+	args, errObj := stringArgs(env, "http-get", expr, 1)
+	if errObj != nil {
+		return errObj
+	}
+	req, err := http.NewRequestWithContext(env.context(), http.MethodGet, args[0], nil)
+	if err != nil {
+		return &object.Error{Err: fmt.Errorf("http-get: %v", err)}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return &object.Error{Err: fmt.Errorf("http-get: %v", err)}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return &object.Error{Err: fmt.Errorf("http-get %s: %v", args[0], err)}
+	}
+	if resp.StatusCode/100 != 2 {
+		return &object.Error{Err: fmt.Errorf("http-get %s: %s", args[0], resp.Status)}
+	}
+	return newString(env, string(body))
+}
+
+// (getenv "HOME") => "/home/welp"
+// returns null if the variable isn't set.
+func getenv(env *Environ, expr *parser.Node) object.Object {
+	args, errObj := stringArgs(env, "getenv", expr, 1)
+	if errObj != nil {
+		return errObj
+	}
+	value, ok := os.LookupEnv(args[0])
+	if !ok {
+		return &object.Null{}
+	}
+	return newString(env, value)
+}
+
+// (exec "echo" "hi") => "hi\n"
+// runs a command, returning its output.
+func execCommand(env *Environ, expr *parser.Node) object.Object {
+	args, errObj := stringArgs(env, "exec", expr, -1)
+	if errObj != nil {
+		return errObj
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(env.context(), args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg != "" {
+			return &object.Error{Err: fmt.Errorf("exec %s: %v: %s", args[0], err, msg)}
+		}
+		return &object.Error{Err: fmt.Errorf("exec %s: %v", args[0], err)}
+	}
+	return newString(env, string(out))
+}
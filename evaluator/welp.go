@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/rtfb/welp/lexer"
 	"github.com/rtfb/welp/object"
@@ -11,18 +12,80 @@ import (
 )
 
 // Evaluator holds global values required for evaluation of the expressions.
+//
+// An Evaluator is safe for use by multiple goroutines. The stdlib env it
+// loads is frozen, and the envs created by NewEnv are cheap layers on top of
+// it, so the way to evaluate independent scripts concurrently is to give each
+// of them an env of its own. The bindings of an env are guarded by a lock, so
+// an env can be shared as well, but the values bound in it aren't: e.g. the
+// goroutines appending to the same array have to take turns, like they would
+// in Go. The modules are loaded one at a time, and once per Evaluator.
 type Evaluator struct {
 	stdlibEnv *Environ
+
+	// stdlibDir overrides the embedded stdlib if set
+	stdlibDir string
+
+	// loading is held while the modules are loaded, it guards modules and
+	// importing
+	loading sync.Mutex
+
+	// modules holds the imported modules, keyed by their absolute paths
+	modules map[string]*module
+
+	// importing holds the modules being loaded, for detecting the cycles
+	importing []string
+
+	// debugger is offered the conditions no handler takes care of
+	debugger Debugger
+
+	// methods holds the names of the methods callable like funcs, see
+	// WithHostTypes
+	methods map[string]bool
+}
+
+// Option configures an Evaluator.
+type Option func(*Evaluator)
+
+// WithStdlibDir makes the Evaluator load the stdlib modules from the files
+// in dir instead of the ones embedded in the binary. It's meant for working on
+// the stdlib, see Load for reporting the errors in the files.
+func WithStdlibDir(dir string) Option {
+	return func(e *Evaluator) {
+		e.stdlibDir = dir
+	}
+}
+
+// New creates an Evaluator. It panics if the stdlib can't be loaded, which
+// can only happen when it's loaded from a directory, see Load.
+func New(opts ...Option) *Evaluator {
+	e, err := Load(opts...)
+	if err != nil {
+		panic(err)
+	}
+	return e
 }
 
-// New creates an Evaluator.
-func New() *Evaluator {
-	return &Evaluator{
-		stdlibEnv: initStdlib(),
+// Load creates an Evaluator like New does, but returns the error if the
+// stdlib can't be loaded, e.g. from the directory given by WithStdlibDir.
+func Load(opts ...Option) (*Evaluator, error) {
+	e := &Evaluator{}
+	for _, opt := range opts {
+		opt(e)
+	}
+	env, err := initStdlib(e.stdlibDir)
+	if err != nil {
+		return nil, err
 	}
+	e.stdlibEnv = env
+	e.stdlibEnv.evtor = e
+	e.stdlibEnv.freeze()
+	return e, nil
 }
 
-// NewEnv creates an environment.
+// NewEnv creates an environment for evaluating a script. The definitions
+// made by the script stay in its env, the stdlib shared by all the envs of
+// the Evaluator isn't affected.
 func (e *Evaluator) NewEnv() *Environ {
 	return newEnv(e)
 }
@@ -37,7 +100,7 @@ func num(env *Environ, tok lexer.Token) int64 {
 		}
 		return int64(n)
 	case lexer.TokIdentifier:
-		val := env.vars[string(tok.Value)]
+		val, _ := env.lookupVar(string(tok.Value))
 		intVal, ok := val.(*object.Integer)
 		if !ok {
 			fmt.Printf("wrong type %T, expected %s", val, object.IntegerType)
@@ -56,27 +119,47 @@ func nilNode(n *parser.Node) bool {
 }
 
 // (add 3 7) => 10
-func callUserFunc(env *Environ, f *callable, expr *parser.Node) object.Object {
-	newFrame := env.deepCopy()
-	param := f.params
-	arg := expr
-	// TODO: add checking. At least check if number of args is correct
-	for param.R != nil && arg.R != nil {
-		val := eval(env, arg)
-		newFrame.vars[ident(param)] = val
-		param = param.R
-		arg = arg.R
+// A recur in the tail position of the body calls the func again without
+// growing the stack.
+func callUserFunc(env *Environ, f *callable, call *parser.Node) object.Object {
+	args, err := evalArgs(env, call.R)
+	if err != nil {
+		return err
+	}
+	return applyUserFunc(f, callPos(call), args, env.state)
+}
+
+// applyUserFunc calls f with already evaluated args, as a part of the
+// evaluation tracked by state, which is nil if it's unlimited.
+func applyUserFunc(f *callable, pos int, args []object.Object, state *evalState) object.Object {
+	for {
+		frame := newFrame(f.env, state)
+		if err := bindValues(frame, f, pos, args); err != nil {
+			return err
+		}
+		result := evalBody(frame, f.body)
+		sig, ok := result.(*signal)
+		if !ok {
+			return result
+		}
+		switch sig.kind {
+		case recurSignal:
+			args = sig.args
+		case restartSignal:
+			// unwinds to its restart-case
+			return sig
+		default:
+			return strayError(sig)
+		}
 	}
-	return eval(newFrame, f.body)
 }
 
 func ident(node *parser.Node) string {
 	return string(node.L.Tok.Value)
 }
 
-var indent int
-
-func dump(expr *parser.Node) {
+// dump prints the tree of expr, indented by indent spaces, for debugging.
+func dump(expr *parser.Node, indent int) {
 	indent += 4
 	prefix := strings.Repeat(" ", indent)
 	if expr.Tok.Typ == lexer.TokVoid {
@@ -85,10 +168,9 @@ func dump(expr *parser.Node) {
 		fmt.Printf("%stok: %s\n", prefix, expr.Tok.String())
 	}
 	if expr.L != nil {
-		dump(expr.L)
+		dump(expr.L, indent)
 	}
 	if expr.R != nil {
-		dump(expr.R)
+		dump(expr.R, indent)
 	}
-	indent -= 4
 }
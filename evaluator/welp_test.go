@@ -21,6 +21,7 @@ func TestEvalMath(t *testing.T) {
 		{"(+ 123 321)", 444},
 		{"(exp 2 3)", 8},
 		{"(exp 2 3 2 4)", 512},
+		{"(exp 2)", 2},
 		{"(- 7 5)", 2},
 	}
 	for _, test := range tests {
@@ -63,10 +64,10 @@ func TestEvalEq(t *testing.T) {
 	}
 }
 
-func TestLet(t *testing.T) {
+func TestDefine(t *testing.T) {
 	env := testEvaluator.NewEnv()
 	// assign something to x
-	got := eval(env, parser.ParseString("(let x 5)"))
+	got := eval(env, parser.ParseString("(define x 5)"))
 	assert.IsType(t, &object.Integer{}, got)
 	intGot := got.(*object.Integer)
 	assert.Equal(t, int64(5), intGot.Value)
@@ -106,3 +107,84 @@ func TestArrays(t *testing.T) {
 		assert.Equal(t, test.expected, got)
 	}
 }
+
+func TestLet(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected object.Object
+	}{
+		{"(let ((x 1) (y 2)) (+ x y))", &object.Integer{Value: 3}},
+		{"(let () 7)", &object.Integer{Value: 7}},
+		{"(let ((x 1)) (define y 2) (+ x y))", &object.Integer{Value: 3}},
+		{"(let* ((x 1) (y (+ x 1))) y)", &object.Integer{Value: 2}},
+		{"(letrec ((x 1) (y (+ x 1))) (+ x y))", &object.Integer{Value: 3}},
+		{"(let ((x 1)) (let ((x 2)) x))", &object.Integer{Value: 2}},
+	}
+	for _, test := range tests {
+		env := testEvaluator.NewEnv()
+		got := eval(env, parser.ParseString(test.input))
+		assert.Equal(t, test.expected, got, "eval(%q)", test.input)
+	}
+}
+
+func TestLetScope(t *testing.T) {
+	env := testEvaluator.NewEnv()
+	eval(env, parser.ParseString("(define x 1)"))
+	got := eval(env, parser.ParseString("(let ((x 2) (y x)) y)"))
+	assert.Equal(t, &object.Integer{Value: 1}, got)
+	// let bindings don't leak into the enclosing scope
+	eval(env, parser.ParseString("(let ((x 5) (z 6)) z)"))
+	assert.Equal(t, &object.Integer{Value: 1}, eval(env, parser.ParseString("x")))
+	_, ok := env.lookupVar("z")
+	assert.False(t, ok)
+	got = eval(env, parser.ParseString("(let (x) x)"))
+	assert.IsType(t, &object.Error{}, got)
+	got = eval(env, parser.ParseString("(let x 5)"))
+	assert.IsType(t, &object.Error{}, got)
+}
+
+func TestSet(t *testing.T) {
+	env := testEvaluator.NewEnv()
+	eval(env, parser.ParseString("(define x 1)"))
+	got := eval(env, parser.ParseString("(let ((y 0)) (set! x 2) (set! y 3) y)"))
+	assert.Equal(t, &object.Integer{Value: 3}, got)
+	assert.Equal(t, &object.Integer{Value: 2}, eval(env, parser.ParseString("x")))
+	got = eval(env, parser.ParseString("(set! nope 2)"))
+	assert.IsType(t, &object.Error{}, got)
+}
+
+func TestClosureScope(t *testing.T) {
+	env := testEvaluator.NewEnv()
+	eval(env, parser.ParseString("(define x 10)"))
+	eval(env, parser.ParseString("(fn get-x () x)"))
+	// functions see the scope they were defined in, not the caller's
+	got := eval(env, parser.ParseString("(let ((x 20)) (get-x))"))
+	assert.Equal(t, &object.Integer{Value: 10}, got)
+}
+
+func TestStdlib(t *testing.T) {
+	env := New().NewEnv()
+	assert.Equal(t, "3", Eval(env, parser.ParseString("(last [1 2 3])")).Inspect())
+	env = New(WithStdlibDir("../stdlib")).NewEnv()
+	assert.Equal(t, "[2, 3]", Eval(env, parser.ParseString("(cdr [1 2 3])")).Inspect())
+	assert.Panics(t, func() { New(WithStdlibDir("no-such-dir")) })
+	_, err := Load(WithStdlibDir("no-such-dir"))
+	assert.Error(t, err)
+}
+
+func TestCondErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"(cond (1 2) (t 3))", "ERR: type error: cond clause evaluates to INTEGER, not BOOLEAN"},
+		{"(cond ((nope) 2) (t 3))", `ERR: no such symbol "nope"`},
+		{"(cond (nil 2) (1 3) (t 4))", "ERR: type error: cond clause evaluates to INTEGER, not BOOLEAN"},
+		{"(cond (1 2))", "2"},
+		{"(cond)", "ERR: cond expects a clause"},
+	}
+	for _, test := range tests {
+		got := Eval(testEvaluator.NewEnv(), parser.ParseString(test.input))
+		assert.Equal(t, test.expected, got.Inspect(), "eval(%q)", test.input)
+	}
+}
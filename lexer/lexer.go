@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 )
 
 // TokType defines the type of a token.
@@ -20,6 +21,10 @@ const (
 	TokIdentifier
 	TokString
 	TokEOF
+	TokOpenBracket
+	TokCloseBracket
+	TokOpenBrace
+	TokCloseBrace
 )
 
 // String implements Stringer.
@@ -39,6 +44,14 @@ func (t TokType) String() string {
 		return "TokString"
 	case TokEOF:
 		return "TokEOF"
+	case TokOpenBracket:
+		return "TokOpenBracket"
+	case TokCloseBracket:
+		return "TokCloseBracket"
+	case TokOpenBrace:
+		return "TokOpenBrace"
+	case TokCloseBrace:
+		return "TokCloseBrace"
 	default:
 		panic("unknown TokType")
 	}
@@ -62,13 +75,43 @@ type Tokenizer struct {
 	r    *bufio.Reader
 	Head int
 	Tok  chan Token
+
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
 // NewTokenizer creates a lexer with a reader to read data from.
 func NewTokenizer(r io.Reader) *Tokenizer {
 	return &Tokenizer{
-		r:   bufio.NewReader(r),
-		Tok: make(chan Token),
+		r:    bufio.NewReader(r),
+		Tok:  make(chan Token),
+		done: make(chan struct{}),
+	}
+}
+
+// Stop makes OnStart return once it's done reading the current token, instead
+// of waiting for someone to receive it. It's needed when the tokens aren't
+// read up to the EOF.
+func (t *Tokenizer) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.done)
+	})
+}
+
+// emit sends a token, unless the tokenizer is stopped.
+func (t *Tokenizer) emit(tok Token) {
+	select {
+	case t.Tok <- tok:
+	case <-t.done:
+	}
+}
+
+func (t *Tokenizer) stopped() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
 	}
 }
 
@@ -78,6 +121,9 @@ func (t *Tokenizer) OnStart() {
 	var err error
 	var b byte
 	for {
+		if t.stopped() {
+			return
+		}
 		b, err = t.r.ReadByte()
 		if err != nil {
 			break
@@ -92,16 +138,27 @@ func (t *Tokenizer) OnStart() {
 			t.onOpenParen()
 		case b == ')':
 			t.onCloseParen()
+		case b == '[':
+			t.onDelimiter(TokOpenBracket, b)
+		case b == ']':
+			t.onDelimiter(TokCloseBracket, b)
+		case b == '{':
+			t.onDelimiter(TokOpenBrace, b)
+		case b == '}':
+			t.onDelimiter(TokCloseBrace, b)
 		case b == '"':
 			t.onDoublequote()
 		default:
 			t.r.UnreadByte()
-			t.onChar()
+			t.onChar(nil)
 		}
 	}
-	t.Tok <- Token{Typ: TokEOF, Pos: t.Head, Err: err}
+	t.emit(Token{Typ: TokEOF, Pos: t.Head, Err: err})
 }
 
+// delimiters are the chars that end numbers and identifiers.
+const delimiters = " \n\t\r()[]{}\""
+
 func (t *Tokenizer) onNumber() {
 	var buf bytes.Buffer
 	var b byte
@@ -117,15 +174,21 @@ func (t *Tokenizer) onNumber() {
 		}
 		buf.WriteByte(b)
 	}
+	if err == nil && strings.IndexByte(delimiters, b) == -1 {
+		// a number followed by other chars, like 1+, is an identifier
+		t.onChar(buf.Bytes())
+		return
+	}
 	if err == io.EOF {
 		err = nil
 	}
-	t.Tok <- Token{Typ: TokNumber, Value: buf.Bytes(), Pos: t.Head, Err: err}
+	t.emit(Token{Typ: TokNumber, Value: buf.Bytes(), Pos: t.Head, Err: err})
 	t.Head += buf.Len()
 }
 
-func (t *Tokenizer) onChar() {
-	var buf bytes.Buffer
+// onChar lexes an identifier, which starts with prefix.
+func (t *Tokenizer) onChar(prefix []byte) {
+	buf := bytes.NewBuffer(prefix)
 	var b byte
 	var err error
 	for {
@@ -133,7 +196,7 @@ func (t *Tokenizer) onChar() {
 		if err != nil {
 			break
 		}
-		if strings.IndexByte(" \n\t()\"", b) != -1 {
+		if strings.IndexByte(delimiters, b) != -1 {
 			t.r.UnreadByte()
 			break
 		}
@@ -142,17 +205,22 @@ func (t *Tokenizer) onChar() {
 	if err == io.EOF {
 		err = nil
 	}
-	t.Tok <- Token{Typ: TokIdentifier, Value: buf.Bytes(), Pos: t.Head, Err: err}
+	t.emit(Token{Typ: TokIdentifier, Value: buf.Bytes(), Pos: t.Head, Err: err})
 	t.Head += buf.Len()
 }
 
 func (t *Tokenizer) onOpenParen() {
-	t.Tok <- Token{Typ: TokOpenParen, Value: []byte{'('}, Pos: t.Head}
+	t.emit(Token{Typ: TokOpenParen, Value: []byte{'('}, Pos: t.Head})
 	t.Head++
 }
 
 func (t *Tokenizer) onCloseParen() {
-	t.Tok <- Token{Typ: TokCloseParen, Value: []byte{')'}, Pos: t.Head}
+	t.emit(Token{Typ: TokCloseParen, Value: []byte{')'}, Pos: t.Head})
+	t.Head++
+}
+
+func (t *Tokenizer) onDelimiter(typ TokType, b byte) {
+	t.emit(Token{Typ: typ, Value: []byte{b}, Pos: t.Head})
 	t.Head++
 }
 
@@ -198,6 +266,6 @@ loop:
 	if (err == nil || err == io.EOF) && !foundClosingDoublequote {
 		err = fmt.Errorf("unclosed string")
 	}
-	t.Tok <- Token{Typ: TokString, Value: buf.Bytes(), Pos: t.Head, Err: err}
+	t.emit(Token{Typ: TokString, Value: buf.Bytes(), Pos: t.Head, Err: err})
 	t.Head += buf.Len()
 }
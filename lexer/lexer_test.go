@@ -24,6 +24,9 @@ func TestTokenizer(t *testing.T) {
 		{"x", []string{"x"}},
 		{"9", []string{"9"}},
 		{"19", []string{"19"}},
+		{"(let (([a b] [1 2])) a)", []string{"(", "let", "(", "(", "[", "a", "b", "]", "[", "1", "2", "]", ")", ")", "a", ")"}},
+		{"{:a 1}", []string{"{", ":a", "1", "}"}},
+		{"(1+ 2)", []string{"(", "1+", "2", ")"}},
 	}
 	for _, test := range tests {
 		tokzer := NewTokenizer(strings.NewReader(test.input))
@@ -0,0 +1,220 @@
+package object
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// These are the types of the values used by the goroutines of welp code.
+const (
+	ChanType      = "CHANNEL"
+	WaitGroupType = "WAIT-GROUP"
+	MutexType     = "MUTEX"
+)
+
+// Chan is a channel the goroutines started by welp code talk over.
+type Chan struct {
+	C chan Object
+}
+
+// NewChan creates a channel with a buffer of size values.
+func NewChan(size int) *Chan {
+	return &Chan{C: make(chan Object, size)}
+}
+
+// Type implements Object.
+func (c *Chan) Type() Type {
+	return ChanType
+}
+
+// Inspect implements Object.
+func (c *Chan) Inspect() string {
+	return fmt.Sprintf("<channel %d/%d>", len(c.C), cap(c.C))
+}
+
+// WaitGroup waits for a number of goroutines to finish, like sync.WaitGroup
+// does, except that the waiting can be abandoned.
+type WaitGroup struct {
+	mu    sync.Mutex
+	count int64
+	zero  chan struct{} // closed once the count drops to zero
+}
+
+// NewWaitGroup creates a wait group with a zero count.
+func NewWaitGroup() *WaitGroup {
+	zero := make(chan struct{})
+	close(zero)
+	return &WaitGroup{zero: zero}
+}
+
+// Type implements Object.
+func (wg *WaitGroup) Type() Type {
+	return WaitGroupType
+}
+
+// Inspect implements Object.
+func (wg *WaitGroup) Inspect() string {
+	wg.mu.Lock()
+	defer wg.mu.Unlock()
+	return fmt.Sprintf("<wait-group %d>", wg.count)
+}
+
+// Add adds delta, which may be negative, to the count. It fails if the count
+// would become negative.
+func (wg *WaitGroup) Add(delta int64) error {
+	wg.mu.Lock()
+	defer wg.mu.Unlock()
+	count := wg.count + delta
+	switch {
+	case count < 0:
+		return errors.New("negative wait group count")
+	case wg.count == 0 && count > 0:
+		wg.zero = make(chan struct{})
+	case wg.count > 0 && count == 0:
+		close(wg.zero)
+	}
+	wg.count = count
+	return nil
+}
+
+// Wait returns a channel that gets closed once the count drops to zero.
+func (wg *WaitGroup) Wait() <-chan struct{} {
+	wg.mu.Lock()
+	defer wg.mu.Unlock()
+	return wg.zero
+}
+
+// Mutex is a lock, which unlike sync.Mutex can be waited for with a select.
+type Mutex struct {
+	c chan struct{} // holds a value while the mutex is locked
+}
+
+// NewMutex creates an unlocked mutex.
+func NewMutex() *Mutex {
+	return &Mutex{c: make(chan struct{}, 1)}
+}
+
+// Type implements Object.
+func (m *Mutex) Type() Type {
+	return MutexType
+}
+
+// Inspect implements Object.
+func (m *Mutex) Inspect() string {
+	if len(m.c) > 0 {
+		return "<mutex locked>"
+	}
+	return "<mutex>"
+}
+
+// Lock returns the channel a send to which locks the mutex.
+func (m *Mutex) Lock() chan<- struct{} {
+	return m.c
+}
+
+// Unlock unlocks the mutex. It fails if the mutex isn't locked.
+func (m *Mutex) Unlock() error {
+	select {
+	case <-m.c:
+		return nil
+	default:
+		return errors.New("unlock of an unlocked mutex")
+	}
+}
+
+// These are the types of the values computed asynchronously.
+const (
+	PromiseType = "PROMISE"
+	FutureType  = "FUTURE"
+)
+
+// Awaitable is a value that becomes known at some point, like a promise or
+// a future.
+type Awaitable interface {
+	Object
+
+	// Done returns a channel that gets closed once the value is known.
+	Done() <-chan struct{}
+
+	// Value returns the value, and whether it's known yet.
+	Value() (Object, bool)
+}
+
+// Promise is a value delivered once, by any goroutine, to all the goroutines
+// waiting for it.
+type Promise struct {
+	once  sync.Once
+	done  chan struct{}
+	value Object
+}
+
+// NewPromise creates a promise that's yet to be delivered.
+func NewPromise() *Promise {
+	return &Promise{done: make(chan struct{})}
+}
+
+// Type implements Object.
+func (p *Promise) Type() Type {
+	return PromiseType
+}
+
+// Inspect implements Object.
+func (p *Promise) Inspect() string {
+	return inspectAwaitable("promise", p)
+}
+
+// Deliver delivers the value, unless a value has been delivered already. It
+// reports whether it did.
+func (p *Promise) Deliver(value Object) bool {
+	delivered := false
+	p.once.Do(func() {
+		p.value = value
+		close(p.done)
+		delivered = true
+	})
+	return delivered
+}
+
+// Done implements Awaitable.
+func (p *Promise) Done() <-chan struct{} {
+	return p.done
+}
+
+// Value implements Awaitable.
+func (p *Promise) Value() (Object, bool) {
+	select {
+	case <-p.done:
+		return p.value, true
+	default:
+		return nil, false
+	}
+}
+
+// Future is a promise delivered by the computation it was made for.
+type Future struct {
+	Promise
+}
+
+// NewFuture creates a future that's yet to be delivered.
+func NewFuture() *Future {
+	return &Future{Promise: Promise{done: make(chan struct{})}}
+}
+
+// Type implements Object.
+func (f *Future) Type() Type {
+	return FutureType
+}
+
+// Inspect implements Object.
+func (f *Future) Inspect() string {
+	return inspectAwaitable("future", f)
+}
+
+func inspectAwaitable(kind string, a Awaitable) string {
+	value, ok := a.Value()
+	if !ok {
+		return fmt.Sprintf("<%s pending>", kind)
+	}
+	return fmt.Sprintf("<%s %s>", kind, value.Inspect())
+}
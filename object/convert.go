@@ -0,0 +1,461 @@
+package object
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+var (
+	objectType = reflect.TypeOf((*Object)(nil)).Elem()
+	errorType  = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// FromGo converts a Go value into a welp one:
+//
+//	nil, nil pointers, slices and maps  null
+//	bool                                Boolean
+//	ints, uints, floats                 Integer
+//	string                              String
+//	slices and arrays                   Array
+//	maps                                Map, with the keys sorted
+//	structs                             Map, keyed by the field keywords
+//	funcs                               Func, see below
+//	Objects                             themselves
+//
+// Welp has no floats, so only the floats without a fractional part convert.
+// The exported fields of a struct are keyed by their names, or by the names
+// given by their welp tags, e.g. `welp:"name"`. The fields tagged with
+// `welp:"-"` are left out.
+//
+// A func converts into a Func whose Impl is an Applicable, which converts the
+// args with ToGo and the results with FromGo. If the last result of the func
+// is an error, a non-nil one is returned as an Error. The rest of the results
+// are returned as they are if there's a single one, as an Array if there are
+// more, and as null if there are none.
+//
+// A value that contains itself, through pointers, maps or slices, fails to
+// convert with a "cyclic value" error.
+func FromGo(v interface{}) (Object, error) {
+	if obj, ok := v.(Object); ok {
+		return obj, nil
+	}
+	return fromValue(reflect.ValueOf(v), visited{})
+}
+
+// visit identifies a pointer, a map or a slice being converted.
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+// visited are the pointers, maps and slices being converted, which would be
+// converted forever if they were met again, inside themselves.
+type visited map[visit]bool
+
+// enter marks v as being converted until leave is called, failing if it
+// already is.
+func (s visited) enter(v reflect.Value) (leave func(), err error) {
+	key := visit{ptr: v.Pointer(), typ: v.Type()}
+	if s[key] {
+		return nil, errors.New("cyclic value")
+	}
+	s[key] = true
+	return func() { delete(s, key) }, nil
+}
+
+func fromValue(v reflect.Value, seen visited) (Object, error) {
+	if !v.IsValid() || (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return &Null{}, nil
+	}
+	if v.Type().Implements(objectType) {
+		return v.Interface().(Object), nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		return &Boolean{Value: v.Bool()}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Integer{Value: v.Int()}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("%d overflows an integer", v.Uint())
+		}
+		return &Integer{Value: int64(v.Uint())}, nil
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			return nil, fmt.Errorf("%v can't be converted to an integer", f)
+		}
+		return &Integer{Value: int64(f)}, nil
+	case reflect.String:
+		return &String{Value: v.String()}, nil
+	case reflect.Interface:
+		return fromValue(v.Elem(), seen)
+	case reflect.Ptr:
+		leave, err := seen.enter(v)
+		if err != nil {
+			return nil, err
+		}
+		defer leave()
+		return fromValue(v.Elem(), seen)
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice {
+			if v.IsNil() {
+				return &Null{}, nil
+			}
+			if v.Len() > 0 {
+				leave, err := seen.enter(v)
+				if err != nil {
+					return nil, err
+				}
+				defer leave()
+			}
+		}
+		values := make([]Object, v.Len())
+		for i := range values {
+			value, err := fromValue(v.Index(i), seen)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return NewArray(values), nil
+	case reflect.Map:
+		if v.IsNil() {
+			return &Null{}, nil
+		}
+		leave, err := seen.enter(v)
+		if err != nil {
+			return nil, err
+		}
+		defer leave()
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return lessKey(keys[i], keys[j]) })
+		m := NewMap()
+		for _, key := range keys {
+			k, err := fromValue(key, seen)
+			if err != nil {
+				return nil, err
+			}
+			value, err := fromValue(v.MapIndex(key), seen)
+			if err != nil {
+				return nil, err
+			}
+			if err := m.Set(k, value); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case reflect.Struct:
+		m := NewMap()
+		for _, f := range fields(v.Type()) {
+			value, err := fromValue(v.Field(f.index), seen)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", f.name, err)
+			}
+			m.Set(&Keyword{Name: f.name}, value)
+		}
+		return m, nil
+	case reflect.Func:
+		if v.IsNil() {
+			return &Null{}, nil
+		}
+		name := runtime.FuncForPC(v.Pointer()).Name()
+		name = name[strings.LastIndexByte(name, '.')+1:]
+		return &Func{Name: name, Impl: &goFunc{name: name, fn: v}}, nil
+	}
+	return nil, fmt.Errorf("can't convert a %s", v.Type())
+}
+
+// lessKey orders the keys of a Go map.
+func lessKey(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() < b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() < b.Uint()
+	case reflect.String:
+		return a.String() < b.String()
+	}
+	return fmt.Sprint(a.Interface()) < fmt.Sprint(b.Interface())
+}
+
+// field is an exported field of a struct.
+type field struct {
+	name  string
+	index int
+}
+
+// fields returns the fields of a struct type that get converted.
+func fields(t reflect.Type) []field {
+	var result []field
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("welp"); ok {
+			if tag == "-" {
+				continue
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+		result = append(result, field{name: name, index: i})
+	}
+	return result
+}
+
+// ToGo stores the Go value of obj in the value target points to, undoing what
+// FromGo does. It converts an Integer into any numeric type that can hold it,
+// a Keyword into a string, and a Map into a struct by setting the fields
+// found among the keys, which can be either keywords or strings. The fields
+// missing from the map are left alone. Null converts into the zero value of
+// pointers, slices, maps and interfaces. Into an empty interface, the values
+// convert into bool, int64, string, []interface{} and
+// map[interface{}]interface{}, and the funcs, the errors and the host
+// objects stay Objects. Otherwise a Host converts into its value.
+func ToGo(obj Object, target interface{}) error {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return errors.New("ToGo needs a non-nil pointer")
+	}
+	return toValue(obj, v.Elem())
+}
+
+func toValue(obj Object, v reflect.Value) error {
+	t := v.Type()
+	if reflect.TypeOf(obj).AssignableTo(t) && (t.Kind() != reflect.Interface || t.NumMethod() > 0) {
+		v.Set(reflect.ValueOf(obj))
+		return nil
+	}
+	if h, ok := obj.(*Host); ok && h.Value != nil && reflect.TypeOf(h.Value).AssignableTo(t) &&
+		(t.Kind() != reflect.Interface || t.NumMethod() > 0) {
+		v.Set(reflect.ValueOf(h.Value))
+		return nil
+	}
+	if _, ok := obj.(*Null); ok {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+			v.Set(reflect.Zero(t))
+			return nil
+		}
+	}
+	mismatch := fmt.Errorf("can't convert %s to %s", obj.Type(), t)
+	switch t.Kind() {
+	case reflect.Interface:
+		natural, err := toNatural(obj)
+		if err != nil {
+			return err
+		}
+		if natural == nil {
+			v.Set(reflect.Zero(t))
+			return nil
+		}
+		if !reflect.TypeOf(natural).AssignableTo(t) {
+			return mismatch
+		}
+		v.Set(reflect.ValueOf(natural))
+	case reflect.Bool:
+		b, ok := obj.(*Boolean)
+		if !ok {
+			return mismatch
+		}
+		v.SetBool(b.Value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := obj.(*Integer)
+		if !ok {
+			return mismatch
+		}
+		if v.OverflowInt(n.Value) {
+			return fmt.Errorf("%d overflows %s", n.Value, t)
+		}
+		v.SetInt(n.Value)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := obj.(*Integer)
+		if !ok {
+			return mismatch
+		}
+		if n.Value < 0 || v.OverflowUint(uint64(n.Value)) {
+			return fmt.Errorf("%d overflows %s", n.Value, t)
+		}
+		v.SetUint(uint64(n.Value))
+	case reflect.Float32, reflect.Float64:
+		n, ok := obj.(*Integer)
+		if !ok {
+			return mismatch
+		}
+		v.SetFloat(float64(n.Value))
+	case reflect.String:
+		switch s := obj.(type) {
+		case *String:
+			v.SetString(s.Value)
+		case *Keyword:
+			v.SetString(s.Name)
+		default:
+			return mismatch
+		}
+	case reflect.Ptr:
+		elem := reflect.New(t.Elem())
+		if err := toValue(obj, elem.Elem()); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.Slice, reflect.Array:
+		arr, ok := obj.(*Array)
+		if !ok {
+			return mismatch
+		}
+		if t.Kind() == reflect.Array {
+			if len(arr.Value) != t.Len() {
+				return fmt.Errorf("can't convert an array of %d to %s", len(arr.Value), t)
+			}
+		} else {
+			v.Set(reflect.MakeSlice(t, len(arr.Value), len(arr.Value)))
+		}
+		for i, elem := range arr.Value {
+			if err := toValue(elem, v.Index(i)); err != nil {
+				return fmt.Errorf("element %d: %v", i, err)
+			}
+		}
+	case reflect.Map:
+		m, ok := obj.(*Map)
+		if !ok {
+			return mismatch
+		}
+		result := reflect.MakeMapWithSize(t, m.Len())
+		for _, pair := range m.Pairs() {
+			key := reflect.New(t.Key()).Elem()
+			if err := toValue(pair.Key, key); err != nil {
+				return fmt.Errorf("key %s: %v", pair.Key.Inspect(), err)
+			}
+			value := reflect.New(t.Elem()).Elem()
+			if err := toValue(pair.Value, value); err != nil {
+				return fmt.Errorf("%s: %v", pair.Key.Inspect(), err)
+			}
+			result.SetMapIndex(key, value)
+		}
+		v.Set(result)
+	case reflect.Struct:
+		m, ok := obj.(*Map)
+		if !ok {
+			return mismatch
+		}
+		for _, f := range fields(t) {
+			value, ok := m.Get(&Keyword{Name: f.name})
+			if !ok {
+				value, ok = m.Get(&String{Value: f.name})
+			}
+			if !ok {
+				continue
+			}
+			if err := toValue(value, v.Field(f.index)); err != nil {
+				return fmt.Errorf("%s: %v", f.name, err)
+			}
+		}
+	default:
+		return mismatch
+	}
+	return nil
+}
+
+// toNatural converts obj into the Go value it's most naturally stored as.
+func toNatural(obj Object) (interface{}, error) {
+	switch obj := obj.(type) {
+	case *Null:
+		return nil, nil
+	case *Boolean:
+		return obj.Value, nil
+	case *Integer:
+		return obj.Value, nil
+	case *String:
+		return obj.Value, nil
+	case *Keyword:
+		return obj.Name, nil
+	case *Array:
+		values := make([]interface{}, len(obj.Value))
+		for i, elem := range obj.Value {
+			value, err := toNatural(elem)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return values, nil
+	case *Map:
+		m := make(map[interface{}]interface{}, obj.Len())
+		for _, pair := range obj.Pairs() {
+			key, err := toNatural(pair.Key)
+			if err != nil {
+				return nil, err
+			}
+			value, err := toNatural(pair.Value)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = value
+		}
+		return m, nil
+	}
+	return obj, nil
+}
+
+// goFunc is a Go func converted by FromGo.
+type goFunc struct {
+	name string
+	fn   reflect.Value
+}
+
+// Apply implements Applicable.
+func (f *goFunc) Apply(args []Object) Object {
+	t := f.fn.Type()
+	params := t.NumIn()
+	switch {
+	case t.IsVariadic() && len(args) < params-1:
+		return &Error{Err: fmt.Errorf("%s expects at least %d args, got %d", f.name, params-1,
+			len(args))}
+	case !t.IsVariadic() && len(args) != params:
+		return &Error{Err: fmt.Errorf("%s expects %d args, got %d", f.name, params, len(args))}
+	}
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		var paramType reflect.Type
+		if t.IsVariadic() && i >= params-1 {
+			paramType = t.In(params - 1).Elem()
+		} else {
+			paramType = t.In(i)
+		}
+		in[i] = reflect.New(paramType).Elem()
+		if err := toValue(arg, in[i]); err != nil {
+			return &Error{Err: fmt.Errorf("arg %d: %v", i+1, err)}
+		}
+	}
+	out := f.fn.Call(in)
+	if n := len(out); n > 0 && t.Out(n-1) == errorType {
+		if err := out[n-1].Interface(); err != nil {
+			return &Error{Err: err.(error)}
+		}
+		out = out[:n-1]
+	}
+	results := make([]Object, len(out))
+	for i, v := range out {
+		result, err := fromValue(v, visited{})
+		if err != nil {
+			return &Error{Err: fmt.Errorf("result %d: %v", i+1, err)}
+		}
+		results[i] = result
+	}
+	switch len(results) {
+	case 0:
+		return &Null{}
+	case 1:
+		return results[0]
+	}
+	return NewArray(results)
+}
@@ -0,0 +1,195 @@
+package object
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type point struct {
+	X, Y   int
+	Label  string `welp:"label"`
+	Secret string `welp:"-"`
+	hidden int
+}
+
+func TestFromGo(t *testing.T) {
+	n := 3
+	tests := []struct {
+		input    interface{}
+		expected string
+	}{
+		{nil, "null"},
+		{true, "true"},
+		{int8(-5), "-5"},
+		{uint32(7), "7"},
+		{2.0, "2"},
+		{"hi", `"hi"`},
+		{&n, "3"},
+		{(*int)(nil), "null"},
+		{[]int{1, 2}, "[1, 2]"},
+		{[2]string{"a", "b"}, `["a", "b"]`},
+		{[]int(nil), "null"},
+		{map[string]int{"b": 2, "a": 1}, `{"a" 1, "b" 2}`},
+		{map[int]bool{10: true, 9: false}, "{9 false, 10 true}"},
+		{point{X: 1, Y: 2, Label: "p", Secret: "s"}, `{:X 1, :Y 2, :label "p"}`},
+		{[]interface{}{1, "a", nil}, `[1, "a", null]`},
+		{&Integer{Value: 4}, "4"},
+		{[]Object{&Keyword{Name: "k"}}, "[:k]"},
+		{[]*int{&n, &n}, "[3, 3]"},
+	}
+	for _, test := range tests {
+		got, err := FromGo(test.input)
+		assert.NoError(t, err, "FromGo(%#v)", test.input)
+		assert.Equal(t, test.expected, got.Inspect(), "FromGo(%#v)", test.input)
+	}
+	errTests := []struct {
+		input    interface{}
+		expected string
+	}{
+		{1.5, "1.5 can't be converted to an integer"},
+		{uint64(1 << 63), "9223372036854775808 overflows an integer"},
+		{make(chan int), "can't convert a chan int"},
+		{map[string]interface{}{"a": []float64{0.5}}, "0.5 can't be converted to an integer"},
+	}
+	for _, test := range errTests {
+		_, err := FromGo(test.input)
+		assert.EqualError(t, err, test.expected, "FromGo(%#v)", test.input)
+	}
+}
+
+type node struct {
+	Value int
+	Next  *node
+}
+
+func TestFromGoCyclic(t *testing.T) {
+	n := &node{Value: 1}
+	n.Next = n
+	m := map[string]interface{}{}
+	m["self"] = m
+	s := []interface{}{nil}
+	s[0] = s
+	tests := []struct {
+		name     string
+		input    interface{}
+		expected string
+	}{
+		{"pointer", n, "Next: cyclic value"},
+		{"map", m, "cyclic value"},
+		{"slice", s, "cyclic value"},
+	}
+	for _, test := range tests {
+		_, err := FromGo(test.input)
+		assert.EqualError(t, err, test.expected, test.name)
+	}
+	f, err := FromGo(func() *node { return n })
+	assert.NoError(t, err)
+	result := f.(*Func).Impl.(Applicable).Apply(nil)
+	assert.Equal(t, "ERR: result 1: Next: cyclic value", result.Inspect())
+}
+
+func TestToGo(t *testing.T) {
+	var p point
+	m := NewMap()
+	m.Set(&Keyword{Name: "X"}, &Integer{Value: 1})
+	m.Set(&String{Value: "label"}, &Keyword{Name: "origin"})
+	m.Set(&Keyword{Name: "Secret"}, &String{Value: "s"})
+	assert.NoError(t, ToGo(m, &p))
+	assert.Equal(t, point{X: 1, Label: "origin"}, p)
+
+	var ints []uint8
+	assert.NoError(t, ToGo(NewArray([]Object{&Integer{Value: 1}, &Integer{Value: 255}}), &ints))
+	assert.Equal(t, []uint8{1, 255}, ints)
+
+	var f float64
+	assert.NoError(t, ToGo(&Integer{Value: 3}, &f))
+	assert.Equal(t, 3.0, f)
+
+	var any interface{}
+	arr := NewArray([]Object{&Integer{Value: 1}, &String{Value: "a"}, m, &Null{}})
+	assert.NoError(t, ToGo(arr, &any))
+	assert.Equal(t, []interface{}{int64(1), "a", map[interface{}]interface{}{
+		"X": int64(1), "label": "origin", "Secret": "s"}, nil}, any)
+
+	var obj Object
+	assert.NoError(t, ToGo(&Integer{Value: 5}, &obj))
+	assert.Equal(t, &Integer{Value: 5}, obj)
+
+	var ptr *int
+	assert.NoError(t, ToGo(&Integer{Value: 6}, &ptr))
+	assert.Equal(t, 6, *ptr)
+	assert.NoError(t, ToGo(&Null{}, &ptr))
+	assert.Nil(t, ptr)
+
+	var byName map[string]int
+	counts := NewMap()
+	counts.Set(&Keyword{Name: "a"}, &Integer{Value: 1})
+	counts.Set(&String{Value: "b"}, &Integer{Value: 2})
+	assert.NoError(t, ToGo(counts, &byName))
+	assert.Equal(t, map[string]int{"a": 1, "b": 2}, byName)
+
+	var small int8
+	var pair [2]int
+	var s string
+	errTests := []struct {
+		obj      Object
+		target   interface{}
+		expected string
+	}{
+		{&Integer{Value: 300}, &small, "300 overflows int8"},
+		{&Integer{Value: -1}, &ints, "can't convert INTEGER to []uint8"},
+		{NewArray([]Object{&Integer{Value: -1}}), &ints, "element 0: -1 overflows uint8"},
+		{NewArray([]Object{&Integer{Value: 1}}), &pair, "can't convert an array of 1 to [2]int"},
+		{m, &byName, `"label": can't convert KEYWORD to int`},
+		{&Boolean{Value: true}, &s, "can't convert BOOLEAN to string"},
+		{&Integer{Value: 1}, s, "ToGo needs a non-nil pointer"},
+	}
+	for _, test := range errTests {
+		err := ToGo(test.obj, test.target)
+		assert.EqualError(t, err, test.expected, "ToGo(%s)", test.obj.Inspect())
+	}
+}
+
+func TestGoFunc(t *testing.T) {
+	divide := func(a, b int) (int, error) {
+		if b == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return a / b, nil
+	}
+	join := func(sep string, parts ...string) string {
+		result := ""
+		for i, part := range parts {
+			if i > 0 {
+				result += sep
+			}
+			result += part
+		}
+		return result
+	}
+	swap := func(a, b string) (string, string) { return b, a }
+	tests := []struct {
+		fn       interface{}
+		args     []Object
+		expected string
+	}{
+		{divide, []Object{&Integer{Value: 7}, &Integer{Value: 2}}, "3"},
+		{divide, []Object{&Integer{Value: 7}, &Integer{Value: 0}}, "ERR: division by zero"},
+		{divide, []Object{&Integer{Value: 7}}, "ERR: func1 expects 2 args, got 1"},
+		{divide, []Object{&Integer{Value: 7}, &String{Value: "x"}},
+			"ERR: arg 2: can't convert STRING to int"},
+		{join, []Object{&String{Value: "-"}, &String{Value: "a"}, &Keyword{Name: "b"}}, `"a-b"`},
+		{join, []Object{&String{Value: "-"}}, `""`},
+		{join, nil, "ERR: func2 expects at least 1 args, got 0"},
+		{swap, []Object{&String{Value: "a"}, &String{Value: "b"}}, `["b", "a"]`},
+		{func() {}, nil, "null"},
+	}
+	for _, test := range tests {
+		f, err := FromGo(test.fn)
+		assert.NoError(t, err)
+		got := f.(*Func).Impl.(Applicable).Apply(test.args)
+		assert.Equal(t, test.expected, got.Inspect())
+	}
+}
@@ -0,0 +1,107 @@
+package object
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// HostMethod is a method of a host object, called with the wrapped value and
+// the evaluated args.
+type HostMethod func(value interface{}, args []Object) (Object, error)
+
+// HostType describes a kind of host objects. All the fields but Name are
+// optional.
+type HostType struct {
+	// Name is returned by the Type of the objects
+	Name string
+
+	// Methods are the methods callable from welp, as
+	// (. obj method args...), or as (method obj args...) if the type is
+	// known to the evaluator
+	Methods map[string]HostMethod
+
+	// Inspect describes a value, the default is <Name>
+	Inspect func(value interface{}) string
+
+	// Equal compares two values of the type. By default, the values are
+	// compared with == if their Go type is comparable, and are never equal
+	// otherwise, unless they are the same object.
+	Equal func(a, b interface{}) bool
+}
+
+// Host wraps a Go value, like a database handle, so that it can be passed
+// around by welp code. The value itself is opaque to welp: it can only be
+// manipulated by the methods of its type.
+type Host struct {
+	HostType *HostType
+	Value    interface{}
+}
+
+// NewHost wraps value into a host object of type t.
+func NewHost(t *HostType, value interface{}) *Host {
+	return &Host{HostType: t, Value: value}
+}
+
+// Type implements Object.
+func (h *Host) Type() Type {
+	return Type(h.HostType.Name)
+}
+
+// Inspect implements Object.
+func (h *Host) Inspect() string {
+	if h.HostType.Inspect != nil {
+		return h.HostType.Inspect(h.Value)
+	}
+	return fmt.Sprintf("<%s>", h.HostType.Name)
+}
+
+// Method returns the named method, or nil if there's no such method.
+func (h *Host) Method(name string) HostMethod {
+	return h.HostType.Methods[name]
+}
+
+// Call calls the named method with the args.
+func (h *Host) Call(method string, args []Object) Object {
+	m := h.Method(method)
+	if m == nil {
+		return &Error{Err: fmt.Errorf("%s has no method %s", h.HostType.Name, method)}
+	}
+	result, err := m(h.Value, args)
+	switch {
+	case err != nil:
+		return &Error{Err: fmt.Errorf("%s: %v", method, err)}
+	case result == nil:
+		return &Null{}
+	}
+	return result
+}
+
+// MethodNames returns the names of the methods, sorted.
+func (h *Host) MethodNames() []string {
+	var names []string
+	for name := range h.HostType.Methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// equal implements Equal for the host objects.
+func (h *Host) equal(other *Host) bool {
+	switch {
+	case h == other:
+		return true
+	case h.HostType != other.HostType:
+		return false
+	case h.HostType.Equal != nil:
+		return h.HostType.Equal(h.Value, other.Value)
+	}
+	if h.Value == nil || other.Value == nil {
+		return h.Value == other.Value
+	}
+	if !reflect.TypeOf(h.Value).Comparable() || reflect.TypeOf(h.Value) != reflect.TypeOf(other.Value) {
+		return false
+	}
+	return h.Value == other.Value
+}
@@ -10,13 +10,16 @@ type Type string
 
 // These are all the possible value types.
 const (
-	IntegerType = "INTEGER"
-	BooleanType = "BOOLEAN"
-	StringType  = "STRING"
-	NullType    = "NULL"
-	FuncType    = "FUNCTION"
-	ArrayType   = "ARRAY"
-	ErrType     = "ERROR"
+	IntegerType   = "INTEGER"
+	BooleanType   = "BOOLEAN"
+	StringType    = "STRING"
+	NullType      = "NULL"
+	FuncType      = "FUNCTION"
+	ArrayType     = "ARRAY"
+	ErrType       = "ERROR"
+	KeywordType   = "KEYWORD"
+	MapType       = "MAP"
+	GeneratorType = "GENERATOR"
 )
 
 // Object is an interface of any object in WELP.
@@ -87,6 +90,9 @@ func (n *Null) Inspect() string {
 // Func represents WELP's function values.
 type Func struct {
 	Name string
+	// Impl is the evaluator's representation of the function, opaque to
+	// everyone else.
+	Impl interface{}
 }
 
 // Type implements Object.
@@ -99,6 +105,38 @@ func (f *Func) Inspect() string {
 	return fmt.Sprintf("<func %s>", f.Name)
 }
 
+// Applicable is implemented by the Impl of the funcs that can be called from
+// outside of the code that created them, e.g. funcs compiled for the vm called
+// by the evaluator. Apply gets the args already evaluated, and reports errors
+// by returning an *Error.
+type Applicable interface {
+	Apply(args []Object) Object
+}
+
+// Iterable is implemented by the values that produce their items on demand,
+// like generators. Iterate calls yield with every item, stopping early if
+// yield returns false.
+type Iterable interface {
+	Object
+	Iterate(yield func(item Object) bool) error
+}
+
+// Keyword represents WELP's keywords, like :foo. Keywords evaluate to
+// themselves.
+type Keyword struct {
+	Name string
+}
+
+// Type implements Object.
+func (k *Keyword) Type() Type {
+	return KeywordType
+}
+
+// Inspect implements Object.
+func (k *Keyword) Inspect() string {
+	return ":" + k.Name
+}
+
 // Error represents WELP's error values.
 type Error struct {
 	Err error
@@ -141,3 +179,176 @@ func (a *Array) Inspect() string {
 	sb.WriteString("]")
 	return sb.String()
 }
+
+// NewArray creates an array of values. If all the values are of the same type,
+// the array is typed accordingly, otherwise it can hold anything.
+func NewArray(values []Object) *Array {
+	arr := &Array{Value: values}
+	for i, v := range values {
+		if i == 0 {
+			arr.ValueType = v.Type()
+		} else if v.Type() != arr.ValueType {
+			arr.ValueType = ""
+			break
+		}
+	}
+	return arr
+}
+
+// HashKey identifies a map key. Only integers, booleans, strings and keywords
+// can be used as keys.
+type HashKey struct {
+	Type  Type
+	Value string
+}
+
+// Hashable is implemented by objects that can be used as map keys.
+type Hashable interface {
+	Object
+	HashKey() HashKey
+}
+
+// HashKey implements Hashable.
+func (i *Integer) HashKey() HashKey {
+	return HashKey{Type: i.Type(), Value: i.Inspect()}
+}
+
+// HashKey implements Hashable.
+func (b *Boolean) HashKey() HashKey {
+	return HashKey{Type: b.Type(), Value: b.Inspect()}
+}
+
+// HashKey implements Hashable.
+func (s *String) HashKey() HashKey {
+	return HashKey{Type: s.Type(), Value: s.Value}
+}
+
+// HashKey implements Hashable.
+func (k *Keyword) HashKey() HashKey {
+	return HashKey{Type: k.Type(), Value: k.Name}
+}
+
+// MapPair is a single key-value pair of a map.
+type MapPair struct {
+	Key   Object
+	Value Object
+}
+
+// Map represents a map. It remembers the order in which the keys were
+// inserted.
+type Map struct {
+	keys  []HashKey
+	pairs map[HashKey]MapPair
+}
+
+// NewMap creates an empty map.
+func NewMap() *Map {
+	return &Map{pairs: make(map[HashKey]MapPair)}
+}
+
+// Type implements Object.
+func (m *Map) Type() Type {
+	return MapType
+}
+
+// Inspect implements Object.
+func (m *Map) Inspect() string {
+	sb := strings.Builder{}
+	sb.WriteString("{")
+	for i, pair := range m.Pairs() {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(pair.Key.Inspect())
+		sb.WriteString(" ")
+		sb.WriteString(pair.Value.Inspect())
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
+
+// Get looks up the value of a key.
+func (m *Map) Get(key Object) (Object, bool) {
+	h, ok := key.(Hashable)
+	if !ok {
+		return nil, false
+	}
+	pair, ok := m.pairs[h.HashKey()]
+	return pair.Value, ok
+}
+
+// Set associates a value with a key. It fails if the key is not Hashable.
+func (m *Map) Set(key, value Object) error {
+	h, ok := key.(Hashable)
+	if !ok {
+		return fmt.Errorf("unusable as map key: %v", key.Type())
+	}
+	hk := h.HashKey()
+	if _, ok := m.pairs[hk]; !ok {
+		m.keys = append(m.keys, hk)
+	}
+	m.pairs[hk] = MapPair{Key: key, Value: value}
+	return nil
+}
+
+// Len returns the number of pairs in the map.
+func (m *Map) Len() int {
+	return len(m.keys)
+}
+
+// Pairs returns all the pairs in insertion order.
+func (m *Map) Pairs() []MapPair {
+	pairs := make([]MapPair, len(m.keys))
+	for i, k := range m.keys {
+		pairs[i] = m.pairs[k]
+	}
+	return pairs
+}
+
+// Equal reports whether a and b are of the same type and hold equal values.
+// Arrays and maps are compared element by element, everything else that has
+// no value of its own (like funcs) by identity.
+func Equal(a, b Object) bool {
+	if a.Type() != b.Type() {
+		return false
+	}
+	switch left := a.(type) {
+	case *Integer:
+		return left.Value == b.(*Integer).Value
+	case *Boolean:
+		return left.Value == b.(*Boolean).Value
+	case *String:
+		return left.Value == b.(*String).Value
+	case *Keyword:
+		return left.Name == b.(*Keyword).Name
+	case *Null:
+		return true
+	case *Array:
+		right := b.(*Array)
+		if len(left.Value) != len(right.Value) {
+			return false
+		}
+		for i := range left.Value {
+			if !Equal(left.Value[i], right.Value[i]) {
+				return false
+			}
+		}
+		return true
+	case *Map:
+		right := b.(*Map)
+		if left.Len() != right.Len() {
+			return false
+		}
+		for _, pair := range left.Pairs() {
+			v, ok := right.Get(pair.Key)
+			if !ok || !Equal(pair.Value, v) {
+				return false
+			}
+		}
+		return true
+	case *Host:
+		return left.equal(b.(*Host))
+	default:
+		return a == b
+	}
+}
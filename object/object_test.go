@@ -14,3 +14,96 @@ func TestArray(t *testing.T) {
 	a.Value = []Object{&Integer{Value: 7}, &Integer{Value: 12}}
 	assert.Equal(t, "[7, 12]", a.Inspect())
 }
+
+func TestMap(t *testing.T) {
+	m := NewMap()
+	assert.Equal(t, "{}", m.Inspect())
+	assert.NoError(t, m.Set(&Keyword{Name: "b"}, &Integer{Value: 1}))
+	assert.NoError(t, m.Set(&String{Value: "a"}, &Integer{Value: 2}))
+	assert.NoError(t, m.Set(&Keyword{Name: "b"}, &Integer{Value: 3}))
+	assert.Error(t, m.Set(&Array{}, &Integer{Value: 4}))
+	assert.Equal(t, `{:b 3, "a" 2}`, m.Inspect())
+	assert.Equal(t, 2, m.Len())
+	v, ok := m.Get(&Keyword{Name: "b"})
+	assert.True(t, ok)
+	assert.Equal(t, &Integer{Value: 3}, v)
+	_, ok = m.Get(&String{Value: "b"})
+	assert.False(t, ok)
+}
+
+func TestEqual(t *testing.T) {
+	m1 := NewMap()
+	m1.Set(&Keyword{Name: "a"}, &Array{Value: []Object{&Integer{Value: 1}}})
+	m2 := NewMap()
+	m2.Set(&Keyword{Name: "a"}, &Array{Value: []Object{&Integer{Value: 1}}})
+	f := &Func{Name: "f"}
+	tests := []struct {
+		a, b     Object
+		expected bool
+	}{
+		{&Integer{Value: 1}, &Integer{Value: 1}, true},
+		{&Integer{Value: 1}, &String{Value: "1"}, false},
+		{&String{Value: "a"}, &String{Value: "a"}, true},
+		{&Keyword{Name: "a"}, &Keyword{Name: "b"}, false},
+		{&Null{}, &Null{}, true},
+		{&Array{Value: []Object{&Integer{Value: 1}}}, &Array{}, false},
+		{m1, m2, true},
+		{m1, NewMap(), false},
+		{f, f, true},
+		{f, &Func{Name: "f"}, false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, Equal(test.a, test.b), "Equal(%s, %s)",
+			test.a.Inspect(), test.b.Inspect())
+	}
+}
+
+func TestHost(t *testing.T) {
+	type conn struct{ name string }
+	connType := &HostType{
+		Name: "CONN",
+		Methods: map[string]HostMethod{
+			"name": func(value interface{}, args []Object) (Object, error) {
+				return &String{Value: value.(*conn).name}, nil
+			},
+			"close": func(value interface{}, args []Object) (Object, error) {
+				return nil, nil
+			},
+		},
+	}
+	a := NewHost(connType, &conn{name: "a"})
+	assert.Equal(t, Type("CONN"), a.Type())
+	assert.Equal(t, "<CONN>", a.Inspect())
+	assert.Equal(t, []string{"close", "name"}, a.MethodNames())
+	assert.Equal(t, `"a"`, a.Call("name", nil).Inspect())
+	assert.Equal(t, "null", a.Call("close", nil).Inspect())
+	assert.Equal(t, "ERR: CONN has no method open", a.Call("open", nil).Inspect())
+
+	// the pointers are compared
+	assert.True(t, Equal(a, NewHost(connType, a.Value)))
+	assert.False(t, Equal(a, NewHost(connType, &conn{name: "a"})))
+	assert.False(t, Equal(a, NewHost(&HostType{Name: "CONN"}, a.Value)))
+	// the values of uncomparable types are only equal to themselves
+	slices := &HostType{Name: "SLICE"}
+	s := NewHost(slices, []int{1})
+	assert.True(t, Equal(s, s))
+	assert.False(t, Equal(s, NewHost(slices, []int{1})))
+
+	named := &HostType{
+		Name:    "CONN",
+		Inspect: func(value interface{}) string { return "<conn " + value.(*conn).name + ">" },
+		Equal: func(a, b interface{}) bool {
+			return a.(*conn).name == b.(*conn).name
+		},
+	}
+	b := NewHost(named, &conn{name: "b"})
+	assert.Equal(t, "<conn b>", b.Inspect())
+	assert.True(t, Equal(b, NewHost(named, &conn{name: "b"})))
+
+	var c *conn
+	assert.NoError(t, ToGo(b, &c))
+	assert.Equal(t, "b", c.name)
+	var obj Object
+	assert.NoError(t, ToGo(b, &obj))
+	assert.Equal(t, b, obj)
+}
@@ -0,0 +1,265 @@
+package object
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// These are the types of the references to the state shared by goroutines.
+const (
+	AtomType = "ATOM"
+	RefType  = "REF"
+)
+
+// Reference is a value that holds another one, which can be changed and
+// watched.
+type Reference interface {
+	Object
+
+	// Deref returns the current value.
+	Deref() Object
+
+	// AddWatch adds a watch, replacing the one with an equal key.
+	AddWatch(key, fn Object)
+
+	// RemoveWatch removes the watch with an equal key.
+	RemoveWatch(key Object)
+}
+
+// Watch is a func called after a reference changes, with its key, the
+// reference, the old and the new value.
+type Watch struct {
+	Key Object
+	Fn  Object
+}
+
+// Change describes a change of a reference, for calling its watches. The
+// watches are the ones the reference had when it changed.
+type Change struct {
+	Ref      Reference
+	Old, New Object
+	Watches  []Watch
+}
+
+// watches is a list of the watches of a reference. It's guarded by the lock
+// of the reference.
+type watches []Watch
+
+func (w *watches) add(key, fn Object) {
+	w.remove(key)
+	*w = append(*w, Watch{Key: key, Fn: fn})
+}
+
+func (w *watches) remove(key Object) {
+	for i, watch := range *w {
+		if Equal(watch.Key, key) {
+			*w = append((*w)[:i:i], (*w)[i+1:]...)
+			return
+		}
+	}
+}
+
+// Atom holds a value that any goroutine can change, atomically.
+type Atom struct {
+	mu      sync.Mutex
+	value   Object
+	watches watches
+}
+
+// NewAtom creates an atom holding value.
+func NewAtom(value Object) *Atom {
+	return &Atom{value: value}
+}
+
+// Type implements Object.
+func (a *Atom) Type() Type {
+	return AtomType
+}
+
+// Inspect implements Object.
+func (a *Atom) Inspect() string {
+	return fmt.Sprintf("<atom %s>", a.Deref().Inspect())
+}
+
+// Deref implements Reference.
+func (a *Atom) Deref() Object {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.value
+}
+
+// CompareAndSet sets the value to new if it's still old, which is compared
+// by identity. It reports whether it did.
+func (a *Atom) CompareAndSet(old, new Object) (Change, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.value != old {
+		return Change{}, false
+	}
+	a.value = new
+	return Change{Ref: a, Old: old, New: new, Watches: a.watches}, true
+}
+
+// Reset sets the value to new.
+func (a *Atom) Reset(new Object) Change {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	old := a.value
+	a.value = new
+	return Change{Ref: a, Old: old, New: new, Watches: a.watches}
+}
+
+// AddWatch implements Reference.
+func (a *Atom) AddWatch(key, fn Object) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.watches.add(key, fn)
+}
+
+// RemoveWatch implements Reference.
+func (a *Atom) RemoveWatch(key Object) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.watches.remove(key)
+}
+
+// Ref holds a value that's changed by transactions, which change all the
+// refs they touch at once, or none of them.
+type Ref struct {
+	mu      sync.Mutex
+	value   Object
+	version uint64 // incremented by every change
+	watches watches
+}
+
+// NewRef creates a ref holding value.
+func NewRef(value Object) *Ref {
+	return &Ref{value: value}
+}
+
+// Type implements Object.
+func (r *Ref) Type() Type {
+	return RefType
+}
+
+// Inspect implements Object.
+func (r *Ref) Inspect() string {
+	return fmt.Sprintf("<ref %s>", r.Deref().Inspect())
+}
+
+// Deref implements Reference. It returns the value committed last.
+func (r *Ref) Deref() Object {
+	value, _ := r.current()
+	return value
+}
+
+func (r *Ref) current() (Object, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.value, r.version
+}
+
+// AddWatch implements Reference.
+func (r *Ref) AddWatch(key, fn Object) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.watches.add(key, fn)
+}
+
+// RemoveWatch implements Reference.
+func (r *Ref) RemoveWatch(key Object) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.watches.remove(key)
+}
+
+// Transaction changes a number of refs at once. The refs are read and set
+// through it, and the changes are only seen by the others once it commits.
+// A transaction is used by one goroutine.
+type Transaction struct {
+	// seen holds the versions of the refs the transaction has read or set,
+	// which must be current when it commits
+	seen map[*Ref]uint64
+
+	// values holds the values of those refs, as seen by the transaction
+	values map[*Ref]Object
+
+	// set holds the refs the transaction has set
+	set map[*Ref]bool
+}
+
+// NewTransaction starts a transaction.
+func NewTransaction() *Transaction {
+	return &Transaction{
+		seen:   make(map[*Ref]uint64),
+		values: make(map[*Ref]Object),
+		set:    make(map[*Ref]bool),
+	}
+}
+
+// Deref returns the value of the ref, as seen by the transaction: the one it
+// has set, or the one it read first.
+func (tx *Transaction) Deref(r *Ref) Object {
+	if value, ok := tx.values[r]; ok {
+		return value
+	}
+	value, version := r.current()
+	tx.seen[r] = version
+	tx.values[r] = value
+	return value
+}
+
+// Set sets the value of the ref, once the transaction commits.
+func (tx *Transaction) Set(r *Ref, value Object) {
+	tx.Deref(r)
+	tx.values[r] = value
+	tx.set[r] = true
+}
+
+// Valid tells if none of the refs the transaction has seen has changed since.
+// A transaction that isn't valid has to be retried.
+func (tx *Transaction) Valid() bool {
+	for r, version := range tx.seen {
+		if _, current := r.current(); current != version {
+			return false
+		}
+	}
+	return true
+}
+
+// Commit makes the changes of the transaction seen, unless any of the refs
+// the transaction has seen has changed since, in which case it changes
+// nothing. It reports whether it committed.
+func (tx *Transaction) Commit() ([]Change, bool) {
+	refs := make([]*Ref, 0, len(tx.seen))
+	for r := range tx.seen {
+		refs = append(refs, r)
+	}
+	// the refs are locked in the same order by every transaction, so that
+	// they don't deadlock
+	sort.Slice(refs, func(i, j int) bool {
+		return reflect.ValueOf(refs[i]).Pointer() < reflect.ValueOf(refs[j]).Pointer()
+	})
+	for _, r := range refs {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+	}
+	for _, r := range refs {
+		if r.version != tx.seen[r] {
+			return nil, false
+		}
+	}
+	var changes []Change
+	for _, r := range refs {
+		if !tx.set[r] {
+			continue
+		}
+		changes = append(changes, Change{Ref: r, Old: r.value, New: tx.values[r],
+			Watches: r.watches})
+		r.value = tx.values[r]
+		r.version++
+	}
+	return changes, true
+}
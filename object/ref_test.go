@@ -0,0 +1,90 @@
+package object
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAtom(t *testing.T) {
+	a := NewAtom(&Integer{Value: 0})
+	a.AddWatch(&Keyword{Name: "w"}, &Null{})
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				old := a.Deref()
+				value := &Integer{Value: old.(*Integer).Value + 1}
+				if change, ok := a.CompareAndSet(old, value); ok {
+					assert.Len(t, change.Watches, 1)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, "<atom 100>", a.Inspect())
+	change := a.Reset(&String{Value: "x"})
+	assert.Equal(t, "100", change.Old.Inspect())
+	a.RemoveWatch(&Keyword{Name: "w"})
+	assert.Empty(t, a.Reset(&Null{}).Watches)
+	// the change keeps the watches the atom had
+	assert.Len(t, change.Watches, 1)
+}
+
+func TestTransaction(t *testing.T) {
+	accounts := []*Ref{NewRef(&Integer{Value: 100}), NewRef(&Integer{Value: 100}),
+		NewRef(&Integer{Value: 100})}
+	var wg sync.WaitGroup
+	for i := 0; i < 300; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			from, to := accounts[i%3], accounts[(i+1)%3]
+			for {
+				tx := NewTransaction()
+				tx.Set(from, &Integer{Value: tx.Deref(from).(*Integer).Value - 1})
+				tx.Set(to, &Integer{Value: tx.Deref(to).(*Integer).Value + 1})
+				if _, ok := tx.Commit(); ok {
+					return
+				}
+			}
+		}(i)
+	}
+	// the transactions that only read see consistent values
+	for i := 0; i < 100; i++ {
+		tx := NewTransaction()
+		sum := int64(0)
+		for _, r := range accounts {
+			sum += tx.Deref(r).(*Integer).Value
+		}
+		if _, ok := tx.Commit(); ok {
+			assert.Equal(t, int64(300), sum)
+		}
+	}
+	wg.Wait()
+	for _, r := range accounts {
+		assert.Equal(t, "<ref 100>", r.Inspect())
+	}
+}
+
+func TestTransactionConflict(t *testing.T) {
+	r := NewRef(&Integer{Value: 1})
+	tx := NewTransaction()
+	assert.Equal(t, "1", tx.Deref(r).Inspect())
+	tx.Set(r, &Integer{Value: 2})
+	assert.Equal(t, "2", tx.Deref(r).Inspect())
+	assert.Equal(t, "1", r.Deref().Inspect())
+	other := NewTransaction()
+	other.Set(r, &Integer{Value: 3})
+	changes, ok := other.Commit()
+	assert.True(t, ok)
+	assert.Len(t, changes, 1)
+	assert.False(t, tx.Valid())
+	_, ok = tx.Commit()
+	assert.False(t, ok)
+	assert.Equal(t, "3", r.Deref().Inspect())
+}
@@ -0,0 +1,351 @@
+// Package optimizer rewrites parsed welp expressions into cheaper equivalent
+// ones, before they get evaluated or compiled. It folds the arithmetic and the
+// comparisons of constants, inlines small non-recursive funcs, and removes
+// the cond clauses that can never be taken.
+//
+// The rewrites that depend on what a name refers to are only done when the
+// optimizer can be sure of it: a name that gets bound anywhere in the code,
+// e.g. as a param, a let binding or by set!, is never assumed to be a
+// primitive or an inlinable func. Code that uses defmacro, eval or import can
+// bind names the optimizer doesn't see, so such code only gets the cond
+// clauses removed.
+//
+// The errors raised by the inlined code report the position of the call
+// instead of the position inside the inlined func.
+package optimizer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rtfb/welp/lexer"
+	"github.com/rtfb/welp/parser"
+)
+
+// Note describes a single rewrite done by the optimizer.
+type Note struct {
+	Pos int
+	Msg string
+}
+
+func (n Note) String() string {
+	return fmt.Sprintf("position %d: %s", n.Pos, n.Msg)
+}
+
+// Optimizer rewrites expressions. It remembers the funcs defined by the
+// learned and optimized code, so that the code optimized later can get them
+// inlined.
+type Optimizer struct {
+	// funcs holds the funcs defined by the top level fn forms, which are
+	// the candidates for inlining
+	funcs map[string]*function
+
+	// bound holds the names bound anywhere other than by a top level fn,
+	// and the funcs defined more than once
+	bound map[string]bool
+
+	// dynamic is set if the code may bind names the optimizer doesn't see
+	dynamic bool
+
+	// inlining holds the funcs being inlined, to stop the mutually recursive
+	// ones from being inlined forever
+	inlining map[string]bool
+
+	notes []Note
+}
+
+// function is a func defined by a top level fn form.
+type function struct {
+	name   string
+	params []string
+	body   *parser.Node // nil if the func can't be inlined
+}
+
+// maxInlineSize limits the number of nodes in the body of an inlined func.
+const maxInlineSize = 16
+
+// specialForms are the forms the evaluator doesn't evaluate like func calls.
+var specialForms = map[string]bool{
+	"eval": true, "fn": true, "lambda": true, "defmacro": true, "cond": true,
+	"match": true, "define": true, "def": true, "let": true, "let*": true,
+	"letrec": true, "set!": true, "while": true, "dotimes": true,
+	"doseq": true, "for-each": true, "loop": true, "recur": true,
+	"break": true, "continue": true, "import": true, "module": true, ".": true,
+	"go": true, "select": true, "with-lock": true, "dosync": true, "future": true,
+	"reset": true, "shift": true, "generator": true, "defvar": true, "binding": true,
+	"parameterize": true, "handler-bind": true, "restart-case": true,
+}
+
+// New creates an Optimizer.
+func New() *Optimizer {
+	return &Optimizer{
+		funcs:    make(map[string]*function),
+		bound:    make(map[string]bool),
+		inlining: make(map[string]bool),
+	}
+}
+
+// Learn records the definitions made by exprs, like the ones of the stdlib,
+// without rewriting them. The code optimized later must be run with exprs
+// already evaluated.
+func (o *Optimizer) Learn(exprs ...*parser.Node) {
+	for _, expr := range exprs {
+		o.scanTop(expr)
+	}
+}
+
+// Optimize returns the rewritten exprs. The exprs have to make up all of the
+// code that's going to run after the learned code, so that the optimizer
+// sees all the names that get bound.
+func (o *Optimizer) Optimize(exprs ...*parser.Node) []*parser.Node {
+	o.Learn(exprs...)
+	result := make([]*parser.Node, len(exprs))
+	for i, expr := range exprs {
+		result[i] = o.optimizeTop(expr)
+	}
+	return result
+}
+
+// Notes returns the notes about the rewrites done so far.
+func (o *Optimizer) Notes() []Note {
+	return o.notes
+}
+
+func (o *Optimizer) note(pos int, format string, args ...interface{}) {
+	o.notes = append(o.notes, Note{Pos: pos, Msg: fmt.Sprintf(format, args...)})
+}
+
+// isAtom tells if the top level expr is a standalone atom, which the parser
+// wraps into a node of its own.
+func isAtom(expr *parser.Node) bool {
+	return expr.Tok.Typ == lexer.TokVoid && expr.L != nil && expr.R == nil
+}
+
+// head returns the name at the head of a (...) list, or "" if it doesn't
+// start with an identifier.
+func head(list *parser.Node) string {
+	if list.Tok.Typ != lexer.TokVoid || list.L == nil ||
+		list.L.Tok.Typ != lexer.TokIdentifier {
+		return ""
+	}
+	return string(list.L.Tok.Value)
+}
+
+// pos returns the position of an atom, or the position of the first atom in
+// a list.
+func pos(n *parser.Node) int {
+	for n != nil && n.Tok.Typ == lexer.TokVoid {
+		n = n.L
+	}
+	if n == nil {
+		return 0
+	}
+	return n.Tok.Pos
+}
+
+// elems returns the elements of a list.
+func elems(list *parser.Node) []*parser.Node {
+	var result []*parser.Node
+	for cell := list; cell != nil && cell.L != nil; cell = cell.R {
+		result = append(result, cell.L)
+	}
+	return result
+}
+
+// list makes a list of the elements, of the type of the list like.
+func list(like lexer.Token, elements []*parser.Node) *parser.Node {
+	first := &parser.Node{Tok: like}
+	cell := first
+	for _, elem := range elements {
+		cell.L = elem
+		cell.R = &parser.Node{}
+		cell = cell.R
+	}
+	return first
+}
+
+// isSpecial tells if name refers to a special form.
+func (o *Optimizer) isSpecial(name string) bool {
+	return specialForms[name] && !o.bound[name] && o.funcs[name] == nil
+}
+
+// scanTop records the names bound by a top level expr.
+func (o *Optimizer) scanTop(expr *parser.Node) {
+	if expr.Err != nil || isAtom(expr) {
+		return
+	}
+	if head(expr) != "fn" || !o.isSpecial("fn") {
+		o.scan(expr)
+		return
+	}
+	parts := elems(expr)
+	if len(parts) < 3 || parts[1].Tok.Typ != lexer.TokIdentifier {
+		o.scan(expr)
+		return
+	}
+	name := string(parts[1].Tok.Value)
+	if o.funcs[name] != nil || o.bound[name] {
+		delete(o.funcs, name)
+		o.bound[name] = true
+	} else {
+		o.funcs[name] = o.function(name, parts[2], parts[3:])
+	}
+	o.bindAll(parts[2])
+	for _, part := range parts[3:] {
+		o.scan(part)
+	}
+}
+
+// function makes a function out of the params and the body of an fn form,
+// which can be inlined only if it takes only the required params, and its
+// body is a single small expression which is made of func calls only and
+// doesn't call the func itself.
+func (o *Optimizer) function(name string, params *parser.Node, body []*parser.Node) *function {
+	f := &function{name: name}
+	for _, param := range elems(params) {
+		if param.Tok.Typ != lexer.TokIdentifier || strings.HasPrefix(string(param.Tok.Value), "&") {
+			return f
+		}
+		f.params = append(f.params, string(param.Tok.Value))
+	}
+	if len(body) != 1 {
+		return f
+	}
+	size := 0
+	ok := true
+	var walk func(n *parser.Node)
+	walk = func(n *parser.Node) {
+		size++
+		switch n.Tok.Typ {
+		case lexer.TokIdentifier:
+			if string(n.Tok.Value) == name {
+				ok = false
+			}
+			return
+		case lexer.TokNumber, lexer.TokString:
+			return
+		case lexer.TokVoid:
+			if n.L == nil || n.L.Tok.Typ != lexer.TokIdentifier || specialForms[head(n)] {
+				ok = false
+				return
+			}
+		}
+		for _, elem := range elems(n) {
+			walk(elem)
+		}
+	}
+	walk(body[0])
+	if ok && size <= maxInlineSize {
+		f.body = body[0]
+	}
+	return f
+}
+
+// scan records the names bound by expr and the exprs nested in it.
+func (o *Optimizer) scan(expr *parser.Node) {
+	if expr.Tok.Typ != lexer.TokVoid && expr.Tok.Typ != lexer.TokOpenBracket &&
+		expr.Tok.Typ != lexer.TokOpenBrace {
+		return
+	}
+	parts := elems(expr)
+	name := head(expr)
+	if !o.isSpecial(name) {
+		for _, part := range parts {
+			o.scan(part)
+		}
+		return
+	}
+	switch name {
+	case "defmacro", "eval", "import":
+		o.dynamic = true
+	case "let", "let*", "letrec", "loop", "binding", "parameterize":
+		if len(parts) > 1 {
+			for _, binding := range elems(parts[1]) {
+				if binding.Tok.Typ != lexer.TokVoid || binding.L == nil {
+					o.bindAll(binding)
+					continue
+				}
+				o.bindAll(binding.L)
+				for _, init := range elems(binding.R) {
+					o.scan(init)
+				}
+			}
+			parts = parts[1:]
+		}
+	case "define", "def", "defvar", "set!", "fn":
+		if len(parts) > 1 {
+			o.bindAll(parts[1])
+			parts = parts[1:]
+		}
+		if name == "fn" && len(parts) > 1 {
+			o.bindAll(parts[1])
+			parts = parts[1:]
+		}
+	case "lambda", "shift":
+		if len(parts) > 1 {
+			o.bindAll(parts[1])
+			parts = parts[1:]
+		}
+	case "dotimes", "doseq", "for-each":
+		if len(parts) > 1 && parts[1].L != nil {
+			o.bindAll(parts[1].L)
+			for _, part := range elems(parts[1].R) {
+				o.scan(part)
+			}
+			parts = parts[1:]
+		}
+	case "select":
+		for _, clause := range parts[1:] {
+			if clause.L != nil && head(clause.L) == "recv" && clause.R != nil {
+				o.bindAll(clause.R.L)
+			}
+		}
+	case "match":
+		if len(parts) > 1 {
+			o.scan(parts[1])
+			for _, clause := range parts[2:] {
+				if clause.L != nil {
+					o.bindAll(clause.L)
+					for _, part := range elems(clause.R) {
+						o.scan(part)
+					}
+				}
+			}
+		}
+		return
+	case "restart-case":
+		if len(parts) > 1 {
+			o.scan(parts[1])
+			for _, clause := range parts[2:] {
+				if clause.R != nil {
+					o.bindAll(clause.R.L)
+					for _, part := range elems(clause.R.R) {
+						o.scan(part)
+					}
+				}
+			}
+		}
+		return
+	}
+	for _, part := range parts[1:] {
+		o.scan(part)
+	}
+}
+
+// bindAll marks all the identifiers in n as bound. It's used for the param
+// lists and the patterns, which aren't worth taking apart: binding a few
+// extra names only makes the optimizer more careful.
+func (o *Optimizer) bindAll(n *parser.Node) {
+	if n == nil {
+		return
+	}
+	if n.Tok.Typ == lexer.TokIdentifier {
+		name := string(n.Tok.Value)
+		if name != "t" && name != "nil" && !strings.HasPrefix(name, ":") {
+			delete(o.funcs, name)
+			o.bound[name] = true
+		}
+	}
+	o.bindAll(n.L)
+	o.bindAll(n.R)
+}
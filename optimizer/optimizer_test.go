@@ -0,0 +1,96 @@
+package optimizer_test
+
+import (
+	"testing"
+
+	"github.com/rtfb/welp/evaluator"
+	"github.com/rtfb/welp/optimizer"
+	"github.com/rtfb/welp/parser"
+	"github.com/rtfb/welp/stdlib"
+	"github.com/stretchr/testify/assert"
+)
+
+// render renders a top level expression, which is a list unless it's a
+// standalone atom.
+func render(expr *parser.Node) string {
+	if expr.R == nil && expr.L != nil {
+		return expr.L.String()
+	}
+	return expr.String()
+}
+
+func TestOptimize(t *testing.T) {
+	lib, err := stdlib.Parse("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	evtor := evaluator.New()
+	tests := []struct {
+		input    []string
+		expected string
+	}{
+		{[]string{"(* 2 (+ 3 7))"}, "20"},
+		{[]string{"(< 1 2)"}, "t"},
+		{[]string{"(+1 41)"}, "42"},
+		{[]string{"(car [1 2 3])"}, "(let ((arr [1 2 3])) (nth 0 arr))"},
+		{[]string{"(let ((x [1 2])) (first x))"},
+			"(let ((x [1 2])) (let ((arr x)) (let ((arr arr)) (nth 0 arr))))"},
+		{[]string{"(cond ((eq 1 2) 1) ((< 1 2) 2) (t 3))"}, "2"},
+		{[]string{"(define n 5)", "(cond ((eq 1 2) 1) ((< 1 n) 2) (t 3))"},
+			"(cond ((< 1 n) 2) (t 3))"},
+		{[]string{"(define n 5)", "(cond ((> 1 n) 1) (t 2) (nil 3))"},
+			"(cond ((> 1 n) 1) (t 2))"},
+		{[]string{"(fn sq (x) (* x x))", "(sq 3)"}, "9"},
+		{[]string{"(fn sq (x) (* x x))", "(fn sq (x) x)", "(sq 3)"}, "(sq 3)"},
+		{[]string{"(fn down (n) (cond ((eq n 0) 0) (t (down (- n 1)))))", "(down 3)"},
+			"(down 3)"},
+		{[]string{"(let ((+ -)) (+ 1 2))"}, "(let ((+ -)) (+ 1 2))"},
+		{[]string{"(let () (fn f (x) (+ x 1)) (f (+ 1 1)))"},
+			"(let () (fn f (x) (+ x 1)) (f 2))"},
+		{[]string{"(let () (defmacro m () 1) (+ 1 2))"},
+			"(let () (defmacro m () 1) (+ 1 2))"},
+		{[]string{"(+ 1 :a)"}, "(+ 1 :a)"},
+		{[]string{"(let ((nth 1)) (car [1 2]))"}, "(let ((nth 1)) (car [1 2]))"},
+		{[]string{"(fn sq (x) (* x x))", "(recv (go (sq (+ 1 2))))"}, "(recv (go (sq 3)))"},
+		{[]string{"(fn sq (x) (* x x))", "(let ((ch (chan 1))) (send ch 2) (select ((recv ch) v (sq v)) ((timeout (* 10 10)) (sq 2))))"},
+			"(let ((ch (chan 1))) (send ch 2) (select ((recv ch) v (let ((x v)) (* x x))) ((timeout 100) 4)))"},
+		{[]string{"(reset (+ 1 (shift k (k (* 2 5)))))"}, "(reset (+ 1 (shift k (k 10))))"},
+		{[]string{"(handler-bind ((:oops (lambda (k v) (* 2 2)))) (+ 1 1))"},
+			"(handler-bind ((:oops (lambda (k v) 4))) 2)"},
+		{[]string{"(restart-case (* 2 3) (:use-value (x) (+ x (* 2 2))))"},
+			"(restart-case 6 (:use-value (x) (+ x 4)))"},
+	}
+	for _, test := range tests {
+		var exprs []*parser.Node
+		for _, input := range test.input {
+			exprs = append(exprs, parser.ParseString(input))
+		}
+		opt := optimizer.New()
+		opt.Learn(lib...)
+		optimized := opt.Optimize(exprs...)
+		last := optimized[len(optimized)-1]
+		assert.Equal(t, test.expected, render(last), "%q", test.input)
+
+		env, optEnv := evtor.NewEnv(), evtor.NewEnv()
+		for i := range exprs {
+			want := evaluator.Eval(env, exprs[i]).Inspect()
+			got := evaluator.Eval(optEnv, optimized[i]).Inspect()
+			assert.Equal(t, want, got, "eval(%q)", test.input[i])
+		}
+	}
+}
+
+func TestNotes(t *testing.T) {
+	opt := optimizer.New()
+	opt.Optimize(parser.ParseString("(* 2 (cond (nil 1) (t (+ 3 7))))"))
+	var notes []string
+	for _, note := range opt.Notes() {
+		notes = append(notes, note.String())
+	}
+	assert.Equal(t, []string{
+		"position 12: removed a cond clause that's never taken",
+		"position 23: folded (+ 3 7) into 10",
+		"position 20: replaced a cond with its last clause",
+		"position 1: folded (* 2 10) into 20",
+	}, notes)
+}
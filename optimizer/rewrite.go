@@ -0,0 +1,387 @@
+package optimizer
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/rtfb/welp/lexer"
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+	"github.com/rtfb/welp/primitive"
+)
+
+// foldable are the primitives without side effects, which can be run at
+// compile time.
+var foldable = map[string]bool{
+	"+": true, "-": true, "*": true, "exp": true, "eq": true, "<": true,
+	">": true, "<=": true, ">=": true, "not": true,
+}
+
+func (o *Optimizer) optimizeTop(expr *parser.Node) *parser.Node {
+	if expr.Err != nil || isAtom(expr) {
+		return expr
+	}
+	result := o.optimize(expr)
+	if result.Tok.Typ != lexer.TokVoid {
+		// the parser wraps the standalone atoms
+		return &parser.Node{L: result}
+	}
+	return result
+}
+
+// optimize returns the rewritten expr. It never modifies expr.
+func (o *Optimizer) optimize(expr *parser.Node) *parser.Node {
+	switch expr.Tok.Typ {
+	case lexer.TokOpenBracket, lexer.TokOpenBrace:
+		return list(expr.Tok, o.optimizeAll(elems(expr)))
+	case lexer.TokVoid:
+	default:
+		return expr
+	}
+	parts := elems(expr)
+	if len(parts) == 0 {
+		return expr
+	}
+	name := head(expr)
+	if o.isSpecial(name) {
+		return o.optimizeForm(expr, name, parts)
+	}
+	parts = o.optimizeAll(parts)
+	if name != "" && !o.dynamic && !o.bound[name] {
+		if folded := o.fold(name, parts); folded != nil {
+			return folded
+		}
+		if f := o.funcs[name]; f != nil {
+			if inlined := o.inline(f, parts); inlined != nil {
+				return inlined
+			}
+		}
+	}
+	return list(expr.Tok, parts)
+}
+
+func (o *Optimizer) optimizeAll(exprs []*parser.Node) []*parser.Node {
+	result := make([]*parser.Node, len(exprs))
+	for i, expr := range exprs {
+		result[i] = o.optimize(expr)
+	}
+	return result
+}
+
+// optimizeForm rewrites the exprs nested in a special form, leaving the
+// names, params and patterns alone.
+func (o *Optimizer) optimizeForm(expr *parser.Node, name string, parts []*parser.Node) *parser.Node {
+	// keep tells how many parts following the name aren't exprs
+	keep := 0
+	switch name {
+	case "defmacro", "module":
+		return expr
+	case "cond":
+		return o.optimizeCond(expr, parts)
+	case "let", "let*", "letrec", "loop", "binding", "parameterize", "handler-bind":
+		if len(parts) > 1 {
+			var bindings []*parser.Node
+			for _, binding := range elems(parts[1]) {
+				bindings = append(bindings, o.optimizeRest(binding))
+			}
+			parts = append([]*parser.Node{parts[0], list(parts[1].Tok, bindings)},
+				parts[2:]...)
+			keep = 1
+		}
+	case "dotimes", "doseq", "for-each":
+		if len(parts) > 1 {
+			parts = append([]*parser.Node{parts[0], o.optimizeRest(parts[1])}, parts[2:]...)
+			keep = 1
+		}
+	case "define", "def", "defvar", "set!", "lambda", "shift":
+		keep = 1
+	case "fn":
+		keep = 2
+	case ".":
+		if len(parts) > 2 {
+			result := []*parser.Node{parts[0], o.optimize(parts[1]), parts[2]}
+			return list(expr.Tok, append(result, o.optimizeAll(parts[3:])...))
+		}
+	case "go":
+		if len(parts) == 2 {
+			return list(expr.Tok, []*parser.Node{parts[0], o.optimizeRest(parts[1])})
+		}
+	case "select":
+		return o.optimizeSelect(expr, parts)
+	case "match":
+		if len(parts) > 1 {
+			clauses := []*parser.Node{parts[0], o.optimize(parts[1])}
+			for _, clause := range parts[2:] {
+				clauses = append(clauses, o.optimizeRest(clause))
+			}
+			return list(expr.Tok, clauses)
+		}
+	case "restart-case":
+		if len(parts) > 1 {
+			clauses := []*parser.Node{parts[0], o.optimize(parts[1])}
+			for _, clause := range parts[2:] {
+				clauses = append(clauses, o.optimizeRestart(clause))
+			}
+			return list(expr.Tok, clauses)
+		}
+	}
+	if keep >= len(parts) {
+		return expr
+	}
+	result := append([]*parser.Node{}, parts[:keep+1]...)
+	result = append(result, o.optimizeAll(parts[keep+1:])...)
+	return list(expr.Tok, result)
+}
+
+// optimizeSelect rewrites the args of the channel operations and the bodies
+// of the clauses of a select, leaving the operations themselves, and the
+// patterns of the recv clauses alone.
+func (o *Optimizer) optimizeSelect(expr *parser.Node, parts []*parser.Node) *parser.Node {
+	clauses := []*parser.Node{parts[0]}
+	for _, clause := range parts[1:] {
+		elements := elems(clause)
+		if clause.Tok.Typ != lexer.TokVoid || len(elements) == 0 {
+			return expr
+		}
+		keep := 1
+		if head(elements[0]) == "recv" {
+			keep = 2
+		}
+		if keep > len(elements) {
+			return expr
+		}
+		result := append([]*parser.Node{o.optimizeRest(elements[0])}, elements[1:keep]...)
+		result = append(result, o.optimizeAll(elements[keep:])...)
+		clauses = append(clauses, list(clause.Tok, result))
+	}
+	return list(expr.Tok, clauses)
+}
+
+// optimizeRestart rewrites the body of a restart-case clause, leaving its
+// name and params alone.
+func (o *Optimizer) optimizeRestart(clause *parser.Node) *parser.Node {
+	parts := elems(clause)
+	if clause.Tok.Typ != lexer.TokVoid || len(parts) < 2 {
+		return clause
+	}
+	return list(clause.Tok, append(parts[:2:2], o.optimizeAll(parts[2:])...))
+}
+
+// optimizeRest rewrites all but the first element of a list, like the init of
+// a binding or the body of a match clause.
+func (o *Optimizer) optimizeRest(expr *parser.Node) *parser.Node {
+	parts := elems(expr)
+	if expr.Tok.Typ != lexer.TokVoid || len(parts) == 0 {
+		return expr
+	}
+	return list(expr.Tok, append([]*parser.Node{parts[0]}, o.optimizeAll(parts[1:])...))
+}
+
+// optimizeCond rewrites the clauses of a cond, and drops the ones that can't
+// be taken. Like in the evaluator, the condition of the last clause is never
+// checked, and only the first expr of the taken clause is evaluated.
+func (o *Optimizer) optimizeCond(expr *parser.Node, parts []*parser.Node) *parser.Node {
+	var clauses []*parser.Node
+	for i, clause := range parts[1:] {
+		clause = o.optimizeRest(o.optimizeFirst(clause))
+		last := i == len(parts)-2
+		switch cond := literalName(clause.L); {
+		case last:
+		case cond == "nil":
+			o.note(pos(clause), "removed a cond clause that's never taken")
+			continue
+		case cond == "t" && clause.R != nil && clause.R.L != nil:
+			if len(clauses) == 0 {
+				o.note(pos(clause), "replaced a cond with the clause that's always taken")
+				return clause.R.L
+			}
+			// the following clauses are never reached, and this one
+			// becomes the last
+			o.note(pos(clause), "removed the cond clauses after one that's always taken")
+			clauses = append(clauses, clause)
+			return list(expr.Tok, append([]*parser.Node{parts[0]}, clauses...))
+		}
+		clauses = append(clauses, clause)
+	}
+	if len(clauses) == 1 && clauses[0].R != nil && clauses[0].R.L != nil {
+		o.note(pos(clauses[0]), "replaced a cond with its last clause")
+		return clauses[0].R.L
+	}
+	return list(expr.Tok, append([]*parser.Node{parts[0]}, clauses...))
+}
+
+// optimizeFirst rewrites the first element of a list, like the condition of
+// a cond clause.
+func (o *Optimizer) optimizeFirst(expr *parser.Node) *parser.Node {
+	parts := elems(expr)
+	if expr.Tok.Typ != lexer.TokVoid || len(parts) == 0 {
+		return expr
+	}
+	parts[0] = o.optimize(parts[0])
+	return list(expr.Tok, parts)
+}
+
+// fold runs a call to a foldable primitive whose args are all literals. It
+// returns nil if the call can't be folded, including the calls that fail,
+// which are left to fail at run time.
+func (o *Optimizer) fold(name string, parts []*parser.Node) *parser.Node {
+	if !foldable[name] || o.funcs[name] != nil {
+		return nil
+	}
+	var args []object.Object
+	for _, part := range parts[1:] {
+		value := literal(part)
+		if value == nil {
+			return nil
+		}
+		args = append(args, value)
+	}
+	result := primitive.Table[name](args)
+	node := toNode(result, pos(parts[0]))
+	if node != nil {
+		o.note(pos(parts[0]), "folded %s into %s", list(lexer.Token{}, parts), node)
+	}
+	return node
+}
+
+// literal returns the value of a literal, or nil if n isn't one.
+func literal(n *parser.Node) object.Object {
+	if n == nil {
+		return nil
+	}
+	switch n.Tok.Typ {
+	case lexer.TokNumber:
+		v, err := strconv.ParseInt(string(n.Tok.Value), 10, 64)
+		if err != nil {
+			return nil
+		}
+		return &object.Integer{Value: v}
+	case lexer.TokString:
+		return &object.String{Value: string(n.Tok.Value)}
+	case lexer.TokIdentifier:
+		name := string(n.Tok.Value)
+		switch {
+		case name == "t":
+			return &object.Boolean{Value: true}
+		case name == "nil":
+			return &object.Boolean{Value: false}
+		case strings.HasPrefix(name, ":") && len(name) > 1:
+			return &object.Keyword{Name: name[1:]}
+		}
+	}
+	return nil
+}
+
+// literalName returns the name of the t or nil literal, or "" if n is
+// neither.
+func literalName(n *parser.Node) string {
+	if b, ok := literal(n).(*object.Boolean); ok {
+		if b.Value {
+			return "t"
+		}
+		return "nil"
+	}
+	return ""
+}
+
+// toNode makes a literal out of the value, or returns nil if the value can't
+// be written as one.
+func toNode(value object.Object, pos int) *parser.Node {
+	tok := lexer.Token{Pos: pos}
+	switch value := value.(type) {
+	case *object.Integer:
+		tok.Typ = lexer.TokNumber
+		tok.Value = []byte(strconv.FormatInt(value.Value, 10))
+	case *object.String:
+		tok.Typ = lexer.TokString
+		tok.Value = []byte(value.Value)
+	case *object.Boolean:
+		tok.Typ = lexer.TokIdentifier
+		tok.Value = []byte("nil")
+		if value.Value {
+			tok.Value = []byte("t")
+		}
+	case *object.Keyword:
+		tok.Typ = lexer.TokIdentifier
+		tok.Value = []byte(":" + value.Name)
+	default:
+		return nil
+	}
+	return &parser.Node{Tok: tok}
+}
+
+// inline replaces a call to f with the body of f. The args that are literals
+// are substituted for the params, the rest are bound by a let around the
+// body. It returns nil if the call can't be inlined.
+func (o *Optimizer) inline(f *function, parts []*parser.Node) *parser.Node {
+	args := parts[1:]
+	if f.body == nil || len(args) != len(f.params) || o.inlining[f.name] {
+		return nil
+	}
+	params := make(map[string]bool)
+	for _, param := range f.params {
+		params[param] = true
+	}
+	if !o.canInline(f.body, params) {
+		return nil
+	}
+	callPos := pos(parts[0])
+	subst := make(map[string]*parser.Node)
+	var bindings []*parser.Node
+	for i, param := range f.params {
+		if literal(args[i]) != nil {
+			subst[param] = args[i]
+			continue
+		}
+		paramNode := &parser.Node{Tok: lexer.Token{Typ: lexer.TokIdentifier,
+			Value: []byte(param), Pos: callPos}}
+		bindings = append(bindings, list(lexer.Token{}, []*parser.Node{paramNode, args[i]}))
+	}
+	if len(bindings) > 0 && !o.isSpecial("let") {
+		return nil
+	}
+	body := copyNode(f.body, subst, callPos)
+	o.note(callPos, "inlined %s", f.name)
+	o.inlining[f.name] = true
+	body = o.optimize(body)
+	delete(o.inlining, f.name)
+	if len(bindings) == 0 {
+		return body
+	}
+	let := &parser.Node{Tok: lexer.Token{Typ: lexer.TokIdentifier, Value: []byte("let"),
+		Pos: callPos}}
+	return list(lexer.Token{}, []*parser.Node{let, list(lexer.Token{}, bindings), body})
+}
+
+// canInline tells if the names the body refers to, other than the params,
+// mean the same at the call site as they do in the func.
+func (o *Optimizer) canInline(body *parser.Node, params map[string]bool) bool {
+	if body == nil {
+		return true
+	}
+	if body.Tok.Typ == lexer.TokIdentifier {
+		name := string(body.Tok.Value)
+		if !params[name] && literal(body) == nil && o.bound[name] {
+			return false
+		}
+	}
+	return o.canInline(body.L, params) && o.canInline(body.R, params)
+}
+
+// copyNode copies n, substituting the identifiers found in subst, and moving
+// the copied atoms to pos.
+func copyNode(n *parser.Node, subst map[string]*parser.Node, pos int) *parser.Node {
+	if n == nil {
+		return nil
+	}
+	if n.Tok.Typ == lexer.TokIdentifier {
+		if s, ok := subst[string(n.Tok.Value)]; ok {
+			return s
+		}
+	}
+	c := &parser.Node{Tok: n.Tok, L: copyNode(n.L, subst, pos), R: copyNode(n.R, subst, pos)}
+	if c.Tok.Typ != lexer.TokVoid {
+		c.Tok.Pos = pos
+	}
+	return c
+}
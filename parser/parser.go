@@ -1,19 +1,74 @@
 package parser
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 
 	"github.com/rtfb/welp/lexer"
 )
 
-// Node defines a single node in the s-expression.
+// Node defines a single node in the s-expression. A list is a chain of nodes
+// linked by R, holding the elements in L. The first node of a list stands for
+// the list itself: its Tok is void for (...) lists, TokOpenBracket for [...]
+// and TokOpenBrace for {...}.
 type Node struct {
 	Tok  lexer.Token
 	L, R *Node
 	Err  error
+
+	memo atomic.Value // see SetMemo
+}
+
+// Memo returns the value stored by SetMemo, or nil if there's none.
+func (n *Node) Memo() interface{} {
+	return n.memo.Load()
+}
+
+// SetMemo stores a value derived from the node, like its compiled form, for
+// the users of the tree. The value lives as long as the node does. The values
+// stored for a node have to be of the same type.
+func (n *Node) SetMemo(v interface{}) {
+	n.memo.Store(v)
+}
+
+// String renders the node back to source code. For a list, it renders the
+// whole list.
+func (n *Node) String() string {
+	var sb strings.Builder
+	n.write(&sb)
+	return sb.String()
+}
+
+func (n *Node) write(sb *strings.Builder) {
+	switch n.Tok.Typ {
+	case lexer.TokString:
+		sb.WriteString(strconv.Quote(string(n.Tok.Value)))
+		return
+	case lexer.TokNumber, lexer.TokIdentifier:
+		sb.Write(n.Tok.Value)
+		return
+	}
+	open, close := "(", ")"
+	switch n.Tok.Typ {
+	case lexer.TokOpenBracket:
+		open, close = "[", "]"
+	case lexer.TokOpenBrace:
+		open, close = "{", "}"
+	}
+	sb.WriteString(open)
+	for cell := n; cell != nil && cell.L != nil; cell = cell.R {
+		if cell != n {
+			sb.WriteString(" ")
+		}
+		cell.L.write(sb)
+	}
+	sb.WriteString(close)
 }
 
 // Parser contains the state of the parser.
@@ -24,6 +79,18 @@ type Parser struct {
 	done   bool
 	tokzer *lexer.Tokenizer
 	debug  bool
+	open   []lexer.TokType // closing tokens expected for the open lists
+	err    error
+
+	// pos is the position following the last token received, which is
+	// tracked here since the lexer's own position belongs to its goroutine
+	pos int
+}
+
+var closers = map[lexer.TokType]lexer.TokType{
+	lexer.TokOpenParen:   lexer.TokCloseParen,
+	lexer.TokOpenBracket: lexer.TokCloseBracket,
+	lexer.TokOpenBrace:   lexer.TokCloseBrace,
 }
 
 // New constructs a Parser.
@@ -41,6 +108,7 @@ func (p *Parser) rparse() {
 	var tok lexer.Token
 	for tok.Typ != lexer.TokEOF {
 		tok = <-p.tokzer.Tok
+		p.pos = tok.Pos + len(tok.Value)
 		if p.debug {
 			fmt.Println(&tok)
 		}
@@ -49,15 +117,20 @@ func (p *Parser) rparse() {
 		}
 		var treeNode *Node
 		switch tok.Typ {
-		case lexer.TokOpenParen:
+		case lexer.TokOpenParen, lexer.TokOpenBracket, lexer.TokOpenBrace:
 			p.depth++
+			p.open = append(p.open, closers[tok.Typ])
+			list := &Node{}
+			if tok.Typ != lexer.TokOpenParen {
+				list.Tok = tok
+			}
 			var branchPoint *Node
 			if p.tree == nil {
-				p.tree = &Node{}
+				p.tree = list
 				p.head = p.tree
 			} else {
 				branchPoint = p.head
-				p.head.L = &Node{}
+				p.head.L = list
 				p.head = p.head.L
 			}
 			p.rparse()
@@ -69,7 +142,14 @@ func (p *Parser) rparse() {
 				p.head = branchPoint.R
 			}
 			continue
-		case lexer.TokCloseParen:
+		case lexer.TokCloseParen, lexer.TokCloseBracket, lexer.TokCloseBrace:
+			if len(p.open) == 0 || p.open[len(p.open)-1] != tok.Typ {
+				if p.err == nil {
+					p.err = fmt.Errorf("unexpected %q at position %d", tok.Value, tok.Pos)
+				}
+			} else {
+				p.open = p.open[:len(p.open)-1]
+			}
 			p.depth--
 			if p.depth == 0 {
 				p.done = true
@@ -108,11 +188,20 @@ func (p *Parser) Start() {
 	go p.tokzer.OnStart()
 }
 
+// Stop stops the concurrent part of the parser, which otherwise lingers
+// until the whole input is parsed. The parser can't be used afterwards.
+func (p *Parser) Stop() {
+	p.tokzer.Stop()
+}
+
 // Parse parses source code into an expression tree.
 func (p *Parser) Parse() (node *Node, n int) {
 	p.Reset()
 	p.rparse()
-	return p.tree, p.tokzer.Head
+	if p.err != nil && p.tree != nil {
+		p.tree.Err = p.err
+	}
+	return p.tree, p.pos
 }
 
 // Reset clears parser state.
@@ -120,39 +209,76 @@ func (p *Parser) Reset() {
 	p.tree = nil
 	p.head = nil
 	p.done = false
+	p.open = nil
+	p.err = nil
 }
 
 // ParseString is a convenience func that parses a string.
 func ParseString(input string) *Node {
 	p := New(strings.NewReader(input))
 	p.Start()
+	defer p.Stop()
 	n, _ := p.Parse()
 	return n
 }
 
+// ParseFile reads and parses all expressions in the named file. The
+// expressions that failed to parse have their Err set.
+func ParseFile(name string) ([]*Node, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var exprs []*Node
+	for expr := range ParseStream(f) {
+		exprs = append(exprs, expr)
+	}
+	return exprs, nil
+}
+
 // ParseStream reads and parses all expressions from a given stream and sends
-// them down the channel.
+// them down the channel. The channel has to be drained, see
+// ParseStreamContext for stopping early.
 func ParseStream(r io.Reader) <-chan *Node {
+	return ParseStreamContext(context.Background(), r)
+}
+
+// ParseStreamContext is like ParseStream, but it stops parsing and closes the
+// channel once ctx is done. The goroutines parsing the stream exit once they
+// are done reading the current expression.
+func ParseStreamContext(ctx context.Context, r io.Reader) <-chan *Node {
 	p := New(r)
 	p.Start()
 	n := 0
 	ch := make(chan *Node)
+	send := func(node *Node) bool {
+		select {
+		case ch <- node:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
 	go func() {
-		for {
+		defer close(ch)
+		defer p.Stop()
+		for ctx.Err() == nil {
 			node, newN := p.Parse()
 			if node == nil {
-				break
+				return
 			}
 			if newN == n {
-				ch <- &Node{
+				send(&Node{
 					Err: errors.New("newN == n, can't progress"),
-				}
-				break
+				})
+				return
 			}
 			n = newN
-			ch <- node
+			if !send(node) {
+				return
+			}
 		}
-		close(ch)
 	}()
 	return ch
 }
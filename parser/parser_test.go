@@ -1,7 +1,11 @@
 package parser
 
 import (
+	"context"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/rtfb/welp/lexer"
 	"github.com/stretchr/testify/assert"
@@ -14,3 +18,53 @@ func TestParseString(t *testing.T) {
 	assert.Equal(t, lexer.TokIdentifier, node.L.Tok.Typ)
 	assert.Equal(t, lexer.TokNumber, node.R.L.Tok.Typ)
 }
+
+func TestParseBrackets(t *testing.T) {
+	node := ParseString("(f [1 2] {:a 3})")
+	assert.NoError(t, node.Err)
+	assert.Equal(t, lexer.TokOpenBracket, node.R.L.Tok.Typ)
+	assert.Equal(t, lexer.TokNumber, node.R.L.L.Tok.Typ)
+	assert.Equal(t, lexer.TokOpenBrace, node.R.R.L.Tok.Typ)
+	assert.Equal(t, lexer.TokIdentifier, node.R.R.L.L.Tok.Typ)
+	node = ParseString("(f [1 2)]")
+	assert.EqualError(t, node.Err, `unexpected ")" at position 7`)
+}
+
+func TestNodeString(t *testing.T) {
+	tests := []string{
+		"(+ 1 2)",
+		`(let (([a b & c] [1 2 3]) ({:keys [x]} {:x "y\n"})) ())`,
+	}
+	for _, test := range tests {
+		assert.Equal(t, test, ParseString(test).String())
+	}
+}
+
+// goroutinesSettle waits for the number of goroutines to drop to n, returning
+// the number it drops to.
+func goroutinesSettle(n int) int {
+	for i := 0; i < 100 && runtime.NumGoroutine() > n; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	return runtime.NumGoroutine()
+}
+
+func TestParseStringStops(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		ParseString("(+ 1 2) (+ 3 4)")
+	}
+	assert.True(t, goroutinesSettle(before) <= before, "leaked goroutines")
+}
+
+func TestParseStreamContext(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := ParseStreamContext(ctx, strings.NewReader(strings.Repeat("(+ 1 2) ", 100)))
+	assert.Equal(t, "(+ 1 2)", (<-ch).String())
+	cancel()
+	for range ch {
+		// at most the expression being sent can still arrive
+	}
+	assert.True(t, goroutinesSettle(before) <= before, "leaked goroutines")
+}
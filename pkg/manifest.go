@@ -0,0 +1,180 @@
+// Package pkg implements the welp packages: directories of modules described
+// by a welp.mod manifest, which can depend on other packages found at local
+// paths or in tarballs. The dependencies are copied into the welp_modules
+// directory next to the manifest, where the imports find them by name.
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// ManifestName is the name of the manifest file.
+	ManifestName = "welp.mod"
+
+	// ModulesDir is the name of the directory the dependencies are
+	// vendored into.
+	ModulesDir = "welp_modules"
+)
+
+// Manifest describes a package. The manifest has a directive per line:
+//
+//	package geometry
+//	version 1.2.0
+//	main geometry.lisp
+//	require mathutil ../mathutil
+//	require strutil ../dist/strutil-0.3.tar.gz
+//
+// The package directive is required, the rest are optional. The names of the
+// packages can't contain path separators, and the main module has to be
+// inside the package. The required paths are relative to the directory of
+// the manifest. Everything following
+// a # is a comment.
+type Manifest struct {
+	Name     string
+	Version  string
+	Main     string
+	Requires []Require
+}
+
+// Require is a dependency of a package.
+type Require struct {
+	Name string
+	Path string // a directory, or a .tar, .tar.gz or .tgz file
+}
+
+// MainFile returns the module imported by the name of the package, which
+// defaults to the one named like the package.
+func (m *Manifest) MainFile() string {
+	if m.Main != "" {
+		return m.Main
+	}
+	return m.Name + ".lisp"
+}
+
+// ParseManifest parses a manifest, name is only used in the error messages.
+func ParseManifest(r io.Reader, name string) (*Manifest, error) {
+	m := &Manifest{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		args := len(fields) - 1
+		switch fields[0] {
+		case "package", "version", "main":
+			if args != 1 {
+				return nil, fmt.Errorf("%s:%d: %s expects a single argument", name, line, fields[0])
+			}
+			switch fields[0] {
+			case "package":
+				if !validName(fields[1]) {
+					return nil, fmt.Errorf("%s:%d: invalid package name %q", name, line, fields[1])
+				}
+				m.Name = fields[1]
+			case "version":
+				m.Version = fields[1]
+			case "main":
+				if !validPath(fields[1]) {
+					return nil, fmt.Errorf("%s:%d: invalid main module %q", name, line, fields[1])
+				}
+				m.Main = fields[1]
+			}
+		case "require":
+			if args != 2 {
+				return nil, fmt.Errorf("%s:%d: require expects a name and a path", name, line)
+			}
+			if !validName(fields[1]) {
+				return nil, fmt.Errorf("%s:%d: invalid package name %q", name, line, fields[1])
+			}
+			m.Requires = append(m.Requires, Require{Name: fields[1], Path: fields[2]})
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown directive %s", name, line, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if m.Name == "" {
+		return nil, fmt.Errorf("%s: missing the package directive", name)
+	}
+	return m, nil
+}
+
+// validName tells if name can name a package, which is also the name of its
+// directory in welp_modules.
+func validName(name string) bool {
+	return name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// validPath tells if path names a file inside the package.
+func validPath(path string) bool {
+	if filepath.IsAbs(path) || strings.HasPrefix(path, "/") {
+		return false
+	}
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadManifest reads the manifest in dir.
+func ReadManifest(dir string) (*Manifest, error) {
+	name := filepath.Join(dir, ManifestName)
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseManifest(f, name)
+}
+
+// Find returns the file of the module imported by path from a file in dir, if
+// the path names a package found in a welp_modules directory, either in dir
+// or in one of its parents. The path is either the name of the package,
+// which imports its main module, or the name followed by the path of a
+// module inside the package, like geometry/shapes. It returns "" if there's
+// no such package.
+func Find(dir, path string) (string, error) {
+	parts := strings.SplitN(filepath.ToSlash(path), "/", 2)
+	if parts[0] == "" || parts[0] == "." || parts[0] == ".." {
+		return "", nil
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		pkgDir := filepath.Join(dir, ModulesDir, parts[0])
+		if info, err := os.Stat(pkgDir); err == nil && info.IsDir() {
+			if len(parts) == 2 {
+				return filepath.Join(pkgDir, filepath.FromSlash(parts[1])), nil
+			}
+			m, err := ReadManifest(pkgDir)
+			if os.IsNotExist(err) {
+				m, err = &Manifest{Name: parts[0]}, nil
+			}
+			if err != nil {
+				return "", err
+			}
+			return filepath.Join(pkgDir, filepath.FromSlash(m.MainFile())), nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
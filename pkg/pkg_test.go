@@ -0,0 +1,187 @@
+package pkg
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseManifest(t *testing.T) {
+	m, err := ParseManifest(strings.NewReader(`
+		# the geometry package
+		package geometry
+		version 1.2.0  # stable
+		require mathutil ../mathutil
+		require strutil ../dist/strutil.tgz
+	`), "welp.mod")
+	assert.Nil(t, err)
+	assert.Equal(t, &Manifest{
+		Name:    "geometry",
+		Version: "1.2.0",
+		Requires: []Require{
+			{Name: "mathutil", Path: "../mathutil"},
+			{Name: "strutil", Path: "../dist/strutil.tgz"},
+		},
+	}, m)
+	assert.Equal(t, "geometry.lisp", m.MainFile())
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"version 1.0", "welp.mod: missing the package directive"},
+		{"package a\npackage", "welp.mod:2: package expects a single argument"},
+		{"package a\nrequire b", "welp.mod:2: require expects a name and a path"},
+		{"package a\nreplace b c", "welp.mod:2: unknown directive replace"},
+		{"package ../a", `welp.mod:1: invalid package name "../a"`},
+		{"package a\nrequire ../../x ../x", `welp.mod:2: invalid package name "../../x"`},
+		{"package a\nrequire b/c ../x", `welp.mod:2: invalid package name "b/c"`},
+		{"package a\nrequire .. ../x", `welp.mod:2: invalid package name ".."`},
+		{"package a\nmain ../a.lisp", `welp.mod:2: invalid main module "../a.lisp"`},
+		{"package a\nmain /a.lisp", `welp.mod:2: invalid main module "/a.lisp"`},
+	}
+	for _, test := range tests {
+		_, err := ParseManifest(strings.NewReader(test.input), "welp.mod")
+		assert.EqualError(t, err, test.expected, "ParseManifest(%q)", test.input)
+	}
+}
+
+// writeFiles writes the files into a fresh temporary directory, returning its
+// path.
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "welp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// writeTarball writes a gzipped tarball with the files.
+func writeTarball(t *testing.T, name string, files map[string]string) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVendor(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"app/welp.mod": "package app\nrequire geometry ../geometry\n",
+		"geometry/welp.mod": "package geometry\nversion 1.0.0\n" +
+			"require mathutil ../dist/mathutil-0.1.tar.gz\n",
+		"geometry/geometry.lisp":           "(fn area (r) (* 3 r r))",
+		"geometry/shapes/circle.lisp":      "(fn circle (r) r)",
+		"geometry/.git/HEAD":               "ref: refs/heads/master",
+		"geometry/welp_modules/old/x.lisp": "(define x 1)",
+		"app/welp_modules/stale/x.lisp":    "(define x 1)",
+	})
+	defer os.RemoveAll(dir)
+	writeTarball(t, filepath.Join(dir, "dist", "mathutil-0.1.tar.gz"), map[string]string{
+		"mathutil-0.1/welp.mod":      "package mathutil\nmain lib/math.lisp\n",
+		"mathutil-0.1/lib/math.lisp": "(fn twice (x) (* 2 x))",
+	})
+	app := filepath.Join(dir, "app")
+	assert.Nil(t, Vendor(app))
+	modules := filepath.Join(app, ModulesDir)
+	for _, name := range []string{
+		"geometry/welp.mod", "geometry/geometry.lisp", "geometry/shapes/circle.lisp",
+		"mathutil/welp.mod", "mathutil/lib/math.lisp",
+	} {
+		_, err := os.Stat(filepath.Join(modules, name))
+		assert.Nil(t, err, name)
+	}
+	for _, name := range []string{"stale", "geometry/.git", "geometry/welp_modules"} {
+		_, err := os.Stat(filepath.Join(modules, name))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+
+	src := filepath.Join(app, "src")
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"geometry", "geometry/geometry.lisp"},
+		{"geometry/shapes/circle", "geometry/shapes/circle"},
+		{"mathutil", "mathutil/lib/math.lisp"},
+		{"nope", ""},
+		{"../geometry", ""},
+	}
+	for _, test := range tests {
+		got, err := Find(src, test.path)
+		assert.Nil(t, err)
+		if test.expected != "" {
+			test.expected = filepath.Join(modules, filepath.FromSlash(test.expected))
+		}
+		assert.Equal(t, test.expected, got, "Find(%q)", test.path)
+	}
+}
+
+func TestVendorErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"wrong/welp.mod":   "package a\nrequire b ../b\n",
+		"b/welp.mod":       "package c\n",
+		"missing/welp.mod": "package a\nrequire b ../nope\n",
+		"clash/welp.mod":   "package a\nrequire b ../b1\nrequire c ../c\n",
+		"b1/welp.mod":      "package b\nversion 1\n",
+		"c/welp.mod":       "package c\nrequire b ../b2\n",
+		"b2/welp.mod":      "package b\nversion 2\n",
+		"escape/welp.mod":  "package a\nrequire d ../d\n",
+		"d/welp.mod":       "package d\nrequire ../../x ../b1\n",
+	})
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		dir      string
+		expected string
+	}{
+		{"wrong", "a requires b, but " + filepath.Join(dir, "b") + " is package c"},
+		{"missing", "a requires b: stat " + filepath.Join(dir, "nope") + ": no such file or directory"},
+		{"clash", "c requires b from " + filepath.Join(dir, "b2") +
+			", but it's already vendored from " + filepath.Join(dir, "b1")},
+		{"escape", "a requires d: " + filepath.Join(dir, "escape", ModulesDir, "d", ManifestName) +
+			`:2: invalid package name "../../x"`},
+	}
+	for _, test := range tests {
+		err := Vendor(filepath.Join(dir, test.dir))
+		assert.EqualError(t, err, test.expected, test.dir)
+	}
+	// the package with the bad manifest isn't left behind
+	_, err := os.Stat(filepath.Join(dir, "escape", ModulesDir, "d"))
+	assert.True(t, os.IsNotExist(err), "%v", err)
+	_, err = os.Stat(filepath.Join(dir, "x"))
+	assert.True(t, os.IsNotExist(err), "%v", err)
+}
@@ -0,0 +1,243 @@
+package pkg
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// vendored is a package copied into welp_modules.
+type vendored struct {
+	source   string
+	manifest *Manifest
+}
+
+// Vendor copies the dependencies of the package in dir, along with their own
+// dependencies, into dir/welp_modules, replacing what was there. The
+// dependencies all end up side by side, so a package required more than once
+// has to come in the same version every time.
+func Vendor(dir string) error {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(dir, ModulesDir)
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	done := make(map[string]*vendored)
+	type pending struct {
+		req  Require
+		base string // the directory the path is relative to
+		by   string // the package requiring it
+	}
+	var queue []pending
+	for _, req := range m.Requires {
+		queue = append(queue, pending{req, dir, m.Name})
+	}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		source := p.req.Path
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(p.base, source)
+		}
+		if v, ok := done[p.req.Name]; ok {
+			if v.source != source && !sameVersion(v.manifest, source) {
+				return fmt.Errorf("%s requires %s from %s, but it's already vendored from %s",
+					p.by, p.req.Name, source, v.source)
+			}
+			continue
+		}
+		// the name was checked by ParseManifest, so pkgDir is in dest
+		pkgDir := filepath.Join(dest, p.req.Name)
+		if err := place(source, pkgDir); err != nil {
+			os.RemoveAll(pkgDir)
+			return fmt.Errorf("%s requires %s: %v", p.by, p.req.Name, err)
+		}
+		dep, err := ReadManifest(pkgDir)
+		if err != nil {
+			os.RemoveAll(pkgDir)
+			return fmt.Errorf("%s requires %s: %v", p.by, p.req.Name, err)
+		}
+		if dep.Name != p.req.Name {
+			os.RemoveAll(pkgDir)
+			return fmt.Errorf("%s requires %s, but %s is package %s", p.by, p.req.Name,
+				source, dep.Name)
+		}
+		done[p.req.Name] = &vendored{source: source, manifest: dep}
+		base := source
+		if isTarball(source) {
+			base = filepath.Dir(source)
+		}
+		for _, req := range dep.Requires {
+			queue = append(queue, pending{req, base, dep.Name})
+		}
+	}
+	return nil
+}
+
+// sameVersion tells if the package at source has the version of m.
+func sameVersion(m *Manifest, source string) bool {
+	if isTarball(source) || m.Version == "" {
+		// reading a tarball's manifest means unpacking it, and
+		// packages without a version can't be told apart
+		return false
+	}
+	other, err := ReadManifest(source)
+	return err == nil && other.Version == m.Version
+}
+
+func isTarball(name string) bool {
+	return strings.HasSuffix(name, ".tar") || strings.HasSuffix(name, ".tar.gz") ||
+		strings.HasSuffix(name, ".tgz")
+}
+
+// place copies the package at source into dir.
+func place(source, dir string) error {
+	if isTarball(source) {
+		return extract(source, dir)
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is neither a directory nor a tarball", source)
+	}
+	return copyDir(source, dir)
+}
+
+// copyDir copies the files of the package, leaving out its own welp_modules
+// and the hidden files.
+func copyDir(src, dest string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel != "." && (strings.HasPrefix(info.Name(), ".") || rel == ModulesDir) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(dest, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return writeFile(target, f, info.Mode())
+	})
+}
+
+// extract unpacks the tarball into dir. If all the files in the tarball are
+// in a single top level directory without the manifest, as it's common for
+// tarballs, the files are taken out of the directory.
+func extract(name, dir string) error {
+	var prefix string
+	stripped := true
+	err := walkTar(name, func(hdr *tar.Header, r io.Reader) error {
+		path := strings.Trim(strings.TrimPrefix(filepath.ToSlash(hdr.Name), "./"), "/")
+		parts := strings.SplitN(path, "/", 2)
+		switch {
+		case len(parts) == 1 && hdr.Typeflag != tar.TypeDir:
+			stripped = false
+		case prefix == "":
+			prefix = parts[0]
+		case prefix != parts[0]:
+			stripped = false
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !stripped {
+		prefix = ""
+	}
+	return walkTar(name, func(hdr *tar.Header, r io.Reader) error {
+		path := strings.TrimPrefix(filepath.ToSlash(hdr.Name), "./")
+		if prefix != "" {
+			path = strings.TrimPrefix(strings.TrimPrefix(path, prefix), "/")
+		}
+		if path == "" {
+			return nil
+		}
+		target := filepath.Join(dir, filepath.FromSlash(path))
+		if !strings.HasPrefix(target, filepath.Clean(dir)+string(filepath.Separator)) {
+			return fmt.Errorf("%s: %s is outside of the package", name, hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			return os.MkdirAll(target, 0755)
+		case tar.TypeReg, tar.TypeRegA:
+			return writeFile(target, r, os.FileMode(hdr.Mode).Perm())
+		}
+		// the links and the special files have no business in a package
+		return nil
+	})
+}
+
+// walkTar calls fn for each entry of the tarball, which may be gzipped.
+func walkTar(name string, fn func(hdr *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if !strings.HasSuffix(name, ".tar") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func writeFile(name string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode|0200)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,406 @@
+// Package primitive implements the built-in functions that operate on already
+// evaluated values. They are shared by the evaluator and the vm, so that both
+// agree on what the primitives do.
+package primitive
+
+import (
+	"fmt"
+
+	"github.com/rtfb/welp/object"
+)
+
+// Func is a primitive function. Errors are reported by returning an
+// *object.Error.
+type Func func(args []object.Object) object.Object
+
+// Table maps the names of all the primitives to their implementations.
+var Table = map[string]Func{
+	"+":        Sum,
+	"-":        Sub,
+	"*":        Mul,
+	"exp":      Exp,
+	"eq":       Eq,
+	"<":        Less,
+	">":        Greater,
+	"<=":       LessOrEqual,
+	">=":       GreaterOrEqual,
+	"not":      Not,
+	"mk-array": MakeArray,
+	"append":   Append,
+	"nth":      Nth,
+	"len":      Len,
+	"get":      Get,
+	"print":    Print,
+	"take":     Take,
+	"seq":      Seq,
+}
+
+func errorf(format string, args ...interface{}) object.Object {
+	return &object.Error{Err: fmt.Errorf(format, args...)}
+}
+
+// ints checks that all the args are integers and returns their values.
+func ints(name string, args []object.Object) ([]int64, object.Object) {
+	values := make([]int64, len(args))
+	for i, arg := range args {
+		n, ok := arg.(*object.Integer)
+		if !ok {
+			return nil, errorf("type error: unexpected type %v for %s", arg.Type(), name)
+		}
+		values[i] = n.Value
+	}
+	return values, nil
+}
+
+// Sum adds integers up.
+// (+ 1 2 3) => 6
+func Sum(args []object.Object) object.Object {
+	values, err := ints("+", args)
+	if err != nil {
+		return err
+	}
+	acc := int64(0)
+	for _, v := range values {
+		acc += v
+	}
+	return &object.Integer{Value: acc}
+}
+
+// Sub subtracts the rest of the integers from the first one.
+// (- 10 2 3) => 5
+func Sub(args []object.Object) object.Object {
+	values, err := ints("-", args)
+	if err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		return errorf("- expects at least one arg")
+	}
+	acc := values[0]
+	for _, v := range values[1:] {
+		acc -= v
+	}
+	return &object.Integer{Value: acc}
+}
+
+// Mul multiplies integers.
+// (* 2 3 4) => 24
+func Mul(args []object.Object) object.Object {
+	values, err := ints("*", args)
+	if err != nil {
+		return err
+	}
+	acc := int64(1)
+	for _, v := range values {
+		acc *= v
+	}
+	return &object.Integer{Value: acc}
+}
+
+// Exp raises the base to the sum of the powers.
+// (exp base pow1 pow2 pow3) => base ^ (pow1 + pow2 + pow3)
+func Exp(args []object.Object) object.Object {
+	values, err := ints("exp", args)
+	if err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		return errorf("exp expects a base")
+	}
+	pow := int64(0)
+	for _, v := range values[1:] {
+		pow += v
+	}
+	result := values[0]
+	for ; pow > 1; pow-- {
+		result *= values[0]
+	}
+	return &object.Integer{Value: result}
+}
+
+// Eq compares two values of the same type.
+// (eq 3 3) => T
+// (eq 3 4) => NIL
+func Eq(args []object.Object) object.Object {
+	if len(args) != 2 {
+		return errorf("eq expects 2 args, got %d", len(args))
+	}
+	leftObj, rightObj := args[0], args[1]
+	if leftObj.Type() != rightObj.Type() {
+		return errorf("type mismatch: %v and %v", leftObj.Type(), rightObj.Type())
+	}
+	switch left := leftObj.(type) {
+	case *object.Integer:
+		right := rightObj.(*object.Integer)
+		return &object.Boolean{Value: left.Value == right.Value}
+	case *object.Boolean:
+		right := rightObj.(*object.Boolean)
+		return &object.Boolean{Value: left.Value == right.Value}
+	case *object.Error:
+		right := rightObj.(*object.Error)
+		return &object.Boolean{Value: left.Err == right.Err}
+	case *object.Host:
+		return &object.Boolean{Value: object.Equal(left, rightObj)}
+	default:
+		return errorf("types not comparable with eq: %v and %v",
+			leftObj.Type(), rightObj.Type())
+	}
+}
+
+// Less implements <.
+// (< 3 4) => T
+// (< 4 3) => NIL
+func Less(args []object.Object) object.Object {
+	return compareInts(args, "<", func(a, b int64) bool { return a < b })
+}
+
+// Greater implements >.
+func Greater(args []object.Object) object.Object {
+	return compareInts(args, ">", func(a, b int64) bool { return a > b })
+}
+
+// LessOrEqual implements <=.
+func LessOrEqual(args []object.Object) object.Object {
+	return compareInts(args, "<=", func(a, b int64) bool { return a <= b })
+}
+
+// GreaterOrEqual implements >=.
+func GreaterOrEqual(args []object.Object) object.Object {
+	return compareInts(args, ">=", func(a, b int64) bool { return a >= b })
+}
+
+func compareInts(args []object.Object, name string, cmp func(a, b int64) bool) object.Object {
+	if len(args) != 2 {
+		return errorf("%s expects 2 args, got %d", name, len(args))
+	}
+	left, lok := args[0].(*object.Integer)
+	right, rok := args[1].(*object.Integer)
+	if !lok || !rok {
+		return errorf("types not comparable with %s: %v and %v",
+			name, args[0].Type(), args[1].Type())
+	}
+	return &object.Boolean{Value: cmp(left.Value, right.Value)}
+}
+
+// Not negates the truthiness of a value.
+// (not nil) => T
+// (not 0) => NIL
+func Not(args []object.Object) object.Object {
+	if len(args) != 1 {
+		return errorf("not expects 1 arg, got %d", len(args))
+	}
+	return &object.Boolean{Value: !Truthy(args[0])}
+}
+
+// Truthy reports whether a value counts as true in a condition: everything
+// except false and null does.
+func Truthy(obj object.Object) bool {
+	switch o := obj.(type) {
+	case *object.Boolean:
+		return o.Value
+	case *object.Null:
+		return false
+	}
+	return true
+}
+
+// MakeArray creates an empty array.
+// (define arr (mk-array))
+// arr => []
+// TODO: find a way to specify the array type upfront.
+func MakeArray(args []object.Object) object.Object {
+	return &object.Array{Value: nil}
+}
+
+// Append appends values to an array in place.
+// (define arr (mk-array))
+// arr => []
+// (append arr 3 5)
+// arr => [3, 5]
+func Append(args []object.Object) object.Object {
+	if len(args) == 0 {
+		return errorf("append expects an array")
+	}
+	arr, ok := args[0].(*object.Array)
+	if !ok {
+		return errorf("expected array, got %v", args[0].Type())
+	}
+	for _, value := range args[1:] {
+		if len(arr.Value) == 0 {
+			arr.ValueType = value.Type()
+		} else if arr.ValueType != "" && value.Type() != arr.ValueType {
+			return errorf("type mismatch: %v and %v", value.Type(), arr.ValueType)
+		}
+		arr.Value = append(arr.Value, value)
+	}
+	return arr
+}
+
+// Nth returns an element of an array.
+// (append arr 1 2 3)
+// (nth 1 arr)
+// => 2
+func Nth(args []object.Object) object.Object {
+	if len(args) != 2 {
+		return errorf("nth expects 2 args, got %d", len(args))
+	}
+	index, ok := args[0].(*object.Integer)
+	if !ok {
+		return errorf("type mismatch: %v and %v", args[0].Type(), object.IntegerType)
+	}
+	arr, ok := args[1].(*object.Array)
+	if !ok {
+		return errorf("expected array, got %v", args[1].Type())
+	}
+	if index.Value < 0 || index.Value >= int64(len(arr.Value)) {
+		return errorf("out of bounds: %d >= %d", index.Value, len(arr.Value))
+	}
+	return arr.Value[index.Value]
+}
+
+// Len returns the length of an array.
+// (len (append (mk-array) 7 9))
+// => 2
+func Len(args []object.Object) object.Object {
+	if len(args) != 1 {
+		return errorf("len expects 1 arg, got %d", len(args))
+	}
+	arr, ok := args[0].(*object.Array)
+	if !ok {
+		return errorf("expected array, got %v", args[0].Type())
+	}
+	return &object.Integer{Value: int64(len(arr.Value))}
+}
+
+// Get looks up a key in a map.
+// (get {:a 1} :a) => 1
+// (get {:a 1} :b 0) => 0
+// Looking up a missing key without a default is an error.
+func Get(args []object.Object) object.Object {
+	if len(args) != 2 && len(args) != 3 {
+		return errorf("get expects 2 or 3 args, got %d", len(args))
+	}
+	m, ok := args[0].(*object.Map)
+	if !ok {
+		return errorf("expected map, got %v", args[0].Type())
+	}
+	if value, ok := m.Get(args[1]); ok {
+		return value
+	}
+	if len(args) == 3 {
+		return args[2]
+	}
+	return errorf("key not found: %s", args[1].Inspect())
+}
+
+// Print prints its args.
+// (print "hi") prints "hi" and returns null.
+func Print(args []object.Object) object.Object {
+	for _, arg := range args {
+		fmt.Println(arg.Inspect())
+	}
+	return &object.Null{}
+}
+
+// Iterate calls yield with every item of a collection, stopping early if
+// yield returns false. Strings are iterated by character, maps by [key value]
+// pairs, and the object.Iterables, like generators, produce their own items.
+func Iterate(coll object.Object, yield func(item object.Object) bool) error {
+	switch c := coll.(type) {
+	case *object.Array:
+		for _, item := range c.Value {
+			if !yield(item) {
+				return nil
+			}
+		}
+	case *object.Map:
+		for _, pair := range c.Pairs() {
+			if !yield(object.NewArray([]object.Object{pair.Key, pair.Value})) {
+				return nil
+			}
+		}
+	case *object.String:
+		for _, r := range c.Value {
+			if !yield(&object.String{Value: string(r)}) {
+				return nil
+			}
+		}
+	case *object.Null:
+	case object.Iterable:
+		return c.Iterate(yield)
+	default:
+		return fmt.Errorf("can't iterate over %v", coll.Type())
+	}
+	return nil
+}
+
+// Take returns an array of the first n items of a collection, see Iterate. It
+// stops iterating once it has them, so it takes from infinite generators too.
+// (take 2 [1 2 3]) => [1, 2]
+func Take(args []object.Object) object.Object {
+	if len(args) != 2 {
+		return errorf("take expects 2 args, got %d", len(args))
+	}
+	n, ok := args[0].(*object.Integer)
+	if !ok {
+		return errorf("type mismatch: %v and %v", args[0].Type(), object.IntegerType)
+	}
+	if n.Value <= 0 {
+		return object.NewArray([]object.Object{})
+	}
+	return Collect(args[1], n.Value, nil)
+}
+
+// Seq returns an array of all the items of a collection, see Iterate. An array
+// is returned as it is.
+// (seq "abc") => ["a", "b", "c"]
+func Seq(args []object.Object) object.Object {
+	if len(args) != 1 {
+		return errorf("seq expects 1 arg, got %d", len(args))
+	}
+	return Collect(args[0], -1, nil)
+}
+
+// Size tells how many values obj holds, for charging them against the
+// allocation limits: the elements of an array or a map, or the bytes of a
+// string.
+func Size(obj object.Object) int64 {
+	switch obj := obj.(type) {
+	case *object.Array:
+		return int64(len(obj.Value))
+	case *object.Map:
+		return int64(obj.Len())
+	case *object.String:
+		return int64(len(obj.Value))
+	}
+	return 0
+}
+
+// Collect returns an array of the first n items of a collection, or of all of
+// them if n is negative, like Take and Seq do. An array of all the items is
+// returned as it is. Unless count is nil, it's called before each item is
+// collected, and an error it returns stops the collecting and is returned
+// instead of the array.
+func Collect(coll object.Object, n int64, count func() object.Object) object.Object {
+	if arr, ok := coll.(*object.Array); ok && n < 0 {
+		return arr
+	}
+	items := []object.Object{}
+	var errObj object.Object
+	err := Iterate(coll, func(item object.Object) bool {
+		if count != nil {
+			if errObj = count(); errObj != nil {
+				return false
+			}
+		}
+		items = append(items, item)
+		return n < 0 || int64(len(items)) < n
+	})
+	switch {
+	case errObj != nil:
+		return errObj
+	case err != nil:
+		return &object.Error{Err: err}
+	}
+	return object.NewArray(items)
+}
@@ -0,0 +1,3 @@
+(fn identity (x) x)
+(fn car (arr) (nth 0 arr))
+(fn first (arr) (car arr))
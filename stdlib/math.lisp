@@ -0,0 +1,16 @@
+(fn +1 (arg) (+ arg 1))
+(fn 1+ (arg) (+1 arg))
+(fn 1- (arg) (- arg 1))
+(fn square (n) (* n n))
+(fn abs (n)
+  (cond
+    ((< n 0) (- 0 n))
+    (t n)))
+(fn min (a b)
+  (cond
+    ((< b a) b)
+    (t a)))
+(fn max (a b)
+  (cond
+    ((> b a) b)
+    (t a)))
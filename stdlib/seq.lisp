@@ -0,0 +1,12 @@
+(fn rest-impl (arr new-arr pos)
+  (cond
+    ((eq pos (len arr)) new-arr)
+    (t
+      (rest-impl arr (append new-arr (nth pos arr)) (+ pos 1)))))
+(fn rest (coll)
+  (rest-impl (seq coll) (mk-array) 1))
+(fn cdr (coll) (rest coll))
+(fn last (coll)
+  (let ((arr (seq coll)))
+    (nth (- (len arr) 1) arr)))
+(fn empty? (coll) (eq (len (take 1 coll)) 0))
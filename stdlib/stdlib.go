@@ -0,0 +1,47 @@
+// Package stdlib holds the welp standard library. The modules are embedded
+// into the binaries, so they don't depend on the working directory.
+package stdlib
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rtfb/welp/parser"
+)
+
+//go:embed *.lisp
+var files embed.FS
+
+// Modules are the names of the stdlib modules, in the order they're loaded.
+// Module foo is kept in foo.lisp.
+var Modules = []string{"core", "seq", "string", "math"}
+
+// Parse parses all the modules. If dir isn't empty, the modules are read from
+// the files in it instead of the embedded ones, which is meant for working on
+// the stdlib without rebuilding.
+func Parse(dir string) ([]*parser.Node, error) {
+	var exprs []*parser.Node
+	for _, module := range Modules {
+		name := module + ".lisp"
+		var src []byte
+		var err error
+		if dir == "" {
+			src, err = files.ReadFile(name)
+		} else {
+			src, err = os.ReadFile(filepath.Join(dir, name))
+		}
+		if err != nil {
+			return nil, err
+		}
+		for expr := range parser.ParseStream(bytes.NewReader(src)) {
+			if expr.Err != nil {
+				return nil, fmt.Errorf("stdlib %s: %v", name, expr.Err)
+			}
+			exprs = append(exprs, expr)
+		}
+	}
+	return exprs, nil
+}
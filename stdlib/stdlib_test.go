@@ -0,0 +1,16 @@
+package stdlib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	exprs, err := Parse("")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "(fn identity (x) x)", exprs[0].String())
+	}
+	_, err = Parse("no-such-dir")
+	assert.Error(t, err)
+}
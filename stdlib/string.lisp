@@ -0,0 +1,6 @@
+(fn chars (s)
+  (let ((acc (mk-array)))
+    (doseq (c s) (append acc c))
+    acc))
+(fn str-len (s) (len (chars s)))
+(fn str-empty? (s) (eq (str-len s) 0))
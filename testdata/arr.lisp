@@ -1,6 +1,6 @@
-(let arr (mk-array))
+(def arr (mk-array))
 (append arr 3 4 5)
-(let i 1)
+(def i 1)
 (nth i (append arr 7))
 (nth 2 (append (mk-array) 3 (+ 2 3) 7))
 (rest arr)
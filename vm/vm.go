@@ -0,0 +1,611 @@
+// Package vm runs the bytecode produced by the compiler.
+package vm
+
+import (
+	"fmt"
+
+	"github.com/rtfb/welp/compiler"
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/primitive"
+)
+
+// maxFrames limits the depth of the calls.
+const maxFrames = 1 << 16
+
+var (
+	null     = &object.Null{}
+	trueObj  = &object.Boolean{Value: true}
+	falseObj = &object.Boolean{Value: false}
+)
+
+// Closure is a compiled func along with the variables it captured. It's the
+// Impl of the funcs created by the compiled code.
+type Closure struct {
+	proto *compiler.FuncProto
+	free  []*box
+	vm    *VM
+}
+
+// Apply implements object.Applicable by running the closure in its vm.
+func (cl *Closure) Apply(args []object.Object) object.Object {
+	result, err := cl.vm.Call(&object.Func{Name: cl.proto.Name, Impl: cl}, args)
+	if err != nil {
+		return &object.Error{Err: err}
+	}
+	return result
+}
+
+// ApplyMetered implements MeteredApplicable by running the closure in its vm
+// with the meter set to m for the duration of the call.
+func (cl *Closure) ApplyMetered(m Meter, args []object.Object) object.Object {
+	saved := cl.vm.meter
+	cl.vm.meter = m
+	defer func() {
+		cl.vm.meter = saved
+	}()
+	return cl.Apply(args)
+}
+
+// Meter is told about the work done by a vm, and stops it by returning an
+// error, which the vm fails with.
+type Meter interface {
+	// Step is called on every call and every jump back, which includes
+	// every iteration of a loop.
+	Step() error
+
+	// Charge is called with the number of values allocated by the array
+	// and map literals, and by the primitives, see primitive.Size.
+	Charge(n int64) error
+}
+
+// MeteredApplicable is implemented by the Impl of the funcs that count the
+// work they do against the meter of the vm calling them.
+type MeteredApplicable interface {
+	object.Applicable
+	ApplyMetered(m Meter, args []object.Object) object.Object
+}
+
+// box holds a local variable captured by a closure.
+type box struct {
+	value object.Object
+}
+
+// Type implements Object.
+func (b *box) Type() object.Type {
+	return "BOX"
+}
+
+// Inspect implements Object.
+func (b *box) Inspect() string {
+	return fmt.Sprintf("<box %s>", b.value.Inspect())
+}
+
+// unbound marks the &optional params that got no arg.
+type unbound struct{}
+
+// Type implements Object.
+func (u *unbound) Type() object.Type {
+	return "UNBOUND"
+}
+
+// Inspect implements Object.
+func (u *unbound) Inspect() string {
+	return "<unbound>"
+}
+
+var missing = &unbound{}
+
+// iterator is the state of a doseq loop.
+type iterator struct {
+	items []object.Object
+	next  int
+}
+
+// Type implements Object.
+func (it *iterator) Type() object.Type {
+	return "ITERATOR"
+}
+
+// Inspect implements Object.
+func (it *iterator) Inspect() string {
+	return "<iterator>"
+}
+
+type frame struct {
+	cl   *Closure
+	ip   int
+	base int // the stack index of the first local slot
+}
+
+// VM is a stack machine running bytecode. The locals of each call occupy a
+// fixed number of slots on the stack, followed by the operands of the
+// instructions. The globals persist between runs.
+type VM struct {
+	globals []object.Object
+	defined []bool
+	names   []string
+	stack   []object.Object
+	sp      int
+	frames  []frame
+
+	// resolver looks up the globals that aren't defined by the code
+	resolver func(name string) object.Object
+
+	// meter is told about the work done, if it's set
+	meter Meter
+}
+
+// New creates a VM.
+func New() *VM {
+	return &VM{stack: make([]object.Object, 1024)}
+}
+
+// Run runs the bytecode and returns the value it yields. The bytecode must
+// come from the same compiler as all the bytecode run before, since the
+// globals are numbered by the compiler.
+func (vm *VM) Run(bc *compiler.Bytecode) (object.Object, error) {
+	for len(vm.globals) < len(bc.Globals) {
+		vm.globals = append(vm.globals, nil)
+		vm.defined = append(vm.defined, false)
+	}
+	vm.names = bc.Globals
+	vm.sp = 0
+	vm.frames = vm.frames[:0]
+	vm.push(null) // stands for the callee
+	if err := vm.enter(&Closure{proto: bc.Main, vm: vm}, 0, 0); err != nil {
+		return nil, err
+	}
+	return vm.execute(0)
+}
+
+// Call calls fn with args. It can be called between the runs, as well as
+// during one, e.g. by a func that got called by the vm.
+func (vm *VM) Call(fn object.Object, args []object.Object) (object.Object, error) {
+	sp, depth := vm.sp, len(vm.frames)
+	vm.push(fn)
+	for _, arg := range args {
+		vm.push(arg)
+	}
+	err := vm.call(len(args), 0)
+	if err == nil && len(vm.frames) == depth {
+		return vm.pop(), nil
+	}
+	if err == nil {
+		var result object.Object
+		if result, err = vm.execute(depth); err == nil {
+			return result, nil
+		}
+	}
+	vm.sp = sp
+	vm.frames = vm.frames[:depth]
+	return nil, err
+}
+
+// SetResolver sets the func that looks up the globals which the code refers
+// to, but doesn't define. It's consulted before the primitives, and should
+// return nil for the names it doesn't know.
+func (vm *VM) SetResolver(resolver func(name string) object.Object) {
+	vm.resolver = resolver
+}
+
+// SetMeter sets the meter that is told about the work done by the vm, and that
+// can stop it. A nil meter lets the vm run unchecked.
+func (vm *VM) SetMeter(m Meter) {
+	vm.meter = m
+}
+
+// step tells the meter about a call or a jump back.
+func (vm *VM) step() error {
+	if vm.meter == nil {
+		return nil
+	}
+	return vm.meter.Step()
+}
+
+// charge tells the meter about n allocated values.
+func (vm *VM) charge(n int64) error {
+	if vm.meter == nil || n == 0 {
+		return nil
+	}
+	return vm.meter.Charge(n)
+}
+
+// Globals returns the globals defined by the code run so far.
+func (vm *VM) Globals() map[string]object.Object {
+	globals := make(map[string]object.Object)
+	for i, value := range vm.globals {
+		if vm.defined[i] {
+			globals[vm.names[i]] = value
+		}
+	}
+	return globals
+}
+
+func (vm *VM) push(obj object.Object) {
+	if vm.sp == len(vm.stack) {
+		vm.stack = append(vm.stack, obj)
+	} else {
+		vm.stack[vm.sp] = obj
+	}
+	vm.sp++
+}
+
+func (vm *VM) pop() object.Object {
+	vm.sp--
+	return vm.stack[vm.sp]
+}
+
+// reserve makes sure the stack has room for n more values.
+func (vm *VM) reserve(n int) {
+	if need := vm.sp + n; need > len(vm.stack) {
+		grown := make([]object.Object, 2*need)
+		copy(grown, vm.stack[:vm.sp])
+		vm.stack = grown
+	}
+}
+
+// enter calls cl with the argc args on top of the stack. pos is the position
+// of the call, for error messages.
+func (vm *VM) enter(cl *Closure, argc int, pos int) error {
+	if len(vm.frames) >= maxFrames {
+		return fmt.Errorf("%s: stack overflow at position %d", cl.proto.Name, pos)
+	}
+	if err := vm.step(); err != nil {
+		return err
+	}
+	base := vm.sp - argc
+	if err := vm.bindArgs(cl.proto, base, argc, pos); err != nil {
+		return err
+	}
+	vm.frames = append(vm.frames, frame{cl: cl, base: base})
+	return nil
+}
+
+// bindArgs turns the argc args starting at base into the local slots of a
+// call to p, checking the arity.
+func (vm *VM) bindArgs(p *compiler.FuncProto, base, argc int, pos int) error {
+	positional := p.NumRequired + p.NumOptional
+	if argc < p.NumRequired || (argc > positional && !p.HasRest) {
+		return fmt.Errorf("%s: wrong number of args at position %d: expected %s, got %d",
+			p.Name, pos, p.Arity(), argc)
+	}
+	vm.reserve(p.NumLocals)
+	var rest []object.Object
+	if p.HasRest && argc > positional {
+		rest = append(rest, vm.stack[base+positional:base+argc]...)
+	}
+	n := argc
+	for ; n < positional; n++ {
+		vm.stack[base+n] = missing
+	}
+	if p.HasRest {
+		vm.stack[base+positional] = object.NewArray(rest)
+		n = positional + 1
+	}
+	for i := n; i < p.NumLocals; i++ {
+		vm.stack[base+i] = nil
+	}
+	vm.sp = base + p.NumLocals
+	return nil
+}
+
+// call calls the func below the argc args on top of the stack. Calls to
+// closures push a frame, everything else is called right away.
+func (vm *VM) call(argc int, pos int) error {
+	callee := vm.stack[vm.sp-argc-1]
+	f, ok := callee.(*object.Func)
+	if !ok {
+		// like in the evaluator, calling a value that's not a func yields
+		// the value
+		vm.sp -= argc + 1
+		vm.push(callee)
+		return nil
+	}
+	var result object.Object
+	args := vm.stack[vm.sp-argc : vm.sp : vm.sp]
+	if cl, ok := f.Impl.(*Closure); ok && cl.vm == vm {
+		return vm.enter(cl, argc, pos)
+	}
+	switch impl := f.Impl.(type) {
+	case primitive.Func:
+		var before int64
+		if argc > 0 {
+			before = primitive.Size(args[0])
+		}
+		result = impl(args)
+		n := primitive.Size(result)
+		if argc > 0 && result == args[0] {
+			// grown in place
+			n -= before
+		}
+		if err := vm.charge(n); err != nil {
+			return err
+		}
+	case MeteredApplicable:
+		// the args are copied, since the callee may call back into the vm
+		args = append([]object.Object(nil), args...)
+		if vm.meter != nil {
+			result = impl.ApplyMetered(vm.meter, args)
+		} else {
+			result = impl.Apply(args)
+		}
+	case object.Applicable:
+		// the args are copied, since the callee may call back into the vm
+		result = impl.Apply(append([]object.Object(nil), args...))
+	default:
+		return fmt.Errorf("%s: can't call at position %d", f.Name, pos)
+	}
+	vm.sp -= argc + 1
+	if err, ok := result.(*object.Error); ok {
+		return err.Err
+	}
+	vm.push(result)
+	return nil
+}
+
+// execute runs the frames until the number of frames drops to stop, and
+// returns the value returned by the last one.
+func (vm *VM) execute(stop int) (object.Object, error) {
+	for {
+		fr := &vm.frames[len(vm.frames)-1]
+		code := fr.cl.proto.Code
+		ip := fr.ip
+		op := compiler.Opcode(code[ip])
+		fr.ip++
+		var err error
+		switch op {
+		case compiler.OpConstant:
+			vm.push(fr.cl.proto.Constants[vm.operand(fr)])
+		case compiler.OpNull:
+			vm.push(null)
+		case compiler.OpTrue:
+			vm.push(trueObj)
+		case compiler.OpFalse:
+			vm.push(falseObj)
+		case compiler.OpPop:
+			vm.sp--
+		case compiler.OpPopN:
+			vm.sp -= vm.operand(fr)
+		case compiler.OpDup:
+			vm.push(vm.stack[vm.sp-1])
+		case compiler.OpGetGlobal:
+			var v object.Object
+			v, err = vm.global(vm.operand(fr))
+			if err == nil {
+				vm.push(v)
+			}
+		case compiler.OpSetGlobal:
+			i := vm.operand(fr)
+			if vm.globals[i] == nil {
+				err = fmt.Errorf("set!: unbound variable %q", vm.names[i])
+			} else {
+				vm.globals[i] = vm.pop()
+			}
+		case compiler.OpDefGlobal:
+			i := vm.operand(fr)
+			vm.globals[i] = vm.pop()
+			vm.defined[i] = true
+		case compiler.OpGetLocal:
+			v := vm.stack[fr.base+vm.operand(fr)]
+			if v == nil {
+				v = null
+			}
+			vm.push(v)
+		case compiler.OpSetLocal:
+			vm.stack[fr.base+vm.operand(fr)] = vm.pop()
+		case compiler.OpNewBox:
+			vm.stack[fr.base+vm.operand(fr)] = &box{value: vm.pop()}
+		case compiler.OpGetBoxed:
+			vm.push(vm.stack[fr.base+vm.operand(fr)].(*box).value)
+		case compiler.OpSetBoxed:
+			vm.stack[fr.base+vm.operand(fr)].(*box).value = vm.pop()
+		case compiler.OpGetFree:
+			vm.push(fr.cl.free[vm.operand(fr)].value)
+		case compiler.OpSetFree:
+			fr.cl.free[vm.operand(fr)].value = vm.pop()
+		case compiler.OpJump:
+			fr.ip = vm.operand(fr)
+			if fr.ip < ip {
+				err = vm.step()
+			}
+		case compiler.OpJumpIfFalse:
+			target := vm.operand(fr)
+			if !primitive.Truthy(vm.pop()) {
+				fr.ip = target
+			}
+		case compiler.OpJumpIfBound:
+			slot := vm.operand(fr)
+			target := vm.operand(fr)
+			if vm.stack[fr.base+slot] != missing {
+				fr.ip = target
+			}
+		case compiler.OpCall:
+			argc := int(code[fr.ip])
+			fr.ip++
+			err = vm.call(argc, fr.cl.proto.PosAt(ip))
+		case compiler.OpReturn:
+			result := vm.pop()
+			vm.sp = fr.base - 1
+			vm.frames = vm.frames[:len(vm.frames)-1]
+			if len(vm.frames) == stop {
+				return result, nil
+			}
+			vm.push(result)
+		case compiler.OpRecur:
+			argc := int(code[fr.ip])
+			copy(vm.stack[fr.base:], vm.stack[vm.sp-argc:vm.sp])
+			err = vm.bindArgs(fr.cl.proto, fr.base, argc, fr.cl.proto.PosAt(ip))
+			fr.ip = 0
+			if err == nil {
+				err = vm.step()
+			}
+		case compiler.OpClosure:
+			vm.push(vm.closure(fr, vm.operand(fr)))
+		case compiler.OpArray:
+			n := vm.operand(fr)
+			if err = vm.charge(int64(n)); err != nil {
+				break
+			}
+			values := make([]object.Object, n)
+			copy(values, vm.stack[vm.sp-n:vm.sp])
+			if n == 0 {
+				values = nil
+			}
+			vm.sp -= n
+			vm.push(object.NewArray(values))
+		case compiler.OpMap:
+			n := vm.operand(fr)
+			if err = vm.charge(int64(n)); err != nil {
+				break
+			}
+			m := object.NewMap()
+			for i := vm.sp - 2*n; i < vm.sp && err == nil; i += 2 {
+				err = m.Set(vm.stack[i], vm.stack[i+1])
+			}
+			vm.sp -= 2 * n
+			vm.push(m)
+		case compiler.OpIter:
+			var it *iterator
+			it, err = newIterator(vm.pop())
+			if err == nil {
+				vm.push(it)
+			}
+		case compiler.OpIterNext:
+			target := vm.operand(fr)
+			it := vm.stack[vm.sp-1].(*iterator)
+			if it.next < len(it.items) {
+				vm.push(it.items[it.next])
+				it.next++
+			} else {
+				vm.sp--
+				fr.ip = target
+			}
+		case compiler.OpAdd, compiler.OpSub, compiler.OpMul, compiler.OpEq,
+			compiler.OpLess, compiler.OpGreater, compiler.OpLessOrEqual,
+			compiler.OpGreaterOrEqual:
+			err = vm.binary(op)
+		default:
+			err = fmt.Errorf("unknown opcode %d", op)
+		}
+		if err != nil {
+			vm.frames = vm.frames[:stop]
+			return nil, err
+		}
+	}
+}
+
+// operand reads a two byte operand.
+func (vm *VM) operand(fr *frame) int {
+	v := int(compiler.ReadUint16(fr.cl.proto.Code[fr.ip:]))
+	fr.ip += 2
+	return v
+}
+
+// global returns the value of a global. Globals that weren't defined by the
+// code are looked up by the resolver, then among the primitives.
+func (vm *VM) global(i int) (object.Object, error) {
+	if v := vm.globals[i]; v != nil {
+		return v, nil
+	}
+	name := vm.names[i]
+	if vm.resolver != nil {
+		if v := vm.resolver(name); v != nil {
+			return v, nil
+		}
+	}
+	prim, ok := primitive.Table[name]
+	if !ok {
+		return nil, fmt.Errorf("no such symbol %q", name)
+	}
+	v := &object.Func{Name: name, Impl: prim}
+	vm.globals[i] = v
+	return v, nil
+}
+
+func (vm *VM) closure(fr *frame, index int) object.Object {
+	proto := fr.cl.proto.Constants[index].(*compiler.FuncProto)
+	cl := &Closure{proto: proto, free: make([]*box, len(proto.Free)), vm: vm}
+	for i, fv := range proto.Free {
+		if fv.Local {
+			cl.free[i] = vm.stack[fr.base+fv.Index].(*box)
+		} else {
+			cl.free[i] = fr.cl.free[fv.Index]
+		}
+	}
+	return &object.Func{Name: proto.Name, Impl: cl}
+}
+
+var binaryPrims = map[compiler.Opcode]primitive.Func{
+	compiler.OpAdd:            primitive.Sum,
+	compiler.OpSub:            primitive.Sub,
+	compiler.OpMul:            primitive.Mul,
+	compiler.OpEq:             primitive.Eq,
+	compiler.OpLess:           primitive.Less,
+	compiler.OpGreater:        primitive.Greater,
+	compiler.OpLessOrEqual:    primitive.LessOrEqual,
+	compiler.OpGreaterOrEqual: primitive.GreaterOrEqual,
+}
+
+// binary runs an arithmetic or comparison instruction, handling integers
+// inline and leaving the rest to the primitives.
+func (vm *VM) binary(op compiler.Opcode) error {
+	b := vm.pop()
+	a := vm.pop()
+	x, xok := a.(*object.Integer)
+	y, yok := b.(*object.Integer)
+	if xok && yok {
+		switch op {
+		case compiler.OpAdd:
+			vm.push(&object.Integer{Value: x.Value + y.Value})
+		case compiler.OpSub:
+			vm.push(&object.Integer{Value: x.Value - y.Value})
+		case compiler.OpMul:
+			vm.push(&object.Integer{Value: x.Value * y.Value})
+		case compiler.OpEq:
+			vm.push(boolean(x.Value == y.Value))
+		case compiler.OpLess:
+			vm.push(boolean(x.Value < y.Value))
+		case compiler.OpGreater:
+			vm.push(boolean(x.Value > y.Value))
+		case compiler.OpLessOrEqual:
+			vm.push(boolean(x.Value <= y.Value))
+		case compiler.OpGreaterOrEqual:
+			vm.push(boolean(x.Value >= y.Value))
+		}
+		return nil
+	}
+	result := binaryPrims[op]([]object.Object{a, b})
+	if err, ok := result.(*object.Error); ok {
+		return err.Err
+	}
+	vm.push(result)
+	return nil
+}
+
+func boolean(b bool) object.Object {
+	if b {
+		return trueObj
+	}
+	return falseObj
+}
+
+// newIterator returns an iterator over the items of coll, which are taken
+// all at once. The Iterables, like the generators, may never run out of
+// items, so they're left to the evaluator.
+func newIterator(coll object.Object) (*iterator, error) {
+	switch coll := coll.(type) {
+	case *object.Array:
+		return &iterator{items: coll.Value}, nil
+	case object.Iterable:
+		return nil, fmt.Errorf("doseq: can't iterate over %v in compiled code", coll.Type())
+	}
+	it := &iterator{}
+	err := primitive.Iterate(coll, func(item object.Object) bool {
+		it.items = append(it.items, item)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("doseq: %v", err)
+	}
+	return it, nil
+}
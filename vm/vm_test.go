@@ -0,0 +1,297 @@
+package vm_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/rtfb/welp/compiler"
+	"github.com/rtfb/welp/evaluator"
+	"github.com/rtfb/welp/object"
+	"github.com/rtfb/welp/parser"
+	"github.com/rtfb/welp/stdlib"
+	"github.com/rtfb/welp/vm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	var err error
+	if stdlibExprs, err = stdlib.Parse(""); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+var (
+	evtor       = evaluator.New()
+	stdlibExprs []*parser.Node
+)
+
+// compileAndRun runs the input in a fresh vm which has the stdlib loaded.
+func compileAndRun(t *testing.T, input string) string {
+	c := compiler.New()
+	machine := vm.New()
+	bc, err := c.Compile(stdlibExprs...)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	if _, err := machine.Run(bc); !assert.NoError(t, err) {
+		return ""
+	}
+	bc, err = c.Compile(parser.ParseString(input))
+	if err != nil {
+		return "COMPILE ERR: " + err.Error()
+	}
+	result, err := machine.Run(bc)
+	if err != nil {
+		return "ERR: " + err.Error()
+	}
+	return result.Inspect()
+}
+
+// TestDifferential checks that the vm and the evaluator agree.
+func TestDifferential(t *testing.T) {
+	tests := []string{
+		"(+ 1 2 3)",
+		"(- 10 2 3)",
+		"(* 2 3 4)",
+		"(exp 2 3 2)",
+		"(exp 2)",
+		"(- 5)",
+		"(+ 1)",
+		"(< 1 2)",
+		"(>= 1 2)",
+		"(eq 3 3)",
+		"(not nil)",
+		"(not 0)",
+		`"str"`,
+		"(let ((x 1) (y 2)) (+ x y))",
+		"(let ((x 1)) (let ((x 2) (y x)) y))",
+		"(let ((x 1) (x 2)) x)",
+		"(let* ((x 1) (y (+ x 1))) y)",
+		"(letrec ((even (lambda (n) (cond ((eq n 0) t) (t (odd (- n 1))))))" +
+			" (odd (lambda (n) (cond ((eq n 0) nil) (t (even (- n 1)))))))" +
+			" (even 10))",
+		"(let () (define x 5) (set! x (+ x 1)) x)",
+		`(let ()
+		   (fn fib (n) (cond ((< n 2) n) (t (+ (fib (- n 1)) (fib (- n 2))))))
+		   (fib 15))`,
+		`(let ()
+		   (fn make-counter () (let ((n 0)) (lambda () (set! n (+ n 1)))))
+		   (define c1 (make-counter))
+		   (define c2 (make-counter))
+		   (c1) (c1) (c2)
+		   [(c1) (c2)])`,
+		`(let ()
+		   (fn adder (x) (lambda (y) (lambda (z) (+ x y z))))
+		   (((adder 1) 2) 3))`,
+		`(let ((fs (mk-array)))
+		   (dotimes (i 3) (append fs (lambda () i)))
+		   [((nth 0 fs)) ((nth 1 fs)) ((nth 2 fs))])`,
+		`(let ((fs (mk-array)))
+		   (doseq (x [1 2 3]) (append fs (lambda () (* x 10))))
+		   [((nth 0 fs)) ((nth 2 fs))])`,
+		`(let ((i 0) (acc 0))
+		   (while (< i 10)
+		     (set! i (+ i 1))
+		     (cond ((eq i 3) (continue)) (t nil))
+		     (set! acc (+ acc i)))
+		   acc)`,
+		"(let ((i 0)) (while t (set! i (+ i 1)) (cond ((eq i 7) (break i)) (t nil))))",
+		"(let ((i 0)) (while (< i 3) (set! i (+ i 1))))",
+		"(let ((acc 0)) (dotimes (i 5) (set! acc (+ acc i))) acc)",
+		"(dotimes (i 5) (cond ((eq i 3) (break (* i 2))) (t nil)))",
+		"(let ((acc (mk-array))) (doseq (x \"abc\") (append acc x)) acc)",
+		"(let ((acc (mk-array))) (doseq (kv {:a 1 :b 2}) (append acc kv)) acc)",
+		"(let ((n 0)) (doseq (x [1 2 3 4]) (cond ((eq x 3) (break n)) (t (set! n (+ n x))))))",
+		"(doseq (x nil) x)",
+		"(loop ((i 0) (acc 1)) (cond ((eq i 5) acc) (t (recur (+ i 1) (* acc 2)))))",
+		"(loop ((i 0)) (cond ((eq i 3) (break 42)) (t (recur (+ i 1)))))",
+		`(loop ((i 0) (n 0))
+		   (cond
+		     ((eq i 4) n)
+		     (t (dotimes (j 10)
+		          (cond ((eq j i) (recur (+ i 1) (+ n j))) (t nil)))))))`,
+		`(let ()
+		   (fn sum-to (n acc) (cond ((eq n 0) acc) (t (recur (- n 1) (+ acc n)))))
+		   (sum-to 10000 0))`,
+		"(let () (fn f (a &optional (b 10) c) [a b c]) [(f 1) (f 1 2) (f 1 2 3)])",
+		"(let () (fn f (a &optional (b (+ a 1))) b) (f 1))",
+		"(let () (fn f (a &rest more) more) [(f 1) (f 1 2 3)])",
+		"(let () (fn twice (f x) (f (f x))) (twice (lambda (x) (* x 2)) 3))",
+		"(let () (fn inc (x) (+ x 1)) (define g inc) (g 1))",
+		"(let ((f +)) (f 1 2))",
+		"(car [1 2 3])",
+		"(rest [1 2 3])",
+		"(+1 41)",
+		"(last [1 2 3])",
+		"(empty? (mk-array))",
+		`(chars "abc")`,
+		`(str-len "abc")`,
+		"[(abs (- 0 5)) (max 3 7) (min 3 7) (square 4) (1- 1)]",
+		"[1 (+ 1 1) [3]]",
+		`{:a 1 "b" (+ 1 1)}`,
+		"(get {:a 1} :a)",
+		"(get {:a 1} :b 0)",
+		"(len (append (mk-array) 7 9))",
+		"(cond ((eq 1 2) 1) ((eq 1 1) 2) (t 3))",
+		"(let ((x 5)) (x 1 2))",
+		"(nth 5 [1 2])",
+		"(get {:a 1} :b)",
+		"(+ 1 \"a\")",
+		"(< 1 :a)",
+		"undefined-thing",
+		"(let () (set! nowhere 1))",
+		"(let () (fn add (a b) (+ a b)) (add 1))",
+		"(let () (fn f (a &optional b) a) (f))",
+		"(doseq (x 5) x)",
+		"{[1] 2}",
+	}
+	for _, input := range tests {
+		expected := evaluator.Eval(evtor.NewEnv(), parser.ParseString(input)).Inspect()
+		assert.Equal(t, expected, compileAndRun(t, input), "run(%q)", input)
+	}
+}
+
+func TestGlobals(t *testing.T) {
+	c := compiler.New()
+	machine := vm.New()
+	inputs := []struct {
+		input    string
+		expected string
+	}{
+		{"(define x 40)", "40"},
+		{"(fn add-x (y) (+ x y))", "<func add-x>"},
+		{"(add-x 2)", "42"},
+		{"(set! x 1)", "1"},
+		{"(add-x 2)", "3"},
+		{"(fn + (a b) (* a b))", "<func +>"},
+		{"(+ 3 4)", "12"},
+	}
+	for _, test := range inputs {
+		bc, err := c.Compile(parser.ParseString(test.input))
+		if !assert.NoError(t, err, test.input) {
+			continue
+		}
+		result, err := machine.Run(bc)
+		if assert.NoError(t, err, test.input) {
+			assert.Equal(t, test.expected, result.Inspect(), test.input)
+		}
+	}
+}
+
+func TestVMOnlyErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"(let () (fn f () (break)) (f))", "COMPILE ERR: break outside of a loop"},
+		{"(recur 1)", "COMPILE ERR: recur outside of a loop"},
+		{"(loop ((i 0)) (recur))", "COMPILE ERR: recur: expected 1 args, got 0"},
+		{"(match 1 (_ 2))", "COMPILE ERR: match is not supported by the compiler"},
+		{"(let ([a b] [1 2]) a)", "COMPILE ERR: let: destructuring is not supported by the compiler"},
+		{"(let () (fn f () (f)) (f))", "ERR: f: stack overflow at position 18"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, compileAndRun(t, test.input), "run(%q)", test.input)
+	}
+}
+
+// naturals is an Iterable that never runs out of items.
+type naturals struct{}
+
+func (naturals) Type() object.Type { return "NATURALS" }
+
+func (naturals) Inspect() string { return "<naturals>" }
+
+func (naturals) Iterate(yield func(item object.Object) bool) error {
+	for i := int64(0); yield(&object.Integer{Value: i}); i++ {
+	}
+	return nil
+}
+
+func TestIterables(t *testing.T) {
+	machine := vm.New()
+	machine.SetResolver(func(name string) object.Object {
+		if name == "nats" {
+			return naturals{}
+		}
+		return nil
+	})
+	bc, err := compiler.New().Compile(parser.ParseString("(doseq (n nats) (break n))"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = machine.Run(bc)
+	assert.EqualError(t, err, "doseq: can't iterate over NATURALS in compiled code")
+}
+
+// budget is a meter that fails once it runs out of steps or values.
+type budget struct {
+	steps, alloc int64
+}
+
+func (b *budget) Step() error {
+	if b.steps--; b.steps < 0 {
+		return errors.New("out of steps")
+	}
+	return nil
+}
+
+func (b *budget) Charge(n int64) error {
+	if b.alloc -= n; b.alloc < 0 {
+		return errors.New("out of memory")
+	}
+	return nil
+}
+
+func TestMeter(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"(while t 1)", "ERR: out of steps"},
+		{"(let () (fn f (n) (recur (+ n 1))) (f 0))", "ERR: out of steps"},
+		{"(let () (fn f (n) (+ 1 (f n))) (f 0))", "ERR: out of steps"},
+		{"(let ((a [])) (while t (append a 1)))", "ERR: out of memory"},
+		{"(let ((i 0)) (while t (set! i [i i])))", "ERR: out of memory"},
+		{"(let ((i 0)) (dotimes (j 10) (set! i (+ i j))) i)", "45"},
+	}
+	for _, test := range tests {
+		bc, err := compiler.New().Compile(parser.ParseString(test.input))
+		if !assert.NoError(t, err, test.input) {
+			continue
+		}
+		machine := vm.New()
+		machine.SetMeter(&budget{steps: 1000, alloc: 100})
+		result, err := machine.Run(bc)
+		got := "ERR: " + fmt.Sprint(err)
+		if err == nil {
+			got = result.Inspect()
+		}
+		assert.Equal(t, test.expected, got, test.input)
+	}
+}
+
+func BenchmarkFib(b *testing.B) {
+	input := `(let ()
+	  (fn fib (n) (cond ((< n 2) n) (t (+ (fib (- n 1)) (fib (- n 2))))))
+	  (fib 20))`
+	b.Run("evaluator", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			evaluator.Eval(evtor.NewEnv(), parser.ParseString(input))
+		}
+	})
+	b.Run("vm", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			bc, err := compiler.New().Compile(parser.ParseString(input))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := vm.New().Run(bc); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}